@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Adaptive controller thresholds. Any signal above its high mark shrinks the
+// probe worker cap; it only grows while every signal is below its low mark.
+const (
+	adaptiveCPUHigh     = 80.0
+	adaptiveCPULow      = 30.0
+	adaptiveSoftirqHigh = 30.0 // softirq is packet forwarding; probes must not starve it
+	adaptiveSoftirqLow  = 10.0
+	adaptiveLoadHigh    = 1.5 // 1-minute load average per CPU
+	adaptiveLoadLow     = 0.7
+	adaptivePSIHigh     = 10.0 // memory PSI "some" avg10, percent of time stalled
+	adaptivePSILow      = 1.0
+	// maxProbeWorkers is the safety cap on probe goroutines per cycle
+	maxProbeWorkers = 500
+)
+
+// AdaptiveSignals is one sample of the system load signals the adaptive
+// controller acts on
+type AdaptiveSignals struct {
+	CPUPercent     float64 `json:"cpu_percent"`
+	SoftirqPercent float64 `json:"softirq_percent"`
+	// Load1PerCPU is the 1-minute load average divided by the number of CPUs
+	Load1PerCPU float64 `json:"load1_per_cpu"`
+	// MemoryPressure is the "some avg10" of /proc/pressure/memory; 0 without PSI
+	MemoryPressure float64 `json:"memory_pressure"`
+}
+
+// AdaptiveStatus exposes the adaptive worker controller in /api/status
+type AdaptiveStatus struct {
+	Workers    int `json:"workers"`
+	MaxWorkers int `json:"max_workers"`
+	// InFlight is the number of probes currently holding a worker slot
+	InFlight     int             `json:"in_flight"`
+	Signals      AdaptiveSignals `json:"signals"`
+	LastDecision string          `json:"last_decision,omitempty"`
+	LastChange   time.Time       `json:"last_change,omitempty"`
+}
+
+// cpuTimes holds the aggregate "cpu" line of /proc/stat in jiffies
+type cpuTimes struct {
+	total   uint64
+	idle    uint64
+	softirq uint64
+}
+
+// readCPUTimes reads the aggregate CPU counters from /proc/stat
+func readCPUTimes() (cpuTimes, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	return parseCPUTimes(string(data))
+}
+
+// parseCPUTimes parses the first line of /proc/stat:
+// cpu user nice system idle iowait irq softirq steal ...
+func parseCPUTimes(data string) (cpuTimes, error) {
+	line, _, _ := strings.Cut(data, "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return cpuTimes{}, fmt.Errorf("unexpected /proc/stat format")
+	}
+	var t cpuTimes
+	for i := 1; i < len(fields); i++ {
+		v, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return cpuTimes{}, err
+		}
+		t.total += v
+		switch i {
+		case 4:
+			t.idle = v
+		case 7:
+			t.softirq = v
+		}
+	}
+	return t, nil
+}
+
+// readLoadPerCPU returns the 1-minute load average divided by ncpu
+func readLoadPerCPU(ncpu int) (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/loadavg format")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	if ncpu < 1 {
+		ncpu = 1
+	}
+	return load / float64(ncpu), nil
+}
+
+// readMemoryPressure returns the "some avg10" value of /proc/pressure/memory.
+// Kernels without CONFIG_PSI do not have the file.
+func readMemoryPressure() (float64, error) {
+	data, err := os.ReadFile("/proc/pressure/memory")
+	if err != nil {
+		return 0, err
+	}
+	return parsePSISomeAvg10(string(data))
+}
+
+// parsePSISomeAvg10 extracts avg10 from the "some" line of a PSI file:
+// some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePSISomeAvg10(data string) (float64, error) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if v, ok := strings.CutPrefix(f, "avg10="); ok {
+				return strconv.ParseFloat(v, 64)
+			}
+		}
+	}
+	return 0, fmt.Errorf("no some avg10 in PSI data")
+}
+
+// cpuSignals derives CPU and softirq utilization between two samples
+func cpuSignals(prev, cur cpuTimes) (cpu, softirq float64, ok bool) {
+	dTotal := float64(cur.total - prev.total)
+	if cur.total <= prev.total || dTotal <= 0 {
+		return 0, 0, false
+	}
+	cpu = (1.0 - float64(cur.idle-prev.idle)/dTotal) * 100.0
+	softirq = float64(cur.softirq-prev.softirq) / dTotal * 100.0
+	return cpu, softirq, true
+}
+
+// overloaded lists the signals above their high marks
+func (sig AdaptiveSignals) overloaded() []string {
+	var why []string
+	if sig.CPUPercent > adaptiveCPUHigh {
+		why = append(why, fmt.Sprintf("cpu %.1f%%", sig.CPUPercent))
+	}
+	if sig.SoftirqPercent > adaptiveSoftirqHigh {
+		why = append(why, fmt.Sprintf("softirq %.1f%%", sig.SoftirqPercent))
+	}
+	if sig.Load1PerCPU > adaptiveLoadHigh {
+		why = append(why, fmt.Sprintf("load %.2f/cpu", sig.Load1PerCPU))
+	}
+	if sig.MemoryPressure > adaptivePSIHigh {
+		why = append(why, fmt.Sprintf("memory psi %.1f%%", sig.MemoryPressure))
+	}
+	return why
+}
+
+// idle reports whether every signal is below its low mark
+func (sig AdaptiveSignals) idle() bool {
+	return sig.CPUPercent < adaptiveCPULow && sig.SoftirqPercent < adaptiveSoftirqLow &&
+		sig.Load1PerCPU < adaptiveLoadLow && sig.MemoryPressure < adaptivePSILow
+}
+
+// clampProbeWorkers bounds a worker count to [1, maxProbeWorkers]
+func clampProbeWorkers(n int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > maxProbeWorkers {
+		return maxProbeWorkers
+	}
+	return n
+}
+
+// probeLimiter bounds the number of probes in flight to a cap that may
+// change at any time; lowering it takes effect as running probes finish,
+// so the pool shrinks mid-cycle without aborting probes
+type probeLimiter struct {
+	mu       sync.Mutex
+	inFlight int
+	// closed and replaced whenever a slot frees up or the cap grows
+	wake chan struct{}
+}
+
+// acquire waits for a slot under the cap returned by limit
+func (l *probeLimiter) acquire(ctx context.Context, limit func() int) error {
+	for {
+		max := limit()
+		l.mu.Lock()
+		if l.inFlight < max {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// release frees a slot taken by acquire
+func (l *probeLimiter) release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.mu.Unlock()
+	l.notify()
+}
+
+// notify wakes waiters to re-check the cap
+func (l *probeLimiter) notify() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// active returns the number of probes in flight
+func (l *probeLimiter) active() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
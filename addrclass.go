@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// specialPurposeRange is one entry of the IANA IPv4/IPv6 special-purpose
+// address registries (RFC 6890 and successors)
+type specialPurposeRange struct {
+	net  *net.IPNet
+	name string
+}
+
+// specialPurposeRanges lists destinations that are never worth probing as
+// internet hosts: private, shared, loopback, link-local, documentation,
+// benchmarking, transition mechanisms, multicast and reserved space.
+var specialPurposeRanges = mustSpecialPurposeRanges([][2]string{
+	// IPv4
+	{"0.0.0.0/8", "this network"},
+	{"10.0.0.0/8", "private"},
+	{"100.64.0.0/10", "shared address space (CGN)"},
+	{"127.0.0.0/8", "loopback"},
+	{"169.254.0.0/16", "link-local"},
+	{"172.16.0.0/12", "private"},
+	{"192.0.0.0/24", "IETF protocol assignments"},
+	{"192.0.2.0/24", "documentation (TEST-NET-1)"},
+	{"192.88.99.0/24", "6to4 relay anycast"},
+	{"192.168.0.0/16", "private"},
+	{"198.18.0.0/15", "benchmarking"},
+	{"198.51.100.0/24", "documentation (TEST-NET-2)"},
+	{"203.0.113.0/24", "documentation (TEST-NET-3)"},
+	{"224.0.0.0/4", "multicast"},
+	{"240.0.0.0/4", "reserved"},
+	{"255.255.255.255/32", "limited broadcast"},
+	// IPv6
+	{"::/128", "unspecified"},
+	{"::1/128", "loopback"},
+	{"64:ff9b::/96", "NAT64 well-known prefix"},
+	{"64:ff9b:1::/48", "NAT64 local-use"},
+	{"100::/64", "discard-only"},
+	{"2001::/32", "Teredo"},
+	{"2001:2::/48", "benchmarking"},
+	{"2001:10::/28", "ORCHID"},
+	{"2001:20::/28", "ORCHIDv2"},
+	{"2001:db8::/32", "documentation"},
+	{"2002::/16", "6to4"},
+	{"3fff::/20", "documentation"},
+	{"5f00::/16", "SRv6 SIDs"},
+	{"fc00::/7", "unique local"},
+	{"fe80::/10", "link-local"},
+	{"fec0::/10", "site-local (deprecated)"},
+	{"ff00::/8", "multicast"},
+})
+
+func mustSpecialPurposeRanges(entries [][2]string) []specialPurposeRange {
+	ranges := make([]specialPurposeRange, 0, len(entries))
+	for _, e := range entries {
+		_, n, err := net.ParseCIDR(e[0])
+		if err != nil {
+			panic(fmt.Sprintf("special-purpose registry: %v", err))
+		}
+		ranges = append(ranges, specialPurposeRange{net: n, name: e[1]})
+	}
+	return ranges
+}
+
+// specialPurposeName returns the registry name of the range containing ip,
+// or "" for ordinary global unicast addresses. IPv4-mapped IPv6 addresses
+// are classified by their IPv4 address.
+func specialPurposeName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, r := range specialPurposeRanges {
+		if r.net.Contains(ip) {
+			return r.name
+		}
+	}
+	return ""
+}
+
+// ipFamily returns "ipv4" or "ipv6" for a textual address, or "" if invalid
+func ipFamily(host string) string {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
+// sameNets reports whether two prefix lists are identical
+func sameNets(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// localPrefixes returns the networks the router itself is addressed from,
+// so its delegated IPv6 LAN prefixes are not mistaken for internet hosts.
+// IPv6 addresses contribute their whole on-link prefix (e.g. the /64 carved
+// from a DHCPv6-PD delegation); IPv4 addresses only the address itself, since
+// a WAN subnet holds other customers that are real internet hosts.
+func localPrefixes(addrs []net.Addr, extra []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || specialPurposeName(n.IP) != "" {
+			continue
+		}
+		if v4 := n.IP.To4(); v4 != nil {
+			out = append(out, &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)})
+			continue
+		}
+		out = append(out, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+	}
+	for _, p := range extra {
+		n, err := parseCIDROrIP(p)
+		if err != nil {
+			return out, fmt.Errorf("local_prefixes: %w", err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
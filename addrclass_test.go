@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSpecialPurposeRegistry(t *testing.T) {
+	special := map[string]string{
+		"10.1.2.3":           "private",
+		"100.72.0.1":         "shared address space (CGN)",
+		"192.0.2.10":         "documentation (TEST-NET-1)",
+		"198.19.255.1":       "benchmarking",
+		"239.255.255.250":    "multicast",
+		"::ffff:192.168.1.1": "private",
+		"64:ff9b::808:808":   "NAT64 well-known prefix",
+		"2001:0:4136:e378::": "Teredo",
+		"2001:db8::1":        "documentation",
+		"2002:c000:204::1":   "6to4",
+		"3fff:1::1":          "documentation",
+		"fd12:3456::1":       "unique local",
+		"fe80::1":            "link-local",
+		"ff02::1":            "multicast",
+		"::1":                "loopback",
+	}
+	for addr, want := range special {
+		if got := specialPurposeName(net.ParseIP(addr)); got != want {
+			t.Fatalf("%s: got %q, want %q", addr, got, want)
+		}
+	}
+	for _, addr := range []string{"1.1.1.1", "93.184.216.34", "2606:4700::1111", "2a00:1450:4001::200e"} {
+		if got := specialPurposeName(net.ParseIP(addr)); got != "" {
+			t.Fatalf("%s should be global, got %q", addr, got)
+		}
+	}
+}
+
+func TestLocalPrefixesExcludeRouterAddresses(t *testing.T) {
+	addr := func(cidr string) net.Addr {
+		ip, n, _ := net.ParseCIDR(cidr)
+		return &net.IPNet{IP: ip, Mask: n.Mask}
+	}
+	s := &CakeAutoRTTService{config: DefaultConfig()}
+	s.config.LocalPrefixes = []string{"2a01:4f8:aaaa::/48"}
+	s.interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			addr("192.168.1.1/24"),           // private: already special-purpose
+			addr("81.2.69.142/24"),           // WAN IPv4: only the address itself
+			addr("2a02:8071:1:2::1/64"),      // LAN /64 from the delegated prefix
+			addr("fe80::1/64"),               // link-local: already special-purpose
+			addr("2a02:8071:ffff::abcd/128"), // WAN IA_NA
+		}, nil
+	}
+	s.refreshLocalPrefixes()
+
+	cases := map[string]bool{
+		"2a02:8071:1:2::1234":  true,  // a LAN client's global address
+		"2a02:8071:ffff::abcd": true,  // the router's WAN address
+		"2a02:8071:1:3::1":     false, // outside the on-link /64
+		"81.2.69.142":          true,
+		"81.2.69.1":            false, // another customer on the WAN subnet
+		"2a01:4f8:aaaa:1::1":   true,  // configured local_prefixes
+		"2606:4700::1111":      false,
+		"203.0.113.9":          true, // documentation range
+	}
+	for ip, want := range cases {
+		if got := s.isLANAddress(ip); got != want {
+			t.Fatalf("%s: got %t, want %t", ip, got, want)
+		}
+	}
+
+	// Turning auto detection off keeps only the configured prefixes
+	s.config.AutoLocalPrefixes = false
+	s.refreshLocalPrefixes()
+	if s.isLANAddress("2a02:8071:1:2::1234") || !s.isLANAddress("2a01:4f8:aaaa:1::1") {
+		t.Fatalf("expected only configured prefixes without auto detection")
+	}
+	if _, err := localPrefixes(nil, []string{"nope"}); err == nil {
+		t.Fatalf("expected error for invalid local_prefixes entry")
+	}
+}
+
+func TestRTTStatsByFamily(t *testing.T) {
+	samples := []RTTSample{
+		{Host: "1.1.1.1", RTTMs: 10},
+		{Host: "8.8.8.8", RTTMs: 30},
+		{Host: "2606:4700::1111", RTTMs: 50},
+		{Host: "h1", RTTMs: 99},
+	}
+	byFamily := ComputeRTTStatsByFamily(maxAggregator{}, samples)
+	if len(byFamily) != 2 || byFamily["ipv4"].Samples != 2 || byFamily["ipv4"].ResultMs != 30 ||
+		byFamily["ipv6"].Samples != 1 || byFamily["ipv6"].ResultMs != 50 {
+		t.Fatalf("unexpected per-family stats: %+v", byFamily)
+	}
+	if ComputeRTTStatsByFamily(maxAggregator{}, []RTTSample{{Host: "h1", RTTMs: 1}}) != nil {
+		t.Fatalf("expected no family stats without address hosts")
+	}
+}
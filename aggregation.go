@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RTTSample is a single per-host RTT measurement fed into an RTTAggregator
+type RTTSample struct {
+	Host  string
+	RTTMs float64
+	// Weight is the relative importance of the host (e.g. its share of traffic).
+	// Aggregators that do not use weights ignore it; zero is treated as 1.
+	Weight float64
+	// Probe is how the sample was taken: tcp, icmp or passive
+	Probe string
+}
+
+// RTTStats holds the result and intermediate statistics of one aggregation pass
+type RTTStats struct {
+	Strategy string  `json:"strategy"`
+	Samples  int     `json:"samples"`
+	MinMs    float64 `json:"min_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	MeanMs   float64 `json:"mean_ms"`
+	MedianMs float64 `json:"median_ms"`
+	P90Ms    float64 `json:"p90_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	StdDevMs float64 `json:"stddev_ms"`
+	ResultMs float64 `json:"result_ms"`
+	// Rejected counts the probe samples dropped as outliers before aggregation
+	Rejected int `json:"rejected"`
+}
+
+// RTTAggregator reduces a set of per-host RTT samples to the single value
+// applied to CAKE
+type RTTAggregator interface {
+	Name() string
+	Aggregate(samples []RTTSample) float64
+}
+
+// NewRTTAggregator returns the aggregator for a strategy name as used by the
+// rtt_aggregation config key: max, mean, median, pNN (e.g. p90, p95),
+// trimmed_mean or weighted_mean. An empty name selects max, which matches the
+// historical worst-case behaviour. With weighted set, the mean, percentile and
+// trimmed-mean strategies count each sample by its Weight (traffic share)
+// instead of equally; max is unaffected.
+func NewRTTAggregator(name string, trimPercent int, weighted bool) (RTTAggregator, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "", "max", "worst":
+		return maxAggregator{}, nil
+	case "mean", "avg", "average":
+		if weighted {
+			return weightedMeanAggregator{}, nil
+		}
+		return meanAggregator{}, nil
+	case "median", "p50":
+		return percentileAggregator{name: "median", p: 50, weighted: weighted}, nil
+	case "trimmed_mean", "trimmed":
+		if trimPercent < 0 || trimPercent >= 50 {
+			return nil, fmt.Errorf("rtt_trim_percent must be between 0 and 49, got %d", trimPercent)
+		}
+		return trimmedMeanAggregator{trimPercent: trimPercent, weighted: weighted}, nil
+	case "weighted_mean", "weighted":
+		return weightedMeanAggregator{}, nil
+	}
+
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && p > 0 && p <= 100 {
+			return percentileAggregator{name: name, p: p, weighted: weighted}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown rtt_aggregation %q", name)
+}
+
+// maxAggregator returns the worst (highest) RTT
+type maxAggregator struct{}
+
+func (maxAggregator) Name() string { return "max" }
+
+func (maxAggregator) Aggregate(samples []RTTSample) float64 {
+	worst := 0.0
+	for _, s := range samples {
+		if s.RTTMs > worst {
+			worst = s.RTTMs
+		}
+	}
+	return worst
+}
+
+// meanAggregator returns the arithmetic mean RTT
+type meanAggregator struct{}
+
+func (meanAggregator) Name() string { return "mean" }
+
+func (meanAggregator) Aggregate(samples []RTTSample) float64 {
+	return mean(sortedRTTs(samples))
+}
+
+// percentileAggregator returns the p-th percentile RTT (linear interpolation,
+// or by cumulative weight when weighted)
+type percentileAggregator struct {
+	name     string
+	p        float64
+	weighted bool
+}
+
+func (a percentileAggregator) Name() string {
+	if a.weighted {
+		return a.name + "/weighted"
+	}
+	return a.name
+}
+
+func (a percentileAggregator) Aggregate(samples []RTTSample) float64 {
+	if a.weighted {
+		return weightedPercentile(samples, a.p)
+	}
+	return percentile(sortedRTTs(samples), a.p)
+}
+
+// trimmedMeanAggregator discards trimPercent of samples (or of total weight)
+// from each end before averaging the remainder
+type trimmedMeanAggregator struct {
+	trimPercent int
+	weighted    bool
+}
+
+func (a trimmedMeanAggregator) Name() string {
+	if a.weighted {
+		return fmt.Sprintf("trimmed_mean(%d%%)/weighted", a.trimPercent)
+	}
+	return fmt.Sprintf("trimmed_mean(%d%%)", a.trimPercent)
+}
+
+func (a trimmedMeanAggregator) Aggregate(samples []RTTSample) float64 {
+	if a.weighted {
+		return weightedTrimmedMean(samples, float64(a.trimPercent))
+	}
+	values := sortedRTTs(samples)
+	cut := len(values) * a.trimPercent / 100
+	if len(values)-2*cut <= 0 {
+		return mean(values)
+	}
+	return mean(values[cut : len(values)-cut])
+}
+
+// weightedMeanAggregator averages RTTs weighted by each host's Weight
+type weightedMeanAggregator struct{}
+
+func (weightedMeanAggregator) Name() string { return "weighted_mean" }
+
+func (weightedMeanAggregator) Aggregate(samples []RTTSample) float64 {
+	var sum, total float64
+	for _, s := range samples {
+		w := sampleWeight(s)
+		sum += s.RTTMs * w
+		total += w
+	}
+	if total == 0 {
+		return 0
+	}
+	return sum / total
+}
+
+// sampleWeight returns a sample's weight, treating missing weights as 1
+func sampleWeight(s RTTSample) float64 {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// sortedByRTT returns a copy of samples in ascending RTT order
+func sortedByRTT(samples []RTTSample) []RTTSample {
+	out := append([]RTTSample(nil), samples...)
+	sort.Slice(out, func(i, j int) bool { return out[i].RTTMs < out[j].RTTMs })
+	return out
+}
+
+// weightedPercentile returns the smallest RTT whose cumulative weight reaches
+// p percent of the total weight
+func weightedPercentile(samples []RTTSample, p float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := sortedByRTT(samples)
+	total := 0.0
+	for _, s := range sorted {
+		total += sampleWeight(s)
+	}
+	target := total * p / 100
+	cum := 0.0
+	for _, s := range sorted {
+		cum += sampleWeight(s)
+		if cum >= target {
+			return s.RTTMs
+		}
+	}
+	return sorted[len(sorted)-1].RTTMs
+}
+
+// weightedTrimmedMean discards trimPercent of the total weight from each end
+// (partially trimming samples that straddle a cut) and averages the rest
+func weightedTrimmedMean(samples []RTTSample, trimPercent float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := sortedByRTT(samples)
+	total := 0.0
+	for _, s := range sorted {
+		total += sampleWeight(s)
+	}
+	lo := total * trimPercent / 100
+	hi := total - lo
+
+	var sum, kept, cum float64
+	for _, s := range sorted {
+		w := sampleWeight(s)
+		start, end := cum, cum+w
+		cum = end
+		// portion of this sample's weight inside [lo, hi]
+		overlap := math.Min(end, hi) - math.Max(start, lo)
+		if overlap <= 0 {
+			continue
+		}
+		sum += s.RTTMs * overlap
+		kept += overlap
+	}
+	if kept == 0 {
+		return weightedMeanAggregator{}.Aggregate(samples)
+	}
+	return sum / kept
+}
+
+// ComputeRTTStats runs the aggregator over samples and collects the summary
+// statistics shown in the status API
+func ComputeRTTStats(agg RTTAggregator, samples []RTTSample) RTTStats {
+	stats := RTTStats{Strategy: agg.Name(), Samples: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	values := sortedRTTs(samples)
+	stats.MinMs = values[0]
+	stats.MaxMs = values[len(values)-1]
+	stats.MeanMs = mean(values)
+	stats.MedianMs = percentile(values, 50)
+	stats.P90Ms = percentile(values, 90)
+	stats.P95Ms = percentile(values, 95)
+
+	var variance float64
+	for _, v := range values {
+		variance += (v - stats.MeanMs) * (v - stats.MeanMs)
+	}
+	stats.StdDevMs = math.Sqrt(variance / float64(len(values)))
+
+	stats.ResultMs = agg.Aggregate(samples)
+	return stats
+}
+
+// ComputeRTTStatsByFamily computes RTTStats separately for the IPv4 and IPv6
+// samples, keyed "ipv4"/"ipv6". Samples whose host is not an address are
+// left out; families without samples are absent.
+func ComputeRTTStatsByFamily(agg RTTAggregator, samples []RTTSample) map[string]RTTStats {
+	split := make(map[string][]RTTSample, 2)
+	for _, smp := range samples {
+		if fam := ipFamily(smp.Host); fam != "" {
+			split[fam] = append(split[fam], smp)
+		}
+	}
+	if len(split) == 0 {
+		return nil
+	}
+	out := make(map[string]RTTStats, len(split))
+	for fam, smps := range split {
+		out[fam] = ComputeRTTStats(agg, smps)
+	}
+	return out
+}
+
+// sortedRTTs returns the sample RTTs in ascending order
+func sortedRTTs(samples []RTTSample) []float64 {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = s.RTTMs
+	}
+	sort.Float64s(values)
+	return values
+}
+
+// mean returns the arithmetic mean of values (0 when empty)
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// percentile returns the p-th percentile of sorted values using linear
+// interpolation between closest ranks
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	if len(sorted) == 1 || p <= 0 {
+		return sorted[0]
+	}
+	if p >= 100 {
+		return sorted[len(sorted)-1]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	frac := rank - float64(lo)
+	return sorted[lo] + (sorted[hi]-sorted[lo])*frac
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func samplesOf(rtts ...float64) []RTTSample {
+	out := make([]RTTSample, len(rtts))
+	for i, r := range rtts {
+		out[i] = RTTSample{Host: "h", RTTMs: r, Weight: 1}
+	}
+	return out
+}
+
+func TestRTTAggregators(t *testing.T) {
+	// One distant outlier among otherwise close hosts
+	samples := samplesOf(10, 20, 30, 40, 50, 60, 70, 80, 90, 300)
+
+	cases := []struct {
+		name string
+		want float64
+	}{
+		{"", 300},
+		{"max", 300},
+		{"mean", 75},
+		{"median", 55},
+		{"p90", 111},
+		{"p50", 55},
+		{"trimmed_mean", 55},
+	}
+	for _, c := range cases {
+		agg, err := NewRTTAggregator(c.name, 10, false)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", c.name, err)
+		}
+		if got := agg.Aggregate(samples); math.Abs(got-c.want) > 1e-9 {
+			t.Fatalf("%q: got %.3f want %.3f", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWeightedMeanAggregator(t *testing.T) {
+	agg, err := NewRTTAggregator("weighted_mean", 0, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	samples := []RTTSample{
+		{Host: "busy", RTTMs: 20, Weight: 9},
+		{Host: "idle", RTTMs: 200, Weight: 1},
+	}
+	if got := agg.Aggregate(samples); math.Abs(got-38) > 1e-9 {
+		t.Fatalf("weighted mean: got %.3f want 38", got)
+	}
+
+	// Missing weights count as 1
+	samples[0].Weight = 0
+	if got := agg.Aggregate(samples); math.Abs(got-110) > 1e-9 {
+		t.Fatalf("zero weights: got %.3f want 110", got)
+	}
+}
+
+func TestNewRTTAggregatorInvalid(t *testing.T) {
+	for _, name := range []string{"bogus", "p0", "p101", "px"} {
+		if _, err := NewRTTAggregator(name, 10, false); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+	if _, err := NewRTTAggregator("trimmed_mean", 50, false); err == nil {
+		t.Fatalf("expected error for 50%% trim")
+	}
+}
+
+func TestComputeRTTStats(t *testing.T) {
+	agg, _ := NewRTTAggregator("p95", 0, false)
+	stats := ComputeRTTStats(agg, samplesOf(40, 10, 30, 20))
+	if stats.Strategy != "p95" || stats.Samples != 4 {
+		t.Fatalf("unexpected header: %+v", stats)
+	}
+	if stats.MinMs != 10 || stats.MaxMs != 40 || stats.MeanMs != 25 || stats.MedianMs != 25 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if math.Abs(stats.ResultMs-38.5) > 1e-9 || stats.ResultMs != stats.P95Ms {
+		t.Fatalf("unexpected p95 result: %+v", stats)
+	}
+	if math.Abs(stats.StdDevMs-math.Sqrt(125)) > 1e-9 {
+		t.Fatalf("unexpected stddev: %.3f", stats.StdDevMs)
+	}
+}
+
+func TestTrafficWeightedAggregators(t *testing.T) {
+	// A busy nearby CDN and a few idle distant hosts
+	samples := []RTTSample{
+		{Host: "cdn", RTTMs: 10, Weight: 900},
+		{Host: "a", RTTMs: 150, Weight: 40},
+		{Host: "b", RTTMs: 200, Weight: 40},
+		{Host: "c", RTTMs: 250, Weight: 20},
+	}
+
+	cases := []struct {
+		name string
+		want float64
+	}{
+		{"median", 10},
+		{"p95", 200},
+		{"p99", 250},
+		{"mean", 28},
+		{"trimmed_mean", 10},
+		{"max", 250},
+	}
+	for _, c := range cases {
+		agg, err := NewRTTAggregator(c.name, 10, true)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", c.name, err)
+		}
+		if got := agg.Aggregate(samples); math.Abs(got-c.want) > 1e-9 {
+			t.Fatalf("%q weighted: got %.3f want %.3f", c.name, got, c.want)
+		}
+	}
+}
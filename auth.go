@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionCookie is the cookie carrying a login page session
+const sessionCookie = "cake_autortt_session"
+
+// basicAuthCacheTTL is how long a verified basic auth password is trusted
+// without running bcrypt again; the dashboard polls several endpoints and
+// bcrypt is slow by design, especially on router CPUs
+const basicAuthCacheTTL = 5 * time.Minute
+
+// WebAuthConfig configures who may use the web interface and API. Without
+// tokens or users the interface is read-only for everyone.
+type WebAuthConfig struct {
+	// Static tokens accepted as "Authorization: Bearer <token>"
+	Tokens []WebTokenConfig `mapstructure:"tokens" yaml:"tokens"`
+	// Users for HTTP basic auth and the login page
+	Users []WebUserConfig `mapstructure:"users" yaml:"users"`
+	// Serve /login and accept its session cookie instead of prompting for basic auth
+	LoginPage     bool `mapstructure:"login_page" yaml:"login_page"`
+	SessionTTLSec int  `mapstructure:"session_ttl_sec" yaml:"session_ttl_sec"`
+	// Role of requests without credentials: none, read or write; empty means
+	// read without tokens or users and none with them
+	Anonymous string `mapstructure:"anonymous" yaml:"anonymous"`
+	// Role required per route, overriding read for GET and write otherwise;
+	// public lets anyone in, e.g. {"/metrics": "public"}
+	EndpointRoles map[string]string `mapstructure:"endpoint_roles" yaml:"endpoint_roles"`
+}
+
+// WebTokenConfig is a bearer token with its role (read or write)
+type WebTokenConfig struct {
+	Name  string `mapstructure:"name" yaml:"name"`
+	Token string `mapstructure:"token" yaml:"token"`
+	Role  string `mapstructure:"role" yaml:"role"`
+}
+
+// WebUserConfig is a user with a bcrypt password hash (htpasswd -nbB) and role
+type WebUserConfig struct {
+	Name         string `mapstructure:"name" yaml:"name"`
+	PasswordHash string `mapstructure:"password_hash" yaml:"password_hash"`
+	Role         string `mapstructure:"role" yaml:"role"`
+}
+
+// webRole is an access level; each level includes the ones below it
+type webRole int
+
+const (
+	roleNone webRole = iota
+	roleRead
+	roleWrite
+)
+
+func (r webRole) String() string {
+	switch r {
+	case roleRead:
+		return "read"
+	case roleWrite:
+		return "write"
+	}
+	return "none"
+}
+
+// parseWebRole parses none (also public), read or write; empty yields def
+func parseWebRole(s string, def webRole) (webRole, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return def, nil
+	case "none", "public":
+		return roleNone, nil
+	case "read":
+		return roleRead, nil
+	case "write":
+		return roleWrite, nil
+	}
+	return roleNone, fmt.Errorf("unknown role %q (want none, read or write)", s)
+}
+
+// webPrincipal is who a request was authenticated as
+type webPrincipal struct {
+	name string
+	role webRole
+	// via is token, basic, session or anonymous
+	via string
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+type webToken struct {
+	name string
+	sum  [32]byte
+	role webRole
+}
+
+type webUser struct {
+	hash []byte
+	role webRole
+}
+
+// webAuth is the validated form of WebAuthConfig
+type webAuth struct {
+	tokens        []webToken
+	users         map[string]webUser
+	anonymous     webRole
+	endpointRoles map[string]webRole
+	loginPage     bool
+	sessionTTL    time.Duration
+
+	// successful basic auth checks, keyed by a digest of user, password and hash
+	basicMu    sync.Mutex
+	basicCache map[[32]byte]time.Time
+}
+
+func newWebAuth(cfg WebAuthConfig) (*webAuth, error) {
+	a := &webAuth{
+		users:         make(map[string]webUser, len(cfg.Users)),
+		endpointRoles: make(map[string]webRole, len(cfg.EndpointRoles)),
+		loginPage:     cfg.LoginPage,
+		sessionTTL:    time.Duration(cfg.SessionTTLSec) * time.Second,
+		basicCache:    make(map[[32]byte]time.Time),
+	}
+	if a.sessionTTL <= 0 {
+		a.sessionTTL = 12 * time.Hour
+	}
+
+	for i, t := range cfg.Tokens {
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("token%d", i+1)
+		}
+		if len(t.Token) < 16 {
+			return nil, fmt.Errorf("web_auth: token %s must be at least 16 characters", name)
+		}
+		role, err := parseWebRole(t.Role, roleRead)
+		if err != nil {
+			return nil, fmt.Errorf("web_auth: token %s: %w", name, err)
+		}
+		a.tokens = append(a.tokens, webToken{name: name, sum: sha256.Sum256([]byte(t.Token)), role: role})
+	}
+	for _, u := range cfg.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("web_auth: user without a name")
+		}
+		if _, dup := a.users[u.Name]; dup {
+			return nil, fmt.Errorf("web_auth: user %s listed twice", u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("web_auth: user %s: password_hash is not a bcrypt hash", u.Name)
+		}
+		role, err := parseWebRole(u.Role, roleRead)
+		if err != nil {
+			return nil, fmt.Errorf("web_auth: user %s: %w", u.Name, err)
+		}
+		a.users[u.Name] = webUser{hash: []byte(u.PasswordHash), role: role}
+	}
+	if a.loginPage && len(a.users) == 0 {
+		return nil, fmt.Errorf("web_auth: login_page needs at least one user")
+	}
+
+	anonDefault := roleRead
+	if a.enabled() {
+		anonDefault = roleNone
+	}
+	anon, err := parseWebRole(cfg.Anonymous, anonDefault)
+	if err != nil {
+		return nil, fmt.Errorf("web_auth: anonymous: %w", err)
+	}
+	a.anonymous = anon
+
+	for path, r := range cfg.EndpointRoles {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("web_auth: endpoint_roles: %q is not a path", path)
+		}
+		role, err := parseWebRole(r, roleRead)
+		if err != nil {
+			return nil, fmt.Errorf("web_auth: endpoint_roles %s: %w", path, err)
+		}
+		a.endpointRoles[path] = role
+	}
+	return a, nil
+}
+
+// enabled reports whether any credentials are configured
+func (a *webAuth) enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0
+}
+
+// endpointRole is the role a route requires: its configured override, or def
+func (a *webAuth) endpointRole(path string, def webRole) webRole {
+	if r, ok := a.endpointRoles[path]; ok {
+		return r
+	}
+	return def
+}
+
+// authenticate identifies the request by bearer token, basic auth or
+// session cookie, falling back to the anonymous role. Credentials that are
+// present but wrong are an error rather than anonymous access.
+func (a *webAuth) authenticate(r *http.Request, sessions *webSessions, now time.Time) (webPrincipal, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		scheme, cred, _ := strings.Cut(h, " ")
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			if t, ok := a.checkToken(strings.TrimSpace(cred)); ok {
+				return webPrincipal{name: t.name, role: t.role, via: "token"}, nil
+			}
+		case "basic":
+			if user, pass, ok := r.BasicAuth(); ok {
+				if u, ok := a.checkPassword(user, pass, now); ok {
+					return webPrincipal{name: user, role: u.role, via: "basic"}, nil
+				}
+			}
+		}
+		return webPrincipal{}, errInvalidCredentials
+	}
+
+	// Roles come from the current users, so a reload revokes removed users
+	if c, err := r.Cookie(sessionCookie); err == nil && sessions != nil {
+		if user, ok := sessions.lookup(c.Value, now); ok {
+			if u, ok := a.users[user]; ok {
+				return webPrincipal{name: user, role: u.role, via: "session"}, nil
+			}
+		}
+	}
+	return webPrincipal{role: a.anonymous, via: "anonymous"}, nil
+}
+
+// checkToken compares digests in constant time so neither the token nor its
+// length leaks through timing
+func (a *webAuth) checkToken(token string) (webToken, bool) {
+	sum := sha256.Sum256([]byte(token))
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], t.sum[:]) == 1 {
+			return t, true
+		}
+	}
+	return webToken{}, false
+}
+
+// checkPassword verifies a user's password against its bcrypt hash,
+// remembering successes for basicAuthCacheTTL
+func (a *webAuth) checkPassword(user, pass string, now time.Time) (webUser, bool) {
+	u, ok := a.users[user]
+	if !ok {
+		// Spend the same time as a real check so user names cannot be probed
+		bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(pass))
+		return webUser{}, false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + string(u.hash)))
+
+	a.basicMu.Lock()
+	exp, cached := a.basicCache[key]
+	a.basicMu.Unlock()
+	if cached && now.Before(exp) {
+		return u, true
+	}
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(pass)) != nil {
+		return webUser{}, false
+	}
+
+	a.basicMu.Lock()
+	defer a.basicMu.Unlock()
+	if len(a.basicCache) >= 256 {
+		for k, e := range a.basicCache {
+			if !now.Before(e) {
+				delete(a.basicCache, k)
+			}
+		}
+		if len(a.basicCache) >= 256 {
+			clear(a.basicCache)
+		}
+	}
+	a.basicCache[key] = now.Add(basicAuthCacheTTL)
+	return u, true
+}
+
+// dummyBcryptHash is compared against for unknown users; any valid cost-10
+// hash will do
+var dummyBcryptHash = []byte("$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy")
+
+// webSessions holds the login page sessions; they survive config reloads
+type webSessions struct {
+	mu       sync.Mutex
+	sessions map[string]webSession
+}
+
+type webSession struct {
+	user    string
+	expires time.Time
+}
+
+func newWebSessions() *webSessions {
+	return &webSessions{sessions: make(map[string]webSession)}
+}
+
+// create starts a session for user and returns its random id
+func (s *webSessions) create(user string, ttl time.Duration, now time.Time) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, sess := range s.sessions {
+		if !now.Before(sess.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = webSession{user: user, expires: now.Add(ttl)}
+	return id, nil
+}
+
+func (s *webSessions) lookup(id string, now time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || !now.Before(sess.expires) {
+		return "", false
+	}
+	return sess.user, true
+}
+
+func (s *webSessions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// validateAllowedOrigins checks web_allowed_origins entries: "*" or
+// scheme://host[:port]
+func validateAllowedOrigins(origins []string) error {
+	for _, o := range origins {
+		if o == "*" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("web_allowed_origins: %q is not scheme://host[:port]", o)
+		}
+	}
+	return nil
+}
+
+// originAllowed reports whether a browser Origin may use the API and the
+// WebSocket: requests without an Origin (curl, Prometheus) and same-origin
+// requests are allowed, others only when listed
+func originAllowed(origin, host string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeRedirect returns next when it is a local path, otherwise the dashboard
+func safeRedirect(next string) string {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return next
+	}
+	return "/cake-autortt"
+}
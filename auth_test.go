@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestWebServer(t *testing.T, auth WebAuthConfig) *WebServer {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.WebAuth = auth
+	ws, err := NewWebServer(nil, cfg)
+	if err != nil {
+		t.Fatalf("web server: %v", err)
+	}
+	return ws
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWebAuthRoles(t *testing.T) {
+	// Without credentials everything is readable, as before
+	open := newTestWebServer(t, WebAuthConfig{}).router()
+	if rec := serve(open, httptest.NewRequest("GET", "/api/probes", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("expected open read access, got %d", rec.Code)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	r := newTestWebServer(t, WebAuthConfig{
+		Tokens:        []WebTokenConfig{{Name: "grafana", Token: "0123456789abcdef0123"}},
+		Users:         []WebUserConfig{{Name: "admin", PasswordHash: string(hash), Role: "write"}},
+		EndpointRoles: map[string]string{"/metrics": "public", "/api/hosts": "write"},
+	}).router()
+
+	get := func(path string, set func(*http.Request)) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if set != nil {
+			set(req)
+		}
+		return serve(r, req).Code
+	}
+	bearer := func(tok string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+tok) }
+	}
+	basic := func(user, pass string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, pass) }
+	}
+
+	rec := serve(r, httptest.NewRequest("GET", "/api/probes", nil))
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Fatalf("expected a basic auth challenge, got %d %v", rec.Code, rec.Header())
+	}
+	for _, c := range []struct {
+		path string
+		set  func(*http.Request)
+		want int
+	}{
+		{"/api/probes", bearer("0123456789abcdef0123"), http.StatusOK},
+		{"/api/probes", bearer("0123456789abcdef0124"), http.StatusUnauthorized},
+		{"/api/probes", basic("admin", "s3cret"), http.StatusOK},
+		{"/api/probes", basic("admin", "wrong"), http.StatusUnauthorized},
+		{"/api/probes", basic("nobody", "s3cret"), http.StatusUnauthorized},
+		{"/metrics", nil, http.StatusOK},
+		{"/api/hosts", bearer("0123456789abcdef0123"), http.StatusForbidden},
+		{"/api/hosts", basic("admin", "s3cret"), http.StatusOK},
+	} {
+		if got := get(c.path, c.set); got != c.want {
+			t.Fatalf("%s: got %d, want %d", c.path, got, c.want)
+		}
+	}
+}
+
+func TestWebLoginSession(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	ws := newTestWebServer(t, WebAuthConfig{LoginPage: true, Users: []WebUserConfig{{Name: "admin", PasswordHash: string(hash)}}})
+	r := ws.router()
+
+	// Browsers are sent to the login page, API clients get a plain 401
+	req := httptest.NewRequest("GET", "/cake-autortt", nil)
+	req.Header.Set("Accept", "text/html")
+	if rec := serve(r, req); rec.Code != http.StatusFound || rec.Header().Get("Location") != "/login?next=%2Fcake-autortt" {
+		t.Fatalf("expected a login redirect, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := serve(r, httptest.NewRequest("GET", "/api/probes", nil)); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "" {
+		t.Fatalf("expected 401 without a basic challenge, got %d", rec.Code)
+	}
+	if rec := serve(r, httptest.NewRequest("GET", "/login?next=/api/probes", nil)); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `value="/api/probes"`) {
+		t.Fatalf("expected the login form, got %d", rec.Code)
+	}
+
+	login := func(pass, origin string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"admin"}, "password": {pass}, "next": {"//evil.example"}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return serve(r, req)
+	}
+	if rec := login("wrong", ""); rec.Code != http.StatusSeeOther || !strings.Contains(rec.Header().Get("Location"), "error=1") {
+		t.Fatalf("expected a failed login redirect, got %d", rec.Code)
+	}
+	if rec := login("s3cret", "http://evil.example"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a cross-origin login to be refused, got %d", rec.Code)
+	}
+	rec := login("s3cret", "http://example.com")
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/cake-autortt" || len(cookies) != 1 ||
+		!cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("expected a session cookie and a safe redirect, got %d %q %+v", rec.Code, rec.Header().Get("Location"), cookies)
+	}
+
+	withCookie := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(cookies[0])
+		return serve(r, req).Code
+	}
+	if code := withCookie("GET", "/api/probes"); code != http.StatusOK {
+		t.Fatalf("expected session access, got %d", code)
+	}
+	if code := withCookie("POST", "/logout"); code != http.StatusSeeOther {
+		t.Fatalf("logout: got %d", code)
+	}
+	if code := withCookie("GET", "/api/probes"); code != http.StatusUnauthorized {
+		t.Fatalf("expected the session to end at logout, got %d", code)
+	}
+}
+
+func TestWebAuthConfigAndOrigins(t *testing.T) {
+	for _, bad := range []WebAuthConfig{
+		{Tokens: []WebTokenConfig{{Token: "short"}}},
+		{Users: []WebUserConfig{{Name: "admin", PasswordHash: "plaintext"}}},
+		{LoginPage: true},
+		{Anonymous: "admin"},
+		{EndpointRoles: map[string]string{"metrics": "public"}},
+	} {
+		if _, err := newWebAuth(bad); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+	if err := validateAllowedOrigins([]string{"https://grafana.lan", "*"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := validateAllowedOrigins([]string{"grafana.lan"}); err == nil {
+		t.Fatalf("expected a bare host to be rejected")
+	}
+
+	allowed := []string{"https://grafana.lan"}
+	for origin, want := range map[string]bool{
+		"":                          true,
+		"http://192.168.1.1:11111":  true,
+		"https://grafana.lan":       true,
+		"https://evil.example":      false,
+		"http://192.168.1.1.evil.x": false,
+	} {
+		if got := originAllowed(origin, "192.168.1.1:11111", allowed); got != want {
+			t.Fatalf("%q: got %v, want %v", origin, got, want)
+		}
+	}
+	if safeRedirect("//evil.example") != "/cake-autortt" || safeRedirect("/api/status") != "/api/status" {
+		t.Fatalf("unexpected redirect handling")
+	}
+}
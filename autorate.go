@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// autorateState is the per-direction state of the bandwidth controller
+type autorateState string
+
+const (
+	// autorateIdle: link lightly loaded, rate drifts back toward the base rate
+	autorateIdle autorateState = "idle"
+	// autorateRising: link saturated without added delay, rate probes upward
+	autorateRising autorateState = "rising"
+	// autorateBloat: delay above threshold, rate cut below the achieved throughput
+	autorateBloat autorateState = "bufferbloat"
+	// autorateHold: refractory period after a cut, no further changes
+	autorateHold autorateState = "hold"
+)
+
+const (
+	// baseline tracking: follow RTT decreases quickly, increases slowly and
+	// only while the delay is below the bufferbloat threshold
+	autorateBaselineDownAlpha = 0.5
+	autorateBaselineUpAlpha   = 0.02
+)
+
+// AutorateDirectionStatus reports the controller state for one direction
+type AutorateDirectionStatus struct {
+	Interface   string  `json:"interface"`
+	State       string  `json:"state"`
+	RateBps     uint64  `json:"rate_bps"`
+	AchievedBps uint64  `json:"achieved_bps"`
+	LoadPercent float64 `json:"load_percent"`
+	MinBps      uint64  `json:"min_bps"`
+	BaseBps     uint64  `json:"base_bps"`
+	MaxBps      uint64  `json:"max_bps"`
+}
+
+// AutorateStatus reports the bandwidth controller for the status API
+type AutorateStatus struct {
+	BaselineMs float64                 `json:"baseline_ms"`
+	DelayMs    float64                 `json:"delay_ms"`
+	Download   AutorateDirectionStatus `json:"download"`
+	Upload     AutorateDirectionStatus `json:"upload"`
+}
+
+// autorateChange is a rate the controller wants applied to an interface
+type autorateChange struct {
+	iface   string
+	rateBps uint64
+	state   autorateState
+}
+
+// autorateDirection tracks the shaper rate and achieved throughput of one
+// CAKE instance (download or upload)
+type autorateDirection struct {
+	name                    string
+	iface                   string
+	minBps, baseBps, maxBps uint64
+
+	rateBps     uint64
+	appliedBps  uint64
+	achievedBps uint64
+	state       autorateState
+	holdUntil   time.Time
+
+	lastBytes uint64
+	lastAt    time.Time
+}
+
+// autorateController adjusts the CAKE bandwidth from the delay over a learned
+// RTT baseline and the throughput achieved through each qdisc
+type autorateController struct {
+	mu sync.Mutex
+
+	delayThresholdMs float64
+	increasePercent  float64
+	decreasePercent  float64
+	loadThreshold    float64
+	refractory       time.Duration
+
+	baselineMs   float64
+	haveBaseline bool
+	delayMs      float64
+
+	dl, ul autorateDirection
+}
+
+// newAutorateController validates the autorate_* settings and starts both
+// directions at their base rate
+func newAutorateController(cfg *Config) (*autorateController, error) {
+	a := &autorateController{
+		dl: autorateDirection{name: "download", state: autorateIdle},
+		ul: autorateDirection{name: "upload", state: autorateIdle},
+	}
+	if err := a.configure(cfg); err != nil {
+		return nil, err
+	}
+	a.dl.rateBps = a.dl.baseBps
+	a.ul.rateBps = a.ul.baseBps
+	return a, nil
+}
+
+// configure (re)applies the autorate settings, keeping the learned baseline
+// and clamping the current rates into the new limits
+func (a *autorateController) configure(cfg *Config) error {
+	if err := validateAutorateLimits("dl", cfg.AutorateDLMinKbps, cfg.AutorateDLBaseKbps, cfg.AutorateDLMaxKbps); err != nil {
+		return err
+	}
+	if err := validateAutorateLimits("ul", cfg.AutorateULMinKbps, cfg.AutorateULBaseKbps, cfg.AutorateULMaxKbps); err != nil {
+		return err
+	}
+	if cfg.AutorateDelayThresholdMs <= 0 {
+		return fmt.Errorf("autorate_delay_threshold_ms must be positive, got %.1f", cfg.AutorateDelayThresholdMs)
+	}
+	if cfg.AutorateIncreasePercent <= 0 || cfg.AutorateIncreasePercent > 100 {
+		return fmt.Errorf("autorate_increase_percent must be above 0 and at most 100, got %.1f", cfg.AutorateIncreasePercent)
+	}
+	if cfg.AutorateDecreasePercent <= 0 || cfg.AutorateDecreasePercent >= 100 {
+		return fmt.Errorf("autorate_decrease_percent must be between 0 and 100, got %.1f", cfg.AutorateDecreasePercent)
+	}
+	if cfg.AutorateLoadThresholdPercent <= 0 || cfg.AutorateLoadThresholdPercent > 100 {
+		return fmt.Errorf("autorate_load_threshold_percent must be above 0 and at most 100, got %d", cfg.AutorateLoadThresholdPercent)
+	}
+	if cfg.AutorateRefractorySec < 0 {
+		return fmt.Errorf("autorate_refractory_sec must not be negative, got %d", cfg.AutorateRefractorySec)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.delayThresholdMs = cfg.AutorateDelayThresholdMs
+	a.increasePercent = cfg.AutorateIncreasePercent
+	a.decreasePercent = cfg.AutorateDecreasePercent
+	a.loadThreshold = float64(cfg.AutorateLoadThresholdPercent) / 100
+	a.refractory = time.Duration(cfg.AutorateRefractorySec) * time.Second
+
+	a.dl.setLimits(cfg.DLInterface, cfg.AutorateDLMinKbps, cfg.AutorateDLBaseKbps, cfg.AutorateDLMaxKbps)
+	a.ul.setLimits(cfg.ULInterface, cfg.AutorateULMinKbps, cfg.AutorateULBaseKbps, cfg.AutorateULMaxKbps)
+	return nil
+}
+
+// validateAutorateLimits checks min <= base <= max for one direction
+func validateAutorateLimits(dir string, minKbps, baseKbps, maxKbps int) error {
+	if minKbps <= 0 || baseKbps < minKbps || maxKbps < baseKbps {
+		return fmt.Errorf("autorate_%s rates must satisfy 0 < min <= base <= max, got %d/%d/%d kbit/s",
+			dir, minKbps, baseKbps, maxKbps)
+	}
+	return nil
+}
+
+func (d *autorateDirection) setLimits(iface string, minKbps, baseKbps, maxKbps int) {
+	if iface != d.iface {
+		// a different qdisc: forget the counters and force the rate to be applied
+		d.iface = iface
+		d.lastAt = time.Time{}
+		d.appliedBps = 0
+	}
+	d.minBps = uint64(minKbps) * 1000
+	d.baseBps = uint64(baseKbps) * 1000
+	d.maxBps = uint64(maxKbps) * 1000
+	if d.rateBps != 0 {
+		d.rateBps = d.clamp(d.rateBps)
+	}
+}
+
+func (d *autorateDirection) clamp(bps uint64) uint64 {
+	if bps < d.minBps {
+		return d.minBps
+	}
+	if bps > d.maxBps {
+		return d.maxBps
+	}
+	return bps
+}
+
+// observeBytes derives the achieved throughput from the qdisc byte counter
+func (d *autorateDirection) observeBytes(bytes uint64, now time.Time) {
+	if !d.lastAt.IsZero() && bytes >= d.lastBytes {
+		if elapsed := now.Sub(d.lastAt).Seconds(); elapsed > 0 {
+			d.achievedBps = uint64(float64(bytes-d.lastBytes) * 8 / elapsed)
+		}
+	} else {
+		// first sample or counter reset (qdisc replaced)
+		d.achievedBps = 0
+	}
+	d.lastBytes = bytes
+	d.lastAt = now
+}
+
+// observeRTT updates the baseline with one aggregate RTT and returns the delay
+// above it. Must be called with a.mu held.
+func (a *autorateController) observeRTT(rttMs float64) float64 {
+	switch {
+	case !a.haveBaseline:
+		a.baselineMs = rttMs
+		a.haveBaseline = true
+	case rttMs < a.baselineMs:
+		a.baselineMs += (rttMs - a.baselineMs) * autorateBaselineDownAlpha
+	case rttMs-a.baselineMs < a.delayThresholdMs:
+		a.baselineMs += (rttMs - a.baselineMs) * autorateBaselineUpAlpha
+	}
+	a.delayMs = rttMs - a.baselineMs
+	if a.delayMs < 0 {
+		a.delayMs = 0
+	}
+	return a.delayMs
+}
+
+// step runs the state machine for one direction. Must be called with a.mu held.
+func (a *autorateController) step(d *autorateDirection, delayMs float64, now time.Time) {
+	load := 0.0
+	if d.rateBps > 0 {
+		load = float64(d.achievedBps) / float64(d.rateBps)
+	}
+	rate := float64(d.rateBps)
+
+	switch {
+	case now.Before(d.holdUntil):
+		d.state = autorateHold
+	case delayMs > a.delayThresholdMs:
+		// cut below what actually got through so the standing queue drains
+		ref := rate
+		if d.achievedBps > 0 && float64(d.achievedBps) < ref {
+			ref = float64(d.achievedBps)
+		}
+		rate = ref * (1 - a.decreasePercent/100)
+		d.state = autorateBloat
+		d.holdUntil = now.Add(a.refractory)
+	case load >= a.loadThreshold:
+		rate *= 1 + a.increasePercent/100
+		d.state = autorateRising
+	default:
+		// relax toward the base rate while the link is idle
+		base := float64(d.baseBps)
+		if rate > base {
+			rate = max(base, rate*(1-a.increasePercent/100))
+		} else if rate < base {
+			rate = min(base, rate*(1+a.increasePercent/100))
+		}
+		d.state = autorateIdle
+	}
+	d.rateBps = d.clamp(uint64(rate))
+}
+
+// update feeds one cycle's aggregate RTT and the qdisc byte counters (by
+// interface) into the controller and returns the rates that need applying
+func (a *autorateController) update(rttMs float64, bytesByIface map[string]uint64, now time.Time) []autorateChange {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delayMs := a.observeRTT(rttMs)
+	var changes []autorateChange
+	for _, d := range []*autorateDirection{&a.dl, &a.ul} {
+		if d.iface == "" {
+			continue
+		}
+		if bytes, ok := bytesByIface[d.iface]; ok {
+			d.observeBytes(bytes, now)
+		}
+		a.step(d, delayMs, now)
+		if d.rateBps != d.appliedBps {
+			changes = append(changes, autorateChange{iface: d.iface, rateBps: d.rateBps, state: d.state})
+		}
+	}
+	return changes
+}
+
+// markApplied records that the rate for iface reached the qdisc
+func (a *autorateController) markApplied(iface string, rateBps uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, d := range []*autorateDirection{&a.dl, &a.ul} {
+		if d.iface == iface {
+			d.appliedBps = rateBps
+		}
+	}
+}
+
+// status returns a snapshot for the status API
+func (a *autorateController) status() AutorateStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AutorateStatus{
+		BaselineMs: a.baselineMs,
+		DelayMs:    a.delayMs,
+		Download:   a.dl.status(),
+		Upload:     a.ul.status(),
+	}
+}
+
+func (d *autorateDirection) status() AutorateDirectionStatus {
+	load := 0.0
+	if d.rateBps > 0 {
+		load = float64(d.achievedBps) / float64(d.rateBps) * 100
+	}
+	return AutorateDirectionStatus{
+		Interface:   d.iface,
+		State:       string(d.state),
+		RateBps:     d.rateBps,
+		AchievedBps: d.achievedBps,
+		LoadPercent: load,
+		MinBps:      d.minBps,
+		BaseBps:     d.baseBps,
+		MaxBps:      d.maxBps,
+	}
+}
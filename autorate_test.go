@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func autorateTestConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.DLInterface = "ifb4eth0"
+	cfg.ULInterface = "eth0"
+	cfg.AutorateEnabled = true
+	cfg.AutorateDLMinKbps, cfg.AutorateDLBaseKbps, cfg.AutorateDLMaxKbps = 10000, 50000, 100000
+	cfg.AutorateULMinKbps, cfg.AutorateULBaseKbps, cfg.AutorateULMaxKbps = 2000, 10000, 20000
+	return cfg
+}
+
+func TestAutorateConfigValidation(t *testing.T) {
+	cfg := autorateTestConfig()
+	if _, err := newAutorateController(cfg); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		apply func(*Config)
+	}{
+		{"zero minimum", func(c *Config) { c.AutorateDLMinKbps = 0 }},
+		{"base above max", func(c *Config) { c.AutorateULBaseKbps = 30000 }},
+		{"zero delay threshold", func(c *Config) { c.AutorateDelayThresholdMs = 0 }},
+		{"100% decrease", func(c *Config) { c.AutorateDecreasePercent = 100 }},
+		{"negative decrease", func(c *Config) { c.AutorateDecreasePercent = -5 }},
+		{"negative increase", func(c *Config) { c.AutorateIncreasePercent = -5 }},
+		{"zero increase", func(c *Config) { c.AutorateIncreasePercent = 0 }},
+		{"increase above 100%", func(c *Config) { c.AutorateIncreasePercent = 150 }},
+		{"zero load threshold", func(c *Config) { c.AutorateLoadThresholdPercent = 0 }},
+		{"load threshold above 100%", func(c *Config) { c.AutorateLoadThresholdPercent = 120 }},
+		{"negative refractory", func(c *Config) { c.AutorateRefractorySec = -1 }},
+	} {
+		bad := autorateTestConfig()
+		c.apply(bad)
+		if _, err := newAutorateController(bad); err == nil {
+			t.Fatalf("expected error for %s", c.name)
+		}
+	}
+}
+
+func TestAutorateStateMachine(t *testing.T) {
+	a, err := newAutorateController(autorateTestConfig())
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	dlBytes := uint64(0)
+	// bytesAt returns counters after one 5s cycle at the given download throughput
+	bytesAt := func(bps uint64) map[string]uint64 {
+		dlBytes += bps * 5 / 8
+		return map[string]uint64{"ifb4eth0": dlBytes, "eth0": 0}
+	}
+
+	// First cycle applies the base rates and learns the baseline
+	changes := a.update(20, bytesAt(0), now)
+	if len(changes) != 2 || changes[0].rateBps != 50e6 || changes[1].rateBps != 10e6 {
+		t.Fatalf("expected base rates applied, got %+v", changes)
+	}
+	for _, c := range changes {
+		a.markApplied(c.iface, c.rateBps)
+	}
+
+	// Saturated without extra delay: rate rises
+	now = now.Add(5 * time.Second)
+	a.update(21, bytesAt(48e6), now)
+	st := a.status()
+	if st.Download.State != "rising" || st.Download.RateBps != 52.5e6 {
+		t.Fatalf("expected rising download, got %+v", st.Download)
+	}
+	if st.Upload.State != "idle" || st.Upload.RateBps != 10e6 {
+		t.Fatalf("expected idle upload at base, got %+v", st.Upload)
+	}
+
+	// Delay well above the baseline: cut below the achieved throughput
+	now = now.Add(5 * time.Second)
+	a.update(60, bytesAt(40e6), now)
+	st = a.status()
+	if st.Download.State != "bufferbloat" || st.Download.RateBps != 36e6 {
+		t.Fatalf("expected cut to 90%% of achieved 40Mbit, got %+v", st.Download)
+	}
+	if st.BaselineMs > 21 {
+		t.Fatalf("baseline must not follow bloated RTTs, got %.2f", st.BaselineMs)
+	}
+
+	// Within the refractory period nothing changes, even while still bloated
+	now = now.Add(5 * time.Second)
+	a.update(60, bytesAt(36e6), now)
+	if st = a.status(); st.Download.State != "hold" || st.Download.RateBps != 36e6 {
+		t.Fatalf("expected hold, got %+v", st.Download)
+	}
+
+	// Idle afterwards: rate relaxes toward base, never past it
+	for i := 0; i < 20; i++ {
+		now = now.Add(5 * time.Second)
+		a.update(20, bytesAt(1e6), now)
+	}
+	if st = a.status(); st.Download.State != "idle" || st.Download.RateBps != 50e6 {
+		t.Fatalf("expected idle at base rate, got %+v", st.Download)
+	}
+
+	// Repeated bloat never goes below the floor
+	for i := 0; i < 20; i++ {
+		now = now.Add(15 * time.Second)
+		a.update(200, bytesAt(1e6), now)
+	}
+	if st = a.status(); st.Download.RateBps != 10e6 {
+		t.Fatalf("expected download clamped to min, got %+v", st.Download)
+	}
+}
+
+func TestAdjustCakeBandwidthAppliesRates(t *testing.T) {
+	cfg := autorateTestConfig()
+	fake := &fakeQdiscController{qdiscs: []CakeQdisc{
+		{Interface: "eth0", Parent: "root"},
+		{Interface: "ifb4eth0", Parent: "root"},
+	}}
+	autorate, err := newAutorateController(cfg)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	s := &CakeAutoRTTService{config: cfg, qdisc: fake, autorate: autorate}
+
+	s.adjustCakeBandwidth(20)
+	if fake.bandwidths["ifb4eth0"] != 50e6 || fake.bandwidths["eth0"] != 10e6 {
+		t.Fatalf("expected base rates applied, got %v", fake.bandwidths)
+	}
+
+	// Unchanged rates are not re-applied
+	fake.bandwidths = nil
+	s.adjustCakeBandwidth(20)
+	if len(fake.bandwidths) != 0 {
+		t.Fatalf("unexpected re-apply: %v", fake.bandwidths)
+	}
+
+	status := s.GetSystemStatus()
+	if status.Autorate == nil || status.Autorate.Download.Interface != "ifb4eth0" {
+		t.Fatalf("expected autorate status, got %+v", status.Autorate)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// CakeTinStats holds the statistics of one CAKE priority tin
+type CakeTinStats struct {
+	// ThresholdRateBps is the rate above which the tin loses priority (bits/s)
+	ThresholdRateBps uint64 `json:"threshold_rate_bps"`
+	TargetUs         uint32 `json:"target_us"`
+	IntervalUs       uint32 `json:"interval_us"`
+	PeakDelayUs      uint32 `json:"peak_delay_us"`
+	AvgDelayUs       uint32 `json:"avg_delay_us"`
+	BaseDelayUs      uint32 `json:"base_delay_us"`
+
+	SentBytes    uint64 `json:"sent_bytes"`
+	SentPackets  uint32 `json:"sent_packets"`
+	BacklogBytes uint32 `json:"backlog_bytes"`
+	Drops        uint32 `json:"drops"`
+	ECNMarks     uint32 `json:"ecn_marks"`
+	AckDrops     uint32 `json:"ack_drops"`
+
+	SparseFlows       uint32 `json:"sparse_flows"`
+	BulkFlows         uint32 `json:"bulk_flows"`
+	UnresponsiveFlows uint32 `json:"unresponsive_flows"`
+	MaxPktLen         uint32 `json:"max_pkt_len"`
+	FlowQuantum       uint32 `json:"flow_quantum"`
+
+	WayIndirectHits uint32 `json:"way_indirect_hits"`
+	WayMisses       uint32 `json:"way_misses"`
+	WayCollisions   uint32 `json:"way_collisions"`
+}
+
+// tcJSONQdisc mirrors one element of tc -s -j qdisc show; rates are bytes/s
+// as printed by iproute2's q_cake
+type tcJSONQdisc struct {
+	Kind    string `json:"kind"`
+	Handle  string `json:"handle"`
+	Root    bool   `json:"root"`
+	Parent  string `json:"parent"`
+	Dev     string `json:"dev"`
+	Options struct {
+		// a number, or the string "unlimited"
+		Bandwidth json.RawMessage `json:"bandwidth"`
+		RTT       uint32          `json:"rtt"`
+		Target    uint32          `json:"target"`
+	} `json:"options"`
+
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint64 `json:"packets"`
+	Drops      uint32 `json:"drops"`
+	Overlimits uint32 `json:"overlimits"`
+	Requeues   uint32 `json:"requeues"`
+	Backlog    uint32 `json:"backlog"`
+	Qlen       uint32 `json:"qlen"`
+
+	MemoryUsed       uint32      `json:"memory_used"`
+	MemoryLimit      uint32      `json:"memory_limit"`
+	CapacityEstimate uint64      `json:"capacity_estimate"`
+	Tins             []tcJSONTin `json:"tins"`
+}
+
+type tcJSONTin struct {
+	ThresholdRate     uint64 `json:"threshold_rate"`
+	SentBytes         uint64 `json:"sent_bytes"`
+	BacklogBytes      uint32 `json:"backlog_bytes"`
+	TargetUs          uint32 `json:"target_us"`
+	IntervalUs        uint32 `json:"interval_us"`
+	PeakDelayUs       uint32 `json:"peak_delay_us"`
+	AvgDelayUs        uint32 `json:"avg_delay_us"`
+	BaseDelayUs       uint32 `json:"base_delay_us"`
+	SentPackets       uint32 `json:"sent_packets"`
+	WayIndirectHits   uint32 `json:"way_indirect_hits"`
+	WayMisses         uint32 `json:"way_misses"`
+	WayCollisions     uint32 `json:"way_collisions"`
+	Drops             uint32 `json:"drops"`
+	ECNMark           uint32 `json:"ecn_mark"`
+	AckDrops          uint32 `json:"ack_drops"`
+	SparseFlows       uint32 `json:"sparse_flows"`
+	BulkFlows         uint32 `json:"bulk_flows"`
+	UnresponsiveFlows uint32 `json:"unresponsive_flows"`
+	MaxPktLen         uint32 `json:"max_pkt_len"`
+	FlowQuantum       uint32 `json:"flow_quantum"`
+}
+
+// parseTCQdiscJSON extracts the CAKE qdiscs from tc -s -j qdisc show output
+func parseTCQdiscJSON(output []byte) ([]CakeQdisc, error) {
+	var raw []tcJSONQdisc
+	if err := json.Unmarshal(output, &raw); err != nil {
+		return nil, fmt.Errorf("invalid tc JSON: %w", err)
+	}
+
+	var qdiscs []CakeQdisc
+	for _, r := range raw {
+		if r.Kind != "cake" {
+			continue
+		}
+		q := CakeQdisc{
+			Interface:           r.Dev,
+			Handle:              r.Handle,
+			Parent:              "root",
+			RTTUs:               r.Options.RTT,
+			TargetUs:            r.Options.Target,
+			Bytes:               r.Bytes,
+			Packets:             r.Packets,
+			Drops:               r.Drops,
+			Overlimits:          r.Overlimits,
+			Requeues:            r.Requeues,
+			BacklogBytes:        r.Backlog,
+			BacklogPkts:         r.Qlen,
+			MemoryUsed:          r.MemoryUsed,
+			MemoryLimit:         r.MemoryLimit,
+			CapacityEstimateBps: r.CapacityEstimate * 8,
+		}
+		if !r.Root && r.Parent != "" {
+			q.Parent = r.Parent
+		}
+		var rate uint64
+		if err := json.Unmarshal(r.Options.Bandwidth, &rate); err == nil {
+			q.BandwidthBps = rate * 8
+		}
+		for _, t := range r.Tins {
+			q.Tins = append(q.Tins, CakeTinStats{
+				ThresholdRateBps:  t.ThresholdRate * 8,
+				TargetUs:          t.TargetUs,
+				IntervalUs:        t.IntervalUs,
+				PeakDelayUs:       t.PeakDelayUs,
+				AvgDelayUs:        t.AvgDelayUs,
+				BaseDelayUs:       t.BaseDelayUs,
+				SentBytes:         t.SentBytes,
+				SentPackets:       t.SentPackets,
+				BacklogBytes:      t.BacklogBytes,
+				Drops:             t.Drops,
+				ECNMarks:          t.ECNMark,
+				AckDrops:          t.AckDrops,
+				SparseFlows:       t.SparseFlows,
+				BulkFlows:         t.BulkFlows,
+				UnresponsiveFlows: t.UnresponsiveFlows,
+				MaxPktLen:         t.MaxPktLen,
+				FlowQuantum:       t.FlowQuantum,
+				WayIndirectHits:   t.WayIndirectHits,
+				WayMisses:         t.WayMisses,
+				WayCollisions:     t.WayCollisions,
+			})
+		}
+		q.Summary = formatCakeQdisc(q)
+		qdiscs = append(qdiscs, q)
+	}
+	return qdiscs, nil
+}
+
+// CAKE extended statistics attributes (linux/pkt_sched.h)
+const (
+	tcaCakeStatsCapacityEstimate64 = 2
+	tcaCakeStatsMemoryLimit        = 3
+	tcaCakeStatsMemoryUsed         = 4
+	tcaCakeStatsTinStats           = 10
+
+	tcaCakeTinStatsSentPackets        = 2
+	tcaCakeTinStatsSentBytes64        = 3
+	tcaCakeTinStatsDroppedPackets     = 4
+	tcaCakeTinStatsAcksDroppedPackets = 6
+	tcaCakeTinStatsECNMarkedPackets   = 8
+	tcaCakeTinStatsBacklogBytes       = 11
+	tcaCakeTinStatsThresholdRate64    = 12
+	tcaCakeTinStatsTargetUs           = 13
+	tcaCakeTinStatsIntervalUs         = 14
+	tcaCakeTinStatsWayIndirectHits    = 15
+	tcaCakeTinStatsWayMisses          = 16
+	tcaCakeTinStatsWayCollisions      = 17
+	tcaCakeTinStatsPeakDelayUs        = 18
+	tcaCakeTinStatsAvgDelayUs         = 19
+	tcaCakeTinStatsBaseDelayUs        = 20
+	tcaCakeTinStatsSparseFlows        = 21
+	tcaCakeTinStatsBulkFlows          = 22
+	tcaCakeTinStatsUnresponsiveFlows  = 23
+	tcaCakeTinStatsMaxSkblen          = 24
+	tcaCakeTinStatsFlowQuantum        = 25
+)
+
+// parseCakeXstats decodes the TCA_CAKE_STATS_* attributes carried in
+// TCA_STATS_APP; rates are converted from bytes/s to bits/s
+func parseCakeXstats(b []byte, q *CakeQdisc) error {
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case tcaCakeStatsCapacityEstimate64:
+			q.CapacityEstimateBps = nlaUint64(a.Value) * 8
+		case tcaCakeStatsMemoryLimit:
+			q.MemoryLimit = nlaUint32(a.Value)
+		case tcaCakeStatsMemoryUsed:
+			q.MemoryUsed = nlaUint32(a.Value)
+		case tcaCakeStatsTinStats:
+			// one nested attribute per tin, typed by tin index + 1
+			tins, err := parseNetlinkAttrs(a.Value)
+			if err != nil {
+				return err
+			}
+			q.Tins = q.Tins[:0]
+			for _, tin := range tins {
+				t, err := parseCakeTinStats(tin.Value)
+				if err != nil {
+					return err
+				}
+				q.Tins = append(q.Tins, t)
+			}
+		}
+	}
+	return nil
+}
+
+// parseCakeTinStats decodes one tin's TCA_CAKE_TIN_STATS_* attributes
+func parseCakeTinStats(b []byte) (CakeTinStats, error) {
+	var t CakeTinStats
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return t, err
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case tcaCakeTinStatsSentPackets:
+			t.SentPackets = nlaUint32(a.Value)
+		case tcaCakeTinStatsSentBytes64:
+			t.SentBytes = nlaUint64(a.Value)
+		case tcaCakeTinStatsDroppedPackets:
+			t.Drops = nlaUint32(a.Value)
+		case tcaCakeTinStatsAcksDroppedPackets:
+			t.AckDrops = nlaUint32(a.Value)
+		case tcaCakeTinStatsECNMarkedPackets:
+			t.ECNMarks = nlaUint32(a.Value)
+		case tcaCakeTinStatsBacklogBytes:
+			t.BacklogBytes = nlaUint32(a.Value)
+		case tcaCakeTinStatsThresholdRate64:
+			t.ThresholdRateBps = nlaUint64(a.Value) * 8
+		case tcaCakeTinStatsTargetUs:
+			t.TargetUs = nlaUint32(a.Value)
+		case tcaCakeTinStatsIntervalUs:
+			t.IntervalUs = nlaUint32(a.Value)
+		case tcaCakeTinStatsWayIndirectHits:
+			t.WayIndirectHits = nlaUint32(a.Value)
+		case tcaCakeTinStatsWayMisses:
+			t.WayMisses = nlaUint32(a.Value)
+		case tcaCakeTinStatsWayCollisions:
+			t.WayCollisions = nlaUint32(a.Value)
+		case tcaCakeTinStatsPeakDelayUs:
+			t.PeakDelayUs = nlaUint32(a.Value)
+		case tcaCakeTinStatsAvgDelayUs:
+			t.AvgDelayUs = nlaUint32(a.Value)
+		case tcaCakeTinStatsBaseDelayUs:
+			t.BaseDelayUs = nlaUint32(a.Value)
+		case tcaCakeTinStatsSparseFlows:
+			t.SparseFlows = nlaUint32(a.Value)
+		case tcaCakeTinStatsBulkFlows:
+			t.BulkFlows = nlaUint32(a.Value)
+		case tcaCakeTinStatsUnresponsiveFlows:
+			t.UnresponsiveFlows = nlaUint32(a.Value)
+		case tcaCakeTinStatsMaxSkblen:
+			t.MaxPktLen = nlaUint32(a.Value)
+		case tcaCakeTinStatsFlowQuantum:
+			t.FlowQuantum = nlaUint32(a.Value)
+		}
+	}
+	return t, nil
+}
+
+// nlaUint32 reads a host-order u32 attribute value (0 when short)
+func nlaUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.NativeEndian.Uint32(b)
+}
+
+// nlaUint64 reads a host-order u64 attribute value (0 when short)
+func nlaUint64(b []byte) uint64 {
+	if len(b) < 8 {
+		return 0
+	}
+	return binary.NativeEndian.Uint64(b)
+}
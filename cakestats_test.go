@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// checkGolden compares got, rendered as indented JSON, against
+// testdata/qdisc/<name>.golden.json
+func checkGolden(t *testing.T, name string, got interface{}) {
+	t.Helper()
+	b, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	b = append(b, '\n')
+
+	path := filepath.Join("testdata", "qdisc", name+".golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatalf("update golden: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden (run go test -update to create): %v", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("%s mismatch\n--- got ---\n%s\n--- want ---\n%s", path, b, want)
+	}
+}
+
+func TestParseTCQdiscJSONGolden(t *testing.T) {
+	input, err := os.ReadFile(filepath.Join("testdata", "qdisc", "tc_s_j.json"))
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	qdiscs, err := parseTCQdiscJSON(input)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	checkGolden(t, "tc_s_j", qdiscs)
+
+	if _, err := parseTCQdiscJSON([]byte("qdisc cake 8001: dev eth0 root")); err == nil {
+		t.Fatalf("expected error for non-JSON output")
+	}
+}
+
+func TestParseTCQdiscTextGolden(t *testing.T) {
+	input, err := os.ReadFile(filepath.Join("testdata", "qdisc", "tc_s.txt"))
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	checkGolden(t, "tc_s", parseTCQdiscOutput(input))
+}
+
+func TestParseCakeXstatsGolden(t *testing.T) {
+	u32 := func(typ uint16, v uint32) []byte {
+		b := make([]byte, 4)
+		binary.NativeEndian.PutUint32(b, v)
+		return encodeNetlinkAttr(typ, b)
+	}
+	u64 := func(typ uint16, v uint64) []byte {
+		b := make([]byte, 8)
+		binary.NativeEndian.PutUint64(b, v)
+		return encodeNetlinkAttr(typ, b)
+	}
+	tin := func(index uint16, rate uint64, pk, av, sp, drops, marks, sparse, bulk uint32) []byte {
+		var v []byte
+		for _, a := range [][]byte{
+			u32(tcaCakeTinStatsSentPackets, 1000),
+			u64(tcaCakeTinStatsSentBytes64, 1500000),
+			u32(tcaCakeTinStatsDroppedPackets, drops),
+			u32(tcaCakeTinStatsECNMarkedPackets, marks),
+			u32(tcaCakeTinStatsBacklogBytes, 0),
+			u64(tcaCakeTinStatsThresholdRate64, rate),
+			u32(tcaCakeTinStatsTargetUs, 5000),
+			u32(tcaCakeTinStatsIntervalUs, 100000),
+			u32(tcaCakeTinStatsPeakDelayUs, pk),
+			u32(tcaCakeTinStatsAvgDelayUs, av),
+			u32(tcaCakeTinStatsBaseDelayUs, sp),
+			u32(tcaCakeTinStatsSparseFlows, sparse),
+			u32(tcaCakeTinStatsBulkFlows, bulk),
+			u32(tcaCakeTinStatsMaxSkblen, 1514),
+			u32(tcaCakeTinStatsFlowQuantum, 1514),
+		} {
+			v = append(v, a...)
+		}
+		return encodeNetlinkAttr(index|unix.NLA_F_NESTED, v)
+	}
+
+	var tins []byte
+	tins = append(tins, tin(1, 156250, 2100, 310, 15, 1, 0, 1, 0)...)
+	tins = append(tins, tin(2, 2500000, 8200, 1200, 180, 10, 4, 3, 2)...)
+	tins = append(tins, tin(3, 625000, 950, 210, 40, 1, 0, 2, 0)...)
+
+	var app []byte
+	app = append(app, u64(tcaCakeStatsCapacityEstimate64, 2500000)...)
+	app = append(app, u32(tcaCakeStatsMemoryLimit, 4194304)...)
+	app = append(app, u32(tcaCakeStatsMemoryUsed, 148480)...)
+	app = append(app, encodeNetlinkAttr(tcaCakeStatsTinStats|unix.NLA_F_NESTED, tins)...)
+
+	msgs, err := parseNetlinkMessages(cannedQdiscMsg("cake", 2, 0x80010000, tcHRoot, 2500000, 100000, app))
+	if err != nil {
+		t.Fatalf("parse messages: %v", err)
+	}
+	qdiscs, err := parseQdiscMessages(msgs, func(int) string { return "eth0" })
+	if err != nil {
+		t.Fatalf("parse qdiscs: %v", err)
+	}
+	checkGolden(t, "netlink", qdiscs)
+}
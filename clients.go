@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// ClientConfig selects the flows of one LAN client by source address, MAC
+// address (resolved through the neighbour table) and/or conntrack mark. A
+// flow belongs to the client when any configured selector matches.
+type ClientConfig struct {
+	Name string `mapstructure:"name" yaml:"name"`
+	// Addresses are the client's addresses or prefixes (CIDR or bare IP)
+	Addresses []string `mapstructure:"addresses" yaml:"addresses"`
+	// MAC matches every IPv4/IPv6 address the neighbour table holds for it,
+	// including temporary IPv6 privacy addresses
+	MAC               string `mapstructure:"mac" yaml:"mac"`
+	ConntrackMark     uint32 `mapstructure:"conntrack_mark" yaml:"conntrack_mark"`
+	ConntrackMarkMask uint32 `mapstructure:"conntrack_mark_mask" yaml:"conntrack_mark_mask"`
+	// Weight scales the client's flows in host ranking and the weighted
+	// aggregation strategies (0 means 1)
+	Weight float64 `mapstructure:"weight" yaml:"weight"`
+	// Ignore drops the client's flows, e.g. a TV streaming from a far CDN
+	Ignore bool `mapstructure:"ignore" yaml:"ignore"`
+}
+
+// lanClient is a parsed ClientConfig
+type lanClient struct {
+	name     string
+	nets     []*net.IPNet
+	mac      net.HardwareAddr
+	mark     uint32
+	markMask uint32
+	weight   float64
+	ignore   bool
+	// addrs holds the neighbour-table addresses of mac after resolve
+	addrs map[string]bool
+}
+
+// clientSet decides which LAN clients' flows drive the RTT and how much
+// each counts. With only set, flows of unlisted clients are dropped.
+type clientSet struct {
+	clients []lanClient
+	only    bool
+}
+
+// newClientSet parses the clients list and clients_only
+func newClientSet(cfg *Config) (*clientSet, error) {
+	cs := &clientSet{only: cfg.ClientsOnly}
+	for _, cc := range cfg.Clients {
+		if cc.Name == "" {
+			return nil, fmt.Errorf("clients entry without name")
+		}
+		c := lanClient{name: cc.Name, mark: cc.ConntrackMark, markMask: cc.ConntrackMarkMask,
+			weight: cc.Weight, ignore: cc.Ignore}
+		if c.markMask == 0 && c.mark != 0 {
+			c.markMask = 0xffffffff
+		}
+		if c.weight < 0 {
+			return nil, fmt.Errorf("client %s: weight must not be negative", cc.Name)
+		}
+		if c.weight == 0 {
+			c.weight = 1
+		}
+		for _, a := range cc.Addresses {
+			n, err := parseCIDROrIP(a)
+			if err != nil {
+				return nil, fmt.Errorf("client %s: %w", cc.Name, err)
+			}
+			c.nets = append(c.nets, n)
+		}
+		if cc.MAC != "" {
+			mac, err := net.ParseMAC(cc.MAC)
+			if err != nil {
+				return nil, fmt.Errorf("client %s: invalid mac %q", cc.Name, cc.MAC)
+			}
+			c.mac = mac
+		}
+		if len(c.nets) == 0 && c.mac == nil && c.markMask == 0 {
+			return nil, fmt.Errorf("client %s: needs addresses, mac or conntrack_mark", cc.Name)
+		}
+		cs.clients = append(cs.clients, c)
+	}
+	return cs, nil
+}
+
+// needsNeighbors reports whether any client is selected by MAC
+func (cs *clientSet) needsNeighbors() bool {
+	for _, c := range cs.clients {
+		if c.mac != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns a copy whose MAC selectors carry the addresses the
+// neighbour table currently maps to them
+func (cs *clientSet) resolve(neigh []neighborEntry) *clientSet {
+	out := &clientSet{only: cs.only, clients: make([]lanClient, len(cs.clients))}
+	copy(out.clients, cs.clients)
+	for i := range out.clients {
+		c := &out.clients[i]
+		if c.mac == nil {
+			continue
+		}
+		c.addrs = make(map[string]bool)
+		for _, n := range neigh {
+			if bytes.Equal(n.MAC, c.mac) {
+				c.addrs[n.IP.String()] = true
+			}
+		}
+	}
+	return out
+}
+
+// matches reports whether a flow comes from the client
+func (c *lanClient) matches(e ConntrackEntry) bool {
+	if c.markMask != 0 && e.Mark&c.markMask == c.mark&c.markMask {
+		return true
+	}
+	if e.Src == nil {
+		return false
+	}
+	for _, n := range c.nets {
+		if n.Contains(e.Src) {
+			return true
+		}
+	}
+	return c.addrs[e.Src.String()]
+}
+
+// classify returns the weight of a flow's LAN client, or false with the
+// rule that dropped it. The first matching client wins.
+func (cs *clientSet) classify(e ConntrackEntry) (float64, string, bool) {
+	if cs == nil {
+		return 1, "", true
+	}
+	for i := range cs.clients {
+		c := &cs.clients[i]
+		if !c.matches(e) {
+			continue
+		}
+		if c.ignore {
+			return 0, "client " + c.name + " ignored", false
+		}
+		return c.weight, "", true
+	}
+	if cs.only && len(cs.clients) > 0 {
+		return 0, "client not in clients", false
+	}
+	return 1, "", true
+}
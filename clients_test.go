@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func neighborMessage(state uint16, ip string, mac string) netlinkMessage {
+	data := make([]byte, unix.SizeofNdMsg)
+	binary.NativeEndian.PutUint16(data[8:10], state)
+	addr := net.ParseIP(ip)
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	data = append(data, encodeNetlinkAttr(unix.NDA_DST, addr)...)
+	if mac != "" {
+		hw, _ := net.ParseMAC(mac)
+		data = append(data, encodeNetlinkAttr(unix.NDA_LLADDR, hw)...)
+	}
+	return netlinkMessage{Type: unix.RTM_NEWNEIGH, Data: data}
+}
+
+func TestParseNeighborMessages(t *testing.T) {
+	msgs := []netlinkMessage{
+		neighborMessage(unix.NUD_REACHABLE, "192.168.1.10", "aa:bb:cc:dd:ee:01"),
+		neighborMessage(unix.NUD_STALE, "2001:db8:1:2::1234", "aa:bb:cc:dd:ee:01"),
+		neighborMessage(unix.NUD_FAILED, "192.168.1.11", "aa:bb:cc:dd:ee:02"),
+		neighborMessage(unix.NUD_REACHABLE, "192.168.1.12", ""), // no lladdr
+	}
+	entries, err := parseNeighborMessages(msgs)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(entries) != 2 || entries[0].IP.String() != "192.168.1.10" ||
+		entries[1].IP.String() != "2001:db8:1:2::1234" || entries[1].MAC.String() != "aa:bb:cc:dd:ee:01" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if _, err := parseNeighborMessages([]netlinkMessage{{Type: unix.RTM_NEWNEIGH, Data: []byte{1}}}); err == nil {
+		t.Fatalf("expected error for truncated message")
+	}
+}
+
+func TestClientSetClassify(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Clients = []ClientConfig{
+		{Name: "tv", ConntrackMark: 0x10, ConntrackMarkMask: 0xf0, Ignore: true},
+		{Name: "desk", MAC: "aa:bb:cc:dd:ee:01", Weight: 3},
+		{Name: "console", Addresses: []string{"192.168.1.50", "2001:db8:1:2::50"}},
+	}
+	cs, err := newClientSet(cfg)
+	if err != nil {
+		t.Fatalf("clients: %v", err)
+	}
+	if !cs.needsNeighbors() {
+		t.Fatalf("expected MAC client to need the neighbour table")
+	}
+	cs = cs.resolve([]neighborEntry{
+		{IP: net.ParseIP("192.168.1.10"), MAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}},
+		{IP: net.ParseIP("2001:db8:1:2:a1b2::7"), MAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}},
+	})
+
+	cases := []struct {
+		src    string
+		mark   uint32
+		weight float64
+		rule   string
+		ok     bool
+	}{
+		{"192.168.1.10", 0, 3, "", true},
+		{"2001:db8:1:2:a1b2::7", 0, 3, "", true}, // privacy address via the neighbour table
+		{"192.168.1.10", 0x13, 0, "client tv ignored", false},
+		{"2001:db8:1:2::50", 0, 1, "", true},
+		{"192.168.1.99", 0, 1, "", true}, // unlisted clients count with weight 1
+	}
+	for _, c := range cases {
+		w, rule, ok := cs.classify(ConntrackEntry{Src: net.ParseIP(c.src), Mark: c.mark})
+		if w != c.weight || rule != c.rule || ok != c.ok {
+			t.Fatalf("%s mark=%#x: got %v %q %t", c.src, c.mark, w, rule, ok)
+		}
+	}
+
+	cs.only = true
+	if _, rule, ok := cs.classify(ConntrackEntry{Src: net.ParseIP("192.168.1.99")}); ok || rule != "client not in clients" {
+		t.Fatalf("clients_only should drop unlisted clients: %q %t", rule, ok)
+	}
+
+	for _, bad := range []ClientConfig{
+		{Addresses: []string{"192.168.1.1"}},
+		{Name: "x"},
+		{Name: "x", MAC: "nope"},
+		{Name: "x", Addresses: []string{"nope"}},
+		{Name: "x", Addresses: []string{"192.168.1.1"}, Weight: -1},
+	} {
+		if _, err := newClientSet(&Config{Clients: []ClientConfig{bad}}); err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestSelectHostsWeightsFlowsByClient(t *testing.T) {
+	flow := func(src, dst string) ConntrackEntry {
+		return ConntrackEntry{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP(src), Dst: net.ParseIP(dst), DPort: 443}
+	}
+	entries := []ConntrackEntry{
+		flow("192.168.1.20", "8.8.8.8"),
+		flow("192.168.1.20", "8.8.8.8"),
+		flow("192.168.1.20", "8.8.8.8"),
+		flow("192.168.1.10", "1.1.1.1"),
+		flow("192.168.1.30", "9.9.9.9"), // ignored client
+	}
+	cfg := DefaultConfig()
+	cfg.Clients = []ClientConfig{
+		{Name: "desk", MAC: "aa:bb:cc:dd:ee:01", Weight: 5},
+		{Name: "tv", Addresses: []string{"192.168.1.30"}, Ignore: true},
+	}
+	clients, err := newClientSet(cfg)
+	if err != nil {
+		t.Fatalf("clients: %v", err)
+	}
+	s := &CakeAutoRTTService{config: cfg, clients: clients, conntrackSource: &fakeConntrack{entries: entries}}
+	s.neighborTable = func() ([]neighborEntry, error) {
+		return []neighborEntry{{IP: net.ParseIP("192.168.1.10"), MAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}}}, nil
+	}
+	s.refreshClients()
+
+	hosts := s.selectHosts(entries, hostFilter{})
+	if !reflect.DeepEqual(hosts, []string{"1.1.1.1", "8.8.8.8"}) {
+		t.Fatalf("expected the weighted client's host first, got %v", hosts)
+	}
+	if s.hostWeights["1.1.1.1"] != 5 || s.hostWeights["8.8.8.8"] != 3 {
+		t.Fatalf("unexpected host weights: %v", s.hostWeights)
+	}
+
+	decisions, err := s.HostDecisions()
+	if err != nil {
+		t.Fatalf("decisions: %v", err)
+	}
+	for _, d := range decisions {
+		if d.Host == "9.9.9.9" && (d.Accepted || d.Rule != "client tv ignored") {
+			t.Fatalf("unexpected decision for ignored client: %+v", d)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// configMu serializes SIGHUP reloads and /api/config edits, so an edit is
+// never built on a configuration a reload is replacing
+var configMu sync.Mutex
+
+// configHiddenKeys stay out of /api/config and can only be set in the file:
+// credentials, so a write token cannot grant itself more access, the audit
+// trail, and the paths of files the service writes to
+var configHiddenKeys = map[string]bool{
+	"web_auth":          true,
+	"config_audit_file": true,
+	"web_tls_cert":      true,
+	"web_tls_key":       true,
+	"history_file":      true,
+}
+
+// configRestartKeys are read at startup; edits are saved but only take
+// effect after a restart
+var configRestartKeys = map[string]bool{
+	"rtt_update_interval":         true,
+	"web_enabled":                 true,
+	"web_port":                    true,
+	"web_bind_address":            true,
+	"web_tls":                     true,
+	"web_tls_redirect_port":       true,
+	"conntrack_backend":           true,
+	"qdisc_backend":               true,
+	"adaptive_controller_enabled": true,
+	"history_enabled":             true,
+	"history_max_bytes":           true,
+	"history_flush_sec":           true,
+}
+
+// ConfigChange is one setting changed through /api/config
+type ConfigChange struct {
+	Key             string `json:"key"`
+	Old             any    `json:"old"`
+	New             any    `json:"new"`
+	RestartRequired bool   `json:"restart_required,omitempty"`
+}
+
+// ConfigAuditEntry records who changed which settings through /api/config
+type ConfigAuditEntry struct {
+	Time    time.Time      `json:"time"`
+	User    string         `json:"user"`
+	Via     string         `json:"via"`
+	Remote  string         `json:"remote"`
+	Method  string         `json:"method"`
+	Changes []ConfigChange `json:"changes"`
+}
+
+// configValues returns the settings keyed by their YAML names, without the
+// hidden ones
+func configValues(cfg *Config) (map[string]any, error) {
+	raw, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	for key := range configHiddenKeys {
+		delete(values, key)
+	}
+	return values, nil
+}
+
+// decodeConfigValues builds a Config from settings keyed by YAML name, with
+// the same weak typing as the config file; unknown nested keys are errors
+func decodeConfigValues(values map[string]any) (*Config, error) {
+	raw, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+	next := &Config{}
+	if err := v.Unmarshal(next, func(dc *mapstructure.DecoderConfig) { dc.ErrorUnused = true }); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// editConfig applies an edit to cur and returns the resulting config and the
+// settings it changes. A patch only touches the keys it names (null resets a
+// key to its default); a replacement starts from the defaults. The hidden
+// settings always carry over.
+func editConfig(cur *Config, edit map[string]any, replace bool) (*Config, []ConfigChange, error) {
+	curValues, err := configValues(cur)
+	if err != nil {
+		return nil, nil, err
+	}
+	defaults, err := configValues(DefaultConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base := curValues
+	if replace {
+		base = defaults
+	}
+	merged := make(map[string]any, len(base))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range edit {
+		if configHiddenKeys[k] {
+			return nil, nil, fmt.Errorf("%s can only be changed in the config file", k)
+		}
+		if _, ok := curValues[k]; !ok {
+			return nil, nil, fmt.Errorf("unknown setting %q", k)
+		}
+		if v == nil {
+			v = defaults[k]
+		}
+		merged[k] = v
+	}
+
+	next, err := decodeConfigValues(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key := range configHiddenKeys {
+		configField(next, key).Set(configField(cur, key))
+	}
+	if err := validateConfigEdit(next); err != nil {
+		return nil, nil, err
+	}
+
+	nextValues, err := configValues(next)
+	if err != nil {
+		return nil, nil, err
+	}
+	var changes []ConfigChange
+	for _, k := range sortedKeys(nextValues) {
+		if !reflect.DeepEqual(curValues[k], nextValues[k]) {
+			changes = append(changes, ConfigChange{Key: k, Old: curValues[k], New: nextValues[k], RestartRequired: configRestartKeys[k]})
+		}
+	}
+	return next, changes, nil
+}
+
+// validateConfigEdit adds the checks a running service needs on top of
+// validateConfig: a file edited by hand fails at startup, an API edit must
+// fail before it is applied
+func validateConfigEdit(cfg *Config) error {
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+	if cfg.RTTUpdateInterval < 1 {
+		return fmt.Errorf("rtt_update_interval must be at least 1 second")
+	}
+	if cfg.WebPort < 1 || cfg.WebPort > 65535 {
+		return fmt.Errorf("web_port must be between 1 and 65535")
+	}
+	if _, err := resolveInterfaces(cfg); err != nil {
+		return err
+	}
+	if cfg.AutorateEnabled {
+		if _, err := newAutorateController(cfg); err != nil {
+			return err
+		}
+	}
+	return validateAllowedOrigins(cfg.WebAllowedOrigins)
+}
+
+// configField returns the Config field with the YAML name key
+func configField(cfg *Config, key string) reflect.Value {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ","); name == key {
+			return v.Field(i)
+		}
+	}
+	panic("config: no setting " + key)
+}
+
+// keepRestartSettings copies the configRestartKeys settings of running into
+// cfg: an edit saves them to the file, but what runs keeps the values it
+// started with
+func keepRestartSettings(cfg, running *Config) {
+	for key := range configRestartKeys {
+		configField(cfg, key).Set(configField(running, key))
+	}
+}
+
+// persistConfig writes the changed settings of cfg into the config file,
+// through a temporary file and a rename so a crash never leaves a torn file
+func persistConfig(path string, cfg *Config, changes []ConfigChange) error {
+	src, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := os.FileMode(0o644)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+
+	values := make([]yamlKeyValue, 0, len(changes))
+	for _, ch := range changes {
+		values = append(values, yamlKeyValue{key: ch.Key, value: configField(cfg, ch.Key).Interface()})
+	}
+	out, err := setYAMLKeys(src, values)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type yamlKeyValue struct {
+	key   string
+	value any
+}
+
+// setYAMLKeys replaces the values of top-level keys in a YAML document and
+// appends the keys it lacks. Only the lines of the replaced values change:
+// comments, blank lines and key order survive, as do the trailing comment
+// and the flow or quoting style of each replaced value.
+func setYAMLKeys(src []byte, values []yamlKeyValue) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("config file is not a YAML mapping")
+		}
+	}
+
+	type splice struct {
+		start, end int // 0-based line range, end exclusive
+		text       string
+	}
+	var splices []splice
+	var appended []string
+	for _, kv := range values {
+		var key, val *yaml.Node
+		if root != nil {
+			for i := 0; i+1 < len(root.Content); i += 2 {
+				if root.Content[i].Value == kv.key {
+					key, val = root.Content[i], root.Content[i+1]
+				}
+			}
+		}
+		text, err := encodeYAMLKey(kv.key, kv.value, val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kv.key, err)
+		}
+		if key == nil {
+			appended = append(appended, text)
+			continue
+		}
+		comment := val.LineComment
+		if comment == "" {
+			comment = key.LineComment
+		}
+		if comment != "" {
+			first, rest, _ := strings.Cut(text, "\n")
+			text = first + " " + comment
+			if rest != "" {
+				text += "\n" + rest
+			}
+		}
+		splices = append(splices, splice{start: key.Line - 1, end: max(yamlLastLine(val), key.Line), text: text})
+	}
+
+	lines := strings.SplitAfter(string(src), "\n")
+	sort.Slice(splices, func(i, j int) bool { return splices[i].start > splices[j].start })
+	for _, s := range splices {
+		repl := []string{s.text + "\n"}
+		lines = append(lines[:s.start], append(repl, lines[min(s.end, len(lines)):]...)...)
+	}
+	out := strings.Join(lines, "")
+	for _, text := range appended {
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += text + "\n"
+	}
+	return []byte(out), nil
+}
+
+// encodeYAMLKey renders "key: value", in flow or quoted style when the value
+// it replaces used it
+func encodeYAMLKey(key string, value any, old *yaml.Node) (string, error) {
+	var val yaml.Node
+	if err := val.Encode(value); err != nil {
+		return "", err
+	}
+	if old != nil {
+		switch {
+		case old.Style&yaml.FlowStyle != 0 && (val.Kind == yaml.SequenceNode || val.Kind == yaml.MappingNode):
+			val.Style = yaml.FlowStyle
+		case old.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 && val.Kind == yaml.ScalarNode && val.Tag == "!!str":
+			val.Style = old.Style & (yaml.DoubleQuotedStyle | yaml.SingleQuotedStyle)
+		}
+	}
+	pair := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: key}, &val}}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(pair); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(buf.String(), "\n"), nil
+}
+
+// yamlLastLine is the last (1-based) line holding any part of n
+func yamlLastLine(n *yaml.Node) int {
+	last := n.Line
+	if n.Kind == yaml.ScalarNode && n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		last += strings.Count(strings.TrimRight(n.Value, "\n"), "\n") + 1
+	}
+	for _, c := range n.Content {
+		last = max(last, yamlLastLine(c))
+	}
+	return last
+}
+
+// auditConfigChange appends an entry to config_audit_file as one JSON line
+func auditConfigChange(path string, entry ConfigAuditEntry) error {
+	if path == "" {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// formatConfigChanges summarizes changes for the service log
+func formatConfigChanges(changes []ConfigChange) string {
+	parts := make([]string, len(changes))
+	for i, ch := range changes {
+		old, _ := json.Marshal(ch.Old)
+		next, _ := json.Marshal(ch.New)
+		parts[i] = fmt.Sprintf("%s %s -> %s", ch.Key, old, next)
+		if ch.RestartRequired {
+			parts[i] += " (after restart)"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
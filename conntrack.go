@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ConntrackEntry is one tracked flow, described by its original-direction tuple
+type ConntrackEntry struct {
+	Proto uint8
+	// State is the TCP conntrack state name (e.g. ESTABLISHED); empty for other protocols
+	State string
+	Src   net.IP
+	Dst   net.IP
+	SPort uint16
+	DPort uint16
+	// Bytes and Packets sum both directions; zero unless conntrack accounting
+	// is enabled (net.netfilter.nf_conntrack_acct=1)
+	Bytes   uint64
+	Packets uint64
+	// ReplyDst is the reply-direction destination, i.e. the WAN address a
+	// masqueraded flow was NATed to
+	ReplyDst net.IP
+	// Mark is the connection mark (CONNMARK), e.g. set by multi-WAN policy routing
+	Mark uint32
+}
+
+// ConntrackSource lists the flows currently tracked by the kernel
+type ConntrackSource interface {
+	Name() string
+	Entries() ([]ConntrackEntry, error)
+}
+
+// NewConntrackSource returns the conntrack backend selected by the
+// conntrack_backend config key. "auto" (or empty) prefers ctnetlink and falls
+// back to /proc/net/nf_conntrack when netlink is unavailable (no
+// nf_conntrack_netlink, missing CAP_NET_ADMIN).
+func NewConntrackSource(backend string) (ConntrackSource, error) {
+	switch backend {
+	case "netlink":
+		return &netlinkConntrack{}, nil
+	case "procfs":
+		return &procfsConntrack{path: procConntrackPath}, nil
+	case "", "auto":
+		nl := &netlinkConntrack{}
+		if _, err := nl.Entries(); err == nil {
+			return nl, nil
+		}
+		return &procfsConntrack{path: procConntrackPath}, nil
+	}
+	return nil, fmt.Errorf("unknown conntrack_backend %q (want auto, netlink or procfs)", backend)
+}
+
+// procConntrackPath is the legacy text interface, present only when the kernel
+// is built with nf_conntrack_procfs
+const procConntrackPath = "/proc/net/nf_conntrack"
+
+// procfsConntrack parses the /proc/net/nf_conntrack text table
+type procfsConntrack struct {
+	path string
+}
+
+func (p *procfsConntrack) Name() string { return "procfs" }
+
+func (p *procfsConntrack) Entries() ([]ConntrackEntry, error) {
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", p.path, err)
+	}
+	defer file.Close()
+
+	entries, err := parseProcConntrack(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading conntrack: %w", err)
+	}
+	return entries, nil
+}
+
+// parseProcConntrack parses lines such as
+//
+//	ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.1.2 dst=93.184.216.34 sport=51234 dport=443 src=... [ASSURED] mark=0 use=1
+//
+// The first (original direction) src/dst/sport/dport describe the flow and the
+// second dst is kept as the reply destination; the per-direction
+// bytes=/packets= accounting fields are summed.
+func parseProcConntrack(r io.Reader) ([]ConntrackEntry, error) {
+	var entries []ConntrackEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// skip the optional "ipv4 2" l3 prefix
+		if len(fields) >= 2 && (fields[0] == "ipv4" || fields[0] == "ipv6") {
+			fields = fields[2:]
+		}
+		if len(fields) < 3 {
+			continue
+		}
+
+		var e ConntrackEntry
+		if proto, err := strconv.ParseUint(fields[1], 10, 8); err == nil {
+			e.Proto = uint8(proto)
+		}
+
+		for _, f := range fields[3:] {
+			key, value, ok := strings.Cut(f, "=")
+			if !ok {
+				// the bare upper-case word after the timeout is the TCP state
+				if e.State == "" && e.Src == nil && f != "" && f[0] != '[' {
+					e.State = f
+				}
+				continue
+			}
+			switch key {
+			case "src":
+				if e.Src == nil {
+					e.Src = net.ParseIP(value)
+				}
+			case "dst":
+				if e.Dst == nil {
+					e.Dst = net.ParseIP(value)
+				} else if e.ReplyDst == nil {
+					e.ReplyDst = net.ParseIP(value)
+				}
+			case "sport":
+				if e.SPort == 0 {
+					e.SPort = parsePort(value)
+				}
+			case "dport":
+				if e.DPort == 0 {
+					e.DPort = parsePort(value)
+				}
+			case "bytes":
+				if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+					e.Bytes += v
+				}
+			case "packets":
+				if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+					e.Packets += v
+				}
+			case "mark":
+				if v, err := strconv.ParseUint(value, 10, 32); err == nil {
+					e.Mark = uint32(v)
+				}
+			}
+		}
+
+		if e.Dst != nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parsePort parses a decimal port number, returning 0 when invalid
+func parsePort(s string) uint16 {
+	v, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(v)
+}
+
+// ctnetlink message types and attributes (linux/netfilter/nfnetlink_conntrack.h)
+const (
+	ipctnlMsgCtNew = 0
+	ipctnlMsgCtGet = 1
+
+	ctaTupleOrig     = 1
+	ctaTupleReply    = 2
+	ctaProtoinfo     = 4
+	ctaMark          = 8
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	ctaProtoinfoTCP      = 1
+	ctaProtoinfoTCPState = 1
+
+	ctaCountersPackets   = 1
+	ctaCountersBytes     = 2
+	ctaCounters32Packets = 3
+	ctaCounters32Bytes   = 4
+)
+
+// tcpConntrackStates maps enum tcp_conntrack to the names used by procfs
+var tcpConntrackStates = []string{
+	"NONE", "SYN_SENT", "SYN_RECV", "ESTABLISHED", "FIN_WAIT",
+	"CLOSE_WAIT", "LAST_ACK", "TIME_WAIT", "CLOSE", "SYN_SENT2",
+}
+
+// netlinkConntrack dumps the conntrack table over NETLINK_NETFILTER
+// (NFNL_SUBSYS_CTNETLINK), which works without nf_conntrack_procfs and avoids
+// formatting and re-parsing text for every flow
+type netlinkConntrack struct{}
+
+func (n *netlinkConntrack) Name() string { return "netlink" }
+
+func (n *netlinkConntrack) Entries() ([]ConntrackEntry, error) {
+	// struct nfgenmsg: AF_UNSPEC dumps both IPv4 and IPv6
+	nfgen := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	msgs, err := netlinkExecute(unix.NETLINK_NETFILTER, unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtGet,
+		unix.NLM_F_DUMP, nfgen)
+	if err != nil {
+		return nil, fmt.Errorf("ctnetlink dump: %w", err)
+	}
+	return parseCtnetlinkMessages(msgs)
+}
+
+// parseCtnetlinkMessages decodes the IPCTNL_MSG_CT_NEW messages of a dump
+func parseCtnetlinkMessages(msgs []netlinkMessage) ([]ConntrackEntry, error) {
+	entries := make([]ConntrackEntry, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Type != unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtNew {
+			continue
+		}
+		if len(m.Data) < 4 {
+			return nil, fmt.Errorf("ctnetlink: truncated nfgenmsg")
+		}
+		e, err := parseCtnetlinkEntry(m.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		if e.Dst != nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// parseCtnetlinkEntry decodes the attributes of one conntrack entry
+func parseCtnetlinkEntry(b []byte) (ConntrackEntry, error) {
+	var e ConntrackEntry
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return e, err
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case ctaTupleOrig:
+			if err := parseCtnetlinkTuple(a.Value, &e); err != nil {
+				return e, err
+			}
+		case ctaTupleReply:
+			var reply ConntrackEntry
+			if err := parseCtnetlinkTuple(a.Value, &reply); err != nil {
+				return e, err
+			}
+			e.ReplyDst = reply.Dst
+		case ctaMark:
+			if len(a.Value) >= 4 {
+				e.Mark = binary.BigEndian.Uint32(a.Value)
+			}
+		case ctaProtoinfo:
+			state, err := parseCtnetlinkTCPState(a.Value)
+			if err != nil {
+				return e, err
+			}
+			e.State = state
+		case ctaCountersOrig, ctaCountersReply:
+			if err := parseCtnetlinkCounters(a.Value, &e); err != nil {
+				return e, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// parseCtnetlinkTuple fills addresses and ports from a CTA_TUPLE_* attribute
+func parseCtnetlinkTuple(b []byte, e *ConntrackEntry) error {
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		inner, err := parseNetlinkAttrs(a.Value)
+		if err != nil {
+			return err
+		}
+		switch a.Type {
+		case ctaTupleIP:
+			for _, ia := range inner {
+				ip := net.IP(append([]byte(nil), ia.Value...))
+				switch ia.Type {
+				case ctaIPv4Src, ctaIPv6Src:
+					e.Src = ip
+				case ctaIPv4Dst, ctaIPv6Dst:
+					e.Dst = ip
+				}
+			}
+		case ctaTupleProto:
+			for _, pa := range inner {
+				switch pa.Type {
+				case ctaProtoNum:
+					if len(pa.Value) >= 1 {
+						e.Proto = pa.Value[0]
+					}
+				case ctaProtoSrcPort:
+					if len(pa.Value) >= 2 {
+						e.SPort = binary.BigEndian.Uint16(pa.Value)
+					}
+				case ctaProtoDstPort:
+					if len(pa.Value) >= 2 {
+						e.DPort = binary.BigEndian.Uint16(pa.Value)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// parseCtnetlinkTCPState extracts the TCP state name from CTA_PROTOINFO
+func parseCtnetlinkTCPState(b []byte) (string, error) {
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range attrs {
+		if a.Type != ctaProtoinfoTCP {
+			continue
+		}
+		inner, err := parseNetlinkAttrs(a.Value)
+		if err != nil {
+			return "", err
+		}
+		for _, ia := range inner {
+			if ia.Type == ctaProtoinfoTCPState && len(ia.Value) >= 1 {
+				if int(ia.Value[0]) < len(tcpConntrackStates) {
+					return tcpConntrackStates[ia.Value[0]], nil
+				}
+				return fmt.Sprintf("STATE_%d", ia.Value[0]), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseCtnetlinkCounters adds a CTA_COUNTERS_* (CTA_COUNTERS_ORIG/REPLY)
+// attribute's byte and packet counts to e
+func parseCtnetlinkCounters(b []byte, e *ConntrackEntry) error {
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		var v uint64
+		switch len(a.Value) {
+		case 8:
+			v = binary.BigEndian.Uint64(a.Value)
+		case 4:
+			v = uint64(binary.BigEndian.Uint32(a.Value))
+		default:
+			continue
+		}
+		switch a.Type {
+		case ctaCountersPackets, ctaCounters32Packets:
+			e.Packets += v
+		case ctaCountersBytes, ctaCounters32Bytes:
+			e.Bytes += v
+		}
+	}
+	return nil
+}
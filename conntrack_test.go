@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeConntrack is a ConntrackSource returning canned entries
+type fakeConntrack struct {
+	entries []ConntrackEntry
+}
+
+func (f *fakeConntrack) Name() string                       { return "fake" }
+func (f *fakeConntrack) Entries() ([]ConntrackEntry, error) { return f.entries, nil }
+
+const procConntrackSample = `ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.1.10 dst=93.184.216.34 sport=51234 dport=443 src=93.184.216.34 dst=203.0.113.5 sport=443 dport=51234 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 udp      17 29 src=192.168.1.10 dst=8.8.8.8 sport=40000 dport=53 [UNREPLIED] src=8.8.8.8 dst=203.0.113.5 sport=53 dport=40000 mark=0 zone=0 use=2
+ipv6     10 tcp      6 119 TIME_WAIT src=2001:db8::10 dst=2606:4700::1111 sport=50000 dport=443 src=2606:4700::1111 dst=2001:db8::10 sport=443 dport=50000 [ASSURED] mark=0 zone=0 use=2
+tcp      6 300 ESTABLISHED src=10.0.0.2 dst=1.1.1.1 sport=1000 dport=22 src=1.1.1.1 dst=10.0.0.2 sport=22 dport=1000 [ASSURED] use=1
+`
+
+func TestParseProcConntrack(t *testing.T) {
+	entries, err := parseProcConntrack(strings.NewReader(procConntrackSample))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []ConntrackEntry{
+		{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"), Dst: net.ParseIP("93.184.216.34"), SPort: 51234, DPort: 443},
+		{Proto: 17, Src: net.ParseIP("192.168.1.10"), Dst: net.ParseIP("8.8.8.8"), SPort: 40000, DPort: 53},
+		{Proto: 6, State: "TIME_WAIT", Src: net.ParseIP("2001:db8::10"), Dst: net.ParseIP("2606:4700::1111"), SPort: 50000, DPort: 443},
+		{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("1.1.1.1"), SPort: 1000, DPort: 22},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, w := range want {
+		assertConntrackEntry(t, i, entries[i], w)
+	}
+}
+
+func assertConntrackEntry(t *testing.T, i int, got, want ConntrackEntry) {
+	t.Helper()
+	if got.Proto != want.Proto || got.State != want.State || !got.Src.Equal(want.Src) || !got.Dst.Equal(want.Dst) ||
+		got.SPort != want.SPort || got.DPort != want.DPort {
+		t.Fatalf("entry %d: got %+v, want %+v", i, got, want)
+	}
+}
+
+// cannedCtnetlinkEntry encodes an IPCTNL_MSG_CT_NEW message for one flow
+func cannedCtnetlinkEntry(src, dst net.IP, proto uint8, sport, dport uint16, tcpState int) []byte {
+	srcType, dstType := uint16(ctaIPv6Src), uint16(ctaIPv6Dst)
+	family := byte(unix.AF_INET6)
+	if dst.To4() != nil {
+		srcType, dstType = ctaIPv4Src, ctaIPv4Dst
+		family = unix.AF_INET
+		src, dst = src.To4(), dst.To4()
+	}
+	be16 := func(v uint16) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, v)
+		return b
+	}
+	nested := func(t uint16, parts ...[]byte) []byte {
+		var v []byte
+		for _, p := range parts {
+			v = append(v, p...)
+		}
+		return encodeNetlinkAttr(t|unix.NLA_F_NESTED, v)
+	}
+
+	tuple := func(t uint16, s, d net.IP, sp, dp uint16) []byte {
+		return nested(t,
+			nested(ctaTupleIP, encodeNetlinkAttr(srcType, s), encodeNetlinkAttr(dstType, d)),
+			nested(ctaTupleProto,
+				encodeNetlinkAttr(ctaProtoNum, []byte{proto}),
+				encodeNetlinkAttr(ctaProtoSrcPort, be16(sp)),
+				encodeNetlinkAttr(ctaProtoDstPort, be16(dp))))
+	}
+
+	payload := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	payload = append(payload, tuple(ctaTupleOrig, src, dst, sport, dport)...)
+	payload = append(payload, tuple(ctaTupleReply, dst, src, dport, sport)...)
+	if tcpState >= 0 {
+		payload = append(payload, nested(ctaProtoinfo,
+			nested(ctaProtoinfoTCP, encodeNetlinkAttr(ctaProtoinfoTCPState, []byte{byte(tcpState)})))...)
+	}
+	return encodeNetlinkMessage(unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtNew, unix.NLM_F_MULTI, 1, payload)
+}
+
+func TestParseCtnetlinkMessages(t *testing.T) {
+	var dump []byte
+	dump = append(dump, cannedCtnetlinkEntry(net.ParseIP("192.168.1.10"), net.ParseIP("93.184.216.34"), 6, 51234, 443, 3)...)
+	dump = append(dump, cannedCtnetlinkEntry(net.ParseIP("192.168.1.10"), net.ParseIP("8.8.8.8"), 17, 40000, 53, -1)...)
+	dump = append(dump, cannedCtnetlinkEntry(net.ParseIP("2001:db8::10"), net.ParseIP("2606:4700::1111"), 6, 50000, 443, 7)...)
+
+	msgs, err := parseNetlinkMessages(dump)
+	if err != nil {
+		t.Fatalf("parse messages: %v", err)
+	}
+	entries, err := parseCtnetlinkMessages(msgs)
+	if err != nil {
+		t.Fatalf("parse ctnetlink: %v", err)
+	}
+	want := []ConntrackEntry{
+		{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"), Dst: net.ParseIP("93.184.216.34"), SPort: 51234, DPort: 443},
+		{Proto: 17, Src: net.ParseIP("192.168.1.10"), Dst: net.ParseIP("8.8.8.8"), SPort: 40000, DPort: 53},
+		{Proto: 6, State: "TIME_WAIT", Src: net.ParseIP("2001:db8::10"), Dst: net.ParseIP("2606:4700::1111"), SPort: 50000, DPort: 443},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, w := range want {
+		assertConntrackEntry(t, i, entries[i], w)
+	}
+}
+
+func TestExtractHostsFromConntrackSource(t *testing.T) {
+	entries, err := parseProcConntrack(strings.NewReader(procConntrackSample))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	s := &CakeAutoRTTService{
+		config:          &Config{MaxHosts: 10},
+		conntrackSource: &fakeConntrack{entries: entries},
+	}
+	entries, err = s.conntrackEntries()
+	if err != nil {
+		t.Fatalf("entries: %v", err)
+	}
+	hosts := s.selectHosts(entries, hostFilter{})
+	sort.Strings(hosts)
+	// only ESTABLISHED, non-LAN destinations
+	if len(hosts) != 2 || hosts[0] != "1.1.1.1" || hosts[1] != "93.184.216.34" {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestParseConntrackAccounting(t *testing.T) {
+	line := "ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.1.10 dst=93.184.216.34 sport=51234 dport=443 packets=12 bytes=1500 " +
+		"src=93.184.216.34 dst=203.0.113.5 sport=443 dport=51234 packets=30 bytes=42000 [ASSURED] mark=512 zone=0 use=2\n"
+	entries, err := parseProcConntrack(strings.NewReader(line))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("parse: %v, %d entries", err, len(entries))
+	}
+	if entries[0].Bytes != 43500 || entries[0].Packets != 42 {
+		t.Fatalf("procfs accounting: got bytes=%d packets=%d", entries[0].Bytes, entries[0].Packets)
+	}
+	if !entries[0].ReplyDst.Equal(net.ParseIP("203.0.113.5")) || entries[0].Mark != 512 {
+		t.Fatalf("procfs reply/mark: got %v mark=%d", entries[0].ReplyDst, entries[0].Mark)
+	}
+
+	be64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return b
+	}
+	counters := func(typ uint16, packets, bytes uint64) []byte {
+		inner := append(encodeNetlinkAttr(ctaCountersPackets, be64(packets)), encodeNetlinkAttr(ctaCountersBytes, be64(bytes))...)
+		return encodeNetlinkAttr(typ|unix.NLA_F_NESTED, inner)
+	}
+	msg := cannedCtnetlinkEntry(net.ParseIP("192.168.1.10"), net.ParseIP("93.184.216.34"), 6, 51234, 443, 3)
+	msgs, err := parseNetlinkMessages(msg)
+	if err != nil {
+		t.Fatalf("parse messages: %v", err)
+	}
+	msgs[0].Data = append(msgs[0].Data, counters(ctaCountersOrig, 12, 1500)...)
+	msgs[0].Data = append(msgs[0].Data, counters(ctaCountersReply, 30, 42000)...)
+	mark := make([]byte, 4)
+	binary.BigEndian.PutUint32(mark, 512)
+	msgs[0].Data = append(msgs[0].Data, encodeNetlinkAttr(ctaMark, mark)...)
+	entries, err = parseCtnetlinkMessages(msgs)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("parse ctnetlink: %v, %d entries", err, len(entries))
+	}
+	if entries[0].Bytes != 43500 || entries[0].Packets != 42 {
+		t.Fatalf("ctnetlink accounting: got bytes=%d packets=%d", entries[0].Bytes, entries[0].Packets)
+	}
+	// the canned reply tuple is the un-NATed mirror of the original
+	if !entries[0].ReplyDst.Equal(net.ParseIP("192.168.1.10")) || entries[0].Mark != 512 {
+		t.Fatalf("ctnetlink reply/mark: got %v mark=%d", entries[0].ReplyDst, entries[0].Mark)
+	}
+}
+
+func TestExtractHostsRankedByTraffic(t *testing.T) {
+	flow := func(dst string, bytes, packets uint64) ConntrackEntry {
+		return ConntrackEntry{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"), Dst: net.ParseIP(dst),
+			Bytes: bytes, Packets: packets}
+	}
+	entries := []ConntrackEntry{
+		flow("1.1.1.1", 100, 50),
+		flow("1.1.1.1", 100, 50),
+		flow("1.1.1.1", 100, 50),
+		flow("8.8.8.8", 5000000, 4000),
+		flow("9.9.9.9", 20000, 60),
+		flow("192.168.1.20", 9000000, 9000),
+	}
+	s := &CakeAutoRTTService{config: &Config{MaxHosts: 2, HostRankBy: "bytes"}}
+
+	cases := []struct {
+		rankBy string
+		want   []string
+	}{
+		{"bytes", []string{"8.8.8.8", "9.9.9.9"}},
+		{"packets", []string{"8.8.8.8", "1.1.1.1"}},
+		{"flows", []string{"1.1.1.1", "8.8.8.8"}},
+	}
+	for _, c := range cases {
+		s.config.HostRankBy = c.rankBy
+		hosts := s.selectHosts(entries, hostFilter{})
+		if strings.Join(hosts, ",") != strings.Join(c.want, ",") {
+			t.Fatalf("%s: got %v, want %v", c.rankBy, hosts, c.want)
+		}
+	}
+	if s.hostWeights["8.8.8.8"] != 1 || s.hostWeights["1.1.1.1"] != 3 {
+		t.Fatalf("unexpected flow weights: %v", s.hostWeights)
+	}
+
+	// Without accounting the ranking falls back to flow counts
+	for i := range entries {
+		entries[i].Bytes, entries[i].Packets = 0, 0
+	}
+	s.config.HostRankBy = "bytes"
+	hosts := s.selectHosts(entries, hostFilter{})
+	if len(hosts) != 2 || hosts[0] != "1.1.1.1" || hosts[1] != "8.8.8.8" {
+		t.Fatalf("flow fallback: got %v", hosts)
+	}
+}
+
+func TestNewConntrackSourceSelection(t *testing.T) {
+	if src, err := NewConntrackSource("procfs"); err != nil || src.Name() != "procfs" {
+		t.Fatalf("procfs: got %v, %v", src, err)
+	}
+	if src, err := NewConntrackSource("netlink"); err != nil || src.Name() != "netlink" {
+		t.Fatalf("netlink: got %v, %v", src, err)
+	}
+	if src, err := NewConntrackSource("auto"); err != nil || src == nil {
+		t.Fatalf("auto: got %v, %v", src, err)
+	}
+	if _, err := NewConntrackSource("bogus"); err == nil {
+		t.Fatalf("expected error for unknown backend")
+	}
+}
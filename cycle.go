@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// CycleStatus reports how long measurement cycles take against their
+// deadline and how many were skipped because the previous one still ran
+type CycleStatus struct {
+	Running        bool      `json:"running"`
+	LastStart      time.Time `json:"last_start"`
+	LastDurationMs float64   `json:"last_duration_ms"`
+	DeadlineMs     int64     `json:"deadline_ms"`
+	// LastOutcome is completed, timed_out or cancelled
+	LastOutcome string `json:"last_outcome,omitempty"`
+	Completed   uint64 `json:"completed"`
+	TimedOut    uint64 `json:"timed_out"`
+	Cancelled   uint64 `json:"cancelled"`
+	Skipped     uint64 `json:"skipped"`
+}
+
+// cycleApplyMargin is left between the default cycle deadline and the next
+// tick for applying the result to the qdiscs
+const cycleApplyMargin = 500 * time.Millisecond
+
+// cycleDeadline returns how long one measurement cycle may run. cycle_timeout
+// wins when set. The default ends cycleApplyMargin before the next tick, but
+// never before a single host can time out on every probe port and take all
+// of its probe_samples: below that a slow but normal cycle would be cut
+// short, and it is better to skip a tick.
+func cycleDeadline(cfg *Config) time.Duration {
+	if cfg.CycleTimeout > 0 {
+		return time.Duration(cfg.CycleTimeout) * time.Second
+	}
+	d := time.Duration(cfg.RTTUpdateInterval)*time.Second - cycleApplyMargin
+	return max(d, hostProbeBudget(cfg), time.Second)
+}
+
+// hostProbeBudget is the longest one host may take to probe: a connect
+// timeout per port tried (plus the ICMP echo in auto mode, or the echo
+// alone in icmp mode) and the spacing between its samples
+func hostProbeBudget(cfg *Config) time.Duration {
+	attempts := len(cfg.ProbePorts)
+	switch cfg.ProbeMethod {
+	case "icmp":
+		attempts = 1
+	case "auto":
+		attempts++
+	}
+	attempts = max(attempts, 1)
+	spacing := time.Duration(clampProbeSamples(cfg.ProbeSamples)-1) * time.Duration(cfg.ProbeSampleIntervalMs) * time.Millisecond
+	return time.Duration(attempts*cfg.TCPConnectTimeout)*time.Second + spacing
+}
+
+// record accounts a finished cycle; err is the cycle context's error
+func (c *CycleStatus) record(took time.Duration, err error) {
+	c.Running = false
+	c.LastDurationMs = float64(took.Microseconds()) / 1000
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		c.LastOutcome = "timed_out"
+		c.TimedOut++
+	case err != nil:
+		c.LastOutcome = "cancelled"
+		c.Cancelled++
+	default:
+		c.LastOutcome = "completed"
+		c.Completed++
+	}
+}
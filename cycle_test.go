@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCycleDeadlineAndRecord(t *testing.T) {
+	cfg := DefaultConfig()
+	// 3s connect timeout on each of the 6 default ports outlasts a 5s interval
+	if d := cycleDeadline(cfg); d != 18*time.Second {
+		t.Fatalf("expected the default deadline to fit a host trying every port, got %s", d)
+	}
+	cfg.ProbeSamples = 3
+	if d := cycleDeadline(cfg); d != 18*time.Second+400*time.Millisecond {
+		t.Fatalf("expected the sample spacing on top, got %s", d)
+	}
+	cfg.ProbeMethod, cfg.RTTUpdateInterval = "icmp", 10
+	if d := cycleDeadline(cfg); d != 10*time.Second-cycleApplyMargin {
+		t.Fatalf("expected the deadline just under a long interval, got %s", d)
+	}
+	cfg.CycleTimeout = 2
+	if d := cycleDeadline(cfg); d != 2*time.Second {
+		t.Fatalf("expected cycle_timeout to win, got %s", d)
+	}
+
+	var c CycleStatus
+	c.record(1500*time.Microsecond, nil)
+	c.record(time.Second, context.DeadlineExceeded)
+	c.record(time.Second, context.Canceled)
+	if c.Completed != 1 || c.TimedOut != 1 || c.Cancelled != 1 || c.LastOutcome != "cancelled" || c.LastDurationMs != 1000 {
+		t.Fatalf("unexpected cycle status: %+v", c)
+	}
+}
+
+func TestStartCycleSkipsOverlapAndCancels(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MinHosts = 1
+	cfg.DLInterface, cfg.ULInterface = "eth0", "eth0"
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	fake := &fakeQdiscController{}
+	s := &CakeAutoRTTService{
+		config:  cfg,
+		qdisc:   fake,
+		targets: targets,
+		conntrackSource: &fakeConntrack{entries: []ConntrackEntry{{Proto: 6, State: "ESTABLISHED",
+			Src: net.ParseIP("192.168.1.10"), Dst: net.ParseIP("1.1.1.1")}}},
+		currentProbes: make(map[string]ProbeStatus),
+	}
+	started := make(chan struct{})
+	var once sync.Once
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		once.Do(func() { close(started) })
+		<-ctx.Done()
+		return 0, "", ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if !s.startCycle(ctx, &wg) {
+		t.Fatalf("first cycle should start")
+	}
+	<-started
+	if s.startCycle(ctx, &wg) {
+		t.Fatalf("overlapping cycle should be skipped")
+	}
+
+	// Shutdown cancels the blocked probe and nothing is applied
+	cancel()
+	wg.Wait()
+	st := s.GetSystemStatus().Cycles
+	if st.Skipped != 1 || st.Cancelled != 1 || st.Running || st.DeadlineMs != 18000 {
+		t.Fatalf("unexpected cycle status: %+v", st)
+	}
+	if len(fake.changes) != 0 {
+		t.Fatalf("cancelled cycle must not touch the qdisc: %v", fake.changes)
+	}
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		return 20 * time.Millisecond, "tcp", nil
+	}
+	if !s.startCycle(context.Background(), &wg) {
+		t.Fatalf("a new cycle should start once the previous one finished")
+	}
+	wg.Wait()
+	if st := s.GetSystemStatus().Cycles; st.Completed != 1 || fake.changes["eth0"] != 22000 {
+		t.Fatalf("expected a completed cycle, got %+v %v", st, fake.changes)
+	}
+}
+
+func TestTCPProbeCancelledKeepsCachedPort(t *testing.T) {
+	s := &CakeAutoRTTService{config: DefaultConfig()}
+	s.portCache.set("192.0.2.1", 443, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.measureSingleHostTCP(ctx, "192.0.2.1", 3, ProbeBinding{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if s.portCache.get("192.0.2.1") != 443 {
+		t.Fatalf("a cancelled probe must not drop the cached port")
+	}
+}
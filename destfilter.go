@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// prefixTrie is a binary trie over address bits answering longest-prefix
+// matches in O(address length), independent of the number of prefixes
+type prefixTrie struct {
+	root4 *trieNode
+	root6 *trieNode
+	size  int
+}
+
+type trieNode struct {
+	child  [2]*trieNode
+	prefix *net.IPNet // set on nodes that end an inserted prefix
+}
+
+// trieKey returns the address bytes walked for ip and the root to walk from
+func (t *prefixTrie) trieKey(ip net.IP) ([]byte, **trieNode) {
+	if v4 := ip.To4(); v4 != nil {
+		return v4, &t.root4
+	}
+	if v6 := ip.To16(); v6 != nil {
+		return v6, &t.root6
+	}
+	return nil, nil
+}
+
+// insert adds a prefix; inserting the same prefix twice is a no-op
+func (t *prefixTrie) insert(n *net.IPNet) {
+	key, root := t.trieKey(n.IP)
+	if key == nil {
+		return
+	}
+	ones, _ := n.Mask.Size()
+	if *root == nil {
+		*root = &trieNode{}
+	}
+	node := *root
+	for i := 0; i < ones; i++ {
+		bit := key[i/8] >> (7 - uint(i%8)) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &trieNode{}
+		}
+		node = node.child[bit]
+	}
+	if node.prefix == nil {
+		t.size++
+	}
+	node.prefix = n
+}
+
+// lookup returns the longest inserted prefix containing ip, or nil
+func (t *prefixTrie) lookup(ip net.IP) *net.IPNet {
+	key, root := t.trieKey(ip)
+	if key == nil {
+		return nil
+	}
+	node := *root
+	var best *net.IPNet
+	for i := 0; node != nil; i++ {
+		if node.prefix != nil {
+			best = node.prefix
+		}
+		if i == len(key)*8 {
+			break
+		}
+		node = node.child[key[i/8]>>(7-uint(i%8))&1]
+	}
+	return best
+}
+
+// destRules are the user-defined destination filters: include/exclude
+// prefixes and destination ports. Exclusions always win over inclusions.
+type destRules struct {
+	include      prefixTrie
+	exclude      prefixTrie
+	includePorts map[uint16]bool
+	excludePorts map[uint16]bool
+}
+
+// newDestRules builds the destination rules from include_cidrs,
+// exclude_cidrs, include_ports and exclude_ports
+func newDestRules(cfg *Config) (*destRules, error) {
+	r := &destRules{}
+	for _, c := range cfg.IncludeCIDRs {
+		n, err := parseCIDROrIP(c)
+		if err != nil {
+			return nil, fmt.Errorf("include_cidrs: %w", err)
+		}
+		r.include.insert(n)
+	}
+	for _, c := range cfg.ExcludeCIDRs {
+		n, err := parseCIDROrIP(c)
+		if err != nil {
+			return nil, fmt.Errorf("exclude_cidrs: %w", err)
+		}
+		r.exclude.insert(n)
+	}
+	var err error
+	if r.includePorts, err = portSet("include_ports", cfg.IncludePorts); err != nil {
+		return nil, err
+	}
+	if r.excludePorts, err = portSet("exclude_ports", cfg.ExcludePorts); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func portSet(key string, ports []int) (map[uint16]bool, error) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	set := make(map[uint16]bool, len(ports))
+	for _, p := range ports {
+		if p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid %s entry %d (want 1-65535)", key, p)
+		}
+		set[uint16(p)] = true
+	}
+	return set, nil
+}
+
+// check applies the rules to one flow and names the deciding rule. A zero
+// port (unknown, e.g. passive sockets) skips the port rules.
+func (r *destRules) check(ip net.IP, port uint16) (string, bool) {
+	if n := r.exclude.lookup(ip); n != nil {
+		return "exclude_cidrs " + n.String(), false
+	}
+	rule := "default"
+	if r.include.size > 0 {
+		n := r.include.lookup(ip)
+		if n == nil {
+			return "not in include_cidrs", false
+		}
+		rule = "include_cidrs " + n.String()
+	}
+	if port != 0 {
+		if r.excludePorts[port] {
+			return fmt.Sprintf("exclude_ports %d", port), false
+		}
+		if r.includePorts != nil {
+			if !r.includePorts[port] {
+				return fmt.Sprintf("port %d not in include_ports", port), false
+			}
+			if r.include.size == 0 {
+				rule = fmt.Sprintf("include_ports %d", port)
+			}
+		}
+	}
+	return rule, true
+}
+
+// HostDecision explains why a destination seen in conntrack is or is not
+// probed, as served by /api/hosts
+type HostDecision struct {
+	Host     string `json:"host"`
+	Family   string `json:"family"`
+	Accepted bool   `json:"accepted"`
+	// Rule is the filter that decided, e.g. "exclude_cidrs 10.8.0.1/32",
+	// "special-purpose: private", "no interface filter matched" or "default"
+	Rule  string   `json:"rule"`
+	Flows uint64   `json:"flows"`
+	Bytes uint64   `json:"bytes"`
+	Ports []uint16 `json:"ports,omitempty"`
+	// Interfaces lists the managed interfaces whose host filter matches
+	Interfaces []string `json:"interfaces,omitempty"`
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPrefixTrieLongestMatch(t *testing.T) {
+	var trie prefixTrie
+	for _, c := range []string{"0.0.0.0/0", "1.0.0.0/8", "1.1.1.0/24", "1.1.1.1", "2000::/3", "2606:4700::/32"} {
+		n, err := parseCIDROrIP(c)
+		if err != nil {
+			t.Fatalf("parse %s: %v", c, err)
+		}
+		trie.insert(n)
+	}
+	trie.insert(&net.IPNet{IP: net.ParseIP("1.0.0.0").To4(), Mask: net.CIDRMask(8, 32)}) // duplicate
+	if trie.size != 6 {
+		t.Fatalf("expected 6 prefixes, got %d", trie.size)
+	}
+
+	cases := map[string]string{
+		"1.1.1.1":         "1.1.1.1/32",
+		"1.1.1.2":         "1.1.1.0/24",
+		"1.2.3.4":         "1.0.0.0/8",
+		"9.9.9.9":         "0.0.0.0/0",
+		"2606:4700::1111": "2606:4700::/32",
+		"2a00:1450::1":    "2000::/3",
+	}
+	for ip, want := range cases {
+		if got := trie.lookup(net.ParseIP(ip)); got == nil || got.String() != want {
+			t.Fatalf("%s: got %v, want %s", ip, got, want)
+		}
+	}
+	// IPv4 and IPv6 are separate tries: 0.0.0.0/0 does not cover IPv6
+	if got := trie.lookup(net.ParseIP("fd00::1")); got != nil {
+		t.Fatalf("fd00::1 should not match, got %s", got)
+	}
+}
+
+func TestDestRulesCheck(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.IncludeCIDRs = []string{"0.0.0.0/0"}
+	cfg.ExcludeCIDRs = []string{"198.18.7.0/24", "9.9.9.9"}
+	cfg.ExcludePorts = []int{51820}
+	rules, err := newDestRules(cfg)
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	cases := []struct {
+		ip   string
+		port uint16
+		rule string
+		ok   bool
+	}{
+		{"1.1.1.1", 443, "include_cidrs 0.0.0.0/0", true},
+		{"9.9.9.9", 443, "exclude_cidrs 9.9.9.9/32", false},
+		{"8.8.8.8", 51820, "exclude_ports 51820", false},
+		{"8.8.8.8", 0, "include_cidrs 0.0.0.0/0", true}, // unknown port skips port rules
+		{"2606:4700::1111", 443, "not in include_cidrs", false},
+	}
+	for _, c := range cases {
+		rule, ok := rules.check(net.ParseIP(c.ip), c.port)
+		if rule != c.rule || ok != c.ok {
+			t.Fatalf("%s:%d: got %q %t, want %q %t", c.ip, c.port, rule, ok, c.rule, c.ok)
+		}
+	}
+
+	cfg = DefaultConfig()
+	cfg.IncludePorts = []int{443}
+	rules, _ = newDestRules(cfg)
+	if rule, ok := rules.check(net.ParseIP("1.1.1.1"), 80); ok || rule != "port 80 not in include_ports" {
+		t.Fatalf("unexpected include_ports result: %q %t", rule, ok)
+	}
+	for _, bad := range []*Config{{ExcludeCIDRs: []string{"nope"}}, {IncludePorts: []int{0}}} {
+		if _, err := newDestRules(bad); err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestSelectHostsAndDecisionsApplyDestRules(t *testing.T) {
+	flow := func(dst string, dport uint16, replyDst string) ConntrackEntry {
+		return ConntrackEntry{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"),
+			Dst: net.ParseIP(dst), DPort: dport, ReplyDst: net.ParseIP(replyDst)}
+	}
+	entries := []ConntrackEntry{
+		flow("1.1.1.1", 443, "81.2.69.142"),
+		flow("1.1.1.1", 443, "81.2.69.142"),
+		flow("8.8.8.8", 443, "81.2.69.142"),
+		flow("9.9.9.9", 443, "81.2.69.142"),   // VPN endpoint, excluded
+		flow("4.4.4.4", 51820, "81.2.69.142"), // WireGuard port, excluded
+		flow("4.4.4.4", 443, "100.64.0.9"),    // same host over a second WAN, nobody manages
+		flow("192.168.1.20", 22, "192.168.1.20"),
+	}
+	cfg := DefaultConfig()
+	cfg.ExcludeCIDRs = []string{"9.9.9.9"}
+	cfg.ExcludePorts = []int{51820}
+	cfg.Interfaces = []InterfaceConfig{{Name: "eth0", SourceCIDRs: []string{"81.2.69.142"}}}
+	rules, err := newDestRules(cfg)
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	s := &CakeAutoRTTService{config: cfg, destRules: rules, targets: targets,
+		conntrackSource: &fakeConntrack{entries: entries}}
+
+	hosts := s.selectHosts(entries, targets[0].filter)
+	if !reflect.DeepEqual(hosts, []string{"1.1.1.1", "8.8.8.8"}) {
+		t.Fatalf("unexpected selected hosts: %v", hosts)
+	}
+
+	decisions, err := s.HostDecisions()
+	if err != nil {
+		t.Fatalf("decisions: %v", err)
+	}
+	got := make(map[string]HostDecision, len(decisions))
+	for _, d := range decisions {
+		got[d.Host] = d
+	}
+	want := map[string]struct {
+		accepted bool
+		rule     string
+	}{
+		"1.1.1.1":      {true, "default"},
+		"8.8.8.8":      {true, "default"},
+		"9.9.9.9":      {false, "exclude_cidrs 9.9.9.9/32"},
+		"4.4.4.4":      {false, "no interface filter matched"},
+		"192.168.1.20": {false, "special-purpose: private"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected decisions: %+v", decisions)
+	}
+	for host, w := range want {
+		if d := got[host]; d.Accepted != w.accepted || d.Rule != w.rule {
+			t.Fatalf("%s: got %t %q, want %t %q", host, d.Accepted, d.Rule, w.accepted, w.rule)
+		}
+	}
+	if decisions[0].Host != "1.1.1.1" || decisions[0].Flows != 2 || !reflect.DeepEqual(decisions[0].Interfaces, []string{"eth0"}) {
+		t.Fatalf("expected busiest accepted host first: %+v", decisions[0])
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// hostHealthTTL is how long a host no longer seen in conntrack is remembered
+	hostHealthTTL = time.Hour
+	// maxHostHealthEntries bounds the table; the least recently seen go first
+	maxHostHealthEntries = 4096
+	// hostHealthAlpha is the EWMA weight of the newest probe
+	hostHealthAlpha = 0.3
+	// A host is stable after stableMinProbes probes with at least
+	// stableSuccessRate success and jitter within stableJitterRatio of its
+	// mean RTT (or stableJitterFloorMs)
+	stableMinProbes     = 3
+	stableSuccessRate   = 0.8
+	stableJitterRatio   = 0.25
+	stableJitterFloorMs = 2.0
+)
+
+// HostHealth is the probe history of one destination, as served by
+// /api/host-health
+type HostHealth struct {
+	Host      string `json:"host"`
+	Probes    uint64 `json:"probes"`
+	Successes uint64 `json:"successes"`
+	// SuccessRate is an EWMA over recent probes, so a recovered host regains it
+	SuccessRate         float64   `json:"success_rate"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastRTTMs           float64   `json:"last_rtt_ms,omitempty"`
+	MeanRTTMs           float64   `json:"mean_rtt_ms,omitempty"`
+	JitterMs            float64   `json:"jitter_ms,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastSuccess         time.Time `json:"last_success,omitzero"`
+	LastFailure         time.Time `json:"last_failure,omitzero"`
+	LastSeen            time.Time `json:"last_seen"`
+	BackoffUntil        time.Time `json:"backoff_until,omitzero"`
+	Stable              bool      `json:"stable"`
+}
+
+// stable reports whether the host answers reliably with a steady RTT
+func (h *HostHealth) stable() bool {
+	if h.Probes < stableMinProbes || h.SuccessRate < stableSuccessRate || h.ConsecutiveFailures > 0 {
+		return false
+	}
+	return h.JitterMs <= math.Max(stableJitterFloorMs, stableJitterRatio*h.MeanRTTMs)
+}
+
+// hostBackoff returns the skip period after n consecutive failures: base
+// doubled per further failure, capped at max. A zero base disables backoff.
+func hostBackoff(n int, base, max time.Duration) time.Duration {
+	if base <= 0 || n <= 0 {
+		return 0
+	}
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// hostHealthTable keeps the probe history of destinations across cycles so
+// dead hosts are skipped and stable ones preferred
+type hostHealthTable struct {
+	mu    sync.Mutex
+	hosts map[string]*HostHealth
+}
+
+// entry returns the record of host, creating it. Callers hold mu.
+func (t *hostHealthTable) entry(host string, now time.Time) *HostHealth {
+	if t.hosts == nil {
+		t.hosts = make(map[string]*HostHealth)
+	}
+	h, ok := t.hosts[host]
+	if !ok {
+		h = &HostHealth{Host: host, LastSeen: now}
+		t.hosts[host] = h
+	}
+	return h
+}
+
+// record adds one probe result for host and sets its backoff
+func (t *hostHealthTable) record(host string, rttMs float64, err error, now time.Time, base, max time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.entry(host, now)
+	h.LastSeen = now
+	ok := 0.0
+	if err == nil {
+		ok = 1
+	}
+	if h.Probes == 0 {
+		h.SuccessRate = ok
+	} else {
+		h.SuccessRate += hostHealthAlpha * (ok - h.SuccessRate)
+	}
+	h.Probes++
+
+	if err != nil {
+		h.ConsecutiveFailures++
+		h.LastError = err.Error()
+		h.LastFailure = now
+		if d := hostBackoff(h.ConsecutiveFailures, base, max); d > 0 {
+			h.BackoffUntil = now.Add(d)
+		}
+		h.Stable = false
+		return
+	}
+	h.Successes++
+	h.ConsecutiveFailures = 0
+	h.LastError = ""
+	h.LastSuccess = now
+	h.BackoffUntil = time.Time{}
+	h.LastRTTMs = rttMs
+	if h.Successes == 1 {
+		h.MeanRTTMs = rttMs
+	} else {
+		h.JitterMs += hostHealthAlpha * (math.Abs(rttMs-h.MeanRTTMs) - h.JitterMs)
+		h.MeanRTTMs += hostHealthAlpha * (rttMs - h.MeanRTTMs)
+	}
+	h.Stable = h.stable()
+}
+
+// schedule orders candidate hosts (busiest first) for probing: hosts in
+// backoff are dropped, stable hosts move ahead of new ones and new ones
+// ahead of flaky ones, keeping the traffic order within each group. It
+// returns the hosts to probe and how many were skipped.
+func (t *hostHealthTable) schedule(hosts []string, now time.Time) ([]string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tier := make(map[string]int, len(hosts))
+	out := make([]string, 0, len(hosts))
+	skipped := 0
+	for _, host := range hosts {
+		h, known := t.hosts[host]
+		if !known {
+			tier[host] = 1
+			out = append(out, host)
+			continue
+		}
+		h.LastSeen = now
+		if now.Before(h.BackoffUntil) {
+			skipped++
+			continue
+		}
+		// hosts with too few probes to judge rank with the new ones
+		switch {
+		case h.Stable:
+			tier[host] = 0
+		case h.Probes < stableMinProbes && h.SuccessRate >= stableSuccessRate:
+			tier[host] = 1
+		default:
+			tier[host] = 2
+		}
+		out = append(out, host)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return tier[out[i]] < tier[out[j]] })
+	return out, skipped
+}
+
+// backoff returns when host may be probed again, or the zero time
+func (t *hostHealthTable) backoff(host string, now time.Time) (time.Time, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.hosts[host]; ok && now.Before(h.BackoffUntil) {
+		return h.BackoffUntil, h.ConsecutiveFailures
+	}
+	return time.Time{}, 0
+}
+
+// prune evicts hosts not seen within hostHealthTTL and, beyond
+// maxHostHealthEntries, the least recently seen
+func (t *hostHealthTable) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for host, h := range t.hosts {
+		if now.Sub(h.LastSeen) > hostHealthTTL {
+			delete(t.hosts, host)
+		}
+	}
+	if len(t.hosts) <= maxHostHealthEntries {
+		return
+	}
+	byAge := make([]*HostHealth, 0, len(t.hosts))
+	for _, h := range t.hosts {
+		byAge = append(byAge, h)
+	}
+	sort.Slice(byAge, func(i, j int) bool { return byAge[i].LastSeen.Before(byAge[j].LastSeen) })
+	for _, h := range byAge[:len(byAge)-maxHostHealthEntries] {
+		delete(t.hosts, h.Host)
+	}
+}
+
+// snapshot returns copies of all records, most probed first
+func (t *hostHealthTable) snapshot() []HostHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]HostHealth, 0, len(t.hosts))
+	for _, h := range t.hosts {
+		out = append(out, *h)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Probes != out[j].Probes {
+			return out[i].Probes > out[j].Probes
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
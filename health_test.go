@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHostBackoffDoublesUpToMax(t *testing.T) {
+	base, max := 30*time.Second, 5*time.Minute
+	want := []time.Duration{0, 30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for n, w := range want {
+		if got := hostBackoff(n, base, max); got != w {
+			t.Fatalf("%d failures: got %v, want %v", n, got, w)
+		}
+	}
+	if hostBackoff(3, 0, max) != 0 {
+		t.Fatalf("a zero base must disable backoff")
+	}
+}
+
+func TestHostHealthScheduleSkipsBackoffAndPrefersStable(t *testing.T) {
+	var table hostHealthTable
+	now := time.Unix(1000, 0)
+	base, max := 30*time.Second, 5*time.Minute
+	for i := 0; i < 4; i++ {
+		table.record("stable", 20+float64(i%2), nil, now, base, max)
+		table.record("jittery", float64(20+60*(i%2)), nil, now, base, max)
+	}
+	table.record("dead", 0, errors.New("timeout"), now, base, max)
+
+	order, skipped := table.schedule([]string{"dead", "jittery", "new", "stable"}, now.Add(10*time.Second))
+	if skipped != 1 || !reflect.DeepEqual(order, []string{"stable", "new", "jittery"}) {
+		t.Fatalf("unexpected schedule %v (skipped %d)", order, skipped)
+	}
+	// The backoff expires, and a success clears the failure streak
+	order, _ = table.schedule([]string{"dead"}, now.Add(31*time.Second))
+	if !reflect.DeepEqual(order, []string{"dead"}) {
+		t.Fatalf("expected dead host to be retried after backoff, got %v", order)
+	}
+	table.record("dead", 0, errors.New("timeout"), now.Add(31*time.Second), base, max)
+	if until, failures := table.backoff("dead", now.Add(32*time.Second)); failures != 2 || !until.Equal(now.Add(91*time.Second)) {
+		t.Fatalf("expected doubled backoff, got %v after %d failures", until, failures)
+	}
+	table.record("dead", 15, nil, now.Add(100*time.Second), base, max)
+	if until, _ := table.backoff("dead", now.Add(100*time.Second)); !until.IsZero() {
+		t.Fatalf("success should clear the backoff")
+	}
+
+	snap := table.snapshot()
+	if len(snap) != 3 || snap[0].Host != "jittery" || snap[0].Probes != 4 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	table.prune(now.Add(100*time.Second + hostHealthTTL + time.Second))
+	if len(table.snapshot()) != 0 {
+		t.Fatalf("expected hosts unseen for the TTL to be evicted")
+	}
+}
+
+func TestHostHealthPruneCapsEntries(t *testing.T) {
+	var table hostHealthTable
+	now := time.Unix(1000, 0)
+	for i := 0; i < maxHostHealthEntries+10; i++ {
+		table.record(fmt.Sprintf("h%d", i), 10, nil, now.Add(time.Duration(i)*time.Millisecond), 0, 0)
+	}
+	table.prune(now.Add(time.Minute))
+	if len(table.hosts) != maxHostHealthEntries || table.hosts["h0"] != nil || table.hosts["h10"] == nil {
+		t.Fatalf("expected the least recently seen hosts evicted, %d left", len(table.hosts))
+	}
+}
+
+func TestFailedHostsBackOffAcrossCycles(t *testing.T) {
+	flow := func(dst string) ConntrackEntry {
+		return ConntrackEntry{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"), Dst: net.ParseIP(dst), DPort: 443}
+	}
+	entries := []ConntrackEntry{flow("1.1.1.1"), flow("1.1.1.1"), flow("1.1.1.1"), flow("8.8.8.8"), flow("8.8.8.8"), flow("9.9.9.9")}
+	cfg := DefaultConfig()
+	cfg.MaxHosts = 2
+	s := &CakeAutoRTTService{config: cfg, currentProbes: make(map[string]ProbeStatus)}
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		if host == "1.1.1.1" {
+			return 0, "", errors.New("connection timed out")
+		}
+		return 10 * time.Millisecond, "tcp", nil
+	}
+
+	hosts := s.selectHosts(entries, hostFilter{})
+	if !reflect.DeepEqual(hosts, []string{"1.1.1.1", "8.8.8.8"}) {
+		t.Fatalf("unexpected first selection: %v", hosts)
+	}
+	s.probeHosts(context.Background(), *cfg, hosts, ProbeBinding{})
+
+	// The dead host is skipped next cycle and the next busiest takes its slot
+	hosts = s.selectHosts(entries, hostFilter{})
+	if !reflect.DeepEqual(hosts, []string{"8.8.8.8", "9.9.9.9"}) {
+		t.Fatalf("expected the failed host to back off, got %v", hosts)
+	}
+	h := s.HostHealth()
+	if len(h) != 2 || h[0].Host != "1.1.1.1" || h[0].ConsecutiveFailures != 1 || h[0].BackoffUntil.IsZero() {
+		t.Fatalf("unexpected host health: %+v", h)
+	}
+
+	// Probes cut short by the cycle are not held against the host
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.probeHosts(ctx, *cfg, []string{"9.9.9.9"}, ProbeBinding{})
+	for _, e := range s.HostHealth() {
+		if e.Host == "9.9.9.9" {
+			t.Fatalf("cancelled probe should not be recorded: %+v", e)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// historyTinSlots is the number of CAKE tins kept per record (diffserv8 has the most)
+const historyTinSlots = 8
+
+// historyRecordSize is the encoded size of one record: unix ms, measured and
+// applied RTT, tin count (padded to 4 bytes) and the tin delays
+const historyRecordSize = 8 + 4 + 4 + 4 + 4*historyTinSlots
+
+// historyMaxPoints bounds the points returned per interface when no step is
+// requested; longer ranges are averaged into buckets
+const historyMaxPoints = 1000
+
+// historyMagic and historyVersion identify the on-disk format
+const (
+	historyMagic   = "CAKH"
+	historyVersion = 1
+)
+
+// historyTiers are the resolutions kept per interface: every cycle, then
+// per-minute and per-hour means, with their share of the byte budget
+var historyTiers = []struct {
+	name  string
+	res   time.Duration
+	share float64
+}{
+	{"raw", 0, 0.5},
+	{"1m", time.Minute, 0.3},
+	{"1h", time.Hour, 0.2},
+}
+
+// HistoryPoint is one point of the RTT history of an interface. Zero RTTs
+// mean no measurement (the default RTT was used) or nothing applied yet.
+type HistoryPoint struct {
+	Time       time.Time `json:"time"`
+	MeasuredMs float64   `json:"measured_ms,omitempty"`
+	AppliedMs  float64   `json:"applied_ms,omitempty"`
+	TinDelayMs []float64 `json:"tin_delay_ms,omitempty"`
+}
+
+// HistorySeries is the history of one interface over a queried range
+type HistorySeries struct {
+	Interface string         `json:"interface"`
+	Tier      string         `json:"tier"`
+	StepSec   float64        `json:"step_sec"`
+	Points    []HistoryPoint `json:"points"`
+}
+
+// historyRecord is the fixed-size form of a point kept in the rings
+type historyRecord struct {
+	unixMs     int64
+	measuredMs float32
+	appliedMs  float32
+	tins       uint8
+	tinDelayMs [historyTinSlots]float32
+}
+
+func (r historyRecord) point() HistoryPoint {
+	p := HistoryPoint{Time: time.UnixMilli(r.unixMs), MeasuredMs: float64(r.measuredMs), AppliedMs: float64(r.appliedMs)}
+	for i := 0; i < int(r.tins); i++ {
+		p.TinDelayMs = append(p.TinDelayMs, float64(r.tinDelayMs[i]))
+	}
+	return p
+}
+
+// historyAcc averages the records of one time bucket; missing measured or
+// applied RTTs do not pull the mean towards zero
+type historyAcc struct {
+	bucket   int64
+	n        int
+	measured [2]float64 // sum, count
+	applied  [2]float64
+	tins     uint8
+	tinSum   [historyTinSlots]float64
+	tinCount [historyTinSlots]int
+}
+
+func (a *historyAcc) add(r historyRecord, bucket int64) {
+	if a.n == 0 {
+		*a = historyAcc{bucket: bucket}
+	}
+	a.n++
+	if r.measuredMs > 0 {
+		a.measured[0] += float64(r.measuredMs)
+		a.measured[1]++
+	}
+	if r.appliedMs > 0 {
+		a.applied[0] += float64(r.appliedMs)
+		a.applied[1]++
+	}
+	if r.tins > a.tins {
+		a.tins = r.tins
+	}
+	for i := 0; i < int(r.tins); i++ {
+		a.tinSum[i] += float64(r.tinDelayMs[i])
+		a.tinCount[i]++
+	}
+}
+
+func (a *historyAcc) record() historyRecord {
+	r := historyRecord{unixMs: a.bucket, tins: a.tins}
+	if a.measured[1] > 0 {
+		r.measuredMs = float32(a.measured[0] / a.measured[1])
+	}
+	if a.applied[1] > 0 {
+		r.appliedMs = float32(a.applied[0] / a.applied[1])
+	}
+	for i := 0; i < int(a.tins); i++ {
+		if a.tinCount[i] > 0 {
+			r.tinDelayMs[i] = float32(a.tinSum[i] / float64(a.tinCount[i]))
+		}
+	}
+	return r
+}
+
+// historyRing is one tier: a fixed-capacity ring of records, plus the bucket
+// being averaged for downsampled tiers
+type historyRing struct {
+	res  time.Duration
+	buf  []historyRecord
+	head int // next slot to write
+	n    int
+	acc  historyAcc
+}
+
+func newHistoryRing(res time.Duration, capacity int) *historyRing {
+	return &historyRing{res: res, buf: make([]historyRecord, max(capacity, 1))}
+}
+
+func (r *historyRing) push(rec historyRecord) {
+	r.buf[r.head] = rec
+	r.head = (r.head + 1) % len(r.buf)
+	if r.n < len(r.buf) {
+		r.n++
+	}
+}
+
+// add stores rec, or folds it into the current bucket of a downsampled tier
+// and stores the bucket mean once a record of a later bucket arrives
+func (r *historyRing) add(rec historyRecord) {
+	if r.res == 0 {
+		r.push(rec)
+		return
+	}
+	resMs := r.res.Milliseconds()
+	bucket := rec.unixMs - rec.unixMs%resMs
+	if r.acc.n > 0 && bucket != r.acc.bucket {
+		r.push(r.acc.record())
+		r.acc = historyAcc{}
+	}
+	r.acc.add(rec, bucket)
+}
+
+// records returns the stored records oldest first, followed by the bucket
+// still being averaged
+func (r *historyRing) records() []historyRecord {
+	out := make([]historyRecord, 0, r.n+1)
+	start := (r.head - r.n + len(r.buf)) % len(r.buf)
+	for i := 0; i < r.n; i++ {
+		out = append(out, r.buf[(start+i)%len(r.buf)])
+	}
+	if r.acc.n > 0 {
+		out = append(out, r.acc.record())
+	}
+	return out
+}
+
+// resize changes the capacity, keeping the newest records
+func (r *historyRing) resize(capacity int) {
+	capacity = max(capacity, 1)
+	if capacity == len(r.buf) {
+		return
+	}
+	recs := r.records()
+	if r.acc.n > 0 {
+		recs = recs[:len(recs)-1]
+	}
+	if len(recs) > capacity {
+		recs = recs[len(recs)-capacity:]
+	}
+	r.buf, r.head, r.n = make([]historyRecord, capacity), 0, 0
+	for _, rec := range recs {
+		r.push(rec)
+	}
+}
+
+// historyStore keeps the RTT and tin delay history of each interface in
+// memory within a byte budget, and persists it to a file
+type historyStore struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int
+	series   map[string][]*historyRing
+	dirty    bool
+}
+
+func newHistoryStore(path string, maxBytes int) *historyStore {
+	return &historyStore{path: path, maxBytes: maxBytes, series: make(map[string][]*historyRing)}
+}
+
+// tierCapacity is the number of records of tier i per interface when the
+// budget is split among n interfaces
+func (h *historyStore) tierCapacity(i, n int) int {
+	return int(float64(h.maxBytes)/float64(max(n, 1))*historyTiers[i].share) / historyRecordSize
+}
+
+// seriesLocked returns the rings of iface, creating them and shrinking the
+// other interfaces' rings so the total stays within the budget
+func (h *historyStore) seriesLocked(iface string) []*historyRing {
+	if rings, ok := h.series[iface]; ok {
+		return rings
+	}
+	n := len(h.series) + 1
+	for _, rings := range h.series {
+		for i, r := range rings {
+			r.resize(h.tierCapacity(i, n))
+		}
+	}
+	rings := make([]*historyRing, len(historyTiers))
+	for i, t := range historyTiers {
+		rings[i] = newHistoryRing(t.res, h.tierCapacity(i, n))
+	}
+	h.series[iface] = rings
+	return rings
+}
+
+// add records one cycle of iface in every tier
+func (h *historyStore) add(iface string, rec historyRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.seriesLocked(iface) {
+		r.add(rec)
+	}
+	h.dirty = true
+}
+
+// interfaces returns the interfaces with history, sorted
+func (h *historyStore) interfaces() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make([]string, 0, len(h.series))
+	for name := range h.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// query returns the history of iface between from and to. It reads the
+// finest tier that has not yet dropped anything after from and averages it
+// into buckets of step when step is coarser than the tier; with no step, long
+// ranges are bucketed to at most historyMaxPoints points.
+func (h *historyStore) query(iface string, from, to time.Time, step time.Duration) HistorySeries {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := HistorySeries{Interface: iface, Tier: historyTiers[0].name, Points: []HistoryPoint{}}
+	rings, ok := h.series[iface]
+	if !ok {
+		return out
+	}
+
+	fromMs, toMs := from.UnixMilli(), to.UnixMilli()
+	tier, oldest := -1, int64(math.MaxInt64)
+	var recs []historyRecord
+	for i, r := range rings {
+		rs := r.records()
+		if len(rs) == 0 {
+			continue
+		}
+		// A ring that never filled up still holds everything it was given
+		if rs[0].unixMs <= fromMs || r.n < len(r.buf) {
+			tier, recs = i, rs
+			break
+		}
+		// Nothing reaches back far enough: use the tier with the oldest data
+		if rs[0].unixMs < oldest {
+			tier, recs, oldest = i, rs, rs[0].unixMs
+		}
+	}
+	if tier < 0 {
+		return out
+	}
+	out.Tier = historyTiers[tier].name
+
+	lo := sort.Search(len(recs), func(i int) bool { return recs[i].unixMs >= fromMs })
+	hi := sort.Search(len(recs), func(i int) bool { return recs[i].unixMs > toMs })
+	recs = recs[lo:hi]
+
+	res := rings[tier].res
+	if step < res {
+		step = res
+	}
+	if step == 0 && len(recs) > historyMaxPoints {
+		step = time.Duration(toMs-fromMs) * time.Millisecond / historyMaxPoints
+		step = step.Truncate(time.Second) + time.Second
+	}
+	out.StepSec = step.Seconds()
+
+	if step <= res {
+		for _, r := range recs {
+			out.Points = append(out.Points, r.point())
+		}
+		return out
+	}
+	stepMs := step.Milliseconds()
+	var acc historyAcc
+	for _, r := range recs {
+		bucket := r.unixMs - r.unixMs%stepMs
+		if acc.n > 0 && bucket != acc.bucket {
+			out.Points = append(out.Points, acc.record().point())
+			acc = historyAcc{}
+		}
+		acc.add(r, bucket)
+	}
+	if acc.n > 0 {
+		out.Points = append(out.Points, acc.record().point())
+	}
+	return out
+}
+
+// save writes the store to its file through a temporary file and a rename,
+// so a crash never leaves a torn history behind. Unchanged stores are not
+// rewritten, sparing flash.
+func (h *historyStore) save() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.path == "" || !h.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	tmp := h.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	err = h.encodeLocked(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, h.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("history: %w", err)
+	}
+	h.dirty = false
+	return nil
+}
+
+// encodeLocked writes the header and, per interface, each tier's records
+// oldest first; buckets still being averaged are not persisted
+func (h *historyStore) encodeLocked(w io.Writer) error {
+	names := make([]string, 0, len(h.series))
+	for name := range h.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := append([]byte(historyMagic), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(buf[4:], historyVersion)
+	binary.LittleEndian.PutUint16(buf[6:], uint16(len(names)))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	for _, name := range names {
+		buf = binary.LittleEndian.AppendUint16(buf[:0], uint16(len(name)))
+		buf = append(buf, name...)
+		rings := h.series[name]
+		buf = append(buf, uint8(len(rings)))
+		for _, r := range rings {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(r.res/time.Second))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(r.n))
+			start := (r.head - r.n + len(r.buf)) % len(r.buf)
+			for i := 0; i < r.n; i++ {
+				buf = appendHistoryRecord(buf, r.buf[(start+i)%len(r.buf)])
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendHistoryRecord(buf []byte, r historyRecord) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.unixMs))
+	buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(r.measuredMs))
+	buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(r.appliedMs))
+	buf = append(buf, r.tins, 0, 0, 0)
+	for _, d := range r.tinDelayMs {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(d))
+	}
+	return buf
+}
+
+func decodeHistoryRecord(b []byte) historyRecord {
+	r := historyRecord{
+		unixMs:     int64(binary.LittleEndian.Uint64(b)),
+		measuredMs: math.Float32frombits(binary.LittleEndian.Uint32(b[8:])),
+		appliedMs:  math.Float32frombits(binary.LittleEndian.Uint32(b[12:])),
+		tins:       min(b[16], historyTinSlots),
+	}
+	for i := range r.tinDelayMs {
+		r.tinDelayMs[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[20+4*i:]))
+	}
+	return r
+}
+
+// load reads the store's file, keeping only the interfaces in keep; tiers
+// are matched by resolution and trimmed to the current budget. A missing
+// file is not an error.
+func (h *historyStore) load(keep []string) error {
+	if h.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	errTruncated := fmt.Errorf("history: %s is truncated", h.path)
+	if len(data) < 8 || string(data[:4]) != historyMagic {
+		return fmt.Errorf("history: %s is not a history file", h.path)
+	}
+	if v := binary.LittleEndian.Uint16(data[4:]); v != historyVersion {
+		return fmt.Errorf("history: unsupported version %d in %s", v, h.path)
+	}
+	wanted := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		wanted[name] = true
+	}
+
+	loaded := make(map[string][][]historyRecord)
+	nSeries := int(binary.LittleEndian.Uint16(data[6:]))
+	p := data[8:]
+	for s := 0; s < nSeries; s++ {
+		if len(p) < 2 {
+			return errTruncated
+		}
+		nameLen := int(binary.LittleEndian.Uint16(p))
+		if len(p) < 3+nameLen {
+			return errTruncated
+		}
+		name := string(p[2 : 2+nameLen])
+		nTiers := int(p[2+nameLen])
+		p = p[3+nameLen:]
+		tiers := make([][]historyRecord, len(historyTiers))
+		for t := 0; t < nTiers; t++ {
+			if len(p) < 8 {
+				return errTruncated
+			}
+			res := time.Duration(binary.LittleEndian.Uint32(p)) * time.Second
+			n := int(binary.LittleEndian.Uint32(p[4:]))
+			p = p[8:]
+			if len(p) < n*historyRecordSize {
+				return errTruncated
+			}
+			for i, tier := range historyTiers {
+				if tier.res != res {
+					continue
+				}
+				for j := 0; j < n; j++ {
+					tiers[i] = append(tiers[i], decodeHistoryRecord(p[j*historyRecordSize:]))
+				}
+			}
+			p = p[n*historyRecordSize:]
+		}
+		if wanted[name] {
+			loaded[name] = tiers
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make([]string, 0, len(loaded))
+	for name := range loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rings := h.seriesLocked(name)
+		for i, recs := range loaded[name] {
+			for _, rec := range recs {
+				rings[i].push(rec)
+			}
+		}
+	}
+	return nil
+}
+
+// parseHistoryTime parses a /api/history bound: unix seconds, RFC 3339, or
+// a duration relative to now such as -6h; empty means def
+func parseHistoryTime(v string, now, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if v == "now" {
+		return now, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want unix seconds, RFC 3339 or a duration such as -6h", v)
+}
+
+// parseHistoryStep parses a /api/history step: seconds or a Go duration
+func parseHistoryStep(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid step %q: want seconds or a duration such as 5m", v)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryDownsamplingAndQuery(t *testing.T) {
+	h := newHistoryStore("", 1<<20)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Two hours of 5s cycles; the measured RTT is the minute of the hour
+	for i := 0; i < 2*720; i++ {
+		ts := base.Add(time.Duration(i) * 5 * time.Second)
+		rec := historyRecord{unixMs: ts.UnixMilli(), measuredMs: float32(ts.Minute() + 10), appliedMs: 40, tins: 2}
+		rec.tinDelayMs[0], rec.tinDelayMs[1] = 1, float32(i%2)
+		h.add("eth0", rec)
+	}
+	end := base.Add(2 * time.Hour)
+
+	raw := h.query("eth0", base.Add(time.Hour), end, 0)
+	if raw.Tier != "raw" || len(raw.Points) != 720 || raw.StepSec != 0 {
+		t.Fatalf("expected an hour of raw points, got tier=%s n=%d step=%v", raw.Tier, len(raw.Points), raw.StepSec)
+	}
+
+	// Bucketing raw points per minute averages the two tin delays
+	mins := h.query("eth0", base.Add(time.Hour), end, time.Minute)
+	if len(mins.Points) != 60 || mins.StepSec != 60 {
+		t.Fatalf("expected 60 minute buckets, got %d", len(mins.Points))
+	}
+	p := h.query("eth0", base.Add(time.Hour+5*time.Minute), base.Add(time.Hour+6*time.Minute-time.Second), time.Minute).Points
+	if len(p) != 1 || p[0].MeasuredMs != 15 || p[0].AppliedMs != 40 || len(p[0].TinDelayMs) != 2 || p[0].TinDelayMs[1] != 0.5 {
+		t.Fatalf("unexpected minute bucket: %+v", p)
+	}
+
+	// A range older than the raw ring falls back to the coarser tiers
+	small := newHistoryStore("", 20*historyRecordSize*len(historyTiers))
+	for i := 0; i < 2*720; i++ {
+		small.add("eth0", historyRecord{unixMs: base.Add(time.Duration(i) * 5 * time.Second).UnixMilli(), measuredMs: 20})
+	}
+	old := small.query("eth0", base, end, 0)
+	if old.Tier != "1h" || len(old.Points) != 2 || old.Points[0].MeasuredMs != 20 || !old.Points[0].Time.Equal(base) {
+		t.Fatalf("expected the hourly tier, got %s %+v", old.Tier, old.Points)
+	}
+	if q := small.query("eth0", base.Add(110*time.Minute), end, 0); q.Tier != "1m" {
+		t.Fatalf("expected the minute tier, got %s", q.Tier)
+	}
+	if q := small.query("wlan0", base, end, 0); len(q.Points) != 0 {
+		t.Fatalf("expected no points for an unknown interface")
+	}
+}
+
+func TestHistoryBudgetAndPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "history.bin")
+	h := newHistoryStore(path, 100*historyRecordSize)
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 80; i++ {
+		h.add("eth0", historyRecord{unixMs: base.Add(time.Duration(i) * time.Second).UnixMilli(), measuredMs: float32(i), appliedMs: 30})
+	}
+	if n := h.series["eth0"][0].n; n != 50 {
+		t.Fatalf("expected the raw ring capped at 50 records, got %d", n)
+	}
+	h.add("ifb4eth0", historyRecord{unixMs: base.UnixMilli(), measuredMs: 5, tins: 1})
+	raw := h.series["eth0"][0]
+	if len(raw.buf) != 25 || raw.n != 25 || raw.records()[0].measuredMs != 55 {
+		t.Fatalf("expected eth0 shrunk to its newest 25 records, got cap=%d n=%d", len(raw.buf), raw.n)
+	}
+
+	if err := h.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind")
+	}
+
+	// Only managed interfaces are restored, with every record intact
+	loaded := newHistoryStore(path, 100*historyRecordSize)
+	if err := loaded.load([]string{"eth0"}); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if names := loaded.interfaces(); len(names) != 1 || names[0] != "eth0" {
+		t.Fatalf("unexpected interfaces %v", names)
+	}
+	got := loaded.query("eth0", base, time.Now(), 0).Points
+	if len(got) != 25 || got[0].MeasuredMs != 55 || got[24].MeasuredMs != 79 || got[24].AppliedMs != 30 {
+		t.Fatalf("unexpected restored points: %d %+v", len(got), got[0])
+	}
+
+	// A missing file is an empty history, a damaged one an error
+	if err := newHistoryStore(path+".missing", 1<<20).load(nil); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-10], 0o644)
+	if err := newHistoryStore(path, 1<<20).load([]string{"eth0"}); err == nil {
+		t.Fatalf("expected an error for a truncated file")
+	}
+}
+
+func TestParseHistoryParams(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"":                     now.Add(-time.Hour),
+		"now":                  now,
+		"-6h":                  now.Add(-6 * time.Hour),
+		"1700000000":           time.Unix(1700000000, 0),
+		"2025-05-31T12:00:00Z": now.Add(-24 * time.Hour),
+	}
+	for in, want := range cases {
+		got, err := parseHistoryTime(in, now, now.Add(-time.Hour))
+		if err != nil || !got.Equal(want) {
+			t.Fatalf("%q: got %v, %v", in, got, err)
+		}
+	}
+	if _, err := parseHistoryTime("yesterday", now, now); err == nil {
+		t.Fatalf("expected an error for an invalid time")
+	}
+	if d, err := parseHistoryStep("300"); err != nil || d != 5*time.Minute {
+		t.Fatalf("unexpected step %v, %v", d, err)
+	}
+	if d, err := parseHistoryStep("1h"); err != nil || d != time.Hour {
+		t.Fatalf("unexpected step %v, %v", d, err)
+	}
+	if _, err := parseHistoryStep("-5m"); err == nil {
+		t.Fatalf("expected an error for a negative step")
+	}
+}
+
+func TestRecordHistoryFromCycle(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DLInterface, cfg.ULInterface = "ifb4eth0", "eth0"
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	fake := &fakeQdiscController{qdiscs: []CakeQdisc{{Interface: "eth0", Parent: "root",
+		Tins: []CakeTinStats{{AvgDelayUs: 1500}, {AvgDelayUs: 250}, {AvgDelayUs: 80}}}}}
+	s := &CakeAutoRTTService{config: cfg, qdisc: fake, targets: targets, history: newHistoryStore("", 1<<20)}
+	targets[1].gate.appliedUs = 44000
+
+	s.recordHistory(targets, map[string]float64{"eth0": 40})
+	series, err := s.History("", time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 0)
+	if err != nil || len(series) != 2 {
+		t.Fatalf("expected two series, got %v, %v", series, err)
+	}
+	byName := map[string]HistoryPoint{}
+	for _, sr := range series {
+		byName[sr.Interface] = sr.Points[0]
+	}
+	if p := byName["eth0"]; p.MeasuredMs != 40 || p.AppliedMs != 44 || len(p.TinDelayMs) != 3 || p.TinDelayMs[0] != 1.5 {
+		t.Fatalf("unexpected eth0 point: %+v", p)
+	}
+	if p := byName["ifb4eth0"]; p.MeasuredMs != 0 || p.AppliedMs != 0 || p.TinDelayMs != nil {
+		t.Fatalf("unexpected ifb4eth0 point: %+v", p)
+	}
+
+	s.history = nil
+	if _, err := s.History("", time.Now(), time.Now(), 0); err == nil {
+		t.Fatalf("expected an error with history disabled")
+	}
+}
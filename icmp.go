@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// errICMPUnavailable is returned when neither a datagram nor a raw ICMP socket
+// can be opened (e.g. no CAP_NET_RAW and ping_group_range excludes us)
+var errICMPUnavailable = errors.New("icmp socket unavailable")
+
+// icmpSeq is shared by all ICMP probes so concurrent echoes can be told apart
+var icmpSeq uint32
+
+// icmpPayload is carried in every echo request to make replies recognisable
+var icmpPayload = []byte("cake-autortt")
+
+// openICMPSocket opens an ICMP (v4) or ICMPv6 socket. It prefers unprivileged
+// datagram ping sockets (net.ipv4.ping_group_range) and falls back to a raw
+// socket, which needs CAP_NET_RAW. raw reports which kind was opened: the
+// kernel rewrites the echo ID on datagram sockets, so only raw sockets can
+// filter replies by ID. The socket is bound to the uplink described by bind
+// before anything is sent.
+func openICMPSocket(dst net.IP, bind ProbeBinding) (conn net.PacketConn, raw bool, err error) {
+	v6 := dst.To4() == nil
+	family, proto := unix.AF_INET, protocolICMP
+	if v6 {
+		family, proto = unix.AF_INET6, protocolIPv6ICMP
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		dgramErr := err
+		fd, err = unix.Socket(family, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w (datagram: %v, raw: %v)", errICMPUnavailable, dgramErr, err)
+		}
+		raw = true
+	}
+	if err := bind.apply(fd); err != nil {
+		unix.Close(fd)
+		return nil, false, err
+	}
+	if err := bind.bindSource(fd, dst); err != nil {
+		unix.Close(fd)
+		return nil, false, err
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close() // FilePacketConn dups the descriptor
+	conn, err = net.FilePacketConn(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("icmp socket: %w", err)
+	}
+	return conn, raw, nil
+}
+
+// icmpEchoProbe sends one ICMP/ICMPv6 echo request to ip through the uplink
+// described by bind and returns the time until the matching echo reply
+// arrives. The wait ends early when ctx is cancelled or its deadline passes.
+func icmpEchoProbe(ctx context.Context, ip net.IP, timeout time.Duration, bind ProbeBinding) (time.Duration, error) {
+	v6 := ip.To4() == nil
+	conn, raw, err := openICMPSocket(ip, bind)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var reqType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := protocolICMP
+	if v6 {
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		proto = protocolIPv6ICMP
+	}
+
+	id := os.Getpid() & 0xffff
+	seq := int(atomic.AddUint32(&icmpSeq, 1) & 0xffff)
+	msg := icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: icmpPayload},
+	}
+	// The kernel fills in the ICMPv6 checksum, so no pseudo-header is needed
+	wire, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, fmt.Errorf("icmp marshal: %w", err)
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if raw {
+		dst = &net.IPAddr{IP: ip}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+	// Unblock the read as soon as ctx is cancelled
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
+
+	start := time.Now()
+	if _, err := conn.WriteTo(wire, dst); err != nil {
+		return 0, fmt.Errorf("icmp send: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, fmt.Errorf("icmp probe: %w", ctx.Err())
+			}
+			return 0, fmt.Errorf("no icmp echo reply: %w", err)
+		}
+		rtt := time.Since(start)
+
+		// net.IPConn strips the IPv4 header of raw sockets, so buf holds ICMP only
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || (raw && echo.ID != id) {
+			continue
+		}
+		if !peerIPEqual(peer, ip) {
+			continue
+		}
+		return rtt, nil
+	}
+}
+
+// peerIPEqual reports whether the address a reply came from is ip
+func peerIPEqual(peer net.Addr, ip net.IP) bool {
+	switch p := peer.(type) {
+	case *net.UDPAddr:
+		return p.IP.Equal(ip)
+	case *net.IPAddr:
+		return p.IP.Equal(ip)
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestICMPEchoProbeLoopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		rtt, err := icmpEchoProbe(context.Background(), net.ParseIP(addr), time.Second, ProbeBinding{})
+		if errors.Is(err, errICMPUnavailable) {
+			t.Skipf("icmp sockets not available in this environment: %v", err)
+		}
+		if err != nil {
+			// ::1 may be missing in minimal containers
+			if addr == "::1" {
+				t.Logf("skipping %s: %v", addr, err)
+				continue
+			}
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+		if rtt <= 0 || rtt > time.Second {
+			t.Fatalf("%s: implausible rtt %s", addr, rtt)
+		}
+	}
+}
+
+func TestValidateProbeMethod(t *testing.T) {
+	for _, m := range []string{"", "tcp", "icmp", "auto"} {
+		if err := validateProbeMethod(m); err != nil {
+			t.Fatalf("%q: unexpected error: %v", m, err)
+		}
+	}
+	if err := validateProbeMethod("udp"); err == nil {
+		t.Fatalf("expected error for unknown probe method")
+	}
+}
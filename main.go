@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -20,7 +22,9 @@ const (
 
 // Config represents the application configuration
 type Config struct {
-	RTTUpdateInterval   int    `mapstructure:"rtt_update_interval" yaml:"rtt_update_interval"`
+	RTTUpdateInterval int `mapstructure:"rtt_update_interval" yaml:"rtt_update_interval"`
+	// Deadline for one measurement cycle in seconds; 0 uses rtt_update_interval
+	CycleTimeout        int    `mapstructure:"cycle_timeout" yaml:"cycle_timeout"`
 	MinHosts            int    `mapstructure:"min_hosts" yaml:"min_hosts"`
 	MaxHosts            int    `mapstructure:"max_hosts" yaml:"max_hosts"`
 	RTTMarginPercent    int    `mapstructure:"rtt_margin_percent" yaml:"rtt_margin_percent"`
@@ -32,32 +36,172 @@ type Config struct {
 	MaxConcurrentProbes int    `mapstructure:"max_concurrent_probes" yaml:"max_concurrent_probes"`
 	WebEnabled          bool   `mapstructure:"web_enabled" yaml:"web_enabled"`
 	WebPort             int    `mapstructure:"web_port" yaml:"web_port"`
+	// Address the web server listens on (empty = all interfaces)
+	WebBindAddress string `mapstructure:"web_bind_address" yaml:"web_bind_address"`
+	// Cross-origin pages allowed to use the API and WebSocket (scheme://host[:port])
+	WebAllowedOrigins []string `mapstructure:"web_allowed_origins" yaml:"web_allowed_origins"`
+	// Serve HTTPS with web_tls_cert/web_tls_key, generating a self-signed pair
+	// when both are missing; web_tls_redirect_port (0 = off) redirects HTTP
+	WebTLSEnabled      bool   `mapstructure:"web_tls" yaml:"web_tls"`
+	WebTLSCert         string `mapstructure:"web_tls_cert" yaml:"web_tls_cert"`
+	WebTLSKey          string `mapstructure:"web_tls_key" yaml:"web_tls_key"`
+	WebTLSRedirectPort int    `mapstructure:"web_tls_redirect_port" yaml:"web_tls_redirect_port"`
+	// Bearer tokens, basic auth/login page users and per-endpoint roles
+	WebAuth WebAuthConfig `mapstructure:"web_auth" yaml:"web_auth"`
+	// JSON lines file recording every change made through /api/config (empty = off)
+	ConfigAuditFile string `mapstructure:"config_audit_file" yaml:"config_audit_file"`
 	// Completed probes retention (seconds)
 	CompletedRetentionSec int `mapstructure:"completed_retention_sec" yaml:"completed_retention_sec"`
 	// Max completed probes entries to keep
 	CompletedMaxEntries int `mapstructure:"completed_max_entries" yaml:"completed_max_entries"`
 	// Enable/disable adaptive controller
 	AdaptiveControllerEnabled bool `mapstructure:"adaptive_controller_enabled" yaml:"adaptive_controller_enabled"`
+	// RTT aggregation strategy: max, mean, median, pNN, trimmed_mean, weighted_mean
+	RTTAggregation string `mapstructure:"rtt_aggregation" yaml:"rtt_aggregation"`
+	// Percentage of samples discarded from each end by trimmed_mean
+	RTTTrimPercent int `mapstructure:"rtt_trim_percent" yaml:"rtt_trim_percent"`
+	// Outlier rejection before aggregation: mad, iqr or none; the threshold is
+	// the modified z-score (mad) or fence multiplier (iqr), 0 for the default
+	RTTOutlierRejection string  `mapstructure:"rtt_outlier_rejection" yaml:"rtt_outlier_rejection"`
+	RTTOutlierThreshold float64 `mapstructure:"rtt_outlier_threshold" yaml:"rtt_outlier_threshold"`
+	// Drop TCP connect times quantized by SYN retransmits (~1s, ~3s, ~7s)
+	RTTRejectSYNRetransmits bool `mapstructure:"rtt_reject_syn_retransmits" yaml:"rtt_reject_syn_retransmits"`
+	// Smoothing applied to the aggregate RTT before it reaches CAKE: none, ewma, kalman
+	RTTSmoothing string `mapstructure:"rtt_smoothing" yaml:"rtt_smoothing"`
+	// EWMA weight of the newest measurement (0 < alpha <= 1)
+	RTTSmoothingAlpha float64 `mapstructure:"rtt_smoothing_alpha" yaml:"rtt_smoothing_alpha"`
+	// Kalman filter process and measurement noise (ms^2)
+	RTTKalmanProcessNoise     float64 `mapstructure:"rtt_kalman_process_noise" yaml:"rtt_kalman_process_noise"`
+	RTTKalmanMeasurementNoise float64 `mapstructure:"rtt_kalman_measurement_noise" yaml:"rtt_kalman_measurement_noise"`
+	// Dead-band: skip qdisc updates smaller than this absolute (us) or relative (%) change
+	RTTDeadbandUs      int     `mapstructure:"rtt_deadband_us" yaml:"rtt_deadband_us"`
+	RTTDeadbandPercent float64 `mapstructure:"rtt_deadband_percent" yaml:"rtt_deadband_percent"`
+	// Minimum time an applied RTT is held before it may be changed again (seconds)
+	RTTMinHoldSec int `mapstructure:"rtt_min_hold_sec" yaml:"rtt_min_hold_sec"`
+	// Treat the router's own interface prefixes (e.g. delegated IPv6 LAN prefixes) as local
+	AutoLocalPrefixes bool `mapstructure:"auto_local_prefixes" yaml:"auto_local_prefixes"`
+	// Extra prefixes (CIDR or address) that are never probed as internet hosts
+	LocalPrefixes []string `mapstructure:"local_prefixes" yaml:"local_prefixes"`
+	// Destination filters: only probe hosts in include_cidrs (when set), never
+	// those in exclude_cidrs; the port lists match the conntrack destination port
+	IncludeCIDRs []string `mapstructure:"include_cidrs" yaml:"include_cidrs"`
+	ExcludeCIDRs []string `mapstructure:"exclude_cidrs" yaml:"exclude_cidrs"`
+	IncludePorts []int    `mapstructure:"include_ports" yaml:"include_ports"`
+	ExcludePorts []int    `mapstructure:"exclude_ports" yaml:"exclude_ports"`
+	// TCP ports tried after the cached and conntrack-learned ports of each host
+	ProbePorts []int `mapstructure:"probe_ports" yaml:"probe_ports"`
+	// Hosts whose probes fail are skipped for host_backoff_base_sec, doubling
+	// per further failure up to host_backoff_max_sec (0 base disables backoff)
+	HostBackoffBaseSec int `mapstructure:"host_backoff_base_sec" yaml:"host_backoff_base_sec"`
+	HostBackoffMaxSec  int `mapstructure:"host_backoff_max_sec" yaml:"host_backoff_max_sec"`
+	// Probes per host per cycle, spaced probe_sample_interval_ms apart; a host
+	// contributes its minimum RTT, plus its jitter with probe_sample_add_jitter
+	ProbeSamples          int  `mapstructure:"probe_samples" yaml:"probe_samples"`
+	ProbeSampleIntervalMs int  `mapstructure:"probe_sample_interval_ms" yaml:"probe_sample_interval_ms"`
+	ProbeSampleAddJitter  bool `mapstructure:"probe_sample_add_jitter" yaml:"probe_sample_add_jitter"`
+	// Probe method: tcp (connect), icmp (echo) or auto (icmp, then tcp)
+	ProbeMethod string `mapstructure:"probe_method" yaml:"probe_method"`
+	// RTT source: active (probe conntrack hosts), passive (kernel TCP_INFO via sock_diag) or hybrid (both)
+	RTTSource string `mapstructure:"rtt_source" yaml:"rtt_source"`
+	// Use tcpi_min_rtt instead of the smoothed tcpi_rtt for passive samples
+	PassiveUseMinRTT bool `mapstructure:"passive_use_min_rtt" yaml:"passive_use_min_rtt"`
+	// Conntrack backend: auto (netlink, falling back to procfs), netlink or procfs
+	ConntrackBackend string `mapstructure:"conntrack_backend" yaml:"conntrack_backend"`
+	// Qdisc backend: auto (rtnetlink, falling back to tc), netlink or exec
+	QdiscBackend string `mapstructure:"qdisc_backend" yaml:"qdisc_backend"`
+	// Probe target ranking: bytes, packets or flows (bytes/packets need nf_conntrack_acct)
+	HostRankBy string `mapstructure:"host_rank_by" yaml:"host_rank_by"`
+	// Weight the mean/percentile/trimmed aggregates by each host's share of traffic
+	RTTTrafficWeighted bool `mapstructure:"rtt_traffic_weighted" yaml:"rtt_traffic_weighted"`
+	// Bandwidth autorate: adjust the CAKE bandwidth from delay over the RTT baseline and achieved throughput
+	AutorateEnabled    bool `mapstructure:"autorate_enabled" yaml:"autorate_enabled"`
+	AutorateDLMinKbps  int  `mapstructure:"autorate_dl_min_kbps" yaml:"autorate_dl_min_kbps"`
+	AutorateDLBaseKbps int  `mapstructure:"autorate_dl_base_kbps" yaml:"autorate_dl_base_kbps"`
+	AutorateDLMaxKbps  int  `mapstructure:"autorate_dl_max_kbps" yaml:"autorate_dl_max_kbps"`
+	AutorateULMinKbps  int  `mapstructure:"autorate_ul_min_kbps" yaml:"autorate_ul_min_kbps"`
+	AutorateULBaseKbps int  `mapstructure:"autorate_ul_base_kbps" yaml:"autorate_ul_base_kbps"`
+	AutorateULMaxKbps  int  `mapstructure:"autorate_ul_max_kbps" yaml:"autorate_ul_max_kbps"`
+	// Delay above the learned baseline (ms) treated as bufferbloat
+	AutorateDelayThresholdMs float64 `mapstructure:"autorate_delay_threshold_ms" yaml:"autorate_delay_threshold_ms"`
+	// Per-cycle rate increase while saturated, and cut (below achieved throughput) on bufferbloat
+	AutorateIncreasePercent float64 `mapstructure:"autorate_increase_percent" yaml:"autorate_increase_percent"`
+	AutorateDecreasePercent float64 `mapstructure:"autorate_decrease_percent" yaml:"autorate_decrease_percent"`
+	// Achieved/shaped throughput ratio above which the link counts as saturated
+	AutorateLoadThresholdPercent int `mapstructure:"autorate_load_threshold_percent" yaml:"autorate_load_threshold_percent"`
+	// Seconds after a cut before the rate may change again
+	AutorateRefractorySec int `mapstructure:"autorate_refractory_sec" yaml:"autorate_refractory_sec"`
+	// Managed interfaces with their own host filter, margin, bounds and RTT source;
+	// when empty, dl_interface and ul_interface are managed with the global settings
+	Interfaces []InterfaceConfig `mapstructure:"interfaces" yaml:"interfaces"`
+	// LAN clients whose flows drive the RTT, selected by address, MAC or
+	// conntrack mark, each with a priority weight; with clients_only set,
+	// flows of unlisted clients are ignored
+	Clients     []ClientConfig `mapstructure:"clients" yaml:"clients"`
+	ClientsOnly bool           `mapstructure:"clients_only" yaml:"clients_only"`
+	// Measured/applied RTT and tin delay history, kept per cycle and as 1m/1h
+	// means within history_max_bytes and written to history_file every
+	// history_flush_sec (empty file = memory only); read at startup
+	HistoryEnabled  bool   `mapstructure:"history_enabled" yaml:"history_enabled"`
+	HistoryFile     string `mapstructure:"history_file" yaml:"history_file"`
+	HistoryMaxBytes int    `mapstructure:"history_max_bytes" yaml:"history_max_bytes"`
+	HistoryFlushSec int    `mapstructure:"history_flush_sec" yaml:"history_flush_sec"`
 }
 
 // DefaultConfig returns the default configuration
 func DefaultConfig() *Config {
 	return &Config{
-		RTTUpdateInterval:         5,
-		MinHosts:                  3,
-		MaxHosts:                  100,
-		RTTMarginPercent:          10,
-		DefaultRTTMs:              100,
-		DLInterface:               "",
-		ULInterface:               "",
-		Debug:                     false,
-		TCPConnectTimeout:         3,
-		MaxConcurrentProbes:       50,
-		WebEnabled:                true,
-		WebPort:                   11111,
-		CompletedRetentionSec:     5,
-		CompletedMaxEntries:       50,
-		AdaptiveControllerEnabled: true,
+		RTTUpdateInterval:            5,
+		MinHosts:                     3,
+		MaxHosts:                     100,
+		RTTMarginPercent:             10,
+		DefaultRTTMs:                 100,
+		DLInterface:                  "",
+		ULInterface:                  "",
+		Debug:                        false,
+		TCPConnectTimeout:            3,
+		MaxConcurrentProbes:          50,
+		WebEnabled:                   true,
+		WebPort:                      11111,
+		WebTLSCert:                   "/etc/cake-autortt/web.crt",
+		WebTLSKey:                    "/etc/cake-autortt/web.key",
+		ConfigAuditFile:              "/var/log/cake-autortt-audit.log",
+		CompletedRetentionSec:        5,
+		CompletedMaxEntries:          50,
+		AdaptiveControllerEnabled:    true,
+		RTTAggregation:               "max",
+		RTTTrimPercent:               10,
+		RTTOutlierRejection:          "none",
+		RTTRejectSYNRetransmits:      false,
+		RTTSmoothing:                 "ewma",
+		RTTSmoothingAlpha:            0.3,
+		RTTKalmanProcessNoise:        4,
+		RTTKalmanMeasurementNoise:    100,
+		RTTDeadbandUs:                2000,
+		RTTDeadbandPercent:           5,
+		RTTMinHoldSec:                15,
+		ProbePorts:                   []int{80, 443, 22, 21, 25, 53},
+		ProbeSamples:                 1,
+		ProbeSampleIntervalMs:        200,
+		HostBackoffBaseSec:           30,
+		HostBackoffMaxSec:            900,
+		AutoLocalPrefixes:            true,
+		ProbeMethod:                  "tcp",
+		RTTSource:                    "active",
+		PassiveUseMinRTT:             false,
+		ConntrackBackend:             "auto",
+		QdiscBackend:                 "auto",
+		HostRankBy:                   "bytes",
+		RTTTrafficWeighted:           false,
+		AutorateEnabled:              false,
+		AutorateDelayThresholdMs:     15,
+		AutorateIncreasePercent:      5,
+		AutorateDecreasePercent:      10,
+		AutorateLoadThresholdPercent: 75,
+		AutorateRefractorySec:        10,
+		HistoryEnabled:               false,
+		HistoryFile:                  "/tmp/cake-autortt/history.bin",
+		HistoryMaxBytes:              1 << 20,
+		HistoryFlushSec:              300,
 	}
 }
 
@@ -85,6 +229,7 @@ func init() {
 
 	// Command line flags
 	rootCmd.Flags().IntVar(&cfg.RTTUpdateInterval, "rtt-update-interval", cfg.RTTUpdateInterval, "Interval between qdisc RTT updates (seconds)")
+	rootCmd.Flags().IntVar(&cfg.CycleTimeout, "cycle-timeout", cfg.CycleTimeout, "Deadline for one measurement cycle (seconds, 0 = just under rtt-update-interval, but at least tcp-connect-timeout per probe port plus the probe-samples spacing)")
 	rootCmd.Flags().IntVar(&cfg.MinHosts, "min-hosts", cfg.MinHosts, "Minimum hosts needed for RTT calculation")
 	rootCmd.Flags().IntVar(&cfg.MaxHosts, "max-hosts", cfg.MaxHosts, "Maximum hosts to probe simultaneously")
 	rootCmd.Flags().IntVar(&cfg.RTTMarginPercent, "rtt-margin-percent", cfg.RTTMarginPercent, "Percentage margin added to measured RTT")
@@ -94,16 +239,66 @@ func init() {
 	rootCmd.Flags().BoolVar(&cfg.Debug, "debug", cfg.Debug, "Enable debug logging")
 	rootCmd.Flags().IntVar(&cfg.TCPConnectTimeout, "tcp-timeout", cfg.TCPConnectTimeout, "TCP connection timeout for RTT measurement (seconds)")
 	rootCmd.Flags().IntVar(&cfg.MaxConcurrentProbes, "max-concurrent", cfg.MaxConcurrentProbes, "Maximum concurrent TCP probes")
+	rootCmd.Flags().BoolVar(&cfg.AutoLocalPrefixes, "auto-local-prefixes", cfg.AutoLocalPrefixes, "Exclude the router's own interface prefixes from probing")
+	rootCmd.Flags().StringSliceVar(&cfg.LocalPrefixes, "local-prefixes", cfg.LocalPrefixes, "Extra prefixes never probed as internet hosts")
+	rootCmd.Flags().StringSliceVar(&cfg.IncludeCIDRs, "include-cidrs", cfg.IncludeCIDRs, "Only probe destinations in these prefixes")
+	rootCmd.Flags().StringSliceVar(&cfg.ExcludeCIDRs, "exclude-cidrs", cfg.ExcludeCIDRs, "Never probe destinations in these prefixes")
+	rootCmd.Flags().IntSliceVar(&cfg.IncludePorts, "include-ports", cfg.IncludePorts, "Only consider flows to these destination ports")
+	rootCmd.Flags().IntSliceVar(&cfg.ExcludePorts, "exclude-ports", cfg.ExcludePorts, "Ignore flows to these destination ports")
+	rootCmd.Flags().IntSliceVar(&cfg.ProbePorts, "probe-ports", cfg.ProbePorts, "Fallback TCP probe ports after learned ports")
+	rootCmd.Flags().IntVar(&cfg.ProbeSamples, "probe-samples", cfg.ProbeSamples, "Probes per host per cycle; the host's minimum RTT is used")
+	rootCmd.Flags().IntVar(&cfg.ProbeSampleIntervalMs, "probe-sample-interval-ms", cfg.ProbeSampleIntervalMs, "Spacing between probes of the same host (milliseconds)")
+	rootCmd.Flags().BoolVar(&cfg.ProbeSampleAddJitter, "probe-sample-add-jitter", cfg.ProbeSampleAddJitter, "Add each host's sample jitter to its minimum RTT")
+	rootCmd.Flags().IntVar(&cfg.HostBackoffBaseSec, "host-backoff-base", cfg.HostBackoffBaseSec, "Skip a failing host for this long after its first failure, doubling per failure (seconds, 0 = off)")
+	rootCmd.Flags().IntVar(&cfg.HostBackoffMaxSec, "host-backoff-max", cfg.HostBackoffMaxSec, "Longest a failing host is skipped (seconds)")
+	rootCmd.Flags().StringVar(&cfg.ProbeMethod, "probe-method", cfg.ProbeMethod, "RTT probe method (tcp, icmp, auto)")
+	rootCmd.Flags().StringVar(&cfg.RTTSource, "rtt-source", cfg.RTTSource, "RTT source (active, passive, hybrid)")
+	rootCmd.Flags().BoolVar(&cfg.PassiveUseMinRTT, "passive-use-min-rtt", cfg.PassiveUseMinRTT, "Use tcpi_min_rtt for passive RTT samples")
+	rootCmd.Flags().StringVar(&cfg.ConntrackBackend, "conntrack-backend", cfg.ConntrackBackend, "Conntrack backend (auto, netlink, procfs)")
+	rootCmd.Flags().StringVar(&cfg.QdiscBackend, "qdisc-backend", cfg.QdiscBackend, "Qdisc backend (auto, netlink, exec)")
+	rootCmd.Flags().StringVar(&cfg.HostRankBy, "host-rank-by", cfg.HostRankBy, "Rank probe targets by traffic (bytes, packets, flows)")
+	rootCmd.Flags().BoolVar(&cfg.AutorateEnabled, "autorate", cfg.AutorateEnabled, "Adjust CAKE bandwidth from measured latency (needs autorate_* rates)")
+	rootCmd.Flags().BoolVar(&cfg.RTTTrafficWeighted, "rtt-traffic-weighted", cfg.RTTTrafficWeighted, "Weight the RTT aggregate by each host's traffic share")
+	rootCmd.Flags().StringVar(&cfg.RTTAggregation, "rtt-aggregation", cfg.RTTAggregation, "RTT aggregation strategy (max, mean, median, p90, p95, trimmed_mean, weighted_mean)")
+	rootCmd.Flags().IntVar(&cfg.RTTTrimPercent, "rtt-trim-percent", cfg.RTTTrimPercent, "Percentage trimmed from each end by trimmed_mean aggregation")
+	rootCmd.Flags().StringVar(&cfg.RTTOutlierRejection, "rtt-outlier-rejection", cfg.RTTOutlierRejection, "Outlier rejection before aggregation: mad, iqr or none")
+	rootCmd.Flags().Float64Var(&cfg.RTTOutlierThreshold, "rtt-outlier-threshold", cfg.RTTOutlierThreshold, "Modified z-score (mad) or fence multiplier (iqr), 0 = default")
+	rootCmd.Flags().BoolVar(&cfg.RTTRejectSYNRetransmits, "rtt-reject-syn-retransmits", cfg.RTTRejectSYNRetransmits, "Drop TCP connect times quantized by SYN retransmits (ICMP and passive samples are kept)")
+	rootCmd.Flags().StringVar(&cfg.RTTSmoothing, "rtt-smoothing", cfg.RTTSmoothing, "RTT smoothing filter (none, ewma, kalman)")
+	rootCmd.Flags().Float64Var(&cfg.RTTSmoothingAlpha, "rtt-smoothing-alpha", cfg.RTTSmoothingAlpha, "EWMA smoothing factor (0 < alpha <= 1)")
+	rootCmd.Flags().IntVar(&cfg.RTTDeadbandUs, "rtt-deadband-us", cfg.RTTDeadbandUs, "Skip RTT updates smaller than this change (microseconds)")
+	rootCmd.Flags().Float64Var(&cfg.RTTDeadbandPercent, "rtt-deadband-percent", cfg.RTTDeadbandPercent, "Skip RTT updates smaller than this relative change (percent)")
+	rootCmd.Flags().IntVar(&cfg.RTTMinHoldSec, "rtt-min-hold", cfg.RTTMinHoldSec, "Minimum time between RTT updates (seconds)")
+	rootCmd.Flags().BoolVar(&cfg.HistoryEnabled, "history", cfg.HistoryEnabled, "Keep RTT and tin delay history for /api/history")
+	rootCmd.Flags().StringVar(&cfg.HistoryFile, "history-file", cfg.HistoryFile, "File the history is persisted to (empty = memory only)")
+	rootCmd.Flags().IntVar(&cfg.HistoryMaxBytes, "history-max-bytes", cfg.HistoryMaxBytes, "Size cap of the history, shared by all interfaces")
+	rootCmd.Flags().IntVar(&cfg.HistoryFlushSec, "history-flush", cfg.HistoryFlushSec, "Interval between history writes to the file (seconds)")
 
 	// Add web server flags
 	rootCmd.Flags().BoolVar(&cfg.WebEnabled, "web-enabled", cfg.WebEnabled, "Enable web interface")
 	rootCmd.Flags().IntVar(&cfg.WebPort, "web-port", cfg.WebPort, "Web interface port")
+	rootCmd.Flags().StringVar(&cfg.WebBindAddress, "web-bind-address", cfg.WebBindAddress, "Address the web interface listens on (empty = all)")
+	rootCmd.Flags().BoolVar(&cfg.WebTLSEnabled, "web-tls", cfg.WebTLSEnabled, "Serve the web interface over HTTPS")
+	rootCmd.Flags().StringVar(&cfg.WebTLSCert, "web-tls-cert", cfg.WebTLSCert, "TLS certificate (PEM), generated self-signed when missing")
+	rootCmd.Flags().StringVar(&cfg.WebTLSKey, "web-tls-key", cfg.WebTLSKey, "TLS private key (PEM), generated with the certificate when missing")
+	rootCmd.Flags().IntVar(&cfg.WebTLSRedirectPort, "web-tls-redirect-port", cfg.WebTLSRedirectPort, "Port redirecting plain HTTP to HTTPS (0 = off)")
+	rootCmd.Flags().StringVar(&cfg.ConfigAuditFile, "config-audit-file", cfg.ConfigAuditFile, "File recording configuration changes made through the API (empty = off)")
+	rootCmd.Flags().StringSliceVar(&cfg.WebAllowedOrigins, "web-allowed-origins", cfg.WebAllowedOrigins, "Cross-origin pages allowed to use the API and WebSocket")
 
 	// Bind flags to viper
 	viper.BindPFlags(rootCmd.Flags())
 }
 
-func loadConfig() error {
+// configFilePath is the file loadConfig reads and /api/config writes
+func configFilePath() string {
+	if configFile != "" {
+		return configFile
+	}
+	return DefaultConfigPath
+}
+
+// loadConfig returns a new Config from the flags, environment and config file
+func loadConfig() (*Config, error) {
 	// Use config file from the flag if provided
 	if configFile != "" {
 		viper.SetConfigFile(configFile)
@@ -115,7 +310,7 @@ func loadConfig() error {
 		viper.AddConfigPath(".")
 
 		// Try the explicit YAML config file first
-		viper.SetConfigFile("/etc/cake-autortt.yaml")
+		viper.SetConfigFile(DefaultConfigPath)
 	}
 
 	// Set environment variable prefix
@@ -131,16 +326,36 @@ func loadConfig() error {
 			// Config file not found, use defaults
 			logMessage("WARN", "Config file not found, using defaults")
 		} else {
-			return fmt.Errorf("error reading config file: %w", err)
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+	}
+
+	// Start from the defaults and flag values in cfg, which is never written
+	// after flag parsing. mapstructure decodes into existing slices in place,
+	// so lists the file sets are cleared first rather than overwriting the
+	// backing arrays cfg shares with the copy.
+	c := *cfg
+	next := &c
+	for key, clear := range map[string]func(){
+		"probe_ports":         func() { next.ProbePorts = nil },
+		"local_prefixes":      func() { next.LocalPrefixes = nil },
+		"include_cidrs":       func() { next.IncludeCIDRs = nil },
+		"exclude_cidrs":       func() { next.ExcludeCIDRs = nil },
+		"include_ports":       func() { next.IncludePorts = nil },
+		"exclude_ports":       func() { next.ExcludePorts = nil },
+		"web_allowed_origins": func() { next.WebAllowedOrigins = nil },
+	} {
+		if viper.IsSet(key) {
+			clear()
 		}
 	}
 
 	// Unmarshal config
-	if err := viper.Unmarshal(cfg); err != nil {
-		return fmt.Errorf("error unmarshaling config: %w", err)
+	if err := viper.Unmarshal(next); err != nil {
+		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
-	return nil
+	return next, nil
 }
 
 func logMessage(level, message string) {
@@ -159,15 +374,18 @@ func logMessage(level, message string) {
 
 func runMain(cmd *cobra.Command, args []string) {
 	// Load configuration
-	if err := loadConfig(); err != nil {
+	config, err := loadConfig()
+	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
 	logMessage("INFO", fmt.Sprintf("Starting cake-autortt v%s", Version))
 	logMessage("INFO", fmt.Sprintf("Config: rtt_update_interval=%ds, min_hosts=%d, max_hosts=%d",
-		cfg.RTTUpdateInterval, cfg.MinHosts, cfg.MaxHosts))
-	logMessage("INFO", fmt.Sprintf("Config: rtt_margin=%d%%, default_rtt=%dms, tcp_timeout=%ds",
-		cfg.RTTMarginPercent, cfg.DefaultRTTMs, cfg.TCPConnectTimeout))
+		config.RTTUpdateInterval, config.MinHosts, config.MaxHosts))
+	logMessage("INFO", fmt.Sprintf("Config: rtt_margin=%d%%, default_rtt=%dms, tcp_timeout=%ds, probe_method=%s, rtt_source=%s",
+		config.RTTMarginPercent, config.DefaultRTTMs, config.TCPConnectTimeout, config.ProbeMethod, config.RTTSource))
+	logMessage("INFO", fmt.Sprintf("Config: rtt_aggregation=%s (traffic_weighted=%t), host_rank_by=%s, rtt_smoothing=%s, deadband=%dus/%.1f%%, min_hold=%ds",
+		config.RTTAggregation, config.RTTTrafficWeighted, config.HostRankBy, config.RTTSmoothing, config.RTTDeadbandUs, config.RTTDeadbandPercent, config.RTTMinHoldSec))
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -178,26 +396,39 @@ func runMain(cmd *cobra.Command, args []string) {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Initialize the cake autortt service
-	service, err := NewCakeAutoRTTService(cfg)
+	service, err := NewCakeAutoRTTService(config)
 	if err != nil {
 		log.Fatalf("Failed to initialize service: %v", err)
 	}
 
 	// Initialize web server if enabled
 	var webServer *WebServer
-	if cfg.WebEnabled {
-		webServer = NewWebServer(service, cfg)
+	if config.WebEnabled {
+		webServer, err = NewWebServer(service, config)
+		if err != nil {
+			log.Fatalf("Failed to initialize web server: %v", err)
+		}
 		// Start web server in a separate goroutine
 		go func() {
 			if err := webServer.Start(); err != nil {
 				logMessage("ERROR", fmt.Sprintf("Web server error: %v", err))
 			}
 		}()
-		logMessage("INFO", fmt.Sprintf("Web interface available at http://localhost:%d/cake-autortt", cfg.WebPort))
+		host := config.WebBindAddress
+		if host == "" {
+			host = "localhost"
+		}
+		scheme := "http"
+		if config.WebTLSEnabled {
+			scheme = "https"
+		}
+		logMessage("INFO", fmt.Sprintf("Web interface available at %s://%s/cake-autortt", scheme, net.JoinHostPort(host, strconv.Itoa(config.WebPort))))
 	}
 
 	// Start the service in a goroutine
+	runDone := make(chan struct{})
 	go func() {
+		defer close(runDone)
 		if err := service.Run(ctx); err != nil {
 			logMessage("ERROR", fmt.Sprintf("Service error: %v", err))
 			cancel()
@@ -210,16 +441,24 @@ func runMain(cmd *cobra.Command, args []string) {
 		if sig == syscall.SIGHUP {
 			// Reload configuration
 			logMessage("INFO", "Received SIGHUP, reloading configuration")
-			if err := loadConfig(); err != nil {
+			// A reload builds a new Config and hands it over; running
+			// components never see a half-written one
+			configMu.Lock()
+			if next, err := loadConfig(); err != nil {
 				logMessage("ERROR", fmt.Sprintf("Failed to reload config: %v", err))
+			} else if err := service.UpdateConfig(next); err != nil {
+				logMessage("ERROR", fmt.Sprintf("Invalid configuration, keeping the previous one: %v", err))
 			} else {
-				// Update running components
-				service.UpdateConfig(cfg)
 				if webServer != nil {
-					webServer.config = cfg
+					if err := webServer.UpdateConfig(next); err != nil {
+						logMessage("ERROR", fmt.Sprintf("Invalid web access settings, keeping previous ones: %v", err))
+					} else {
+						webServer.ReloadCertificate()
+					}
 				}
 				logMessage("INFO", "Configuration reloaded")
 			}
+			configMu.Unlock()
 			continue
 		}
 
@@ -229,8 +468,12 @@ func runMain(cmd *cobra.Command, args []string) {
 		break
 	}
 
-	// Give the service time to clean up
-	time.Sleep(1 * time.Second)
+	// Probes are cancelled with ctx, so the in-flight cycle unwinds quickly
+	select {
+	case <-runDone:
+	case <-time.After(5 * time.Second):
+		logMessage("WARN", "Timed out waiting for the measurement cycle to stop")
+	}
 }
 
 func main() {
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Histogram buckets (seconds) for probe RTTs and cycle durations
+var (
+	probeRTTBuckets      = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+	cycleDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// histogram is a cumulative Prometheus-style histogram
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+	updated time.Time
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64, now time.Time) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+	h.updated = now
+}
+
+// serviceMetrics holds the counters and histograms exported on /metrics that
+// are not already part of the service status
+type serviceMetrics struct {
+	mu sync.Mutex
+	// probe outcomes by result: success, timeout, refused, unreachable, cancelled, error
+	probes map[string]uint64
+	// samples rejected before aggregation by reason: syn_retransmit, mad, iqr
+	rejected map[string]uint64
+	// per-host probe RTT histograms
+	hostRTT map[string]*histogram
+	cycle   *histogram
+	// failed qdisc updates per interface and parameter (rtt, bandwidth)
+	qdiscErrors map[[2]string]uint64
+}
+
+// observeProbe counts one probe and adds successful RTTs to the host's histogram
+func (m *serviceMetrics) observeProbe(host string, rtt time.Duration, err error, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.probes == nil {
+		m.probes = make(map[string]uint64)
+		m.hostRTT = make(map[string]*histogram)
+	}
+	m.probes[probeResult(err)]++
+	if err != nil {
+		return
+	}
+	h, ok := m.hostRTT[host]
+	if !ok {
+		h = newHistogram(probeRTTBuckets)
+		m.hostRTT[host] = h
+	}
+	h.observe(rtt.Seconds(), now)
+}
+
+// observeRejected counts a sample dropped as an outlier
+func (m *serviceMetrics) observeRejected(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rejected == nil {
+		m.rejected = make(map[string]uint64)
+	}
+	m.rejected[rejectionKind(reason)]++
+}
+
+// observeCycle adds a finished measurement cycle's duration
+func (m *serviceMetrics) observeCycle(took time.Duration, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cycle == nil {
+		m.cycle = newHistogram(cycleDurationBuckets)
+	}
+	m.cycle.observe(took.Seconds(), now)
+}
+
+// observeQdiscError counts a failed update of param (rtt, bandwidth) on iface
+func (m *serviceMetrics) observeQdiscError(iface, param string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.qdiscErrors == nil {
+		m.qdiscErrors = make(map[[2]string]uint64)
+	}
+	m.qdiscErrors[[2]string{iface, param}]++
+}
+
+// prune drops host histograms not updated within hostHealthTTL so the
+// exported series follow the hosts actually probed
+func (m *serviceMetrics) prune(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for host, h := range m.hostRTT {
+		if now.Sub(h.updated) > hostHealthTTL {
+			delete(m.hostRTT, host)
+		}
+	}
+}
+
+// write renders the counters and histograms
+func (m *serviceMetrics) write(w *metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.header("cake_autortt_probes_total", "Probes by result.", "counter")
+	for _, result := range sortedKeys(m.probes) {
+		w.sample("cake_autortt_probes_total", float64(m.probes[result]), "result", result)
+	}
+	w.header("cake_autortt_samples_rejected_total", "Probe samples rejected as outliers before aggregation.", "counter")
+	for _, reason := range sortedKeys(m.rejected) {
+		w.sample("cake_autortt_samples_rejected_total", float64(m.rejected[reason]), "reason", reason)
+	}
+	w.header("cake_autortt_probe_rtt_seconds", "Successful probe RTT per host.", "histogram")
+	for _, host := range sortedKeys(m.hostRTT) {
+		w.histogram("cake_autortt_probe_rtt_seconds", m.hostRTT[host], "host", host)
+	}
+	w.header("cake_autortt_cycle_duration_seconds", "Measurement cycle duration.", "histogram")
+	if m.cycle != nil {
+		w.histogram("cake_autortt_cycle_duration_seconds", m.cycle)
+	}
+	w.header("cake_autortt_qdisc_update_errors_total", "Failed CAKE qdisc updates per interface and parameter.", "counter")
+	keys := make([][2]string, 0, len(m.qdiscErrors))
+	for k := range m.qdiscErrors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		w.sample("cake_autortt_qdisc_update_errors_total", float64(m.qdiscErrors[k]), "interface", k[0], "param", k[1])
+	}
+}
+
+// probeResult classifies a probe outcome for the probes_total counter
+func probeResult(err error) string {
+	var errno syscall.Errno
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	case errors.As(err, &errno) && errno == syscall.ECONNREFUSED:
+		return "refused"
+	case errors.As(err, &errno) && (errno == syscall.EHOSTUNREACH || errno == syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &errno) && errno == syscall.ETIMEDOUT,
+		errors.As(err, &netErr) && netErr.Timeout(),
+		strings.Contains(err.Error(), "timeout"), strings.Contains(err.Error(), "timed out"):
+		return "timeout"
+	}
+	return "error"
+}
+
+// rejectionKind maps a RejectedSample reason to a label value
+func rejectionKind(reason string) string {
+	switch {
+	case strings.HasPrefix(reason, "SYN retransmit"):
+		return "syn_retransmit"
+	case strings.HasPrefix(reason, "MAD"):
+		return "mad"
+	case strings.HasPrefix(reason, "IQR"):
+		return "iqr"
+	}
+	return "other"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsWriter renders the Prometheus text exposition format (version 0.0.4)
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *metricsWriter) printf(format string, args ...any) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, args...)
+	}
+}
+
+// header writes the HELP and TYPE lines of a metric family
+func (w *metricsWriter) header(name, help, typ string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one series; labels are name/value pairs
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatMetricValue(value))
+}
+
+// histogram writes the bucket, sum and count series of h
+func (w *metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	bucket := func(le string) []string {
+		return append(append([]string(nil), labels...), "le", le)
+	}
+	for i, b := range h.buckets {
+		w.sample(name+"_bucket", float64(h.counts[i]), bucket(formatMetricValue(b))...)
+	}
+	w.sample(name+"_bucket", float64(h.count), bucket("+Inf")...)
+	w.sample(name+"_sum", h.sum, labels...)
+	w.sample(name+"_count", float64(h.count), labels...)
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeQdiscMetrics renders the CAKE qdisc and per-tin counters
+func writeQdiscMetrics(w *metricsWriter, qdiscs []CakeQdisc) {
+	type family struct {
+		name, help, typ string
+		value           func(q *CakeQdisc) float64
+	}
+	qdiscFamilies := []family{
+		{"cake_qdisc_rtt_seconds", "RTT parameter currently set on the qdisc.", "gauge", func(q *CakeQdisc) float64 { return float64(q.RTTUs) / 1e6 }},
+		{"cake_qdisc_bandwidth_bits_per_second", "Shaper rate (0 = unlimited).", "gauge", func(q *CakeQdisc) float64 { return float64(q.BandwidthBps) }},
+		{"cake_qdisc_sent_bytes_total", "Bytes sent.", "counter", func(q *CakeQdisc) float64 { return float64(q.Bytes) }},
+		{"cake_qdisc_sent_packets_total", "Packets sent.", "counter", func(q *CakeQdisc) float64 { return float64(q.Packets) }},
+		{"cake_qdisc_drops_total", "Packets dropped.", "counter", func(q *CakeQdisc) float64 { return float64(q.Drops) }},
+		{"cake_qdisc_overlimits_total", "Overlimit events.", "counter", func(q *CakeQdisc) float64 { return float64(q.Overlimits) }},
+		{"cake_qdisc_backlog_bytes", "Queued bytes.", "gauge", func(q *CakeQdisc) float64 { return float64(q.BacklogBytes) }},
+		{"cake_qdisc_memory_used_bytes", "Memory used by the qdisc.", "gauge", func(q *CakeQdisc) float64 { return float64(q.MemoryUsed) }},
+		{"cake_qdisc_capacity_estimate_bits_per_second", "Ingress capacity estimate.", "gauge", func(q *CakeQdisc) float64 { return float64(q.CapacityEstimateBps) }},
+	}
+	for _, f := range qdiscFamilies {
+		w.header(f.name, f.help, f.typ)
+		for i := range qdiscs {
+			w.sample(f.name, f.value(&qdiscs[i]), "interface", qdiscs[i].Interface, "handle", qdiscs[i].Handle)
+		}
+	}
+
+	type tinFamily struct {
+		name, help, typ string
+		value           func(t *CakeTinStats) float64
+	}
+	tinFamilies := []tinFamily{
+		{"cake_tin_threshold_rate_bits_per_second", "Rate above which the tin loses priority.", "gauge", func(t *CakeTinStats) float64 { return float64(t.ThresholdRateBps) }},
+		{"cake_tin_target_seconds", "AQM target delay.", "gauge", func(t *CakeTinStats) float64 { return float64(t.TargetUs) / 1e6 }},
+		{"cake_tin_peak_delay_seconds", "Peak queueing delay.", "gauge", func(t *CakeTinStats) float64 { return float64(t.PeakDelayUs) / 1e6 }},
+		{"cake_tin_avg_delay_seconds", "Average queueing delay.", "gauge", func(t *CakeTinStats) float64 { return float64(t.AvgDelayUs) / 1e6 }},
+		{"cake_tin_base_delay_seconds", "Base queueing delay.", "gauge", func(t *CakeTinStats) float64 { return float64(t.BaseDelayUs) / 1e6 }},
+		{"cake_tin_sent_bytes_total", "Bytes sent.", "counter", func(t *CakeTinStats) float64 { return float64(t.SentBytes) }},
+		{"cake_tin_sent_packets_total", "Packets sent.", "counter", func(t *CakeTinStats) float64 { return float64(t.SentPackets) }},
+		{"cake_tin_backlog_bytes", "Queued bytes.", "gauge", func(t *CakeTinStats) float64 { return float64(t.BacklogBytes) }},
+		{"cake_tin_drops_total", "Packets dropped.", "counter", func(t *CakeTinStats) float64 { return float64(t.Drops) }},
+		{"cake_tin_ecn_marks_total", "Packets ECN marked.", "counter", func(t *CakeTinStats) float64 { return float64(t.ECNMarks) }},
+		{"cake_tin_ack_drops_total", "ACKs dropped by the ACK filter.", "counter", func(t *CakeTinStats) float64 { return float64(t.AckDrops) }},
+		{"cake_tin_sparse_flows", "Sparse flows.", "gauge", func(t *CakeTinStats) float64 { return float64(t.SparseFlows) }},
+		{"cake_tin_bulk_flows", "Bulk flows.", "gauge", func(t *CakeTinStats) float64 { return float64(t.BulkFlows) }},
+		{"cake_tin_unresponsive_flows", "Unresponsive flows.", "gauge", func(t *CakeTinStats) float64 { return float64(t.UnresponsiveFlows) }},
+		{"cake_tin_way_collisions_total", "Hash way collisions.", "counter", func(t *CakeTinStats) float64 { return float64(t.WayCollisions) }},
+	}
+	for _, f := range tinFamilies {
+		w.header(f.name, f.help, f.typ)
+		for i := range qdiscs {
+			q := &qdiscs[i]
+			for tin := range q.Tins {
+				w.sample(f.name, f.value(&q.Tins[tin]), "interface", q.Interface, "handle", q.Handle, "tin", strconv.Itoa(tin))
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProbeResultClassification(t *testing.T) {
+	cases := map[string]error{
+		"success":     nil,
+		"cancelled":   fmt.Errorf("tcp probe: %w", context.DeadlineExceeded),
+		"refused":     fmt.Errorf("no reachable ports found (tried 443): %w", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}),
+		"unreachable": &net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH},
+		"timeout":     errors.New("icmp echo: i/o timeout"),
+		"error":       errors.New("invalid IP address"),
+	}
+	for want, err := range cases {
+		if got := probeResult(err); got != want {
+			t.Fatalf("%v: got %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestWriteMetricsExposition(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DLInterface, cfg.ULInterface = "ifb4eth0", "eth0"
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	fake := &fakeQdiscController{qdiscs: []CakeQdisc{{Interface: "eth0", Handle: "8001:", Parent: "root", RTTUs: 45000,
+		Bytes: 1000, Tins: []CakeTinStats{{SentBytes: 600, Drops: 2}, {SentBytes: 400, ECNMarks: 1}}}}}
+	s := &CakeAutoRTTService{config: cfg, qdisc: fake, targets: targets, adaptiveWorkers: 10}
+	s.config.AdaptiveControllerEnabled = true
+
+	now := time.Now()
+	s.metrics.observeProbe("1.1.1.1", 12*time.Millisecond, nil, now)
+	s.metrics.observeProbe("1.1.1.1", 30*time.Millisecond, nil, now)
+	s.metrics.observeProbe(`weird"host`, 0, errors.New("connection timed out"), now)
+	s.metrics.observeRejected("SYN retransmit (~1s)")
+	s.metrics.observeCycle(1200*time.Millisecond, now)
+	s.metrics.observeQdiscError("eth0", "rtt")
+	if err := s.adjustTargetRTT(targets[0], 40, true, 3); err != nil {
+		t.Fatalf("adjust: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteMetrics(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`cake_autortt_rtt_measured_seconds{interface="ifb4eth0",source="measured"} 0.04`,
+		`cake_autortt_rtt_updates_total{interface="ifb4eth0",result="applied"} 1`,
+		`cake_autortt_probes_total{result="success"} 2`,
+		`cake_autortt_probes_total{result="timeout"} 1`,
+		`cake_autortt_samples_rejected_total{reason="syn_retransmit"} 1`,
+		`cake_autortt_probe_rtt_seconds_bucket{host="1.1.1.1",le="0.025"} 1`,
+		`cake_autortt_probe_rtt_seconds_bucket{host="1.1.1.1",le="+Inf"} 2`,
+		`cake_autortt_probe_rtt_seconds_count{host="1.1.1.1"} 2`,
+		`cake_autortt_cycle_duration_seconds_bucket{le="1"} 0`,
+		`cake_autortt_cycle_duration_seconds_bucket{le="2.5"} 1`,
+		`cake_autortt_qdisc_update_errors_total{interface="eth0",param="rtt"} 1`,
+		`cake_autortt_probe_workers 10`,
+		`cake_autortt_qdisc_stats_up 1`,
+		`cake_qdisc_rtt_seconds{interface="eth0",handle="8001:"} 0.045`,
+		`cake_tin_drops_total{interface="eth0",handle="8001:",tin="0"} 2`,
+		`cake_tin_ecn_marks_total{interface="eth0",handle="8001:",tin="1"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	// Every line is a comment or a well-formed sample, and each family has one TYPE
+	sample := regexp.MustCompile(`^[a-z_]+(\{([a-z_]+="([^"\\]|\\.)*",?)+\})? [-+0-9.eInfNa]+$`)
+	types := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			name := strings.Fields(line)[2]
+			if types[name] {
+				t.Fatalf("duplicate TYPE for %s", name)
+			}
+			types[name] = true
+			continue
+		}
+		if !strings.HasPrefix(line, "# HELP ") && !sample.MatchString(line) {
+			t.Fatalf("malformed line %q", line)
+		}
+	}
+
+	// Without qdisc statistics the scrape still succeeds
+	fake.err = errors.New("no cake")
+	buf.Reset()
+	if err := s.WriteMetrics(&buf); err != nil || !strings.Contains(buf.String(), "cake_autortt_qdisc_stats_up 0\n") {
+		t.Fatalf("expected qdisc_stats_up 0, got err=%v", err)
+	}
+}
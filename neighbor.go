@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// neighborEntry maps one IPv4/IPv6 address to its link-layer address
+type neighborEntry struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+}
+
+// buildNeighborRequest encodes an ndmsg dumping neighbours of all families
+func buildNeighborRequest() []byte {
+	req := make([]byte, unix.SizeofNdMsg)
+	req[0] = unix.AF_UNSPEC
+	return req
+}
+
+// parseNeighborMessages decodes RTM_NEWNEIGH replies, skipping entries
+// without a link-layer address or whose resolution failed
+func parseNeighborMessages(msgs []netlinkMessage) ([]neighborEntry, error) {
+	var out []neighborEntry
+	for _, m := range msgs {
+		if m.Type != unix.RTM_NEWNEIGH {
+			continue
+		}
+		if len(m.Data) < unix.SizeofNdMsg {
+			return nil, fmt.Errorf("neighbour message too short (%d bytes)", len(m.Data))
+		}
+		state := binary.NativeEndian.Uint16(m.Data[8:10])
+		if state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED|unix.NUD_NOARP) != 0 {
+			continue
+		}
+		attrs, err := parseNetlinkAttrs(m.Data[unix.SizeofNdMsg:])
+		if err != nil {
+			return nil, err
+		}
+		var e neighborEntry
+		for _, a := range attrs {
+			switch a.Type {
+			case unix.NDA_DST:
+				e.IP = net.IP(append([]byte(nil), a.Value...))
+			case unix.NDA_LLADDR:
+				e.MAC = net.HardwareAddr(append([]byte(nil), a.Value...))
+			}
+		}
+		if e.IP != nil && len(e.MAC) > 0 {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// dumpNeighbors returns the kernel neighbour table (ARP and NDP caches)
+func dumpNeighbors() ([]neighborEntry, error) {
+	msgs, err := netlinkExecute(unix.NETLINK_ROUTE, unix.RTM_GETNEIGH, unix.NLM_F_DUMP, buildNeighborRequest())
+	if err != nil {
+		return nil, fmt.Errorf("neighbour dump: %w", err)
+	}
+	return parseNeighborMessages(msgs)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Minimal netlink plumbing shared by the sock_diag, ctnetlink and rtnetlink
+// backends. Netlink uses host byte order for headers and most attributes.
+
+const (
+	nlaHeaderLen = 4
+	// nlaTypeMask strips NLA_F_NESTED / NLA_F_NET_BYTEORDER from an attribute type
+	nlaTypeMask = 0x3fff
+	// netlinkReadTimeout bounds how long a dump may go quiet before it is abandoned
+	netlinkReadTimeout = 5 * time.Second
+)
+
+// netlinkSeq is shared by all requests so replies can be matched to them
+var netlinkSeq uint32
+
+// netlinkMessage is one parsed netlink message
+type netlinkMessage struct {
+	Type  uint16
+	Flags uint16
+	Seq   uint32
+	Data  []byte
+}
+
+// netlinkAttr is one parsed netlink attribute (type has the flag bits removed)
+type netlinkAttr struct {
+	Type  uint16
+	Value []byte
+}
+
+// nlAlign rounds n up to the 4-byte netlink alignment
+func nlAlign(n int) int {
+	return (n + 3) &^ 3
+}
+
+// parseNetlinkMessages splits a buffer read from a netlink socket into messages
+func parseNetlinkMessages(b []byte) ([]netlinkMessage, error) {
+	var msgs []netlinkMessage
+	for len(b) >= unix.NLMSG_HDRLEN {
+		length := int(binary.NativeEndian.Uint32(b[0:4]))
+		if length < unix.NLMSG_HDRLEN || length > len(b) {
+			return nil, fmt.Errorf("netlink: invalid message length %d (buffer %d)", length, len(b))
+		}
+		msgs = append(msgs, netlinkMessage{
+			Type:  binary.NativeEndian.Uint16(b[4:6]),
+			Flags: binary.NativeEndian.Uint16(b[6:8]),
+			Seq:   binary.NativeEndian.Uint32(b[8:12]),
+			Data:  b[unix.NLMSG_HDRLEN:length],
+		})
+		next := nlAlign(length)
+		if next > len(b) {
+			break
+		}
+		b = b[next:]
+	}
+	return msgs, nil
+}
+
+// parseNetlinkAttrs parses a run of netlink attributes
+func parseNetlinkAttrs(b []byte) ([]netlinkAttr, error) {
+	var attrs []netlinkAttr
+	for len(b) >= nlaHeaderLen {
+		length := int(binary.NativeEndian.Uint16(b[0:2]))
+		if length < nlaHeaderLen || length > len(b) {
+			return nil, fmt.Errorf("netlink: invalid attribute length %d (buffer %d)", length, len(b))
+		}
+		attrs = append(attrs, netlinkAttr{
+			Type:  binary.NativeEndian.Uint16(b[2:4]) & nlaTypeMask,
+			Value: b[nlaHeaderLen:length],
+		})
+		next := nlAlign(length)
+		if next > len(b) {
+			break
+		}
+		b = b[next:]
+	}
+	return attrs, nil
+}
+
+// netlinkErrno extracts the errno carried by an NLMSG_ERROR message (0 = ack)
+func netlinkErrno(m netlinkMessage) error {
+	if len(m.Data) < 4 {
+		return fmt.Errorf("netlink: truncated error message")
+	}
+	code := int32(binary.NativeEndian.Uint32(m.Data[0:4]))
+	if code == 0 {
+		return nil
+	}
+	return unix.Errno(-code)
+}
+
+// encodeNetlinkMessage builds a message with a header followed by payload
+func encodeNetlinkMessage(msgType, flags uint16, seq uint32, payload []byte) []byte {
+	length := unix.NLMSG_HDRLEN + len(payload)
+	b := make([]byte, nlAlign(length))
+	binary.NativeEndian.PutUint32(b[0:4], uint32(length))
+	binary.NativeEndian.PutUint16(b[4:6], msgType)
+	binary.NativeEndian.PutUint16(b[6:8], flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	copy(b[unix.NLMSG_HDRLEN:], payload)
+	return b
+}
+
+// encodeNetlinkAttr encodes one attribute, padded to alignment
+func encodeNetlinkAttr(attrType uint16, value []byte) []byte {
+	length := nlaHeaderLen + len(value)
+	b := make([]byte, nlAlign(length))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(b[2:4], attrType)
+	copy(b[nlaHeaderLen:], value)
+	return b
+}
+
+// netlinkExecute sends one request on a fresh socket of the given netlink
+// protocol and collects the reply messages. Dump replies are read until
+// NLMSG_DONE; other requests until the first non-multipart message or ack.
+func netlinkExecute(proto int, msgType, flags uint16, payload []byte) ([]netlinkMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	tv := unix.NsecToTimeval(netlinkReadTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, fmt.Errorf("netlink setsockopt: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	req := encodeNetlinkMessage(msgType, flags|unix.NLM_F_REQUEST, seq, payload)
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %w", err)
+	}
+
+	dump := flags&unix.NLM_F_DUMP == unix.NLM_F_DUMP
+	var out []netlinkMessage
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink recv: %w", err)
+		}
+		// copy out of the shared read buffer before parsing
+		msgs, err := parseNetlinkMessages(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Seq != seq {
+				continue
+			}
+			switch m.Type {
+			case unix.NLMSG_DONE:
+				return out, nil
+			case unix.NLMSG_ERROR:
+				if err := netlinkErrno(m); err != nil {
+					return nil, err
+				}
+				return out, nil
+			}
+			out = append(out, m)
+			if !dump && m.Flags&unix.NLM_F_MULTI == 0 {
+				return out, nil
+			}
+		}
+	}
+}
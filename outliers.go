@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	// outlierMinSamples is the smallest sample set the statistical tests run on
+	outlierMinSamples = 4
+	// outlierMinExcessMs keeps tiny absolute deviations from being rejected
+	// when the spread of the other samples is near zero
+	outlierMinExcessMs = 5.0
+	// defaultMADThreshold is the modified z-score cut-off (Iglewicz & Hoaglin)
+	defaultMADThreshold = 3.5
+	// defaultIQRThreshold is Tukey's fence multiplier
+	defaultIQRThreshold = 1.5
+	// synRetransmitMaxSlackMs bounds how far above a retransmit step a sample
+	// may be and still count as one
+	synRetransmitMaxSlackMs = 250.0
+	synRetransmitMinSlackMs = 50.0
+)
+
+// synRetransmitStepsMs are the connect times a lost SYN adds with the
+// Linux 1s initial RTO: one, two and three retransmits
+var synRetransmitStepsMs = []float64{1000, 3000, 7000}
+
+// RejectedSample is a probe result dropped before aggregation
+type RejectedSample struct {
+	Host   string  `json:"host"`
+	RTTMs  float64 `json:"rtt_ms"`
+	Probe  string  `json:"probe"`
+	Reason string  `json:"reason"`
+}
+
+// validateOutlierRejection checks the rtt_outlier_rejection config value
+func validateOutlierRejection(method string) error {
+	switch strings.ToLower(method) {
+	case "", "none", "mad", "iqr":
+		return nil
+	}
+	return fmt.Errorf("unknown rtt_outlier_rejection %q (want mad, iqr or none)", method)
+}
+
+// rejectOutliers drops samples that would misrepresent the path RTT: TCP
+// connect times quantized by SYN retransmits and, with method mad or iqr, samples
+// statistically far above the rest. Only the high side is rejected: an RTT
+// cannot be measured lower than the path allows, and max aggregation would
+// pass any high artifact straight to CAKE.
+func rejectOutliers(samples []RTTSample, method string, threshold float64, synRetransmits bool) ([]RTTSample, []RejectedSample) {
+	if len(samples) == 0 {
+		return samples, nil
+	}
+	var rejected []RejectedSample
+	kept := samples
+	median := percentile(sortedRTTs(samples), 50)
+
+	if synRetransmits {
+		kept = make([]RTTSample, 0, len(samples))
+		for _, smp := range samples {
+			// ICMP echo and passive tcpi_rtt send no SYN, a slow one is real
+			if step, ok := synRetransmitStep(smp.RTTMs, median); ok && smp.Probe == "tcp" {
+				rejected = append(rejected, RejectedSample{Host: smp.Host, RTTMs: smp.RTTMs, Probe: smp.Probe,
+					Reason: fmt.Sprintf("SYN retransmit (~%.0fs)", step/1000)})
+				continue
+			}
+			kept = append(kept, smp)
+		}
+	}
+	if len(kept) < outlierMinSamples {
+		return kept, rejected
+	}
+
+	values := sortedRTTs(kept)
+	median = percentile(values, 50)
+	var fence float64
+	var describe func(rtt float64) string
+	switch strings.ToLower(method) {
+	case "mad":
+		if threshold <= 0 {
+			threshold = defaultMADThreshold
+		}
+		scale := medianAbsDeviation(values, median)
+		if scale == 0 {
+			return kept, rejected
+		}
+		// modified z-score: 0.6745 * (x - median) / MAD
+		fence = median + threshold*scale/0.6745
+		describe = func(rtt float64) string {
+			return fmt.Sprintf("MAD outlier (z=%.1f > %.1f)", 0.6745*(rtt-median)/scale, threshold)
+		}
+	case "iqr":
+		if threshold <= 0 {
+			threshold = defaultIQRThreshold
+		}
+		q1, q3 := percentile(values, 25), percentile(values, 75)
+		fence = q3 + threshold*(q3-q1)
+		describe = func(rtt float64) string {
+			return fmt.Sprintf("IQR outlier (above %.1fms fence)", fence)
+		}
+	default:
+		return kept, rejected
+	}
+	fence = math.Max(fence, median+outlierMinExcessMs)
+
+	out := make([]RTTSample, 0, len(kept))
+	for _, smp := range kept {
+		if smp.RTTMs > fence {
+			rejected = append(rejected, RejectedSample{Host: smp.Host, RTTMs: smp.RTTMs, Probe: smp.Probe, Reason: describe(smp.RTTMs)})
+			continue
+		}
+		out = append(out, smp)
+	}
+	return out, rejected
+}
+
+// synRetransmitStep reports whether rtt sits just above a SYN retransmit
+// step, i.e. the first SYN (or more) was lost and the RTO, not the path,
+// dominates the connect time. The slack allowed above the step follows the
+// typical RTT of the sample set.
+func synRetransmitStep(rtt, median float64) (float64, bool) {
+	slack := math.Min(math.Max(2*median, synRetransmitMinSlackMs), synRetransmitMaxSlackMs)
+	for _, step := range synRetransmitStepsMs {
+		if rtt >= step && rtt < step+slack {
+			// a set where most hosts are this slow is a slow path, not a retransmit
+			if median >= step {
+				return 0, false
+			}
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// medianAbsDeviation returns the median absolute deviation of sorted values
+// from median, falling back to the scaled mean absolute deviation when more
+// than half of the values are identical
+func medianAbsDeviation(values []float64, median float64) float64 {
+	dev := make([]float64, len(values))
+	sum := 0.0
+	for i, v := range values {
+		dev[i] = math.Abs(v - median)
+		sum += dev[i]
+	}
+	sort.Float64s(dev)
+	if mad := percentile(dev, 50); mad > 0 {
+		return mad
+	}
+	// Iglewicz & Hoaglin use (x - median) / (1.253314 * meanAD) here; scale
+	// it so the caller's 0.6745 * (x - median) / MAD gives the same score
+	return 0.6745 * 1.253314 * sum / float64(len(values))
+}
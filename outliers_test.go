@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rttSamples(rtts ...float64) []RTTSample {
+	out := make([]RTTSample, len(rtts))
+	for i, r := range rtts {
+		out[i] = RTTSample{Host: "h" + string(rune('a'+i)), RTTMs: r, Probe: "tcp"}
+	}
+	return out
+}
+
+func TestRejectOutliersMADAndIQR(t *testing.T) {
+	samples := rttSamples(20, 22, 21, 25, 19, 23, 180)
+	for _, method := range []string{"mad", "iqr"} {
+		kept, rejected := rejectOutliers(samples, method, 0, true)
+		if len(kept) != 6 || len(rejected) != 1 || rejected[0].RTTMs != 180 {
+			t.Fatalf("%s: expected the bufferbloated sample rejected, got %v / %+v", method, kept, rejected)
+		}
+		if !strings.Contains(rejected[0].Reason, strings.ToUpper(method)) {
+			t.Fatalf("%s: unexpected reason %q", method, rejected[0].Reason)
+		}
+	}
+	// Low samples are real nearby hosts, never rejected
+	if _, rejected := rejectOutliers(rttSamples(1, 40, 42, 41, 43, 44), "mad", 0, true); len(rejected) != 0 {
+		t.Fatalf("low samples must be kept: %+v", rejected)
+	}
+	// Identical samples: a small excess stays within the absolute floor
+	if _, rejected := rejectOutliers(rttSamples(20, 20, 20, 20, 23), "mad", 0, true); len(rejected) != 0 {
+		t.Fatalf("a 3ms excess must be kept: %+v", rejected)
+	}
+	if _, rejected := rejectOutliers(rttSamples(20, 20, 20, 20, 60), "mad", 0, true); len(rejected) != 1 {
+		t.Fatalf("expected the 60ms sample rejected with zero MAD")
+	}
+	// Too few samples for statistics, and method none
+	if _, rejected := rejectOutliers(rttSamples(20, 22, 180), "mad", 0, true); len(rejected) != 0 {
+		t.Fatalf("expected no statistical rejection below %d samples", outlierMinSamples)
+	}
+	if _, rejected := rejectOutliers(samples, "none", 0, false); len(rejected) != 0 {
+		t.Fatalf("expected nothing rejected with none")
+	}
+	if validateOutlierRejection("zscore") == nil || validateOutlierRejection("IQR") != nil {
+		t.Fatalf("unexpected rtt_outlier_rejection validation")
+	}
+}
+
+func TestRejectSYNRetransmits(t *testing.T) {
+	kept, rejected := rejectOutliers(rttSamples(30, 1031, 28, 3025), "none", 0, true)
+	if len(kept) != 2 || len(rejected) != 2 ||
+		rejected[0].Reason != "SYN retransmit (~1s)" || rejected[1].Reason != "SYN retransmit (~3s)" {
+		t.Fatalf("unexpected retransmit rejection: %v / %+v", kept, rejected)
+	}
+	// Far above the step, or a path where most hosts are that slow, is not quantization
+	if _, ok := synRetransmitStep(1600, 30); ok {
+		t.Fatalf("1600ms is not a retransmit of a 30ms path")
+	}
+	if _, ok := synRetransmitStep(1040, 1010); ok {
+		t.Fatalf("a 1s median path must not be treated as retransmits")
+	}
+	if _, rejected := rejectOutliers(rttSamples(30, 1031), "none", 0, false); len(rejected) != 0 {
+		t.Fatalf("retransmit detection must be optional")
+	}
+	// An echo or tcpi_rtt that slow is a slow path, no SYN was sent
+	slow := rttSamples(30, 1031, 28, 3025)
+	slow[1].Probe, slow[3].Probe = "icmp", "passive"
+	if _, rejected := rejectOutliers(slow, "none", 0, true); len(rejected) != 0 {
+		t.Fatalf("only TCP connect samples can be SYN retransmits: %+v", rejected)
+	}
+}
+
+func TestProbeHostsMarksRejectedProbes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RTTRejectSYNRetransmits = true
+	s := &CakeAutoRTTService{config: cfg, currentProbes: make(map[string]ProbeStatus),
+		completedMaxEntries: 50, completedRetentionSec: 60}
+	rtts := map[string]time.Duration{"a": 20 * time.Millisecond, "b": 21 * time.Millisecond,
+		"c": 22 * time.Millisecond, "d": 23 * time.Millisecond, "e": 1020 * time.Millisecond}
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		return rtts[host], "tcp", nil
+	}
+
+	samples, rejected := s.probeHosts(context.Background(), *cfg, []string{"a", "b", "c", "d", "e"}, ProbeBinding{})
+	if len(samples) != 4 || len(rejected) != 1 || rejected[0].Host != "e" {
+		t.Fatalf("unexpected probe result: %v / %+v", samples, rejected)
+	}
+	found := false
+	for _, p := range s.GetRecentCompletedProbes() {
+		if p.Host == "e" {
+			found = p.Stage == "rejected" && p.Reason == "SYN retransmit (~1s)"
+		}
+	}
+	if !found {
+		t.Fatalf("expected rejected probe in completed list: %+v", s.GetRecentCompletedProbes())
+	}
+	stats := s.aggregateRTT(*cfg, samples, len(rejected))
+	if stats.Rejected != 1 || stats.MaxMs > 30 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMeasureRTTRejectsPassiveOutliers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RTTOutlierRejection = "mad"
+	s := &CakeAutoRTTService{config: cfg, currentProbes: make(map[string]ProbeStatus),
+		completedMaxEntries: 50, completedRetentionSec: 60}
+	rtts := map[string]time.Duration{"a": 20 * time.Millisecond, "b": 21 * time.Millisecond,
+		"c": 22 * time.Millisecond, "d": 23 * time.Millisecond}
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		return rtts[host], "tcp", nil
+	}
+
+	// An earlier active probe of the host the passive sample comes from
+	s.setProbeResult("stale", 25, nil)
+
+	// A stale tcpi_rtt must not decide the max aggregation
+	passive := []RTTSample{{Host: "p", RTTMs: 24, Probe: "passive"}, {Host: "stale", RTTMs: 400, Probe: "passive"}}
+	rtt, alive, err := s.measureRTT(context.Background(), []string{"a", "b", "c", "d"}, passive, ProbeBinding{})
+	if err != nil || alive != 5 || rtt > 30 {
+		t.Fatalf("expected the stale passive sample to be rejected, got %.1fms from %d hosts (%v)", rtt, alive, err)
+	}
+	if stats := s.lastRTTStats; stats == nil || stats.Rejected != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	for _, p := range s.GetRecentCompletedProbes() {
+		if p.Host == "stale" && p.Stage == "rejected" {
+			t.Fatalf("a rejected passive sample must not mark the host's active probe")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLearnedPorts is the number of conntrack destination ports tried per host
+	maxLearnedPorts = 3
+	// probePortTTL is how long a host's last working port is remembered
+	probePortTTL = time.Hour
+)
+
+// validateProbePorts checks the probe_ports fallback list
+func validateProbePorts(ports []int) error {
+	for _, p := range ports {
+		if p < 1 || p > 65535 {
+			return fmt.Errorf("invalid probe_ports entry %d (want 1-65535)", p)
+		}
+	}
+	return nil
+}
+
+// topPorts returns up to n ports ordered by flow count, lowest port first on ties
+func topPorts(counts map[uint16]uint64, n int) []uint16 {
+	ports := make([]uint16, 0, len(counts))
+	for p := range counts {
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if counts[ports[i]] != counts[ports[j]] {
+			return counts[ports[i]] > counts[ports[j]]
+		}
+		return ports[i] < ports[j]
+	})
+	if len(ports) > n {
+		ports = ports[:n]
+	}
+	return ports
+}
+
+// probePortOrder merges the cached working port, the ports learned from
+// conntrack and the configured fallback list, without duplicates
+func probePortOrder(cached uint16, learned []uint16, fallback []int) []string {
+	seen := make(map[uint16]bool, 1+len(learned)+len(fallback))
+	var out []string
+	add := func(p uint16) {
+		if p == 0 || seen[p] {
+			return
+		}
+		seen[p] = true
+		out = append(out, strconv.Itoa(int(p)))
+	}
+	add(cached)
+	for _, p := range learned {
+		add(p)
+	}
+	for _, p := range fallback {
+		if p > 0 && p <= 65535 {
+			add(uint16(p))
+		}
+	}
+	return out
+}
+
+// probePortCache remembers, per host, the TCP port that last answered a
+// probe so later cycles try it first
+type probePortCache struct {
+	mu    sync.Mutex
+	ports map[string]probePortEntry
+}
+
+type probePortEntry struct {
+	port uint16
+	seen time.Time
+}
+
+// get returns the cached port for host, if one is known
+func (c *probePortCache) get(host string) uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ports[host].port
+}
+
+// set records port as working for host
+func (c *probePortCache) set(host string, port uint16, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ports == nil {
+		c.ports = make(map[string]probePortEntry)
+	}
+	c.ports[host] = probePortEntry{port: port, seen: now}
+}
+
+// forget drops host after every port failed
+func (c *probePortCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ports, host)
+}
+
+// prune drops entries not confirmed within probePortTTL
+func (c *probePortCache) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for host, e := range c.ports {
+		if now.Sub(e.seen) > probePortTTL {
+			delete(c.ports, host)
+		}
+	}
+}
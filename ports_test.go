@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProbePortOrder(t *testing.T) {
+	learned := topPorts(map[uint16]uint64{8443: 5, 443: 5, 22: 1, 993: 3}, maxLearnedPorts)
+	if !reflect.DeepEqual(learned, []uint16{443, 8443, 993}) {
+		t.Fatalf("unexpected learned ports: %v", learned)
+	}
+	got := probePortOrder(993, learned, []int{443, 80})
+	if !reflect.DeepEqual(got, []string{"993", "443", "8443", "80"}) {
+		t.Fatalf("unexpected order: %v", got)
+	}
+	if got := probePortOrder(0, nil, []int{443, 80}); !reflect.DeepEqual(got, []string{"443", "80"}) {
+		t.Fatalf("expected fallback only, got %v", got)
+	}
+	if validateProbePorts([]int{443, 0}) == nil || validateProbePorts([]int{70000}) == nil || validateProbePorts(nil) != nil {
+		t.Fatalf("unexpected probe_ports validation")
+	}
+}
+
+func TestProbePortCacheExpiry(t *testing.T) {
+	var c probePortCache
+	now := time.Now()
+	c.set("1.1.1.1", 853, now.Add(-2*probePortTTL))
+	c.set("8.8.8.8", 443, now)
+	c.prune(now)
+	if c.get("1.1.1.1") != 0 || c.get("8.8.8.8") != 443 {
+		t.Fatalf("expected only the stale entry pruned")
+	}
+	c.forget("8.8.8.8")
+	if c.get("8.8.8.8") != 0 {
+		t.Fatalf("expected entry forgotten")
+	}
+}
+
+func TestSelectHostsLearnsPorts(t *testing.T) {
+	flow := func(dst string, proto uint8, dport uint16) ConntrackEntry {
+		return ConntrackEntry{Proto: proto, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"),
+			Dst: net.ParseIP(dst), DPort: dport}
+	}
+	s := &CakeAutoRTTService{config: DefaultConfig()}
+	s.selectHosts([]ConntrackEntry{
+		flow("1.1.1.1", 6, 853),
+		flow("1.1.1.1", 6, 853),
+		flow("1.1.1.1", 6, 443),
+		flow("1.1.1.1", 17, 53),
+		flow("8.8.8.8", 17, 443),
+	}, hostFilter{})
+
+	if got := s.hostPorts["1.1.1.1"]; !reflect.DeepEqual(got, []uint16{853, 443}) {
+		t.Fatalf("unexpected learned ports: %v", got)
+	}
+	if _, ok := s.hostPorts["8.8.8.8"]; ok {
+		t.Fatalf("UDP-only host should have no learned TCP ports")
+	}
+}
+
+func TestMeasureSingleHostTCPUsesLearnedPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	cfg := DefaultConfig()
+	cfg.ProbePorts = nil
+	s := &CakeAutoRTTService{config: cfg}
+	if _, err := s.measureSingleHostTCP(context.Background(), "127.0.0.1", 1, ProbeBinding{}); err == nil {
+		t.Fatalf("expected failure with no ports to try")
+	}
+
+	// The conntrack-learned port answers and is cached for later cycles
+	s.hostPorts = map[string][]uint16{"127.0.0.1": {port}}
+	if _, err := s.measureSingleHostTCP(context.Background(), "127.0.0.1", 1, ProbeBinding{}); err != nil {
+		t.Fatalf("probe via learned port: %v", err)
+	}
+	if s.portCache.get("127.0.0.1") != port {
+		t.Fatalf("expected port %d cached", port)
+	}
+	s.hostPorts = nil
+	if _, err := s.measureSingleHostTCP(context.Background(), "127.0.0.1", 1, ProbeBinding{}); err != nil {
+		t.Fatalf("probe via cached port: %v", err)
+	}
+
+	// Once the port stops answering the cache entry is dropped
+	ln.Close()
+	if _, err := s.measureSingleHostTCP(context.Background(), "127.0.0.1", 1, ProbeBinding{}); err == nil {
+		t.Fatalf("expected failure after listener closed")
+	}
+	if s.portCache.get("127.0.0.1") != 0 {
+		t.Fatalf("expected cache entry for port %d forgotten", port)
+	}
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CakeQdisc describes one CAKE instance with its options and statistics
+type CakeQdisc struct {
+	Interface string `json:"interface"`
+	Handle    string `json:"handle"` // e.g. "8001:"
+	Parent    string `json:"parent"` // "root" or "maj:min"
+	// BandwidthBps is the shaper rate in bits/s (0 = unlimited)
+	BandwidthBps uint64 `json:"bandwidth_bps"`
+	RTTUs        uint32 `json:"rtt_us"`
+	TargetUs     uint32 `json:"target_us"`
+
+	Bytes        uint64 `json:"bytes"`
+	Packets      uint64 `json:"packets"`
+	Drops        uint32 `json:"drops"`
+	Overlimits   uint32 `json:"overlimits"`
+	Requeues     uint32 `json:"requeues"`
+	BacklogBytes uint32 `json:"backlog_bytes"`
+	BacklogPkts  uint32 `json:"backlog_packets"`
+
+	// CAKE extended statistics (absent from tc builds without CAKE support)
+	MemoryUsed          uint32 `json:"memory_used"`
+	MemoryLimit         uint32 `json:"memory_limit"`
+	CapacityEstimateBps uint64 `json:"capacity_estimate_bps"`
+	// Tins holds per-tin statistics in priority order (e.g. bulk, best effort, voice for diffserv3)
+	Tins []CakeTinStats `json:"tins"`
+
+	// Summary is the tc-style "qdisc cake ..." header line
+	Summary string `json:"summary"`
+}
+
+// QdiscController reads and changes CAKE qdiscs
+type QdiscController interface {
+	Name() string
+	// CakeQdiscs lists every CAKE qdisc on the system with its statistics
+	CakeQdiscs() ([]CakeQdisc, error)
+	// SetRTT changes the rtt parameter of the root CAKE qdisc on iface
+	SetRTT(iface string, rttUs int) error
+	// SetBandwidth changes the shaper rate (bits/s) of the root CAKE qdisc on iface
+	SetBandwidth(iface string, bps uint64) error
+}
+
+// NewQdiscController returns the controller selected by the qdisc_backend
+// config key. "auto" (or empty) prefers rtnetlink and falls back to running
+// tc when netlink is unavailable.
+func NewQdiscController(backend string) (QdiscController, error) {
+	switch backend {
+	case "netlink":
+		return &netlinkQdiscController{}, nil
+	case "exec", "tc":
+		return &execQdiscController{}, nil
+	case "", "auto":
+		nl := &netlinkQdiscController{}
+		if _, err := nl.CakeQdiscs(); err == nil {
+			return nl, nil
+		}
+		return &execQdiscController{}, nil
+	}
+	return nil, fmt.Errorf("unknown qdisc_backend %q (want auto, netlink or exec)", backend)
+}
+
+// execQdiscController shells out to tc
+type execQdiscController struct{}
+
+func (e *execQdiscController) Name() string { return "exec" }
+
+func (e *execQdiscController) CakeQdiscs() ([]CakeQdisc, error) {
+	// Prefer JSON output; BusyBox and old iproute2 builds reject -j
+	if output, err := exec.Command("tc", "-s", "-j", "qdisc", "show").Output(); err == nil {
+		if qdiscs, err := parseTCQdiscJSON(output); err == nil {
+			return qdiscs, nil
+		}
+	}
+
+	output, err := exec.Command("tc", "-s", "qdisc", "show").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run tc -s qdisc show: %w", err)
+	}
+	return parseTCQdiscOutput(output), nil
+}
+
+func (e *execQdiscController) SetRTT(iface string, rttUs int) error {
+	cmd := exec.Command("tc", "qdisc", "change", "root", "dev", iface, "cake", "rtt", fmt.Sprintf("%dus", rttUs))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tc command failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+func (e *execQdiscController) SetBandwidth(iface string, bps uint64) error {
+	cmd := exec.Command("tc", "qdisc", "change", "root", "dev", iface, "cake", "bandwidth", fmt.Sprintf("%dkbit", bps/1000))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tc command failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// parseTCQdiscOutput extracts the CAKE qdiscs from plain tc -s qdisc output,
+// used when tc lacks JSON support. A block starts at each "qdisc" line;
+// indented lines belong to the preceding qdisc, including the per-tin table
+// whose rows are "label value-per-tin...".
+func parseTCQdiscOutput(output []byte) []CakeQdisc {
+	var qdiscs []CakeQdisc
+	var cur *CakeQdisc
+
+	flush := func() {
+		if cur != nil {
+			qdiscs = append(qdiscs, *cur)
+		}
+		cur = nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "qdisc ") {
+			flush()
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[1] != "cake" {
+				continue
+			}
+			cur = &CakeQdisc{Summary: line}
+			parseTCQdiscHeader(fields, cur)
+			continue
+		}
+		if cur == nil || line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "Sent "):
+			// Sent 123 bytes 45 pkt (dropped 0, overlimits 0 requeues 0)
+			for i := 0; i+1 < len(fields); i++ {
+				v := strings.Trim(fields[i], "(,)")
+				n := strings.Trim(fields[i+1], "(,)")
+				switch {
+				case i == 0 && v == "Sent":
+					cur.Bytes, _ = strconv.ParseUint(n, 10, 64)
+				case fields[i+1] == "pkt":
+					cur.Packets, _ = strconv.ParseUint(v, 10, 64)
+				case v == "dropped":
+					cur.Drops = parseUint32(n)
+				case v == "overlimits":
+					cur.Overlimits = parseUint32(n)
+				case v == "requeues":
+					cur.Requeues = parseUint32(n)
+				}
+			}
+		case strings.HasPrefix(line, "backlog ") && strings.Contains(line, "requeues"):
+			// backlog 0b 0p requeues 0 (the per-tin "backlog" row has no requeues)
+			if len(fields) >= 3 {
+				cur.BacklogBytes = parseUint32(strings.TrimSuffix(fields[1], "b"))
+				cur.BacklogPkts = parseUint32(strings.TrimSuffix(fields[2], "p"))
+			}
+		case strings.HasPrefix(line, "memory used:"):
+			// memory used: 145Kb of 4Mb
+			if len(fields) >= 5 {
+				cur.MemoryUsed = uint32(parseTCSize(fields[2]))
+				cur.MemoryLimit = uint32(parseTCSize(fields[4]))
+			}
+		case strings.HasPrefix(line, "capacity estimate:"):
+			if len(fields) >= 3 {
+				cur.CapacityEstimateBps, _ = parseTCRate(fields[2])
+			}
+		default:
+			parseTCTinRow(fields, cur)
+		}
+	}
+	flush()
+	return qdiscs
+}
+
+// parseTCTinRow fills one row of the CAKE per-tin table, e.g.
+// "pk_delay 2.1ms 8.2ms 950us"; the row width sets the number of tins
+func parseTCTinRow(fields []string, q *CakeQdisc) {
+	if len(fields) < 2 {
+		return
+	}
+	values := fields[1:]
+	set := func(f func(t *CakeTinStats, v string)) {
+		if len(q.Tins) == 0 {
+			q.Tins = make([]CakeTinStats, len(values))
+		}
+		for i, v := range values {
+			if i < len(q.Tins) {
+				f(&q.Tins[i], v)
+			}
+		}
+	}
+	usec := func(v string) uint32 {
+		us, _ := parseTCTime(v)
+		return us
+	}
+
+	switch fields[0] {
+	case "thresh":
+		set(func(t *CakeTinStats, v string) { t.ThresholdRateBps, _ = parseTCRate(v) })
+	case "target":
+		set(func(t *CakeTinStats, v string) { t.TargetUs = usec(v) })
+	case "interval":
+		set(func(t *CakeTinStats, v string) { t.IntervalUs = usec(v) })
+	case "pk_delay":
+		set(func(t *CakeTinStats, v string) { t.PeakDelayUs = usec(v) })
+	case "av_delay":
+		set(func(t *CakeTinStats, v string) { t.AvgDelayUs = usec(v) })
+	case "sp_delay":
+		set(func(t *CakeTinStats, v string) { t.BaseDelayUs = usec(v) })
+	case "backlog":
+		set(func(t *CakeTinStats, v string) { t.BacklogBytes = uint32(parseTCSize(v)) })
+	case "pkts":
+		set(func(t *CakeTinStats, v string) { t.SentPackets = parseUint32(v) })
+	case "bytes":
+		set(func(t *CakeTinStats, v string) { t.SentBytes, _ = strconv.ParseUint(v, 10, 64) })
+	case "way_inds":
+		set(func(t *CakeTinStats, v string) { t.WayIndirectHits = parseUint32(v) })
+	case "way_miss":
+		set(func(t *CakeTinStats, v string) { t.WayMisses = parseUint32(v) })
+	case "way_cols":
+		set(func(t *CakeTinStats, v string) { t.WayCollisions = parseUint32(v) })
+	case "drops":
+		set(func(t *CakeTinStats, v string) { t.Drops = parseUint32(v) })
+	case "marks":
+		set(func(t *CakeTinStats, v string) { t.ECNMarks = parseUint32(v) })
+	case "ack_drop":
+		set(func(t *CakeTinStats, v string) { t.AckDrops = parseUint32(v) })
+	case "sp_flows":
+		set(func(t *CakeTinStats, v string) { t.SparseFlows = parseUint32(v) })
+	case "bk_flows":
+		set(func(t *CakeTinStats, v string) { t.BulkFlows = parseUint32(v) })
+	case "un_flows":
+		set(func(t *CakeTinStats, v string) { t.UnresponsiveFlows = parseUint32(v) })
+	case "max_len":
+		set(func(t *CakeTinStats, v string) { t.MaxPktLen = parseUint32(v) })
+	case "quantum":
+		set(func(t *CakeTinStats, v string) { t.FlowQuantum = parseUint32(v) })
+	}
+}
+
+// parseTCQdiscHeader fills device, handle, parent and CAKE options from a
+// "qdisc cake 8001: dev eth0 root refcnt 2 bandwidth 100Mbit ... rtt 100ms" line
+func parseTCQdiscHeader(fields []string, q *CakeQdisc) {
+	if len(fields) >= 3 {
+		q.Handle = fields[2]
+	}
+	for i := 3; i < len(fields); i++ {
+		next := ""
+		if i+1 < len(fields) {
+			next = fields[i+1]
+		}
+		switch fields[i] {
+		case "dev":
+			q.Interface = next
+		case "root":
+			q.Parent = "root"
+		case "parent":
+			q.Parent = next
+		case "bandwidth":
+			q.BandwidthBps, _ = parseTCRate(next)
+		case "rtt":
+			if us, err := parseTCTime(next); err == nil {
+				q.RTTUs = us
+			}
+		}
+	}
+}
+
+// parseTCTime parses a tc time such as 100ms, 1.5s or 500us into microseconds
+func parseTCTime(s string) (uint32, error) {
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(s, "us"):
+		s = strings.TrimSuffix(s, "us")
+	case strings.HasSuffix(s, "ms"):
+		s, unit = strings.TrimSuffix(s, "ms"), 1e3
+	case strings.HasSuffix(s, "s"):
+		s, unit = strings.TrimSuffix(s, "s"), 1e6
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tc time %q", s)
+	}
+	return uint32(math.Round(v * unit)), nil
+}
+
+// parseTCRate parses a tc rate such as 100Mbit, 512Kbit or 1Gbit into bits/s
+func parseTCRate(s string) (uint64, error) {
+	if s == "unlimited" {
+		return 0, nil
+	}
+	mult := 1.0
+	lower := strings.ToLower(s)
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}} {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mult = strings.TrimSuffix(lower, u.suffix), u.mult
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(lower, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tc rate %q", s)
+	}
+	return uint64(v * mult), nil
+}
+
+// parseTCSize parses a tc size such as 145Kb or 4Mb into bytes, returning 0
+// when invalid
+func parseTCSize(s string) uint64 {
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "Gb"):
+		s, mult = strings.TrimSuffix(s, "Gb"), 1<<30
+	case strings.HasSuffix(s, "Mb"):
+		s, mult = strings.TrimSuffix(s, "Mb"), 1<<20
+	case strings.HasSuffix(s, "Kb"):
+		s, mult = strings.TrimSuffix(s, "Kb"), 1<<10
+	case strings.HasSuffix(s, "b"):
+		s = strings.TrimSuffix(s, "b")
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return uint64(v * mult)
+}
+
+// parseUint32 parses a decimal counter, returning 0 when invalid
+func parseUint32(s string) uint32 {
+	v, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(v)
+}
+
+// rtnetlink traffic control attributes (linux/rtnetlink.h, linux/pkt_sched.h,
+// linux/gen_stats.h)
+const (
+	tcMsgLen = 20
+	tcHRoot  = 0xFFFFFFFF
+
+	tcaKind    = 1
+	tcaOptions = 2
+	tcaStats2  = 7
+
+	tcaStatsBasic = 1
+	tcaStatsQueue = 3
+	tcaStatsApp   = 4
+
+	tcaCakeBaseRate64 = 2
+	tcaCakeRTT        = 7
+	tcaCakeTarget     = 8
+)
+
+// netlinkQdiscController talks rtnetlink directly, avoiding a fork of tc per
+// update and working with tc builds that lack CAKE support
+type netlinkQdiscController struct{}
+
+func (n *netlinkQdiscController) Name() string { return "netlink" }
+
+func (n *netlinkQdiscController) CakeQdiscs() ([]CakeQdisc, error) {
+	msgs, err := netlinkExecute(unix.NETLINK_ROUTE, unix.RTM_GETQDISC, unix.NLM_F_DUMP, make([]byte, tcMsgLen))
+	if err != nil {
+		return nil, fmt.Errorf("rtnetlink qdisc dump: %w", err)
+	}
+	return parseQdiscMessages(msgs, func(ifindex int) string {
+		if iface, err := net.InterfaceByIndex(ifindex); err == nil {
+			return iface.Name
+		}
+		return fmt.Sprintf("if%d", ifindex)
+	})
+}
+
+func (n *netlinkQdiscController) SetRTT(iface string, rttUs int) error {
+	if err := n.change(iface, cakeRTTOptions(rttUs)); err != nil {
+		return fmt.Errorf("rtnetlink change cake rtt on %s: %w", iface, err)
+	}
+	return nil
+}
+
+func (n *netlinkQdiscController) SetBandwidth(iface string, bps uint64) error {
+	// the kernel takes the rate in bytes/s
+	rate := make([]byte, 8)
+	binary.NativeEndian.PutUint64(rate, bps/8)
+	if err := n.change(iface, encodeNetlinkAttr(tcaCakeBaseRate64, rate)); err != nil {
+		return fmt.Errorf("rtnetlink change cake bandwidth on %s: %w", iface, err)
+	}
+	return nil
+}
+
+// cakeRTTOptions encodes the options "tc qdisc change ... cake rtt X" sends:
+// the interval and a target of X/20 (at least 1us). The kernel only updates
+// the target when the attribute is present.
+func cakeRTTOptions(rttUs int) []byte {
+	target := rttUs / 20
+	if target < 1 {
+		target = 1
+	}
+	rtt := make([]byte, 4)
+	binary.NativeEndian.PutUint32(rtt, uint32(rttUs))
+	tgt := make([]byte, 4)
+	binary.NativeEndian.PutUint32(tgt, uint32(target))
+	return append(encodeNetlinkAttr(tcaCakeRTT, rtt), encodeNetlinkAttr(tcaCakeTarget, tgt)...)
+}
+
+// change sends the given TCA_CAKE_* options to the root qdisc of iface
+func (n *netlinkQdiscController) change(iface string, options []byte) error {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("interface %s: %w", iface, err)
+	}
+	_, err = netlinkExecute(unix.NETLINK_ROUTE, unix.RTM_NEWQDISC, unix.NLM_F_ACK,
+		buildCakeChangeRequest(link.Index, options))
+	return err
+}
+
+// buildCakeChangeRequest encodes the RTM_NEWQDISC payload equivalent to
+// "tc qdisc change root dev <iface> cake ..." with the given encoded
+// TCA_CAKE_* options. Without NLM_F_CREATE/NLM_F_REPLACE the kernel only
+// changes the attributes given.
+func buildCakeChangeRequest(ifindex int, options []byte) []byte {
+	tcm := make([]byte, tcMsgLen)
+	tcm[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(tcm[4:8], uint32(ifindex))
+	binary.NativeEndian.PutUint32(tcm[12:16], tcHRoot)
+
+	payload := append(tcm, encodeNetlinkAttr(tcaKind, []byte("cake\x00"))...)
+	return append(payload, encodeNetlinkAttr(tcaOptions|unix.NLA_F_NESTED, options)...)
+}
+
+// parseQdiscMessages decodes the CAKE entries of an RTM_GETQDISC dump;
+// ifname resolves interface indexes to names
+func parseQdiscMessages(msgs []netlinkMessage, ifname func(int) string) ([]CakeQdisc, error) {
+	var qdiscs []CakeQdisc
+	for _, m := range msgs {
+		if m.Type != unix.RTM_NEWQDISC {
+			continue
+		}
+		if len(m.Data) < tcMsgLen {
+			return nil, fmt.Errorf("rtnetlink: truncated tcmsg")
+		}
+		attrs, err := parseNetlinkAttrs(m.Data[tcMsgLen:])
+		if err != nil {
+			return nil, err
+		}
+		if kind := attrValue(attrs, tcaKind); strings.TrimRight(string(kind), "\x00") != "cake" {
+			continue
+		}
+
+		ifindex := int(int32(binary.NativeEndian.Uint32(m.Data[4:8])))
+		handle := binary.NativeEndian.Uint32(m.Data[8:12])
+		parent := binary.NativeEndian.Uint32(m.Data[12:16])
+		q := CakeQdisc{
+			Interface: ifname(ifindex),
+			Handle:    fmt.Sprintf("%x:", handle>>16),
+			Parent:    "root",
+		}
+		if parent != tcHRoot {
+			q.Parent = fmt.Sprintf("%x:%x", parent>>16, parent&0xffff)
+		}
+
+		if opts := attrValue(attrs, tcaOptions); opts != nil {
+			if err := parseCakeOptions(opts, &q); err != nil {
+				return nil, err
+			}
+		}
+		if stats := attrValue(attrs, tcaStats2); stats != nil {
+			if err := parseQdiscStats2(stats, &q); err != nil {
+				return nil, err
+			}
+		}
+
+		q.Summary = formatCakeQdisc(q)
+		qdiscs = append(qdiscs, q)
+	}
+	return qdiscs, nil
+}
+
+// attrValue returns the value of the first attribute of the given type
+func attrValue(attrs []netlinkAttr, attrType uint16) []byte {
+	for _, a := range attrs {
+		if a.Type == attrType {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// parseCakeOptions decodes the TCA_CAKE_* attributes in TCA_OPTIONS
+func parseCakeOptions(b []byte, q *CakeQdisc) error {
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case tcaCakeBaseRate64:
+			if len(a.Value) >= 8 {
+				// the kernel stores the rate in bytes/s
+				q.BandwidthBps = binary.NativeEndian.Uint64(a.Value) * 8
+			}
+		case tcaCakeRTT:
+			if len(a.Value) >= 4 {
+				q.RTTUs = binary.NativeEndian.Uint32(a.Value)
+			}
+		case tcaCakeTarget:
+			if len(a.Value) >= 4 {
+				q.TargetUs = binary.NativeEndian.Uint32(a.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// parseQdiscStats2 decodes gnet_stats_basic, gnet_stats_queue and the CAKE
+// extended statistics (TCA_STATS_APP) from TCA_STATS2
+func parseQdiscStats2(b []byte, q *CakeQdisc) error {
+	attrs, err := parseNetlinkAttrs(b)
+	if err != nil {
+		return err
+	}
+	for _, a := range attrs {
+		switch a.Type {
+		case tcaStatsBasic:
+			// struct gnet_stats_basic { __u64 bytes; __u32 packets; }
+			if len(a.Value) >= 12 {
+				q.Bytes = binary.NativeEndian.Uint64(a.Value[0:8])
+				q.Packets = uint64(binary.NativeEndian.Uint32(a.Value[8:12]))
+			}
+		case tcaStatsQueue:
+			// struct gnet_stats_queue { qlen, backlog, drops, requeues, overlimits }
+			if len(a.Value) >= 20 {
+				q.BacklogPkts = binary.NativeEndian.Uint32(a.Value[0:4])
+				q.BacklogBytes = binary.NativeEndian.Uint32(a.Value[4:8])
+				q.Drops = binary.NativeEndian.Uint32(a.Value[8:12])
+				q.Requeues = binary.NativeEndian.Uint32(a.Value[12:16])
+				q.Overlimits = binary.NativeEndian.Uint32(a.Value[16:20])
+			}
+		case tcaStatsApp:
+			if err := parseCakeXstats(a.Value, q); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatCakeQdisc renders the tc-style header line for q, so netlink and tc
+// JSON results display like plain tc output
+func formatCakeQdisc(q CakeQdisc) string {
+	parent := "root"
+	if q.Parent != "root" {
+		parent = "parent " + q.Parent
+	}
+	return fmt.Sprintf("qdisc cake %s dev %s %s bandwidth %s rtt %s", q.Handle, q.Interface, parent,
+		formatTCRate(q.BandwidthBps), formatRTTUs(int64(q.RTTUs)))
+}
+
+// formatTCRate formats bits/s like tc (e.g. 100Mbit); 0 means unlimited
+func formatTCRate(bps uint64) string {
+	switch {
+	case bps == 0:
+		return "unlimited"
+	case bps >= 1e9 && bps%1e6 == 0:
+		return strconv.FormatFloat(float64(bps)/1e9, 'f', -1, 64) + "Gbit"
+	case bps >= 1e6:
+		return strconv.FormatFloat(float64(bps)/1e6, 'f', -1, 64) + "Mbit"
+	case bps >= 1e3:
+		return strconv.FormatFloat(float64(bps)/1e3, 'f', -1, 64) + "Kbit"
+	}
+	return fmt.Sprintf("%dbit", bps)
+}
+
+// formatRTTUs renders an RTT for display: whole milliseconds, or microseconds
+// below 1ms
+func formatRTTUs(us int64) string {
+	if us < 1000 {
+		return fmt.Sprintf("%dus", us)
+	}
+	return fmt.Sprintf("%dms", int64(math.Round(float64(us)/1000)))
+}
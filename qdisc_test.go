@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeQdiscController is a QdiscController returning canned qdiscs and
+// recording RTT changes
+type fakeQdiscController struct {
+	mu         sync.Mutex
+	qdiscs     []CakeQdisc
+	changes    map[string]int
+	bandwidths map[string]uint64
+	err        error
+}
+
+func (f *fakeQdiscController) Name() string { return "fake" }
+
+func (f *fakeQdiscController) CakeQdiscs() ([]CakeQdisc, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]CakeQdisc(nil), f.qdiscs...), f.err
+}
+
+func (f *fakeQdiscController) SetRTT(iface string, rttUs int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if f.changes == nil {
+		f.changes = make(map[string]int)
+	}
+	f.changes[iface] = rttUs
+	for i := range f.qdiscs {
+		if f.qdiscs[i].Interface == iface {
+			f.qdiscs[i].RTTUs = uint32(rttUs)
+		}
+	}
+	return nil
+}
+
+func (f *fakeQdiscController) SetBandwidth(iface string, bps uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	if f.bandwidths == nil {
+		f.bandwidths = make(map[string]uint64)
+	}
+	f.bandwidths[iface] = bps
+	for i := range f.qdiscs {
+		if f.qdiscs[i].Interface == iface {
+			f.qdiscs[i].BandwidthBps = bps
+		}
+	}
+	return nil
+}
+
+// addBytes advances the byte counter of iface, simulating traffic
+func (f *fakeQdiscController) addBytes(iface string, n uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.qdiscs {
+		if f.qdiscs[i].Interface == iface {
+			f.qdiscs[i].Bytes += n
+		}
+	}
+}
+
+const tcQdiscSample = `qdisc noqueue 0: dev lo root refcnt 2
+ Sent 0 bytes 0 pkt (dropped 0, overlimits 0 requeues 0)
+ backlog 0b 0p requeues 0
+qdisc cake 8001: dev eth0 root refcnt 2 bandwidth 20Mbit diffserv3 triple-isolate nonat nowash no-ack-filter split-gso rtt 100ms noatm overhead 18 mpu 64
+ Sent 123456789 bytes 234567 pkt (dropped 12, overlimits 3456 requeues 7)
+ backlog 1514b 1p requeues 7
+ memory used: 145Kb of 4Mb
+ capacity estimate: 20Mbit
+qdisc ingress ffff: dev eth0 parent ffff:fff1 ----------------
+ Sent 98765 bytes 321 pkt (dropped 0, overlimits 0 requeues 0)
+ backlog 0b 0p requeues 0
+qdisc cake 8002: dev ifb4eth0 root refcnt 2 bandwidth 100Mbit besteffort triple-isolate nonat wash no-ack-filter split-gso rtt 45.5ms noatm overhead 18
+ Sent 987654321 bytes 765432 pkt (dropped 99, overlimits 1 requeues 0)
+ backlog 0b 0p requeues 0
+`
+
+func TestParseTCQdiscOutput(t *testing.T) {
+	qdiscs := parseTCQdiscOutput([]byte(tcQdiscSample))
+	if len(qdiscs) != 2 {
+		t.Fatalf("expected 2 cake qdiscs, got %d: %+v", len(qdiscs), qdiscs)
+	}
+
+	eth0 := qdiscs[0]
+	if eth0.Interface != "eth0" || eth0.Handle != "8001:" || eth0.Parent != "root" ||
+		eth0.BandwidthBps != 20e6 || eth0.RTTUs != 100000 {
+		t.Fatalf("unexpected eth0 header: %+v", eth0)
+	}
+	if eth0.Bytes != 123456789 || eth0.Packets != 234567 || eth0.Drops != 12 || eth0.Overlimits != 3456 ||
+		eth0.Requeues != 7 || eth0.BacklogBytes != 1514 || eth0.BacklogPkts != 1 {
+		t.Fatalf("unexpected eth0 counters: %+v", eth0)
+	}
+	if eth0.Summary[:10] != "qdisc cake" {
+		t.Fatalf("expected summary: %+v", eth0)
+	}
+
+	if qdiscs[1].Interface != "ifb4eth0" || qdiscs[1].RTTUs != 45500 || qdiscs[1].BandwidthBps != 100e6 {
+		t.Fatalf("unexpected ifb qdisc: %+v", qdiscs[1])
+	}
+}
+
+// cannedQdiscMsg encodes an RTM_NEWQDISC dump entry as the kernel would send
+// it; app is the optional TCA_STATS_APP payload
+func cannedQdiscMsg(kind string, ifindex int, handle, parent uint32, rateBytes uint64, rttUs uint32, app []byte) []byte {
+	tcm := make([]byte, tcMsgLen)
+	binary.NativeEndian.PutUint32(tcm[4:8], uint32(ifindex))
+	binary.NativeEndian.PutUint32(tcm[8:12], handle)
+	binary.NativeEndian.PutUint32(tcm[12:16], parent)
+
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.NativeEndian.PutUint32(b, v)
+		return b
+	}
+	rate := make([]byte, 8)
+	binary.NativeEndian.PutUint64(rate, rateBytes)
+
+	basic := make([]byte, 16)
+	binary.NativeEndian.PutUint64(basic[0:8], 5000)
+	binary.NativeEndian.PutUint32(basic[8:12], 40)
+	var queue []byte
+	for _, v := range []uint32{2, 3000, 5, 1, 9} {
+		queue = append(queue, u32(v)...)
+	}
+
+	payload := append(tcm, encodeNetlinkAttr(tcaKind, []byte(kind+"\x00"))...)
+	opts := append(encodeNetlinkAttr(tcaCakeBaseRate64, rate), encodeNetlinkAttr(tcaCakeRTT, u32(rttUs))...)
+	opts = append(opts, encodeNetlinkAttr(tcaCakeTarget, u32(5000))...)
+	payload = append(payload, encodeNetlinkAttr(tcaOptions|unix.NLA_F_NESTED, opts)...)
+	stats := append(encodeNetlinkAttr(tcaStatsBasic, basic), encodeNetlinkAttr(tcaStatsQueue, queue)...)
+	if app != nil {
+		stats = append(stats, encodeNetlinkAttr(tcaStatsApp|unix.NLA_F_NESTED, app)...)
+	}
+	payload = append(payload, encodeNetlinkAttr(tcaStats2|unix.NLA_F_NESTED, stats)...)
+	return encodeNetlinkMessage(unix.RTM_NEWQDISC, unix.NLM_F_MULTI, 1, payload)
+}
+
+func TestParseQdiscMessages(t *testing.T) {
+	var dump []byte
+	dump = append(dump, cannedQdiscMsg("fq_codel", 1, 0, tcHRoot, 0, 0, nil)...)
+	dump = append(dump, cannedQdiscMsg("cake", 2, 0x80010000, tcHRoot, 2500000, 100000, nil)...)
+	dump = append(dump, cannedQdiscMsg("cake", 3, 0x80020000, 0x00010001, 0, 30000, nil)...)
+
+	msgs, err := parseNetlinkMessages(dump)
+	if err != nil {
+		t.Fatalf("parse messages: %v", err)
+	}
+	qdiscs, err := parseQdiscMessages(msgs, func(i int) string { return fmt.Sprintf("eth%d", i) })
+	if err != nil {
+		t.Fatalf("parse qdiscs: %v", err)
+	}
+	if len(qdiscs) != 2 {
+		t.Fatalf("expected 2 cake qdiscs, got %d", len(qdiscs))
+	}
+
+	q := qdiscs[0]
+	if q.Interface != "eth2" || q.Handle != "8001:" || q.Parent != "root" || q.BandwidthBps != 20e6 ||
+		q.RTTUs != 100000 || q.TargetUs != 5000 {
+		t.Fatalf("unexpected options: %+v", q)
+	}
+	if q.Bytes != 5000 || q.Packets != 40 || q.BacklogPkts != 2 || q.BacklogBytes != 3000 ||
+		q.Drops != 5 || q.Requeues != 1 || q.Overlimits != 9 {
+		t.Fatalf("unexpected counters: %+v", q)
+	}
+	if q.Summary != "qdisc cake 8001: dev eth2 root bandwidth 20Mbit rtt 100ms" {
+		t.Fatalf("unexpected summary: %q", q.Summary)
+	}
+
+	if qdiscs[1].Parent != "1:1" || qdiscs[1].BandwidthBps != 0 {
+		t.Fatalf("unexpected child qdisc: %+v", qdiscs[1])
+	}
+}
+
+func TestBuildCakeChangeRequest(t *testing.T) {
+	req := buildCakeChangeRequest(7, cakeRTTOptions(42000))
+	if ifindex := binary.NativeEndian.Uint32(req[4:8]); ifindex != 7 {
+		t.Fatalf("unexpected ifindex %d", ifindex)
+	}
+	if parent := binary.NativeEndian.Uint32(req[12:16]); parent != tcHRoot {
+		t.Fatalf("unexpected parent %#x", parent)
+	}
+	attrs, err := parseNetlinkAttrs(req[tcMsgLen:])
+	if err != nil {
+		t.Fatalf("parse attrs: %v", err)
+	}
+	if string(attrValue(attrs, tcaKind)) != "cake\x00" {
+		t.Fatalf("unexpected kind %q", attrValue(attrs, tcaKind))
+	}
+	var q CakeQdisc
+	if err := parseCakeOptions(attrValue(attrs, tcaOptions), &q); err != nil || q.RTTUs != 42000 || q.TargetUs != 2100 {
+		t.Fatalf("unexpected options: %+v, %v", q, err)
+	}
+
+	// Like tc, the target never drops below 1us
+	attrs, _ = parseNetlinkAttrs(buildCakeChangeRequest(7, cakeRTTOptions(10))[tcMsgLen:])
+	q = CakeQdisc{}
+	if err := parseCakeOptions(attrValue(attrs, tcaOptions), &q); err != nil || q.RTTUs != 10 || q.TargetUs != 1 {
+		t.Fatalf("unexpected options for a tiny rtt: %+v, %v", q, err)
+	}
+}
+
+func TestTCUnitParsing(t *testing.T) {
+	for in, want := range map[string]uint32{"100ms": 100000, "1.5s": 1500000, "500us": 500, "45.5ms": 45500} {
+		if got, err := parseTCTime(in); err != nil || got != want {
+			t.Fatalf("parseTCTime(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for in, want := range map[string]uint64{"100Mbit": 100e6, "1Gbit": 1e9, "512Kbit": 512e3, "unlimited": 0} {
+		if got, err := parseTCRate(in); err != nil || got != want {
+			t.Fatalf("parseTCRate(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if formatTCRate(20e6) != "20Mbit" || formatTCRate(1e9) != "1Gbit" || formatTCRate(0) != "unlimited" {
+		t.Fatalf("unexpected rate formatting")
+	}
+}
+
+func TestAdjustCakeRTTUsesQdiscController(t *testing.T) {
+	fake := &fakeQdiscController{qdiscs: []CakeQdisc{{Interface: "eth0"}, {Interface: "ifb4eth0"}}}
+	s := &CakeAutoRTTService{
+		config: &Config{RTTMarginPercent: 10},
+		qdisc:  fake,
+	}
+	if err := s.autoDetectInterfaces(s.config); err != nil {
+		t.Fatalf("auto-detect: %v", err)
+	}
+	if s.config.DLInterface != "ifb4eth0" || s.config.ULInterface != "eth0" {
+		t.Fatalf("unexpected interfaces: dl=%s ul=%s", s.config.DLInterface, s.config.ULInterface)
+	}
+
+	targets, err := newRTTTargets(s.config, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	for _, target := range targets {
+		if err := s.adjustTargetRTT(target, 50, true, 3); err != nil {
+			t.Fatalf("adjust: %v", err)
+		}
+	}
+	if fake.changes["eth0"] != 55000 || fake.changes["ifb4eth0"] != 55000 {
+		t.Fatalf("unexpected rtt changes: %v", fake.changes)
+	}
+}
+
+func TestNewQdiscControllerSelection(t *testing.T) {
+	if c, err := NewQdiscController("exec"); err != nil || c.Name() != "exec" {
+		t.Fatalf("exec: got %v, %v", c, err)
+	}
+	if c, err := NewQdiscController("netlink"); err != nil || c.Name() != "netlink" {
+		t.Fatalf("netlink: got %v, %v", c, err)
+	}
+	if _, err := NewQdiscController("bogus"); err == nil {
+		t.Fatalf("expected error for unknown backend")
+	}
+}
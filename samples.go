@@ -0,0 +1,62 @@
+package main
+
+import "math"
+
+// maxProbeSamples caps probe_samples so one host cannot hold a worker for
+// a whole cycle
+const maxProbeSamples = 20
+
+// ProbeSampleStats summarizes the samples taken of one host in a cycle
+type ProbeSampleStats struct {
+	Samples  int     `json:"samples"`
+	Lost     int     `json:"lost"`
+	MinMs    float64 `json:"min_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	JitterMs float64 `json:"jitter_ms"`
+}
+
+// summarizeSamples computes min/avg/max and the jitter, taken as the mean
+// absolute difference of consecutive samples (as RFC 3550 interarrival
+// jitter without the smoothing)
+func summarizeSamples(rtts []float64, lost int) ProbeSampleStats {
+	st := ProbeSampleStats{Samples: len(rtts), Lost: lost}
+	if len(rtts) == 0 {
+		return st
+	}
+	st.MinMs, st.MaxMs = rtts[0], rtts[0]
+	sum, diffs := 0.0, 0.0
+	for i, r := range rtts {
+		sum += r
+		st.MinMs = math.Min(st.MinMs, r)
+		st.MaxMs = math.Max(st.MaxMs, r)
+		if i > 0 {
+			diffs += math.Abs(r - rtts[i-1])
+		}
+	}
+	st.AvgMs = sum / float64(len(rtts))
+	if len(rtts) > 1 {
+		st.JitterMs = diffs / float64(len(rtts)-1)
+	}
+	return st
+}
+
+// hostRTTMs is the RTT a host contributes to the aggregate: its minimum,
+// the sample closest to propagation delay, plus the jitter when requested
+func (st ProbeSampleStats) hostRTTMs(addJitter bool) float64 {
+	if addJitter {
+		return st.MinMs + st.JitterMs
+	}
+	return st.MinMs
+}
+
+// clampProbeSamples bounds probe_samples to 1..maxProbeSamples
+func clampProbeSamples(n int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > maxProbeSamples {
+		return maxProbeSamples
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSummarizeSamples(t *testing.T) {
+	st := summarizeSamples([]float64{30, 20, 24, 22}, 1)
+	if st.Samples != 4 || st.Lost != 1 || st.MinMs != 20 || st.MaxMs != 30 || st.AvgMs != 24 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	// |20-30| + |24-20| + |22-24| over 3 differences
+	if st.JitterMs != 16.0/3 {
+		t.Fatalf("unexpected jitter %v", st.JitterMs)
+	}
+	if st.hostRTTMs(false) != 20 || st.hostRTTMs(true) != 20+16.0/3 {
+		t.Fatalf("unexpected host RTT")
+	}
+	if one := summarizeSamples([]float64{15}, 0); one.JitterMs != 0 || one.MinMs != 15 {
+		t.Fatalf("unexpected single-sample stats: %+v", one)
+	}
+	if clampProbeSamples(0) != 1 || clampProbeSamples(50) != maxProbeSamples {
+		t.Fatalf("unexpected probe_samples clamp")
+	}
+}
+
+func TestProbeHostsTakesMinimumOfSamples(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ProbeSamples = 3
+	cfg.ProbeSampleIntervalMs = 1
+	cfg.RTTOutlierRejection = "none"
+	s := &CakeAutoRTTService{config: cfg, currentProbes: make(map[string]ProbeStatus),
+		completedMaxEntries: 50, completedRetentionSec: 60}
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[host]++
+		switch host {
+		case "dead":
+			return 0, "", errors.New("connection timed out")
+		case "lossy":
+			if calls[host] == 2 {
+				return 0, "", errors.New("connection timed out")
+			}
+		}
+		return []time.Duration{40, 25, 31}[calls[host]-1] * time.Millisecond, "tcp", nil
+	}
+
+	samples, _ := s.probeHosts(context.Background(), *cfg, []string{"steady", "lossy", "dead"}, ProbeBinding{})
+	got := make(map[string]float64)
+	for _, smp := range samples {
+		got[smp.Host] = smp.RTTMs
+	}
+	if len(got) != 2 || got["steady"] != 25 || got["lossy"] != 31 {
+		t.Fatalf("expected per-host minimum RTTs, got %v", got)
+	}
+	if calls["dead"] != 1 || calls["steady"] != 3 || calls["lossy"] != 3 {
+		t.Fatalf("unexpected probe counts: %v", calls)
+	}
+
+	stats := make(map[string]*ProbeSampleStats)
+	for _, p := range s.GetRecentCompletedProbes() {
+		stats[p.Host] = p.Samples
+	}
+	if st := stats["steady"]; st == nil || st.Samples != 3 || st.MinMs != 25 || st.MaxMs != 40 || st.JitterMs != 10.5 {
+		t.Fatalf("unexpected steady stats: %+v", st)
+	}
+	if st := stats["lossy"]; st == nil || st.Samples != 2 || st.Lost != 1 {
+		t.Fatalf("unexpected lossy stats: %+v", st)
+	}
+
+	// With jitter added, a host contributes min + jitter
+	cfg.ProbeSampleAddJitter = true
+	calls = make(map[string]int)
+	samples, _ = s.probeHosts(context.Background(), *cfg, []string{"steady"}, ProbeBinding{})
+	if len(samples) != 1 || samples[0].RTTMs != 35.5 {
+		t.Fatalf("expected min plus jitter, got %+v", samples)
+	}
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
-	"os/exec"
-	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,7 +24,6 @@ type CakeAutoRTTService struct {
 	config      *Config
 	running     bool
 	mutex       sync.RWMutex
-	lastRTT     map[string]int
 	activeHosts int
 	lastUpdate  time.Time
 	ctx         context.Context
@@ -38,8 +38,10 @@ type CakeAutoRTTService struct {
 	currentProbeCache *fastcache.Cache
 	// bounded queue of current probe keys (hosts) to allow iteration of recent/current probes
 	currentProbeQueue []string
-	// injectable probe function for testing (host, timeoutSec) -> (rtt, error)
-	ProbeFunc func(host string, timeoutSec int) (time.Duration, error)
+	// injectable probe function for testing (cycle ctx, host, timeoutSec, uplink binding) -> (rtt, probe kind, error)
+	ProbeFunc func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error)
+	// injectable uplink prefix lookup used to attribute conntrack hosts to a WAN
+	uplinkNets func(name string) ([]*net.IPNet, error)
 	// adaptive worker cap managed by background controller
 	adaptiveWorkers int
 	// completed probes buffer (recent finished probes for UI). protected by probeMutex
@@ -48,8 +50,16 @@ type CakeAutoRTTService struct {
 	completedRetentionSec int
 	// max completed entries to retain
 	completedMaxEntries int
-	// cpuReader is injectable for tests; returns total,idle or error
-	cpuReader func() (uint64, uint64, error)
+	// cpuReader is injectable for tests; returns the aggregate /proc/stat counters
+	cpuReader func() (cpuTimes, error)
+	// loadReader and psiReader are optional (nil skips the signal); they return
+	// the 1-minute load per CPU and the memory PSI some avg10
+	loadReader func() (float64, error)
+	psiReader  func() (float64, error)
+	// bounds probes in flight to probeWorkerCap, shared by all probe pools
+	probeSlots probeLimiter
+	// last adaptive controller sample and decision. protected by mutex
+	adaptive AdaptiveStatus
 	// cpu sampling interval used by adaptive controller (injectable for tests)
 	cpuSampleInterval time.Duration
 	// fastcache-backed storage for recent logs
@@ -60,6 +70,49 @@ type CakeAutoRTTService struct {
 	recentLogsMaxEntries int
 	// atomic sequence for log keys
 	recentLogSeq uint64
+	// per-host traffic weights from the last conntrack scan (flow counts). protected by mutex
+	hostWeights map[string]float64
+	// per-host TCP destination ports from the last conntrack scan, busiest first. protected by mutex
+	hostPorts map[string][]uint16
+	// last TCP port that answered a probe, per host, kept across cycles
+	portCache probePortCache
+	// per-host probe history for backoff and stable-host preference, kept across cycles
+	hostHealth hostHealthTable
+	// counters and histograms for /metrics
+	metrics serviceMetrics
+	// persistent RTT and tin delay history for /api/history, nil when disabled
+	history *historyStore
+	// statistics from the most recent RTT aggregation, overall and per address family. protected by mutex
+	lastRTTStats    *RTTStats
+	lastFamilyStats map[string]RTTStats
+	// user-defined include/exclude destination rules. protected by mutex
+	destRules *destRules
+	// configured LAN clients, and the same with MAC selectors resolved through
+	// the neighbour table at the start of each cycle. protected by mutex
+	clients         *clientSet
+	resolvedClients *clientSet
+	// injectable neighbour table dump for MAC client selectors
+	neighborTable func() ([]neighborEntry, error)
+	// router-local prefixes excluded from probing, refreshed every cycle
+	localNets atomic.Pointer[[]*net.IPNet]
+	// injectable interface address lookup for local prefix detection
+	interfaceAddrs func() ([]net.Addr, error)
+	// managed interfaces with their own host filter, smoothing, gate and history. protected by mutex
+	targets []*rttTarget
+	// set once ICMP sockets turn out to be unavailable so auto mode stops trying them
+	icmpUnavailable atomic.Bool
+	// conntrack backend (ctnetlink or procfs) chosen at startup; injectable for tests
+	conntrackSource ConntrackSource
+	// qdisc controller (rtnetlink or tc exec) chosen at startup; injectable for tests
+	qdisc QdiscController
+	// bandwidth autorate controller; nil when autorate is disabled. protected by mutex
+	autorate *autorateController
+	// set while a measurement cycle runs so overlapping ticks are skipped
+	cycleRunning atomic.Bool
+	// cancels the in-flight cycle, e.g. on config reload. protected by mutex
+	cycleCancel context.CancelFunc
+	// cycle durations and outcome counters. protected by mutex
+	cycles CycleStatus
 }
 
 // LogEntry represents a log entry
@@ -71,20 +124,41 @@ type LogEntry struct {
 
 // SystemStatus represents the current system status
 type SystemStatus struct {
-	Running     bool           `json:"running"`
-	LastUpdate  time.Time      `json:"last_update"`
-	CurrentRTT  map[string]int `json:"current_rtt"`
-	ActiveHosts int            `json:"active_hosts"`
-	DLInterface string         `json:"dl_interface"`
-	ULInterface string         `json:"ul_interface"`
-	Config      *Config        `json:"config"`
+	Running    bool      `json:"running"`
+	LastUpdate time.Time `json:"last_update"`
+	// CurrentRTT is the RTT state and history of each managed interface
+	CurrentRTT       map[string]InterfaceRTTStatus `json:"current_rtt"`
+	ActiveHosts      int                           `json:"active_hosts"`
+	DLInterface      string                        `json:"dl_interface"`
+	ULInterface      string                        `json:"ul_interface"`
+	Config           *Config                       `json:"config"`
+	RTTStats         *RTTStats                     `json:"rtt_stats,omitempty"`
+	RTTStatsByFamily map[string]RTTStats           `json:"rtt_stats_by_family,omitempty"`
+	RTTUpdates       RTTUpdateStats                `json:"rtt_updates"`
+	ConntrackBackend string                        `json:"conntrack_backend"`
+	QdiscBackend     string                        `json:"qdisc_backend"`
+	Autorate         *AutorateStatus               `json:"autorate,omitempty"`
+	Cycles           CycleStatus                   `json:"cycles"`
+	Adaptive         *AdaptiveStatus               `json:"adaptive,omitempty"`
+}
+
+// RTTUpdateStats summarizes the smoothing stage and how many qdisc updates
+// were applied or skipped by the dead-band/hold gate
+type RTTUpdateStats struct {
+	Smoothing      string  `json:"smoothing"`
+	SmoothedMs     float64 `json:"smoothed_ms"`
+	AppliedUs      int     `json:"applied_us"`
+	Applied        uint64  `json:"applied"`
+	Skipped        uint64  `json:"skipped"`
+	LastSkipReason string  `json:"last_skip_reason,omitempty"`
 }
 
 // RTTMeasurement represents a single RTT measurement
 type RTTMeasurement struct {
-	Host string
-	RTT  time.Duration
-	Err  error
+	Host  string
+	RTT   time.Duration
+	Probe string
+	Err   error
 }
 
 // ProbeStatus represents the current state of a probe for the UI
@@ -93,6 +167,10 @@ type ProbeStatus struct {
 	Stage string `json:"stage"`
 	RTTMs int    `json:"rtt_ms,omitempty"`
 	Error string `json:"error,omitempty"`
+	// Reason explains why a completed probe was left out of the aggregate
+	Reason string `json:"reason,omitempty"`
+	// Samples holds per-host statistics when probe_samples is above 1
+	Samples *ProbeSampleStats `json:"samples,omitempty"`
 }
 
 // CompletedProbe holds a probe result with a timestamp for time-based retention
@@ -103,11 +181,16 @@ type CompletedProbe struct {
 
 // NewCakeAutoRTTService creates a new service instance
 func NewCakeAutoRTTService(config *Config) (*CakeAutoRTTService, error) {
+	// The service works on its own copy: auto-detection fills in the
+	// interfaces and reloads swap in a new one, while the caller's struct is
+	// shared with the web server
+	cfg := *config
+	config = &cfg
+
 	ctx, cancel := context.WithCancel(context.Background())
 	service := &CakeAutoRTTService{
 		config:     config,
 		running:    false,
-		lastRTT:    make(map[string]int),
 		lastUpdate: time.Now().Local(),
 		ctx:        ctx,
 		cancel:     cancel,
@@ -119,11 +202,28 @@ func NewCakeAutoRTTService(config *Config) (*CakeAutoRTTService, error) {
 		currentProbesMaxEntries: 100, // limit snapshot size by default
 		currentProbeCache:       fastcache.New(32 << 20),
 		currentProbeQueue:       make([]string, 0, 100),
+		hostWeights:             make(map[string]float64),
 	}
 
-	// default probe function uses the internal TCP probe implementation
-	service.ProbeFunc = func(h string, timeoutSec int) (time.Duration, error) {
-		return service.measureSingleHostTCP(h, timeoutSec)
+	// Fail fast on bad aggregation, smoothing, probing, ranking, outlier,
+	// prefix, destination filter or client settings rather than on the first cycle
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	rules, err := newDestRules(config)
+	if err != nil {
+		return nil, err
+	}
+	service.destRules = rules
+	clients, err := newClientSet(config)
+	if err != nil {
+		return nil, err
+	}
+	service.clients = clients
+
+	// default probe function dispatches to the TCP/ICMP probers per probe_method
+	service.ProbeFunc = func(ctx context.Context, h string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		return service.measureSingleHost(ctx, h, timeoutSec, bind)
 	}
 
 	// initialize adaptive worker cap to configured max
@@ -135,37 +235,29 @@ func NewCakeAutoRTTService(config *Config) (*CakeAutoRTTService, error) {
 	service.completedRetentionSec = 5 // keep completed probes visible for 5s by default
 	service.completedMaxEntries = 50  // keep up to 50 completed entries
 
+	// Select the conntrack backend once; auto prefers ctnetlink over procfs
+	conntrackSource, err := NewConntrackSource(config.ConntrackBackend)
+	if err != nil {
+		return nil, err
+	}
+	service.conntrackSource = conntrackSource
+	service.AddLog("INFO", fmt.Sprintf("Using %s conntrack backend", conntrackSource.Name()))
+
+	// Select the qdisc controller once; auto prefers rtnetlink over forking tc
+	qdisc, err := NewQdiscController(config.QdiscBackend)
+	if err != nil {
+		return nil, err
+	}
+	service.qdisc = qdisc
+	service.AddLog("INFO", fmt.Sprintf("Using %s qdisc backend", qdisc.Name()))
+
 	// Start adaptive controller in background (best-effort; will no-op if /proc not available)
 	if service.config.AdaptiveControllerEnabled {
-		// default cpu reader reads /proc/stat
-		service.cpuReader = func() (uint64, uint64, error) {
-			data, err := os.ReadFile("/proc/stat")
-			if err != nil {
-				return 0, 0, err
-			}
-			lines := strings.Split(string(data), "\n")
-			if len(lines) == 0 {
-				return 0, 0, fmt.Errorf("unexpected /proc/stat format")
-			}
-			fields := strings.Fields(lines[0])
-			if len(fields) < 5 || fields[0] != "cpu" {
-				return 0, 0, fmt.Errorf("unexpected /proc/stat format")
-			}
-			var total uint64
-			var idle uint64
-			for i := 1; i < len(fields); i++ {
-				var v uint64
-				_, err := fmt.Sscan(fields[i], &v)
-				if err != nil {
-					return 0, 0, err
-				}
-				total += v
-				if i == 4 {
-					idle = v
-				}
-			}
-			return total, idle, nil
-		}
+		// default readers use /proc/stat, /proc/loadavg and /proc/pressure/memory
+		service.cpuReader = readCPUTimes
+		ncpu := runtime.NumCPU()
+		service.loadReader = func() (float64, error) { return readLoadPerCPU(ncpu) }
+		service.psiReader = readMemoryPressure
 		// default sample interval
 		service.cpuSampleInterval = 2 * time.Second
 		go service.startAdaptiveController()
@@ -175,13 +267,77 @@ func NewCakeAutoRTTService(config *Config) (*CakeAutoRTTService, error) {
 	go service.startCompletedPruner()
 
 	// Auto-detect interfaces if not specified
-	if err := service.autoDetectInterfaces(); err != nil {
+	if err := service.autoDetectInterfaces(config); err != nil {
 		return nil, fmt.Errorf("failed to auto-detect interfaces: %w", err)
 	}
 
+	// Per-interface RTT state; without an interfaces list this is the detected DL/UL pair
+	targets, err := newRTTTargets(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	service.targets = targets
+
+	// Reload the history of the managed interfaces; a damaged file only costs the history
+	if config.HistoryEnabled {
+		names := make([]string, len(targets))
+		for i, t := range targets {
+			names[i] = t.Name
+		}
+		service.history = newHistoryStore(config.HistoryFile, config.HistoryMaxBytes)
+		if err := service.history.load(names); err != nil {
+			service.AddLog("WARN", fmt.Sprintf("%v, starting with an empty history", err))
+		}
+	}
+
+	// The autorate controller needs the detected interfaces
+	if config.AutorateEnabled {
+		autorate, err := newAutorateController(config)
+		if err != nil {
+			return nil, err
+		}
+		service.autorate = autorate
+	}
+
 	return service, nil
 }
 
+// validateConfig rejects settings the service cannot run with; config edits
+// through /api/config are checked the same way before they are applied
+func validateConfig(config *Config) error {
+	if _, err := NewRTTAggregator(config.RTTAggregation, config.RTTTrimPercent, config.RTTTrafficWeighted); err != nil {
+		return err
+	}
+	if err := validateHostRankBy(config.HostRankBy); err != nil {
+		return err
+	}
+	if _, err := NewRTTSmoother(config); err != nil {
+		return err
+	}
+	if err := validateProbeMethod(config.ProbeMethod); err != nil {
+		return err
+	}
+	if err := validateRTTSource(config.RTTSource); err != nil {
+		return err
+	}
+	if err := validateProbePorts(config.ProbePorts); err != nil {
+		return err
+	}
+	if err := validateOutlierRejection(config.RTTOutlierRejection); err != nil {
+		return err
+	}
+	if _, err := localPrefixes(nil, config.LocalPrefixes); err != nil {
+		return err
+	}
+	if _, err := newDestRules(config); err != nil {
+		return err
+	}
+	if _, err := newClientSet(config); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Run starts the main service loop
 func (s *CakeAutoRTTService) Run(ctx context.Context) error {
 	s.mutex.Lock()
@@ -189,185 +345,852 @@ func (s *CakeAutoRTTService) Run(ctx context.Context) error {
 	s.mutex.Unlock()
 
 	s.AddLog("INFO", "Starting cake-autortt main loop")
-	s.AddLog("INFO", fmt.Sprintf("Detected interfaces - DL: %s, UL: %s", s.config.DLInterface, s.config.ULInterface))
+	s.mutex.RLock()
+	cfg := s.config
+	s.AddLog("INFO", fmt.Sprintf("Detected interfaces - DL: %s, UL: %s", cfg.DLInterface, cfg.ULInterface))
+	for _, t := range s.targets {
+		s.AddLog("INFO", fmt.Sprintf("Managing %s: rtt_source=%s margin=%d%% filter=%s probes via %s",
+			t.Name, t.RTTSource, t.RTTMarginPercent, t.filter.key(), t.binding))
+	}
+	s.mutex.RUnlock()
+
+	// Stop() cancels the service context; either one ends the loop and
+	// cancels the probes of the in-flight cycle
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if s.ctx != nil {
+		defer context.AfterFunc(s.ctx, cancel)()
+	}
 
-	ticker := time.NewTicker(time.Duration(s.config.RTTUpdateInterval) * time.Second)
+	ticker := time.NewTicker(time.Duration(cfg.RTTUpdateInterval) * time.Second)
 	defer ticker.Stop()
 
+	// The history is written periodically and once more on the way out
+	var flush <-chan time.Time
+	if s.history != nil {
+		flushTicker := time.NewTicker(time.Duration(max(cfg.HistoryFlushSec, 1)) * time.Second)
+		defer flushTicker.Stop()
+		flush = flushTicker.C
+	}
+
 	// Run initial measurement
-	s.performRTTMeasurementCycle()
+	var wg sync.WaitGroup
+	s.startCycle(ctx, &wg)
 
 	for {
 		select {
 		case <-ctx.Done():
+			// Probes follow ctx, so the in-flight cycle unwinds promptly
+			wg.Wait()
+			s.saveHistory()
 			s.AddLog("INFO", "Service stopped")
 			return nil
 		case <-ticker.C:
-			s.performRTTMeasurementCycle()
-			s.mutex.Lock()
-			s.lastUpdate = time.Now().Local()
-			s.mutex.Unlock()
+			s.startCycle(ctx, &wg)
+		case <-flush:
+			s.saveHistory()
 		}
 	}
 }
 
-// performRTTMeasurementCycle performs one complete RTT measurement and adjustment cycle
-func (s *CakeAutoRTTService) performRTTMeasurementCycle() {
-	// Extract hosts from conntrack
-	hosts, err := s.extractHostsFromConntrack()
-	if err != nil {
-		s.AddLog("ERROR", fmt.Sprintf("Failed to extract hosts from conntrack: %v", err))
+// saveHistory persists the RTT history when it is enabled
+func (s *CakeAutoRTTService) saveHistory() {
+	if s.history == nil {
 		return
 	}
+	if err := s.history.save(); err != nil {
+		s.AddLog("ERROR", fmt.Sprintf("Failed to save RTT history: %v", err))
+	}
+}
 
-	s.AddLog("DEBUG", fmt.Sprintf("Found %d non-LAN hosts", len(hosts)))
+// startCycle runs one measurement cycle in the background under the cycle
+// deadline. A tick that arrives while the previous cycle is still running is
+// skipped and counted rather than queued behind it.
+func (s *CakeAutoRTTService) startCycle(ctx context.Context, wg *sync.WaitGroup) bool {
+	if !s.cycleRunning.CompareAndSwap(false, true) {
+		s.mutex.Lock()
+		s.cycles.Skipped++
+		running := time.Since(s.cycles.LastStart)
+		s.mutex.Unlock()
+		s.AddLog("WARN", fmt.Sprintf("Skipping measurement cycle, previous cycle still running after %s", running.Round(time.Millisecond)))
+		return false
+	}
 
-	var rttToUse float64 = float64(s.config.DefaultRTTMs)
-	shouldUpdate := true
+	s.mutex.Lock()
+	deadline := cycleDeadline(s.config)
+	cycleCtx, cancel := context.WithTimeout(ctx, deadline)
+	start := time.Now()
+	s.cycleCancel = cancel
+	s.cycles.Running = true
+	s.cycles.LastStart = start
+	s.cycles.DeadlineMs = deadline.Milliseconds()
+	s.mutex.Unlock()
 
-	// Measure RTT if we have enough hosts
-	if len(hosts) >= s.config.MinHosts {
-		measuredRTT, activeCount, err := s.measureRTTTCP(hosts)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer s.cycleRunning.Store(false)
+
+		s.performRTTMeasurementCycle(cycleCtx)
+		err := cycleCtx.Err()
+		took := time.Since(start)
+		cancel()
+
+		s.mutex.Lock()
+		s.cycleCancel = nil
+		s.cycles.record(took, err)
+		s.lastUpdate = time.Now().Local()
+		s.mutex.Unlock()
+		s.metrics.observeCycle(took, time.Now())
 		if err != nil {
-			s.AddLog("DEBUG", fmt.Sprintf("RTT measurement failed: %v, using default RTT: %.2fms", err, rttToUse))
-			// Update RTT tracking with default
-			s.mutex.Lock()
-			s.lastRTT["default"] = int(rttToUse)
-			s.activeHosts = activeCount // Use the count from failed measurement (partial success)
-			s.mutex.Unlock()
+			s.AddLog("WARN", fmt.Sprintf("Measurement cycle ended after %s: %v", took.Round(time.Millisecond), err))
+		}
+	}()
+	return true
+}
+
+// rttCycleInput holds the conntrack table and socket dump read once per cycle
+// and shared by all interface groups
+type rttCycleInput struct {
+	entries    []ConntrackEntry
+	entriesErr error
+	socks      []tcpDiagSocket
+	socksErr   error
+}
+
+// performRTTMeasurementCycle performs one complete RTT measurement and
+// adjustment cycle. Probes stop when ctx ends; groups not measured by the
+// deadline keep their current RTT, and a cancelled cycle (shutdown, reload)
+// applies nothing further.
+func (s *CakeAutoRTTService) performRTTMeasurementCycle(ctx context.Context) {
+	s.mutex.RLock()
+	targets := append([]*rttTarget(nil), s.targets...)
+	dlIface := s.config.DLInterface
+	ulIface := s.config.ULInterface
+	s.mutex.RUnlock()
+
+	// Interfaces with the same host filter and RTT source share one measurement
+	groups := groupRTTTargets(targets)
+	s.portCache.prune(time.Now())
+	s.hostHealth.prune(time.Now())
+	s.metrics.prune(time.Now())
+	s.refreshLocalPrefixes()
+	s.refreshClients()
+
+	var in rttCycleInput
+	needActive, needPassive := false, false
+	for _, g := range groups {
+		needActive = needActive || g.source != "passive"
+		needPassive = needPassive || g.source == "passive" || g.source == "hybrid"
+	}
+	if needActive {
+		in.entries, in.entriesErr = s.conntrackEntries()
+	}
+	if needPassive {
+		in.socks, in.socksErr = dumpTCPSockets()
+	}
+
+	activeTotal := 0
+	measured := make(map[string]float64)
+	for i, g := range groups {
+		if err := ctx.Err(); err != nil {
+			s.AddLog("WARN", fmt.Sprintf("%d of %d interface groups not measured this cycle: %v", len(groups)-i, len(groups), err))
+			break
+		}
+		rttToUse, ok, activeCount, run := s.measureTargetGroup(ctx, g, &in)
+		if !run {
+			continue
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			break
+		}
+		activeTotal += activeCount
+		for _, t := range g.targets {
+			if ok {
+				measured[t.Name] = rttToUse
+			}
+			// Update CAKE RTT parameter
+			if err := s.adjustTargetRTT(t, rttToUse, ok, activeCount); err != nil {
+				s.AddLog("ERROR", fmt.Sprintf("Failed to adjust CAKE RTT: %v", err))
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	s.activeHosts = activeTotal
+	s.mutex.Unlock()
+	s.recordHistory(targets, measured)
+
+	// Only real measurements drive the bandwidth controller, preferring the
+	// RTT seen on the download and upload interfaces
+	names := []string{dlIface, ulIface}
+	for _, t := range targets {
+		names = append(names, t.Name)
+	}
+	for _, name := range names {
+		if rtt, ok := measured[name]; ok {
+			s.adjustCakeBandwidth(rtt)
+			break
+		}
+	}
+}
+
+// recordHistory adds the cycle's measured and applied RTT of each interface,
+// with the average delay of each tin of its root CAKE qdisc, to the history
+func (s *CakeAutoRTTService) recordHistory(targets []*rttTarget, measured map[string]float64) {
+	if s.history == nil {
+		return
+	}
+	tins := make(map[string][]CakeTinStats)
+	if qdiscs, err := s.GetQdiscStats(); err == nil {
+		for _, q := range qdiscs {
+			if q.Parent == "root" {
+				tins[q.Interface] = q.Tins
+			}
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	for _, t := range targets {
+		rec := historyRecord{unixMs: now, measuredMs: float32(measured[t.Name])}
+		s.mutex.RLock()
+		rec.appliedMs = float32(t.gate.appliedUs) / 1000
+		s.mutex.RUnlock()
+		for i, tin := range tins[t.Name] {
+			if i == historyTinSlots {
+				break
+			}
+			rec.tinDelayMs[i] = float32(tin.AvgDelayUs) / 1000
+			rec.tins++
+		}
+		s.history.add(t.Name, rec)
+	}
+}
+
+// History returns the RTT history of the named interface, or of every
+// interface with history when name is empty
+func (s *CakeAutoRTTService) History(name string, from, to time.Time, step time.Duration) ([]HistorySeries, error) {
+	if s.history == nil {
+		return nil, fmt.Errorf("RTT history is disabled (set history_enabled to keep it)")
+	}
+	names := []string{name}
+	if name == "" {
+		names = s.history.interfaces()
+	}
+	out := make([]HistorySeries, 0, len(names))
+	for _, n := range names {
+		out = append(out, s.history.query(n, from, to, step))
+	}
+	return out, nil
+}
+
+// measureTargetGroup measures the RTT for one group of interfaces. It returns
+// the RTT to use (the default when too few hosts respond), whether it was
+// measured, the number of active hosts, and false when the group should not
+// be updated this cycle.
+func (s *CakeAutoRTTService) measureTargetGroup(ctx context.Context, g *rttTargetGroup, in *rttCycleInput) (float64, bool, int, bool) {
+	s.mutex.RLock()
+	minHosts := s.config.MinHosts
+	rttToUse := float64(s.config.DefaultRTTMs)
+	s.mutex.RUnlock()
+
+	names := make([]string, 0, len(g.targets))
+	for _, t := range g.targets {
+		names = append(names, t.Name)
+	}
+	label := strings.Join(names, ",")
+
+	// Extract hosts from conntrack for active probing
+	var hosts []string
+	if g.source != "passive" {
+		if in.entriesErr != nil {
+			if g.source != "hybrid" {
+				s.AddLog("ERROR", fmt.Sprintf("Failed to extract hosts from conntrack: %v", in.entriesErr))
+				return 0, false, 0, false
+			}
+			s.AddLog("WARN", fmt.Sprintf("Failed to extract hosts from conntrack, using passive RTT only: %v", in.entriesErr))
+		} else if filter, err := s.resolveUplinkFilter(g.filter); err != nil {
+			s.AddLog("WARN", fmt.Sprintf("Cannot attribute hosts to %s: %v", label, err))
 		} else {
-			rttToUse = measuredRTT
-			s.AddLog("DEBUG", fmt.Sprintf("Using measured RTT: %.2fms", rttToUse))
-			// Update RTT tracking with measured value
-			s.mutex.Lock()
-			s.lastRTT["measured"] = int(rttToUse)
-			s.activeHosts = activeCount // Use the actual count from successful measurement
-			s.mutex.Unlock()
+			hosts = s.selectHosts(in.entries, filter)
 		}
-	} else {
-		s.AddLog("DEBUG", fmt.Sprintf("Not enough hosts (%d < %d), using default RTT: %.2fms",
-			len(hosts), s.config.MinHosts, rttToUse))
-		// Update RTT tracking with default
-		s.mutex.Lock()
-		s.lastRTT["default"] = int(rttToUse)
-		s.activeHosts = len(hosts) // Show discovered hosts even if not enough for measurement
-		s.mutex.Unlock()
+		s.AddLog("DEBUG", fmt.Sprintf("Found %d non-LAN hosts for %s", len(hosts), label))
 	}
 
-	// Update CAKE RTT parameter
-	if shouldUpdate {
-		if err := s.adjustCakeRTT(rttToUse); err != nil {
-			s.AddLog("ERROR", fmt.Sprintf("Failed to adjust CAKE RTT: %v", err))
+	// Harvest kernel TCP_INFO RTTs for the passive sources
+	var passive []RTTSample
+	if g.source == "passive" || g.source == "hybrid" {
+		if in.socksErr != nil {
+			s.AddLog("ERROR", fmt.Sprintf("Failed to collect passive RTT: %v", in.socksErr))
+		} else if filter, err := s.resolveUplinkFilter(g.filter); err == nil {
+			passive = s.passiveSamples(in.socks, filter)
 		}
 	}
+
+	// Measure RTT if we have enough hosts
+	candidates := len(hosts) + len(passive)
+	if candidates < minHosts {
+		s.AddLog("DEBUG", fmt.Sprintf("Not enough hosts for %s (%d < %d), using default RTT: %.2fms",
+			label, candidates, minHosts, rttToUse))
+		// Show discovered hosts even if not enough for measurement
+		return rttToUse, false, candidates, true
+	}
+
+	measuredRTT, activeCount, err := s.measureRTT(ctx, hosts, passive, g.binding)
+	if err != nil && ctx.Err() != nil {
+		// Too few probes finished in time; a default RTT would be a guess
+		s.AddLog("WARN", fmt.Sprintf("RTT measurement for %s cut short: %v, keeping current RTT", label, ctx.Err()))
+		return 0, false, activeCount, false
+	}
+	if err != nil {
+		s.AddLog("DEBUG", fmt.Sprintf("RTT measurement for %s failed: %v, using default RTT: %.2fms", label, err, rttToUse))
+		// Use the count from failed measurement (partial success)
+		return rttToUse, false, activeCount, true
+	}
+	s.AddLog("DEBUG", fmt.Sprintf("Using measured RTT for %s: %.2fms", label, measuredRTT))
+	return measuredRTT, true, activeCount, true
 }
 
-// extractHostsFromConntrack parses /proc/net/nf_conntrack to extract non-LAN destination addresses
-func (s *CakeAutoRTTService) extractHostsFromConntrack() ([]string, error) {
-	file, err := os.Open("/proc/net/nf_conntrack")
+// resolveUplinkFilter replaces an uplink filter's placeholder with the
+// uplink's current addresses and IPv6 prefixes, so flows NATed or routed out
+// of that WAN are attributed to it. It fails when the uplink is missing or
+// has no address (link down).
+func (s *CakeAutoRTTService) resolveUplinkFilter(f hostFilter) (hostFilter, error) {
+	if f.uplink == "" {
+		return f, nil
+	}
+	lookup := s.uplinkNets
+	if lookup == nil {
+		lookup = uplinkPrefixes
+	}
+	nets, err := lookup(f.uplink)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open /proc/net/nf_conntrack: %w", err)
+		return f, fmt.Errorf("uplink %s: %w", f.uplink, err)
 	}
-	defer file.Close()
+	if len(nets) == 0 {
+		return f, fmt.Errorf("uplink %s has no addresses", f.uplink)
+	}
+	f.sources = nets
+	return f, nil
+}
 
-	hostSet := make(map[string]bool)
-	scanner := bufio.NewScanner(file)
-	dstRegex := regexp.MustCompile(`dst=([0-9a-fA-F:.]+)`)
+// conntrackEntries reads the conntrack table from the selected backend
+func (s *CakeAutoRTTService) conntrackEntries() ([]ConntrackEntry, error) {
+	if s.conntrackSource == nil {
+		return nil, fmt.Errorf("no conntrack backend available")
+	}
+	return s.conntrackSource.Entries()
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+// selectHosts picks the non-LAN destinations of ESTABLISHED flows matching f,
+// busiest first, and records their traffic weights
+func (s *CakeAutoRTTService) selectHosts(entries []ConntrackEntry, f hostFilter) []string {
+	s.mutex.RLock()
+	rules := s.destRules
+	clients := s.activeClients()
+	s.mutex.RUnlock()
 
+	// Sum flows and accounted traffic per ESTABLISHED destination, each flow
+	// scaled by the priority weight of the LAN client it belongs to
+	traffic := make(map[string]*hostTraffic)
+	for _, e := range entries {
 		// Only process ESTABLISHED connections
-		if !strings.Contains(line, "ESTABLISHED") {
+		if e.State != "ESTABLISHED" {
 			continue
 		}
-
-		// Extract destination IP
-		matches := dstRegex.FindStringSubmatch(line)
-		if len(matches) < 2 {
+		if !f.matchEntry(e) {
 			continue
 		}
-
-		dstIP := matches[1]
-		if !s.isLANAddress(dstIP) {
-			hostSet[dstIP] = true
+		weight, _, ok := clients.classify(e)
+		if !ok {
+			continue
+		}
+		if _, ok := s.destinationRule(rules, e.Dst, e.DPort); !ok {
+			continue
+		}
+		dstIP := e.Dst.String()
+		t, ok := traffic[dstIP]
+		if !ok {
+			t = &hostTraffic{host: dstIP}
+			traffic[dstIP] = t
+		}
+		t.flows++
+		t.bytes += e.Bytes
+		t.packets += e.Packets
+		t.wFlows += weight
+		t.wBytes += weight * float64(e.Bytes)
+		t.wPackets += weight * float64(e.Packets)
+		// learn the ports clients actually talk to; only TCP ports help a TCP probe
+		if e.Proto == 6 && e.DPort != 0 {
+			if t.ports == nil {
+				t.ports = make(map[uint16]uint64)
+			}
+			t.ports[e.DPort]++
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading conntrack: %w", err)
-	}
-
-	// Convert to slice and limit to max hosts (read max from config under lock)
+	// Rank and limit to max hosts (read config under lock)
 	s.mutex.RLock()
 	maxHosts := s.config.MaxHosts
+	rankBy := s.config.HostRankBy
 	s.mutex.RUnlock()
 
-	hosts := make([]string, 0, len(hostSet))
-	for host := range hostSet {
-		hosts = append(hosts, host)
-		if len(hosts) >= maxHosts {
-			break
+	ranked, metric := rankHostTraffic(traffic, rankBy)
+
+	// Before the max_hosts cut, skip hosts in backoff so others take their
+	// place, and move stable hosts ahead
+	order := make([]string, len(ranked))
+	for i, t := range ranked {
+		order[i] = t.host
+	}
+	order, skipped := s.hostHealth.schedule(order, time.Now())
+	ranked = ranked[:0]
+	for _, h := range order {
+		ranked = append(ranked, traffic[h])
+	}
+	if skipped > 0 {
+		s.AddLog("DEBUG", fmt.Sprintf("Skipping %d hosts in backoff after failed probes", skipped))
+	}
+
+	if maxHosts > 0 && len(ranked) > maxHosts {
+		ranked = ranked[:maxHosts]
+	}
+
+	hosts := make([]string, 0, len(ranked))
+	weights := make(map[string]float64, len(ranked))
+	ports := make(map[string][]uint16, len(ranked))
+	for _, t := range ranked {
+		hosts = append(hosts, t.host)
+		weights[t.host] = t.value(metric)
+		if len(t.ports) > 0 {
+			ports[t.host] = topPorts(t.ports, maxLearnedPorts)
+		}
+	}
+	if metric != rankBy && rankBy != "" && rankBy != "flows" && len(ranked) > 0 {
+		s.AddLog("DEBUG", fmt.Sprintf("No conntrack %s accounting (nf_conntrack_acct=0?), ranking hosts by flows", rankBy))
+	}
+
+	s.mutex.Lock()
+	s.hostWeights = weights
+	s.hostPorts = ports
+	s.mutex.Unlock()
+
+	return hosts
+}
+
+// hostTraffic accumulates the conntrack flows and accounting of one destination
+type hostTraffic struct {
+	host    string
+	flows   uint64
+	bytes   uint64
+	packets uint64
+	// the same counters scaled by each flow's client weight
+	wFlows   float64
+	wBytes   float64
+	wPackets float64
+	// flow count per TCP destination port
+	ports map[uint16]uint64
+}
+
+// value returns the client-weighted traffic metric used for ranking and
+// weighting
+func (t *hostTraffic) value(metric string) float64 {
+	switch metric {
+	case "bytes":
+		return t.wBytes
+	case "packets":
+		return t.wPackets
+	}
+	return t.wFlows
+}
+
+// rankHostTraffic orders destinations busiest first by the host_rank_by metric,
+// breaking ties by flow count and then address so the max_hosts cut is stable.
+// When no entry carries accounting counters it falls back to flows and
+// returns the metric actually used.
+func rankHostTraffic(traffic map[string]*hostTraffic, rankBy string) ([]*hostTraffic, string) {
+	metric := rankBy
+	if metric != "bytes" && metric != "packets" {
+		metric = "flows"
+	}
+	ranked := make([]*hostTraffic, 0, len(traffic))
+	accounted := false
+	for _, t := range traffic {
+		ranked = append(ranked, t)
+		if t.value(metric) > 0 {
+			accounted = true
 		}
 	}
+	if !accounted {
+		metric = "flows"
+	}
 
-	return hosts, nil
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if va, vb := a.value(metric), b.value(metric); va != vb {
+			return va > vb
+		}
+		if a.flows != b.flows {
+			return a.flows > b.flows
+		}
+		return a.host < b.host
+	})
+	return ranked, metric
 }
 
-// isLANAddress checks if an IP address is a LAN address
+// validateHostRankBy checks the host_rank_by config value
+func validateHostRankBy(rankBy string) error {
+	switch rankBy {
+	case "", "bytes", "packets", "flows":
+		return nil
+	}
+	return fmt.Errorf("unknown host_rank_by %q (want bytes, packets or flows)", rankBy)
+}
+
+// isLANAddress reports whether an address must not be probed as an internet
+// host: anything in the IPv4/IPv6 special-purpose registries or inside one of
+// the router's own prefixes
 func (s *CakeAutoRTTService) isLANAddress(ipStr string) bool {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return true // Invalid IP, treat as LAN
 	}
+	return s.reservedRule(ip) != ""
+}
+
+// reservedRule names why ip is never an internet host (special-purpose
+// range or router-local prefix), or returns "" for global destinations
+func (s *CakeAutoRTTService) reservedRule(ip net.IP) string {
+	if name := specialPurposeName(ip); name != "" {
+		return "special-purpose: " + name
+	}
+	if nets := s.localNets.Load(); nets != nil {
+		for _, n := range *nets {
+			if n.Contains(ip) {
+				return "local prefix " + n.String()
+			}
+		}
+	}
+	return ""
+}
+
+// destinationRule decides whether a flow's destination may be probed and
+// names the deciding rule: reserved addresses first, then the user's
+// include/exclude prefix and port rules
+func (s *CakeAutoRTTService) destinationRule(rules *destRules, ip net.IP, port uint16) (string, bool) {
+	if ip == nil {
+		return "invalid address", false
+	}
+	if rule := s.reservedRule(ip); rule != "" {
+		return rule, false
+	}
+	if rules == nil {
+		return "default", true
+	}
+	return rules.check(ip, port)
+}
+
+// HostDecisions evaluates every ESTABLISHED destination in the current
+// conntrack table against the destination rules and the managed interfaces'
+// host filters, for /api/hosts. Accepted hosts come first, busiest first.
+func (s *CakeAutoRTTService) HostDecisions() ([]HostDecision, error) {
+	entries, err := s.conntrackEntries()
+	if err != nil {
+		return nil, err
+	}
+	clients := s.refreshClients()
+	s.mutex.RLock()
+	rules := s.destRules
+	targets := append([]*rttTarget(nil), s.targets...)
+	s.mutex.RUnlock()
+
+	type namedFilter struct {
+		name   string
+		filter hostFilter
+	}
+	filters := make([]namedFilter, 0, len(targets))
+	for _, t := range targets {
+		if f, err := s.resolveUplinkFilter(t.filter); err == nil {
+			filters = append(filters, namedFilter{t.Name, f})
+		}
+	}
 
-	// Check for IPv4 private ranges
-	if ip.To4() != nil {
-		// 10.0.0.0/8
-		if ip[12] == 10 {
-			return true
+	byHost := make(map[string]*HostDecision)
+	for _, e := range entries {
+		if e.State != "ESTABLISHED" || e.Dst == nil {
+			continue
 		}
-		// 172.16.0.0/12
-		if ip[12] == 172 && ip[13] >= 16 && ip[13] <= 31 {
-			return true
+		host := e.Dst.String()
+		d, ok := byHost[host]
+		if !ok {
+			d = &HostDecision{Host: host, Family: ipFamily(host)}
+			byHost[host] = d
 		}
-		// 192.168.0.0/16
-		if ip[12] == 192 && ip[13] == 168 {
-			return true
+		d.Flows++
+		d.Bytes += e.Bytes
+		if e.Proto == 6 && e.DPort != 0 && !slices.Contains(d.Ports, e.DPort) {
+			d.Ports = append(d.Ports, e.DPort)
 		}
-		// 169.254.0.0/16 (link-local)
-		if ip[12] == 169 && ip[13] == 254 {
-			return true
+		// A host is accepted when any of its flows passes; only passing flows
+		// attribute it to the interfaces that would probe it
+		_, rule, ok := clients.classify(e)
+		if ok {
+			rule, ok = s.destinationRule(rules, e.Dst, e.DPort)
 		}
-		// 127.0.0.0/8 (loopback)
-		if ip[12] == 127 {
-			return true
+		if !ok {
+			if !d.Accepted {
+				d.Rule = rule
+			}
+			continue
 		}
-		// Multicast and reserved ranges
-		if ip[12] >= 224 {
-			return true
+		if !d.Accepted {
+			d.Accepted, d.Rule = true, rule
 		}
-	} else {
-		// IPv6 checks
-		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-			return true
+		for _, nf := range filters {
+			if nf.filter.matchEntry(e) && !slices.Contains(d.Interfaces, nf.name) {
+				d.Interfaces = append(d.Interfaces, nf.name)
+			}
+		}
+	}
+
+	now := time.Now()
+	out := make([]HostDecision, 0, len(byHost))
+	for _, d := range byHost {
+		if d.Accepted && len(d.Interfaces) == 0 && len(targets) > 0 {
+			d.Accepted, d.Rule = false, "no interface filter matched"
 		}
-		// fc00::/7 (unique local)
-		if ip[0] == 0xfc || ip[0] == 0xfd {
-			return true
+		if until, failures := s.hostHealth.backoff(d.Host, now); d.Accepted && !until.IsZero() {
+			d.Accepted = false
+			d.Rule = fmt.Sprintf("backoff after %d failures until %s", failures, until.Format(time.TimeOnly))
 		}
+		out = append(out, *d)
 	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Accepted != out[j].Accepted {
+			return out[i].Accepted
+		}
+		if out[i].Flows != out[j].Flows {
+			return out[i].Flows > out[j].Flows
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out, nil
+}
 
-	return false
+// HostHealth returns the per-host probe history used for backoff, for
+// /api/host-health
+func (s *CakeAutoRTTService) HostHealth() []HostHealth {
+	return s.hostHealth.snapshot()
+}
+
+// WriteMetrics renders the service state in the Prometheus text exposition
+// format for /metrics: per-interface RTTs and update counts, cycle and probe
+// counters, the probe worker pool and the CAKE qdisc and tin counters
+func (s *CakeAutoRTTService) WriteMetrics(out io.Writer) error {
+	s.mutex.RLock()
+	statuses := make([]InterfaceRTTStatus, len(s.targets))
+	names := make([]string, len(s.targets))
+	for i, t := range s.targets {
+		statuses[i] = t.snapshot()
+		names[i] = t.Name
+	}
+	cycles := s.cycles
+	maxWorkers := clampProbeWorkers(s.config.MaxConcurrentProbes)
+	s.mutex.RUnlock()
+
+	w := &metricsWriter{w: out}
+	w.header("cake_autortt_rtt_measured_seconds", "Aggregate RTT measured in the last cycle, before smoothing.", "gauge")
+	for i, st := range statuses {
+		w.sample("cake_autortt_rtt_measured_seconds", float64(st.RawMs)/1e3, "interface", names[i], "source", st.Source)
+	}
+	w.header("cake_autortt_rtt_smoothed_seconds", "Smoothed aggregate RTT.", "gauge")
+	for i, st := range statuses {
+		w.sample("cake_autortt_rtt_smoothed_seconds", st.Updates.SmoothedMs/1e3, "interface", names[i])
+	}
+	w.header("cake_autortt_rtt_applied_seconds", "RTT last applied to the qdisc, including the margin.", "gauge")
+	for i, st := range statuses {
+		w.sample("cake_autortt_rtt_applied_seconds", float64(st.Updates.AppliedUs)/1e6, "interface", names[i])
+	}
+	w.header("cake_autortt_rtt_updates_total", "Qdisc RTT updates applied or skipped by the dead-band/hold gate.", "counter")
+	for i, st := range statuses {
+		w.sample("cake_autortt_rtt_updates_total", float64(st.Updates.Applied), "interface", names[i], "result", "applied")
+		w.sample("cake_autortt_rtt_updates_total", float64(st.Updates.Skipped), "interface", names[i], "result", "skipped")
+	}
+	w.header("cake_autortt_active_hosts", "Hosts that answered in the last cycle.", "gauge")
+	for i, st := range statuses {
+		w.sample("cake_autortt_active_hosts", float64(st.ActiveHosts), "interface", names[i])
+	}
+
+	w.header("cake_autortt_cycles_total", "Measurement cycles by outcome.", "counter")
+	w.sample("cake_autortt_cycles_total", float64(cycles.Completed), "outcome", "completed")
+	w.sample("cake_autortt_cycles_total", float64(cycles.TimedOut), "outcome", "timed_out")
+	w.sample("cake_autortt_cycles_total", float64(cycles.Cancelled), "outcome", "cancelled")
+	w.sample("cake_autortt_cycles_total", float64(cycles.Skipped), "outcome", "skipped")
+
+	w.header("cake_autortt_probe_workers", "Probe worker cap set by max_concurrent_probes and the adaptive controller.", "gauge")
+	w.sample("cake_autortt_probe_workers", float64(s.probeWorkerCap()))
+	w.header("cake_autortt_probe_workers_max", "Configured probe worker limit.", "gauge")
+	w.sample("cake_autortt_probe_workers_max", float64(maxWorkers))
+	w.header("cake_autortt_probes_in_flight", "Probes currently running.", "gauge")
+	w.sample("cake_autortt_probes_in_flight", float64(s.probeSlots.active()))
+
+	s.metrics.write(w)
+
+	qdiscs, err := s.GetQdiscStats()
+	w.header("cake_autortt_qdisc_stats_up", "Whether the CAKE qdisc statistics could be read.", "gauge")
+	if err != nil {
+		w.sample("cake_autortt_qdisc_stats_up", 0)
+		return w.err
+	}
+	w.sample("cake_autortt_qdisc_stats_up", 1)
+	writeQdiscMetrics(w, qdiscs)
+	return w.err
+}
+
+// activeClients returns the clients resolved for the current cycle, or the
+// configured ones before the first resolution. Callers hold the mutex.
+func (s *CakeAutoRTTService) activeClients() *clientSet {
+	if s.resolvedClients != nil {
+		return s.resolvedClients
+	}
+	return s.clients
+}
+
+// refreshClients resolves MAC client selectors against the current neighbour
+// table, so clients changing IPv6 privacy addresses keep matching
+func (s *CakeAutoRTTService) refreshClients() *clientSet {
+	s.mutex.RLock()
+	clients := s.clients
+	s.mutex.RUnlock()
+	if clients == nil || !clients.needsNeighbors() {
+		return clients
+	}
+
+	dump := s.neighborTable
+	if dump == nil {
+		dump = dumpNeighbors
+	}
+	neigh, err := dump()
+	if err != nil {
+		s.AddLog("WARN", fmt.Sprintf("Cannot read neighbour table for client MACs: %v", err))
+	}
+	resolved := clients.resolve(neigh)
+
+	s.mutex.Lock()
+	// a reload may have replaced the clients meanwhile
+	if s.clients == clients {
+		s.resolvedClients = resolved
+	}
+	s.mutex.Unlock()
+	return resolved
+}
+
+// refreshLocalPrefixes rebuilds the router-local prefix list from the
+// interface addresses (when auto_local_prefixes is on) and local_prefixes,
+// so a renumbered IPv6 delegation is picked up on the next cycle
+func (s *CakeAutoRTTService) refreshLocalPrefixes() {
+	s.mutex.RLock()
+	auto := s.config.AutoLocalPrefixes
+	extra := s.config.LocalPrefixes
+	s.mutex.RUnlock()
+
+	var addrs []net.Addr
+	if auto {
+		lookup := s.interfaceAddrs
+		if lookup == nil {
+			lookup = net.InterfaceAddrs
+		}
+		var err error
+		if addrs, err = lookup(); err != nil {
+			s.AddLog("WARN", fmt.Sprintf("Cannot read interface addresses for local prefixes: %v", err))
+		}
+	}
+	nets, err := localPrefixes(addrs, extra)
+	if err != nil {
+		s.AddLog("ERROR", fmt.Sprintf("%v", err))
+	}
+
+	if prev := s.localNets.Load(); prev == nil || !sameNets(*prev, nets) {
+		names := make([]string, 0, len(nets))
+		for _, n := range nets {
+			names = append(names, n.String())
+		}
+		s.AddLog("INFO", fmt.Sprintf("Local prefixes excluded from probing: [%s]", strings.Join(names, ", ")))
+	}
+	s.localNets.Store(&nets)
 }
 
 // measureRTTTCP measures RTT using TCP connections to multiple hosts in parallel
 // Returns the measured RTT, number of active hosts, and any error
 func (s *CakeAutoRTTService) measureRTTTCP(hosts []string) (float64, int, error) {
-	if len(hosts) == 0 {
+	return s.measureRTT(context.Background(), hosts, nil, ProbeBinding{})
+}
+
+// measureRTT actively probes hosts, merges in any passive samples, drops the
+// outliers of the combined set and reduces the rest with the configured
+// aggregation strategy. When a host has both an active and a passive sample
+// the lower RTT is kept. Active probes leave through the uplink described by
+// bind and are cancelled with ctx.
+// Returns the measured RTT, number of active hosts, and any error
+func (s *CakeAutoRTTService) measureRTT(ctx context.Context, hosts []string, passive []RTTSample, bind ProbeBinding) (float64, int, error) {
+	if len(hosts) == 0 && len(passive) == 0 {
 		return 0, 0, fmt.Errorf("no hosts to measure")
 	}
 
+	// Read config under lock into local copy to avoid races while UpdateConfig runs
+	s.mutex.RLock()
+	cfg := *s.config
+	s.mutex.RUnlock()
+
+	var samples []RTTSample
+	var rejected []RejectedSample
+	if len(hosts) > 0 {
+		samples, rejected = s.probeHosts(ctx, cfg, hosts, bind)
+	}
+
+	if len(passive) > 0 {
+		index := make(map[string]int, len(samples))
+		for i, smp := range samples {
+			index[smp.Host] = i
+		}
+		for _, p := range passive {
+			if i, ok := index[p.Host]; ok {
+				if p.RTTMs < samples[i].RTTMs {
+					samples[i].RTTMs, samples[i].Probe = p.RTTMs, p.Probe
+				}
+				continue
+			}
+			samples = append(samples, p)
+		}
+		s.AddLog("DEBUG", fmt.Sprintf("Merged %d passive samples (%d hosts total)", len(passive), len(samples)))
+	}
+
+	// The statistical tests run on the merged set so a stale passive
+	// tcpi_rtt is judged against the same peers as the active probes
+	samples, outliers := rejectOutliers(samples, cfg.RTTOutlierRejection, cfg.RTTOutlierThreshold, false)
+	s.noteRejected(outliers)
+	rejected = append(rejected, outliers...)
+
+	aliveCount := len(samples)
+
+	// Check if we have enough responding hosts
+	if aliveCount < cfg.MinHosts {
+		return 0, aliveCount, fmt.Errorf("not enough responding hosts (%d < %d)", aliveCount, cfg.MinHosts)
+	}
+
+	stats := s.aggregateRTT(cfg, samples, len(rejected))
+
+	s.AddLog("DEBUG", fmt.Sprintf("Using %s RTT: %.2fms (min: %.2fms, median: %.2fms, avg: %.2fms, p95: %.2fms, worst: %.2fms)",
+		stats.Strategy, stats.ResultMs, stats.MinMs, stats.MedianMs, stats.MeanMs, stats.P95Ms, stats.MaxMs))
+
+	return stats.ResultMs, aliveCount, nil
+}
+
+// probeHosts runs the probe worker pool over hosts and returns a sample for
+// every host that responded, less TCP connect times inflated by SYN
+// retransmits, which are returned separately. Statistical outliers are left
+// to measureRTT. Once ctx ends, queued hosts are not probed.
+func (s *CakeAutoRTTService) probeHosts(ctx context.Context, cfg Config, hosts []string, bind ProbeBinding) ([]RTTSample, []RejectedSample) {
 	s.AddLog("DEBUG", fmt.Sprintf("Measuring RTT using TCP for %d hosts", len(hosts)))
 
 	// Worker-pool approach: create a bounded number of workers to avoid creating
@@ -375,19 +1198,12 @@ func (s *CakeAutoRTTService) measureRTTTCP(hosts []string) (float64, int, error)
 	jobs := make(chan string, len(hosts))
 	results := make(chan RTTMeasurement, len(hosts))
 
-	// Read config under lock into local copy to avoid races while UpdateConfig runs
-	s.mutex.RLock()
-	cfg := *s.config
-	s.mutex.RUnlock()
-
-	// Determine number of workers (cap to a reasonable safety limit)
-	workers := cfg.MaxConcurrentProbes
-	if workers < 1 {
-		workers = 1
-	}
-	// Safety cap to avoid overwhelming the system
-	if workers > 500 {
-		workers = 500
+	// Workers are started up to the configured max (with a safety cap); how
+	// many probe at once is bounded by probeWorkerCap, re-read per probe so the
+	// adaptive controller can shrink the pool mid-cycle
+	workers := clampProbeWorkers(cfg.MaxConcurrentProbes)
+	if workers > len(hosts) {
+		workers = len(hosts)
 	}
 
 	var wg sync.WaitGroup
@@ -396,11 +1212,9 @@ func (s *CakeAutoRTTService) measureRTTTCP(hosts []string) (float64, int, error)
 		go func(workerIdx int) {
 			defer wg.Done()
 			for h := range jobs {
-				// Mark as probing
-				s.setProbeStage(h, "probing")
-
-				// Use injected probe function (defaults to internal TCP probe) so tests can mock it.
-				rtt, err := s.ProbeFunc(h, cfg.TCPConnectTimeout)
+				// Once the cycle deadline or shutdown hits, the queue drains
+				// without probing
+				rtt, probe, err := s.sampleHost(ctx, cfg, h, bind)
 
 				// Record result for UI and logs
 				if err != nil {
@@ -409,10 +1223,13 @@ func (s *CakeAutoRTTService) measureRTTTCP(hosts []string) (float64, int, error)
 					s.setProbeResult(h, int(rtt.Nanoseconds()/1e6), nil)
 				}
 
-				results <- RTTMeasurement{Host: h, RTT: rtt, Err: err}
+				results <- RTTMeasurement{Host: h, RTT: rtt, Probe: probe, Err: err}
 
 				// Small pacing to avoid synchronized bursts and excessive short-term load
-				time.Sleep(time.Millisecond * time.Duration(10+(workerIdx%10)))
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Millisecond * time.Duration(10+(workerIdx%10))):
+				}
 			}
 		}(i)
 	}
@@ -430,8 +1247,13 @@ func (s *CakeAutoRTTService) measureRTTTCP(hosts []string) (float64, int, error)
 		close(results)
 	}()
 
+	// Snapshot traffic weights for the weighted aggregation strategies
+	s.mutex.RLock()
+	weights := s.hostWeights
+	s.mutex.RUnlock()
+
 	// Collect results
-	var validRTTs []float64
+	var samples []RTTSample
 	aliveCount := 0
 
 	for result := range results {
@@ -441,33 +1263,158 @@ func (s *CakeAutoRTTService) measureRTTTCP(hosts []string) (float64, int, error)
 		}
 
 		rttMs := float64(result.RTT.Nanoseconds()) / 1e6
-		validRTTs = append(validRTTs, rttMs)
+		samples = append(samples, RTTSample{Host: result.Host, RTTMs: rttMs, Weight: weights[result.Host], Probe: result.Probe})
 		aliveCount++
 		s.AddLog("DEBUG", fmt.Sprintf("Host %s: RTT %.2fms", result.Host, rttMs))
 	}
 
 	s.AddLog("DEBUG", fmt.Sprintf("TCP summary: %d/%d hosts alive", aliveCount, len(hosts)))
 
-	// Check if we have enough responding hosts
-	if aliveCount < s.config.MinHosts {
-		return 0, aliveCount, fmt.Errorf("not enough responding hosts (%d < %d)", aliveCount, s.config.MinHosts)
+	samples, rejected := rejectOutliers(samples, "none", 0, cfg.RTTRejectSYNRetransmits)
+	s.noteRejected(rejected)
+
+	return samples, rejected
+}
+
+// noteRejected marks rejected samples in the metrics and log, and those of
+// active probes in the probe list
+func (s *CakeAutoRTTService) noteRejected(rejected []RejectedSample) {
+	for _, r := range rejected {
+		// a passive sample has no probe entry; the host's last one is unrelated
+		if r.Probe != "passive" {
+			s.markProbeRejected(r.Host, r.Reason)
+		}
+		s.metrics.observeRejected(r.Reason)
+		s.AddLog("DEBUG", fmt.Sprintf("Host %s: rejected %.2fms sample: %s", r.Host, r.RTTMs, r.Reason))
+	}
+}
+
+// sampleHost probes host probe_samples times, probe_sample_interval_ms apart,
+// holding a probe slot only while a probe runs. A host whose first probe
+// fails is not sampled further. It returns the host's RTT (its minimum, plus
+// the jitter with probe_sample_add_jitter) with the probe kind of the
+// minimum, and records the outcome in the host health table.
+func (s *CakeAutoRTTService) sampleHost(ctx context.Context, cfg Config, host string, bind ProbeBinding) (time.Duration, string, error) {
+	n := clampProbeSamples(cfg.ProbeSamples)
+	spacing := time.Duration(cfg.ProbeSampleIntervalMs) * time.Millisecond
+
+	var rtts []float64
+	lost := 0
+	var lastErr error
+	// in auto mode a host can answer ICMP once and TCP the next time
+	var minMs float64
+	var minProbe string
+	for i := 0; i < n; i++ {
+		if i > 0 && spacing > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(spacing):
+			}
+		}
+		// Wait for a slot under the adaptive cap
+		err := ctx.Err()
+		if err == nil {
+			err = s.probeSlots.acquire(ctx, s.probeWorkerCap)
+		}
+		if err != nil {
+			lastErr = err
+			break
+		}
+
+		// Mark as probing
+		s.setProbeStage(host, "probing")
+
+		// Use injected probe function (defaults to internal TCP probe) so tests can mock it.
+		rtt, probe, err := s.ProbeFunc(ctx, host, cfg.TCPConnectTimeout, bind)
+		s.probeSlots.release()
+		s.metrics.observeProbe(host, rtt, err, time.Now())
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil || len(rtts) == 0 {
+				break
+			}
+			lost++
+			continue
+		}
+		rttMs := float64(rtt.Nanoseconds()) / 1e6
+		if len(rtts) == 0 || rttMs < minMs {
+			minMs, minProbe = rttMs, probe
+		}
+		rtts = append(rtts, rttMs)
+		if n > 1 {
+			s.setProbeSamples(host, summarizeSamples(rtts, lost))
+		}
 	}
 
-	// Calculate statistics
-	sort.Float64s(validRTTs)
-	avgRTT := 0.0
-	for _, rtt := range validRTTs {
-		avgRTT += rtt
+	backoffBase := time.Duration(cfg.HostBackoffBaseSec) * time.Second
+	backoffMax := time.Duration(cfg.HostBackoffMaxSec) * time.Second
+	if len(rtts) == 0 {
+		// A probe cut short by the cycle says nothing about the host
+		if ctx.Err() == nil {
+			s.hostHealth.record(host, 0, lastErr, time.Now(), backoffBase, backoffMax)
+		}
+		return 0, "", lastErr
+	}
+	st := summarizeSamples(rtts, lost)
+	rttMs := st.hostRTTMs(cfg.ProbeSampleAddJitter)
+	s.hostHealth.record(host, rttMs, nil, time.Now(), backoffBase, backoffMax)
+	return time.Duration(rttMs * float64(time.Millisecond)), minProbe, nil
+}
+
+// passiveSamples turns the kernel TCP_INFO of established router sockets into
+// per-destination samples. Sockets are matched to f by local address only;
+// conntrack marks are not visible through sock_diag.
+func (s *CakeAutoRTTService) passiveSamples(socks []tcpDiagSocket, f hostFilter) []RTTSample {
+	s.mutex.RLock()
+	useMinRTT := s.config.PassiveUseMinRTT
+	maxHosts := s.config.MaxHosts
+	rules := s.destRules
+	s.mutex.RUnlock()
+
+	matched := socks
+	if len(f.sources) > 0 {
+		matched = make([]tcpDiagSocket, 0, len(socks))
+		for _, sk := range socks {
+			if f.matchSource(sk.Src) {
+				matched = append(matched, sk)
+			}
+		}
+	}
+
+	// Socket ports are the router's own, so only the prefix rules apply
+	excluded := func(host string) bool {
+		_, ok := s.destinationRule(rules, net.ParseIP(host), 0)
+		return !ok
+	}
+	samples := passiveSamplesFromSockets(matched, useMinRTT, excluded)
+	if maxHosts > 0 && len(samples) > maxHosts {
+		samples = samples[:maxHosts]
+	}
+	s.AddLog("DEBUG", fmt.Sprintf("Passive RTT: %d sockets, %d non-LAN hosts", len(matched), len(samples)))
+	return samples
+}
+
+// aggregateRTT reduces samples with the configured strategy and records the
+// resulting statistics, with the number of rejected outliers, for the status
+// API. An invalid strategy (e.g. after a bad config reload) falls back to
+// worst-case max.
+func (s *CakeAutoRTTService) aggregateRTT(cfg Config, samples []RTTSample, rejected int) RTTStats {
+	agg, err := NewRTTAggregator(cfg.RTTAggregation, cfg.RTTTrimPercent, cfg.RTTTrafficWeighted)
+	if err != nil {
+		s.AddLog("ERROR", fmt.Sprintf("Invalid RTT aggregation, falling back to max: %v", err))
+		agg = maxAggregator{}
 	}
-	avgRTT /= float64(len(validRTTs))
 
-	// Use worst (highest) RTT for conservative approach
-	worstRTT := validRTTs[len(validRTTs)-1]
+	stats := ComputeRTTStats(agg, samples)
+	stats.Rejected = rejected
+	byFamily := ComputeRTTStatsByFamily(agg, samples)
 
-	s.AddLog("DEBUG", fmt.Sprintf("Using worst RTT: %.2fms (avg: %.2fms, worst: %.2fms)",
-		worstRTT, avgRTT, worstRTT))
+	s.mutex.Lock()
+	s.lastRTTStats = &stats
+	s.lastFamilyStats = byFamily
+	s.mutex.Unlock()
 
-	return worstRTT, aliveCount, nil
+	return stats
 }
 
 // setProbeStage sets the stage for a given probe host
@@ -481,6 +1428,9 @@ func (s *CakeAutoRTTService) setProbeStage(host, stage string) {
 		ps.Stage = stage
 		ps.Error = ""
 		ps.RTTMs = 0
+		if stage == "queued" {
+			ps.Samples = nil
+		}
 		s.currentProbes[host] = ps
 		if s.currentProbeCache != nil {
 			if b, err := json.Marshal(ps); err == nil {
@@ -569,6 +1519,37 @@ func (s *CakeAutoRTTService) setProbeResult(host string, rttMs int, err error) {
 	}
 }
 
+// setProbeSamples records the per-host sample statistics of an in-flight probe
+func (s *CakeAutoRTTService) setProbeSamples(host string, st ProbeSampleStats) {
+	s.probeMutex.Lock()
+	defer s.probeMutex.Unlock()
+	ps, ok := s.currentProbes[host]
+	if !ok {
+		return
+	}
+	ps.Samples = &st
+	s.currentProbes[host] = ps
+	if s.currentProbeCache != nil {
+		if b, err := json.Marshal(ps); err == nil {
+			s.currentProbeCache.Set([]byte(host), b)
+		}
+	}
+}
+
+// markProbeRejected flags the latest completed probe of host as rejected
+// from the aggregate, with the reason shown in the completed-probes list
+func (s *CakeAutoRTTService) markProbeRejected(host, reason string) {
+	s.probeMutex.Lock()
+	defer s.probeMutex.Unlock()
+	for i := len(s.completedProbes) - 1; i >= 0; i-- {
+		if p := &s.completedProbes[i].Probe; p.Host == host {
+			p.Stage = "rejected"
+			p.Reason = reason
+			return
+		}
+	}
+}
+
 // GetCurrentProbes returns a snapshot of current probes
 func (s *CakeAutoRTTService) GetCurrentProbes() []ProbeStatus {
 	s.probeMutex.RLock()
@@ -636,11 +1617,13 @@ func (s *CakeAutoRTTService) GetRecentCompletedProbesWithTime() []map[string]int
 			continue
 		}
 		entry := map[string]interface{}{
-			"host":   cp.Probe.Host,
-			"stage":  cp.Probe.Stage,
-			"rtt_ms": cp.Probe.RTTMs,
-			"error":  cp.Probe.Error,
-			"when":   cp.When.Format("15:04:05"),
+			"host":    cp.Probe.Host,
+			"stage":   cp.Probe.Stage,
+			"rtt_ms":  cp.Probe.RTTMs,
+			"error":   cp.Probe.Error,
+			"reason":  cp.Probe.Reason,
+			"samples": cp.Probe.Samples,
+			"when":    cp.When.Format("15:04:05"),
 		}
 		out = append(out, entry)
 	}
@@ -652,69 +1635,202 @@ func (s *CakeAutoRTTService) GetRecentCompletedProbesWithTime() []map[string]int
 	return out
 }
 
-// measureSingleHostTCP measures RTT to a single host using TCP connection
-func (s *CakeAutoRTTService) measureSingleHostTCP(host string, timeoutSec int) (time.Duration, error) {
-	// Try common ports in order of preference
-	ports := []string{"80", "443", "22", "21", "25", "53"}
+// validateProbeMethod checks a probe_method value; empty means tcp
+func validateProbeMethod(method string) error {
+	switch method {
+	case "", "tcp", "icmp", "auto":
+		return nil
+	}
+	return fmt.Errorf("unknown probe_method %q (want tcp, icmp or auto)", method)
+}
+
+// validateRTTSource checks an rtt_source value; empty means active
+func validateRTTSource(source string) error {
+	switch source {
+	case "", "active", "passive", "hybrid":
+		return nil
+	}
+	return fmt.Errorf("unknown rtt_source %q (want active, passive or hybrid)", source)
+}
+
+// measureSingleHost measures RTT to a single host with the configured probe method
+// and reports which prober answered (tcp or icmp).
+// In auto mode ICMP echo is tried first, so hosts that only speak UDP (games,
+// VoIP, QUIC) still count, and TCP connect is used when ICMP is filtered or
+// ICMP sockets cannot be opened.
+func (s *CakeAutoRTTService) measureSingleHost(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+	s.mutex.RLock()
+	method := s.config.ProbeMethod
+	s.mutex.RUnlock()
+
+	switch method {
+	case "icmp":
+		rtt, err := s.measureSingleHostICMP(ctx, host, timeoutSec, bind)
+		return rtt, "icmp", err
+	case "auto":
+		if !s.icmpUnavailable.Load() {
+			rtt, err := s.measureSingleHostICMP(ctx, host, timeoutSec, bind)
+			if err == nil || ctx.Err() != nil {
+				return rtt, "icmp", err
+			}
+			if errors.Is(err, errICMPUnavailable) {
+				s.icmpUnavailable.Store(true)
+				s.AddLog("WARN", fmt.Sprintf("ICMP probing disabled, using TCP only: %v", err))
+			}
+		}
+	}
+	rtt, err := s.measureSingleHostTCP(ctx, host, timeoutSec, bind)
+	return rtt, "tcp", err
+}
+
+// measureSingleHostICMP measures RTT to a single host using ICMP/ICMPv6 echo
+func (s *CakeAutoRTTService) measureSingleHostICMP(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IP address %q", host)
+	}
+	return icmpEchoProbe(ctx, ip, time.Duration(timeoutSec)*time.Second, bind)
+}
+
+// measureSingleHostTCP measures RTT to a single host using TCP connection.
+// Ports are tried in order: the port that answered last time, the ports the
+// host is seen on in conntrack, then the probe_ports fallback list.
+func (s *CakeAutoRTTService) measureSingleHostTCP(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, error) {
+	s.mutex.RLock()
+	learned := s.hostPorts[host]
+	fallback := s.config.ProbePorts
+	s.mutex.RUnlock()
+	ports := probePortOrder(s.portCache.get(host), learned, fallback)
 
 	timeout := time.Duration(timeoutSec) * time.Second
+	dialer := bind.dialer(net.ParseIP(host), timeout)
 
+	var lastErr error
 	for _, port := range ports {
 		start := time.Now()
-		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
 		if err != nil {
+			if ctx.Err() != nil {
+				// Cancelled, not a port failure: keep the cached port
+				return 0, fmt.Errorf("tcp probe: %w", ctx.Err())
+			}
+			lastErr = err
 			continue // Try next port
 		}
+		rtt := time.Since(start)
 		conn.Close()
-		return time.Since(start), nil
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			s.portCache.set(host, uint16(p), time.Now())
+		}
+		return rtt, nil
 	}
 
-	return 0, fmt.Errorf("no reachable ports found")
+	s.portCache.forget(host)
+	// wrap the last dial error so callers can tell timeouts from refusals
+	return 0, fmt.Errorf("no reachable ports found (tried %s): %w", strings.Join(ports, ","), lastErr)
 }
 
-// adjustCakeRTT adjusts the CAKE qdisc RTT parameter
-func (s *CakeAutoRTTService) adjustCakeRTT(targetRTTMs float64) error {
-	// Read relevant config fields under lock to avoid races with UpdateConfig
-	s.mutex.RLock()
-	margin := s.config.RTTMarginPercent
-	dlIface := s.config.DLInterface
-	ulIface := s.config.ULInterface
-	s.mutex.RUnlock()
+// adjustTargetRTT smooths rttMs for one interface, adds the interface's
+// margin, clamps it to its bounds and applies it to the qdisc unless the
+// dead-band/hold gate suppresses the change. The default_rtt fallback used
+// when nothing was measured is not a measurement: it is applied as is and
+// leaves the smoother untouched, so real samples resume from where they were.
+func (s *CakeAutoRTTService) adjustTargetRTT(t *rttTarget, rttMs float64, measured bool, activeHosts int) error {
+	now := time.Now()
 
-	// Add margin to measured RTT
-	adjustedRTT := targetRTTMs * (1.0 + float64(margin)/100.0)
+	// Smooth the aggregate so single-cycle jitter does not reach the qdisc
+	s.mutex.Lock()
+	smoothedRTT := rttMs
+	if measured {
+		smoothedRTT = t.smoother.Update(rttMs)
+	}
 
-	// Convert to microseconds for tc command
+	// Add margin to smoothed RTT and keep it within the interface bounds
+	adjustedRTT := t.clampRTT(smoothedRTT * (1.0 + float64(t.RTTMarginPercent)/100.0))
+
+	// Convert to microseconds for the qdisc
 	rttUs := int(adjustedRTT * 1000)
 
-	s.AddLog("INFO", fmt.Sprintf("Adjusting CAKE RTT to %.2fms (%dus)", adjustedRTT, rttUs))
+	// Update RTT tracking with final adjusted value and consult the dead-band/hold gate
+	t.status.Source = "default"
+	if measured {
+		t.status.Source = "measured"
+		t.status.Stats = s.lastRTTStats
+		t.status.FamilyStats = s.lastFamilyStats
+	}
+	t.status.RawMs = int(rttMs)
+	if measured {
+		t.status.SmoothedMs = int(smoothedRTT)
+	}
+	t.status.FinalMs = int(adjustedRTT)
+	t.status.ActiveHosts = activeHosts
+	apply, reason := true, ""
+	if measured {
+		apply, reason = t.gate.check(rttUs, now)
+	} else if t.gate.applied && t.gate.appliedUs == rttUs {
+		apply, reason = false, "unchanged"
+	}
+	if !apply {
+		t.status.Updates.Skipped++
+		t.status.Updates.LastSkipReason = reason
+		t.record(RTTHistoryPoint{Time: now, RTTMs: int(adjustedRTT), Measured: measured})
+	}
+	s.mutex.Unlock()
+
+	if !apply {
+		s.AddLog("DEBUG", fmt.Sprintf("Skipping CAKE RTT update on %s to %.2fms (%dus): %s", t.Name, adjustedRTT, rttUs, reason))
+		return nil
+	}
+
+	s.AddLog("INFO", fmt.Sprintf("Adjusting CAKE RTT on %s to %.2fms (%dus)", t.Name, adjustedRTT, rttUs))
+	err := s.updateInterfaceRTT(t.Name, rttUs)
 
-	// Update RTT tracking with final adjusted value
 	s.mutex.Lock()
-	s.lastRTT["final"] = int(adjustedRTT)
+	if err == nil {
+		t.gate.markApplied(rttUs, now)
+		t.status.Updates.Applied++
+	}
+	t.record(RTTHistoryPoint{Time: now, RTTMs: int(adjustedRTT), Measured: measured, Applied: err == nil})
 	s.mutex.Unlock()
 
-	// Update download interface
-	if dlIface != "" {
-		if err := s.updateInterfaceRTT(dlIface, rttUs); err != nil {
-			s.AddLog("ERROR", fmt.Sprintf("Failed to update RTT on download interface %s: %v",
-				dlIface, err))
-		} else {
-			s.AddLog("DEBUG", fmt.Sprintf("Updated RTT on download interface %s", dlIface))
-		}
+	if err != nil {
+		s.metrics.observeQdiscError(t.Name, "rtt")
+		return fmt.Errorf("failed to update RTT on %s: %w", t.Name, err)
 	}
+	return nil
+}
 
-	// Update upload interface
-	if ulIface != "" {
-		if err := s.updateInterfaceRTT(ulIface, rttUs); err != nil {
-			s.AddLog("ERROR", fmt.Sprintf("Failed to update RTT on upload interface %s: %v",
-				ulIface, err))
-		} else {
-			s.AddLog("DEBUG", fmt.Sprintf("Updated RTT on upload interface %s", ulIface))
+// adjustCakeBandwidth runs one autorate cycle with the aggregate RTT and
+// applies any bandwidth changes to the DL/UL qdiscs
+func (s *CakeAutoRTTService) adjustCakeBandwidth(rttMs float64) {
+	s.mutex.RLock()
+	autorate := s.autorate
+	s.mutex.RUnlock()
+	if autorate == nil {
+		return
+	}
+
+	qdiscs, err := s.GetQdiscStats()
+	if err != nil {
+		s.AddLog("ERROR", fmt.Sprintf("Autorate: %v", err))
+		return
+	}
+	bytesByIface := make(map[string]uint64, len(qdiscs))
+	for _, q := range qdiscs {
+		if q.Parent == "root" {
+			bytesByIface[q.Interface] = q.Bytes
 		}
 	}
 
-	return nil
+	for _, c := range autorate.update(rttMs, bytesByIface, time.Now()) {
+		if err := s.qdisc.SetBandwidth(c.iface, c.rateBps); err != nil {
+			s.metrics.observeQdiscError(c.iface, "bandwidth")
+			s.AddLog("ERROR", fmt.Sprintf("Failed to set bandwidth on %s: %v", c.iface, err))
+			continue
+		}
+		autorate.markApplied(c.iface, c.rateBps)
+		s.AddLog("INFO", fmt.Sprintf("Autorate: %s bandwidth %s (%s)", c.iface, formatTCRate(c.rateBps), c.state))
+	}
 }
 
 // Stop stops the service
@@ -802,32 +1918,88 @@ func (s *CakeAutoRTTService) GetSystemStatus() SystemStatus {
 	cfgCopy := *s.config
 	running := s.running
 	lastUpdate := s.lastUpdate
-	lastRTT := make(map[string]int, len(s.lastRTT))
-	for k, v := range s.lastRTT {
-		lastRTT[k] = v
+	// RTTUpdates sums the per-interface counters; the smoothing state shown
+	// is that of the first managed interface
+	current := make(map[string]InterfaceRTTStatus, len(s.targets))
+	var updates RTTUpdateStats
+	for i, t := range s.targets {
+		st := t.snapshot()
+		current[t.Name] = st
+		if i == 0 {
+			updates = st.Updates
+			continue
+		}
+		updates.Applied += st.Updates.Applied
+		updates.Skipped += st.Updates.Skipped
+		if updates.LastSkipReason == "" {
+			updates.LastSkipReason = st.Updates.LastSkipReason
+		}
 	}
 	active := s.activeHosts
+	var rttStats *RTTStats
+	if s.lastRTTStats != nil {
+		statsCopy := *s.lastRTTStats
+		rttStats = &statsCopy
+	}
+	familyStats := s.lastFamilyStats
+	conntrackBackend := ""
+	if s.conntrackSource != nil {
+		conntrackBackend = s.conntrackSource.Name()
+	}
+	qdiscBackend := ""
+	if s.qdisc != nil {
+		qdiscBackend = s.qdisc.Name()
+	}
+	var autorate *AutorateStatus
+	if s.autorate != nil {
+		st := s.autorate.status()
+		autorate = &st
+	}
+	cycles := s.cycles
+	var adaptive *AdaptiveStatus
+	if cfgCopy.AdaptiveControllerEnabled {
+		st := s.adaptive
+		st.MaxWorkers = clampProbeWorkers(cfgCopy.MaxConcurrentProbes)
+		st.Workers = st.MaxWorkers
+		if s.adaptiveWorkers > 0 && s.adaptiveWorkers < st.Workers {
+			st.Workers = s.adaptiveWorkers
+		}
+		adaptive = &st
+	}
 	s.mutex.RUnlock()
+	if adaptive != nil {
+		adaptive.InFlight = s.probeSlots.active()
+	}
 
 	return SystemStatus{
-		Running:     running,
-		LastUpdate:  lastUpdate,
-		CurrentRTT:  lastRTT,
-		ActiveHosts: active, // Use the properly tracked active hosts count
-		DLInterface: cfgCopy.DLInterface,
-		ULInterface: cfgCopy.ULInterface,
-		Config:      &cfgCopy,
+		Running:          running,
+		LastUpdate:       lastUpdate,
+		CurrentRTT:       current,
+		ActiveHosts:      active, // Use the properly tracked active hosts count
+		DLInterface:      cfgCopy.DLInterface,
+		ULInterface:      cfgCopy.ULInterface,
+		Config:           &cfgCopy,
+		RTTStats:         rttStats,
+		RTTStatsByFamily: familyStats,
+		RTTUpdates:       updates,
+		ConntrackBackend: conntrackBackend,
+		QdiscBackend:     qdiscBackend,
+		Autorate:         autorate,
+		Cycles:           cycles,
+		Adaptive:         adaptive,
 	}
 }
 
-// GetQdiscStats returns the current qdisc statistics
-func (s *CakeAutoRTTService) GetQdiscStats() (string, error) {
-	cmd := exec.Command("tc", "-s", "qdisc")
-	output, err := cmd.Output()
+// GetQdiscStats returns the current CAKE qdiscs and their statistics
+func (s *CakeAutoRTTService) GetQdiscStats() ([]CakeQdisc, error) {
+	if s.qdisc == nil {
+		return nil, fmt.Errorf("no qdisc backend available")
+	}
+	qdiscs, err := s.qdisc.CakeQdiscs()
 	if err != nil {
-		return "", fmt.Errorf("failed to get qdisc stats: %v", err)
+		return nil, fmt.Errorf("failed to get qdisc stats: %v", err)
 	}
-	return string(output), nil
+	return qdiscs, nil
 }
 
 // getAdaptiveWorkers returns the current adaptive worker cap
@@ -849,32 +2021,57 @@ func (s *CakeAutoRTTService) setAdaptiveWorkers(n int) {
 	s.mutex.Lock()
 	s.adaptiveWorkers = n
 	s.mutex.Unlock()
+	// let probes waiting for a slot re-check a raised cap
+	s.probeSlots.notify()
+}
+
+// probeWorkerCap returns how many probes may be in flight: max_concurrent_probes,
+// lowered by the adaptive controller when it is enabled
+func (s *CakeAutoRTTService) probeWorkerCap() int {
+	s.mutex.RLock()
+	limit := clampProbeWorkers(s.config.MaxConcurrentProbes)
+	adaptive := s.config.AdaptiveControllerEnabled
+	workers := s.adaptiveWorkers
+	s.mutex.RUnlock()
+	if adaptive && workers > 0 && workers < limit {
+		return workers
+	}
+	return limit
 }
 
-// computeAdaptiveTarget computes a new worker target given current workers, configured max, and cpu usage
-func (s *CakeAutoRTTService) computeAdaptiveTarget(current, cfgMax int, cpuUsage float64) int {
-	target := current
-	if cpuUsage > 80.0 {
-		target = int(float64(current) * 0.7)
+// computeAdaptiveTarget computes a new worker target from the current cap, the
+// configured max and the latest load signals, and describes the decision.
+// Any overloaded signal shrinks the cap to 70%; it grows by ~10% only while
+// the whole system is idle.
+func (s *CakeAutoRTTService) computeAdaptiveTarget(current, cfgMax int, sig AdaptiveSignals) (int, string) {
+	if current > cfgMax {
+		return cfgMax, fmt.Sprintf("clamp to max_concurrent_probes %d", cfgMax)
+	}
+	if why := sig.overloaded(); len(why) > 0 {
+		target := int(float64(current) * 0.7)
 		if target < 1 {
 			target = 1
 		}
-	} else if cpuUsage < 30.0 {
-		target = int(float64(current)*1.1) + 1
+		return target, "shrink: " + strings.Join(why, ", ")
+	}
+	if sig.idle() {
+		target := int(float64(current)*1.1) + 1
 		if target > cfgMax {
 			target = cfgMax
 		}
+		return target, "grow: system idle"
 	}
-	return target
+	return current, "hold"
 }
 
-// startAdaptiveController runs a background loop sampling /proc/stat and
-// adjusting the adaptive worker cap based on CPU utilization. It is a
-// lightweight, best-effort controller intended for OpenWrt and Linux.
+// startAdaptiveController runs a background loop sampling CPU and softirq
+// time from /proc/stat, the load average and memory pressure (PSI), and
+// adjusts the probe worker cap. It is a lightweight, best-effort controller
+// intended for OpenWrt and Linux.
 func (s *CakeAutoRTTService) startAdaptiveController() {
-	// sample loop using injectable cpuReader and cpuSampleInterval
+	// sample loop using injectable readers and cpuSampleInterval
 	// initial sample
-	prevTotal, prevIdle, err := s.cpuReader()
+	prev, err := s.cpuReader()
 	if err != nil {
 		return
 	}
@@ -887,29 +2084,46 @@ func (s *CakeAutoRTTService) startAdaptiveController() {
 		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			total, idle, err := s.cpuReader()
+			cur, err := s.cpuReader()
 			if err != nil {
 				continue
 			}
-			dTotal := float64(total - prevTotal)
-			dIdle := float64(idle - prevIdle)
-			prevTotal = total
-			prevIdle = idle
-			if dTotal <= 0 {
+			cpu, softirq, ok := cpuSignals(prev, cur)
+			prev = cur
+			if !ok {
 				continue
 			}
-			cpuUsage := (1.0 - dIdle/dTotal) * 100.0
+			sig := AdaptiveSignals{CPUPercent: cpu, SoftirqPercent: softirq}
+			// Load average and PSI are optional; kernels without PSI leave it at 0
+			if s.loadReader != nil {
+				if v, err := s.loadReader(); err == nil {
+					sig.Load1PerCPU = v
+				}
+			}
+			if s.psiReader != nil {
+				if v, err := s.psiReader(); err == nil {
+					sig.MemoryPressure = v
+				}
+			}
 
 			s.mutex.RLock()
-			cfgMax := s.config.MaxConcurrentProbes
+			cfgMax := clampProbeWorkers(s.config.MaxConcurrentProbes)
 			s.mutex.RUnlock()
 
 			current := s.getAdaptiveWorkers()
-			target := s.computeAdaptiveTarget(current, cfgMax, cpuUsage)
+			target, decision := s.computeAdaptiveTarget(current, cfgMax, sig)
+
+			s.mutex.Lock()
+			s.adaptive.Signals = sig
+			s.adaptive.LastDecision = decision
+			if target != current {
+				s.adaptive.LastChange = time.Now()
+			}
+			s.mutex.Unlock()
 
 			if target != current {
 				s.setAdaptiveWorkers(target)
-				s.AddLog("INFO", fmt.Sprintf("Adaptive controller adjusted workers: %d -> %d (cpu %.1f%%)", current, target, cpuUsage))
+				s.AddLog("INFO", fmt.Sprintf("Adaptive controller adjusted workers: %d -> %d (%s)", current, target, decision))
 			}
 		}
 	}
@@ -954,47 +2168,122 @@ func (s *CakeAutoRTTService) pruneCompletedProbes() {
 	}
 }
 
-// UpdateConfig safely updates the service configuration at runtime
-func (s *CakeAutoRTTService) UpdateConfig(newCfg *Config) {
+// UpdateConfig validates a reloaded configuration and switches the service
+// to a private copy of it. An invalid configuration is returned as an error
+// and the previous one stays in effect. Settings only read at startup keep
+// their running values until a restart.
+func (s *CakeAutoRTTService) UpdateConfig(newCfg *Config) error {
+	if err := validateConfig(newCfg); err != nil {
+		return err
+	}
+	// Auto-detection fills in dl/ul_interface, so never write to the
+	// caller's struct, which the web server may be reading
+	cfg := *newCfg
+	newCfg = &cfg
+
+	// Reloads are serialized by configMu, so s.config only changes below.
+	// Everything that may fork tc or fail is done before taking s.mutex,
+	// which the status API and the measurement cycle wait on.
+	s.mutex.RLock()
+	keepRestartSettings(newCfg, s.config)
+	s.mutex.RUnlock()
+
+	// A reload resets dl/ul_interface to the file values; re-detect empty ones
+	if err := s.autoDetectInterfaces(newCfg); err != nil {
+		s.AddLog("ERROR", fmt.Sprintf("Failed to auto-detect interfaces after reload: %v", err))
+	}
+	targets, err := buildRTTTargets(newCfg)
+	if err != nil {
+		return fmt.Errorf("invalid interfaces config: %w", err)
+	}
+	if newCfg.AutorateEnabled {
+		if _, err := newAutorateController(newCfg); err != nil {
+			return fmt.Errorf("invalid autorate config: %w", err)
+		}
+	}
+	rules, err := newDestRules(newCfg)
+	if err != nil {
+		return err
+	}
+	clients, err := newClientSet(newCfg)
+	if err != nil {
+		return err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+
+	// Abort the in-flight cycle so the next tick measures with the new settings
+	if s.cycleCancel != nil {
+		s.cycleCancel()
+		s.AddLog("INFO", "Cancelled in-flight measurement cycle for config reload")
+	}
+	// Per-interface state (smoother, gate, history) carries over by name
+	inheritRTTTargets(newCfg, targets, s.targets)
 	s.config = newCfg
+	s.destRules = rules
+	s.clients, s.resolvedClients = clients, nil
+	s.targets = targets
+	// A raised max_concurrent_probes frees waiting probes right away
+	s.probeSlots.notify()
+	s.reconfigureAutorate(newCfg)
 	s.AddLog("INFO", fmt.Sprintf("Configuration reloaded: min_hosts=%d max_hosts=%d max_concurrent_probes=%d",
 		newCfg.MinHosts, newCfg.MaxHosts, newCfg.MaxConcurrentProbes))
+	return nil
+}
+
+// reconfigureAutorate starts, stops or retunes the bandwidth controller after a
+// config reload. Must be called with s.mutex held, after interface detection.
+func (s *CakeAutoRTTService) reconfigureAutorate(newCfg *Config) {
+	if !newCfg.AutorateEnabled {
+		if s.autorate != nil {
+			s.AddLog("INFO", "Autorate disabled; leaving CAKE bandwidth at its current value")
+		}
+		s.autorate = nil
+		return
+	}
+
+	if s.autorate == nil {
+		autorate, err := newAutorateController(newCfg)
+		if err != nil {
+			s.AddLog("ERROR", fmt.Sprintf("Invalid autorate config, autorate stays disabled: %v", err))
+			return
+		}
+		s.autorate = autorate
+		return
+	}
+	if err := s.autorate.configure(newCfg); err != nil {
+		s.AddLog("ERROR", fmt.Sprintf("Invalid autorate config, keeping previous limits: %v", err))
+	}
 }
 
 // updateInterfaceRTT updates the RTT parameter for a specific interface
 func (s *CakeAutoRTTService) updateInterfaceRTT(iface string, rttUs int) error {
-	cmd := exec.Command("tc", "qdisc", "change", "root", "dev", iface, "cake", "rtt", fmt.Sprintf("%dus", rttUs))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("tc command failed: %w, output: %s", err, string(output))
+	if s.qdisc == nil {
+		return fmt.Errorf("no qdisc backend available")
 	}
-	return nil
+	return s.qdisc.SetRTT(iface, rttUs)
 }
 
-// autoDetectInterfaces automatically detects CAKE-enabled interfaces
-func (s *CakeAutoRTTService) autoDetectInterfaces() error {
-	if s.config.DLInterface != "" && s.config.ULInterface != "" {
+// autoDetectInterfaces fills in the empty dl_interface and ul_interface of cfg
+// from the interfaces running CAKE
+func (s *CakeAutoRTTService) autoDetectInterfaces(cfg *Config) error {
+	if cfg.DLInterface != "" && cfg.ULInterface != "" {
 		return nil // Both interfaces already specified
 	}
 
 	s.AddLog("DEBUG", "Auto-detecting CAKE interfaces")
 
 	// Find interfaces with CAKE qdisc
-	cmd := exec.Command("tc", "qdisc", "show")
-	output, err := cmd.Output()
+	qdiscs, err := s.GetQdiscStats()
 	if err != nil {
-		return fmt.Errorf("failed to run tc qdisc show: %w", err)
+		return err
 	}
 
 	var cakeInterfaces []string
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "qdisc cake") {
-			parts := strings.Fields(line)
-			if len(parts) >= 5 {
-				cakeInterfaces = append(cakeInterfaces, parts[4])
-			}
+	for _, q := range qdiscs {
+		if q.Interface != "" {
+			cakeInterfaces = append(cakeInterfaces, q.Interface)
 		}
 	}
 
@@ -1003,29 +2292,29 @@ func (s *CakeAutoRTTService) autoDetectInterfaces() error {
 	}
 
 	// Auto-detect download interface (prefer ifb-* interfaces)
-	if s.config.DLInterface == "" {
+	if cfg.DLInterface == "" {
 		for _, iface := range cakeInterfaces {
 			if strings.HasPrefix(iface, "ifb") {
-				s.config.DLInterface = iface
+				cfg.DLInterface = iface
 				break
 			}
 		}
-		if s.config.DLInterface == "" && len(cakeInterfaces) > 0 {
-			s.config.DLInterface = cakeInterfaces[0]
+		if cfg.DLInterface == "" && len(cakeInterfaces) > 0 {
+			cfg.DLInterface = cakeInterfaces[0]
 		}
 	}
 
 	// Auto-detect upload interface (prefer non-ifb interfaces)
-	if s.config.ULInterface == "" {
+	if cfg.ULInterface == "" {
 		for _, iface := range cakeInterfaces {
 			if !strings.HasPrefix(iface, "ifb") {
-				s.config.ULInterface = iface
+				cfg.ULInterface = iface
 				break
 			}
 		}
-		if s.config.ULInterface == "" && len(cakeInterfaces) > 0 {
+		if cfg.ULInterface == "" && len(cakeInterfaces) > 0 {
 			// Use the last interface if no non-ifb interface found
-			s.config.ULInterface = cakeInterfaces[len(cakeInterfaces)-1]
+			cfg.ULInterface = cakeInterfaces[len(cakeInterfaces)-1]
 		}
 	}
 
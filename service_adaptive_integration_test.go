@@ -27,14 +27,14 @@ func TestAdaptiveControllerIntegration(t *testing.T) {
 		{1200, 1190}, // low CPU (~10%) -> should increase
 	}
 	idx := 0
-	s.cpuReader = func() (uint64, uint64, error) {
+	s.cpuReader = func() (cpuTimes, error) {
 		if idx >= len(samples) {
 			last := samples[len(samples)-1]
-			return last.total, last.idle, nil
+			return cpuTimes{total: last.total, idle: last.idle}, nil
 		}
 		v := samples[idx]
 		idx++
-		return v.total, v.idle, nil
+		return cpuTimes{total: v.total, idle: v.idle}, nil
 	}
 
 	// Start the adaptive controller
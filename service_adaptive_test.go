@@ -1,27 +1,121 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestComputeAdaptiveTarget(t *testing.T) {
 	s := &CakeAutoRTTService{}
 
 	// High CPU should reduce workers to ~70% (int truncation)
-	if got := s.computeAdaptiveTarget(100, 200, 85.0); got != 70 {
+	if got, _ := s.computeAdaptiveTarget(100, 200, AdaptiveSignals{CPUPercent: 85.0}); got != 70 {
 		t.Fatalf("high cpu reduce: got %d want %d", got, 70)
 	}
 
 	// Very high CPU with current=1 should not go below 1
-	if got := s.computeAdaptiveTarget(1, 100, 95.0); got != 1 {
+	if got, _ := s.computeAdaptiveTarget(1, 100, AdaptiveSignals{CPUPercent: 95.0}); got != 1 {
 		t.Fatalf("min worker: got %d want %d", got, 1)
 	}
 
 	// Low CPU should increase workers by ~10%% + 1, capped at cfgMax
-	if got := s.computeAdaptiveTarget(10, 200, 10.0); got != 12 {
+	if got, _ := s.computeAdaptiveTarget(10, 200, AdaptiveSignals{CPUPercent: 10.0}); got != 12 {
 		t.Fatalf("low cpu increase: got %d want %d", got, 12)
 	}
 
 	// When increase would exceed cfgMax, it should clamp to cfgMax
-	if got := s.computeAdaptiveTarget(190, 200, 10.0); got != 200 {
+	if got, _ := s.computeAdaptiveTarget(190, 200, AdaptiveSignals{CPUPercent: 10.0}); got != 200 {
 		t.Fatalf("cap to cfgMax: got %d want %d", got, 200)
 	}
 }
+
+func TestComputeAdaptiveTargetSignals(t *testing.T) {
+	s := &CakeAutoRTTService{}
+	cases := []struct {
+		sig  AdaptiveSignals
+		want int
+	}{
+		{AdaptiveSignals{CPUPercent: 20, SoftirqPercent: 45}, 70},  // forwarding saturates softirq
+		{AdaptiveSignals{CPUPercent: 20, Load1PerCPU: 2.5}, 70},    // run queue backed up
+		{AdaptiveSignals{CPUPercent: 20, MemoryPressure: 25}, 70},  // tasks stalled on memory
+		{AdaptiveSignals{CPUPercent: 20, SoftirqPercent: 15}, 100}, // between the marks: hold
+		{AdaptiveSignals{CPUPercent: 20, SoftirqPercent: 5}, 111},  // everything idle: grow
+	}
+	for i, c := range cases {
+		if got, why := s.computeAdaptiveTarget(100, 200, c.sig); got != c.want {
+			t.Fatalf("case %d: got %d (%s), want %d", i, got, why, c.want)
+		}
+	}
+	// A lowered max_concurrent_probes clamps the cap regardless of load
+	if got, _ := s.computeAdaptiveTarget(100, 50, AdaptiveSignals{}); got != 50 {
+		t.Fatalf("expected clamp to 50, got %d", got)
+	}
+}
+
+func TestParseLoadSignals(t *testing.T) {
+	times, err := parseCPUTimes("cpu  100 0 50 800 10 5 35 0 0 0\ncpu0 1 2 3 4\n")
+	if err != nil || times.total != 1000 || times.idle != 800 || times.softirq != 35 {
+		t.Fatalf("unexpected cpu times: %+v, %v", times, err)
+	}
+	cpu, softirq, ok := cpuSignals(cpuTimes{total: 1000, idle: 800, softirq: 35}, cpuTimes{total: 1100, idle: 840, softirq: 75})
+	if !ok || int(cpu+0.5) != 60 || int(softirq+0.5) != 40 {
+		t.Fatalf("unexpected signals: cpu %.1f softirq %.1f", cpu, softirq)
+	}
+
+	psi := "some avg10=12.50 avg60=3.00 avg300=1.00 total=123\nfull avg10=2.00 avg60=0.00 avg300=0.00 total=45\n"
+	if v, err := parsePSISomeAvg10(psi); err != nil || v != 12.5 {
+		t.Fatalf("unexpected psi: %v, %v", v, err)
+	}
+	if _, err := parsePSISomeAvg10("garbage"); err == nil {
+		t.Fatalf("expected error for malformed psi")
+	}
+}
+
+func TestProbePoolHonorsAdaptiveCap(t *testing.T) {
+	cfg := &Config{MaxConcurrentProbes: 8, MinHosts: 1, TCPConnectTimeout: 1, AdaptiveControllerEnabled: true}
+	s := &CakeAutoRTTService{config: cfg, adaptiveWorkers: 4, currentProbes: make(map[string]ProbeStatus)}
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	var starts []int
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		starts = append(starts, inFlight)
+		// Shrink the cap mid-cycle, as the controller would under load
+		if len(starts) == 6 {
+			s.setAdaptiveWorkers(1)
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return 5 * time.Millisecond, "tcp", nil
+	}
+
+	hosts := make([]string, 24)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("h%d", i)
+	}
+	if _, alive, err := s.measureRTTTCP(hosts); err != nil || alive != len(hosts) {
+		t.Fatalf("measure: alive %d, %v", alive, err)
+	}
+	if peak > 4 {
+		t.Fatalf("pool exceeded the adaptive cap: peak %d", peak)
+	}
+	for i, n := range starts[len(starts)-10:] {
+		if n != 1 {
+			t.Fatalf("probe %d started with %d in flight after the cap shrank to 1", len(starts)-10+i, n)
+		}
+	}
+	if s.probeSlots.active() != 0 {
+		t.Fatalf("slots leaked: %d", s.probeSlots.active())
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -20,16 +21,16 @@ func TestMeasureRTTTCPWithMockProbe(t *testing.T) {
 	}
 
 	// Inject a fake probe function: h1 -> 10ms, h2 -> fail, h3 -> 50ms
-	s.ProbeFunc = func(host string, timeoutSec int) (time.Duration, error) {
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
 		switch host {
 		case "h1":
-			return 10 * time.Millisecond, nil
+			return 10 * time.Millisecond, "tcp", nil
 		case "h2":
-			return 0, fmt.Errorf("unreachable")
+			return 0, "", fmt.Errorf("unreachable")
 		case "h3":
-			return 50 * time.Millisecond, nil
+			return 50 * time.Millisecond, "tcp", nil
 		default:
-			return 0, fmt.Errorf("unknown host")
+			return 0, "", fmt.Errorf("unknown host")
 		}
 	}
 
@@ -60,8 +61,8 @@ func TestMeasureRTTTCPAllFail(t *testing.T) {
 	}
 
 	// All probes fail
-	s.ProbeFunc = func(host string, timeoutSec int) (time.Duration, error) {
-		return 0, fmt.Errorf("down")
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		return 0, "", fmt.Errorf("down")
 	}
 
 	hosts := []string{"a", "b"}
@@ -91,8 +92,8 @@ func TestCompletedProbesBuffer(t *testing.T) {
 	s.completedRetentionSec = 1
 	s.completedMaxEntries = 2
 
-	s.ProbeFunc = func(host string, timeoutSec int) (time.Duration, error) {
-		return 5 * time.Millisecond, nil
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		return 5 * time.Millisecond, "tcp", nil
 	}
 
 	hosts := []string{"x", "y", "z"}
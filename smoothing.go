@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// RTTSmoother filters the per-cycle aggregate RTT before it is applied to CAKE
+type RTTSmoother interface {
+	Name() string
+	// Update feeds a new measurement (ms) and returns the smoothed value
+	Update(rttMs float64) float64
+	// Value returns the current smoothed value and whether one exists
+	Value() (float64, bool)
+}
+
+// NewRTTSmoother returns the smoother selected by the rtt_smoothing config key:
+// none, ewma or kalman. An empty name disables smoothing.
+func NewRTTSmoother(cfg *Config) (RTTSmoother, error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.RTTSmoothing)) {
+	case "", "none", "off":
+		return &passthroughSmoother{}, nil
+	case "ewma":
+		alpha := cfg.RTTSmoothingAlpha
+		if alpha <= 0 || alpha > 1 {
+			return nil, fmt.Errorf("rtt_smoothing_alpha must be in (0, 1], got %g", alpha)
+		}
+		return &ewmaSmoother{alpha: alpha}, nil
+	case "kalman":
+		if cfg.RTTKalmanProcessNoise <= 0 || cfg.RTTKalmanMeasurementNoise <= 0 {
+			return nil, fmt.Errorf("rtt_kalman_process_noise and rtt_kalman_measurement_noise must be positive")
+		}
+		return &kalmanSmoother{q: cfg.RTTKalmanProcessNoise, r: cfg.RTTKalmanMeasurementNoise}, nil
+	default:
+		return nil, fmt.Errorf("unknown rtt_smoothing %q", cfg.RTTSmoothing)
+	}
+}
+
+// smootherSignature identifies the smoothing settings so config reloads can
+// tell whether the filter needs to be rebuilt
+func smootherSignature(cfg *Config) string {
+	return fmt.Sprintf("%s/%g/%g/%g", strings.ToLower(strings.TrimSpace(cfg.RTTSmoothing)),
+		cfg.RTTSmoothingAlpha, cfg.RTTKalmanProcessNoise, cfg.RTTKalmanMeasurementNoise)
+}
+
+// passthroughSmoother applies no filtering
+type passthroughSmoother struct {
+	value float64
+	ok    bool
+}
+
+func (p *passthroughSmoother) Name() string { return "none" }
+
+func (p *passthroughSmoother) Update(rttMs float64) float64 {
+	p.value, p.ok = rttMs, true
+	return rttMs
+}
+
+func (p *passthroughSmoother) Value() (float64, bool) { return p.value, p.ok }
+
+// ewmaSmoother is an exponentially weighted moving average; higher alpha
+// follows new measurements more quickly
+type ewmaSmoother struct {
+	alpha float64
+	value float64
+	ok    bool
+}
+
+func (e *ewmaSmoother) Name() string { return fmt.Sprintf("ewma(%.2f)", e.alpha) }
+
+func (e *ewmaSmoother) Update(rttMs float64) float64 {
+	if !e.ok {
+		e.value, e.ok = rttMs, true
+		return e.value
+	}
+	e.value = e.alpha*rttMs + (1-e.alpha)*e.value
+	return e.value
+}
+
+func (e *ewmaSmoother) Value() (float64, bool) { return e.value, e.ok }
+
+// kalmanSmoother is a one-dimensional Kalman filter with a random-walk model.
+// q is the process noise (how fast the true RTT drifts, ms^2) and r the
+// measurement noise (per-cycle jitter, ms^2).
+type kalmanSmoother struct {
+	q, r  float64
+	value float64
+	p     float64
+	ok    bool
+}
+
+func (k *kalmanSmoother) Name() string { return "kalman" }
+
+func (k *kalmanSmoother) Update(rttMs float64) float64 {
+	if !k.ok {
+		k.value, k.p, k.ok = rttMs, k.r, true
+		return k.value
+	}
+	// predict
+	k.p += k.q
+	// correct
+	gain := k.p / (k.p + k.r)
+	k.value += gain * (rttMs - k.value)
+	k.p *= 1 - gain
+	return k.value
+}
+
+func (k *kalmanSmoother) Value() (float64, bool) { return k.value, k.ok }
+
+// rttUpdateGate implements the dead-band and minimum hold time that decide
+// whether a new RTT is different enough from the applied one to be worth a
+// `tc qdisc change` (which resets CAKE's internal state)
+type rttUpdateGate struct {
+	deadbandUs      int
+	deadbandPercent float64
+	minHold         time.Duration
+
+	appliedUs int
+	appliedAt time.Time
+	applied   bool
+}
+
+// configure updates the gate thresholds while keeping the last applied value
+func (g *rttUpdateGate) configure(cfg *Config) {
+	g.deadbandUs = cfg.RTTDeadbandUs
+	g.deadbandPercent = cfg.RTTDeadbandPercent
+	g.minHold = time.Duration(cfg.RTTMinHoldSec) * time.Second
+}
+
+// check reports whether rttUs should be applied at now, and if not, why
+func (g *rttUpdateGate) check(rttUs int, now time.Time) (bool, string) {
+	if !g.applied {
+		return true, ""
+	}
+
+	delta := int(math.Abs(float64(rttUs - g.appliedUs)))
+	if delta == 0 {
+		return false, "unchanged"
+	}
+	if delta < g.deadbandUs {
+		return false, fmt.Sprintf("change %dus below dead-band %dus", delta, g.deadbandUs)
+	}
+	if g.appliedUs > 0 {
+		pct := float64(delta) / float64(g.appliedUs) * 100
+		if pct < g.deadbandPercent {
+			return false, fmt.Sprintf("change %.1f%% below dead-band %.1f%%", pct, g.deadbandPercent)
+		}
+	}
+	if held := now.Sub(g.appliedAt); held < g.minHold {
+		return false, fmt.Sprintf("held %s of minimum %s", held.Round(time.Second), g.minHold)
+	}
+	return true, ""
+}
+
+// markApplied records rttUs as the value now active on the qdisc
+func (g *rttUpdateGate) markApplied(rttUs int, now time.Time) {
+	g.appliedUs = rttUs
+	g.appliedAt = now
+	g.applied = true
+}
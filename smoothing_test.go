@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEWMASmoother(t *testing.T) {
+	sm, err := NewRTTSmoother(&Config{RTTSmoothing: "ewma", RTTSmoothingAlpha: 0.5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := sm.Update(100); got != 100 {
+		t.Fatalf("first sample should seed the filter: got %.2f", got)
+	}
+	if got := sm.Update(50); got != 75 {
+		t.Fatalf("ewma step: got %.2f want 75", got)
+	}
+	if got := sm.Update(75); got != 75 {
+		t.Fatalf("ewma steady: got %.2f want 75", got)
+	}
+}
+
+func TestKalmanSmootherConverges(t *testing.T) {
+	sm, err := NewRTTSmoother(&Config{RTTSmoothing: "kalman", RTTKalmanProcessNoise: 1, RTTKalmanMeasurementNoise: 50})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		sm.Update(100)
+	}
+	// Once settled, a single spike should be heavily damped
+	if got := sm.Update(300); got > 200 {
+		t.Fatalf("kalman should damp a spike, got %.2f", got)
+	}
+	// A sustained level shift should eventually be followed
+	var got float64
+	for i := 0; i < 200; i++ {
+		got = sm.Update(40)
+	}
+	if math.Abs(got-40) > 1 {
+		t.Fatalf("kalman should converge to 40, got %.2f", got)
+	}
+}
+
+func TestNewRTTSmootherInvalid(t *testing.T) {
+	bad := []*Config{
+		{RTTSmoothing: "ewma", RTTSmoothingAlpha: 0},
+		{RTTSmoothing: "ewma", RTTSmoothingAlpha: 1.5},
+		{RTTSmoothing: "kalman"},
+		{RTTSmoothing: "median"},
+	}
+	for _, c := range bad {
+		if _, err := NewRTTSmoother(c); err == nil {
+			t.Fatalf("expected error for %+v", c)
+		}
+	}
+	if sm, err := NewRTTSmoother(&Config{}); err != nil || sm.Name() != "none" {
+		t.Fatalf("empty smoothing should be passthrough, got %v, %v", sm, err)
+	}
+}
+
+func TestRTTUpdateGate(t *testing.T) {
+	var g rttUpdateGate
+	g.configure(&Config{RTTDeadbandUs: 2000, RTTDeadbandPercent: 5, RTTMinHoldSec: 10})
+	now := time.Now()
+
+	if ok, _ := g.check(50000, now); !ok {
+		t.Fatalf("first update must always be applied")
+	}
+	g.markApplied(50000, now)
+
+	cases := []struct {
+		rttUs int
+		after time.Duration
+		want  bool
+	}{
+		{50000, time.Minute, false},        // unchanged
+		{51000, time.Minute, false},        // below absolute dead-band
+		{52000, time.Minute, false},        // 4% below relative dead-band
+		{60000, 5 * time.Second, false},    // inside hold time
+		{60000, 10 * time.Second, true},    // large change after hold
+		{40000, 11 * time.Second, true},    // large decrease
+		{100000, 30 * time.Second, true},   // doubling
+		{47600, 30 * time.Second, false},   // 4.8% change
+		{47400, 30 * time.Second, true},    // 5.2% change
+		{49000, 9999 * time.Hour, false},   // dead-band wins regardless of age
+		{80000, 9 * time.Second, false},    // hold wins regardless of size
+		{80000, 10*time.Second + 1, true},  // hold expired
+		{52500, 10*time.Second + 1, true},  // exactly 5% and over 2000us
+		{51100, 10*time.Second + 1, false}, // 2.2%
+	}
+	for i, c := range cases {
+		ok, reason := g.check(c.rttUs, now.Add(c.after))
+		if ok != c.want {
+			t.Fatalf("case %d (%dus after %s): got %v (%s) want %v", i, c.rttUs, c.after, ok, reason, c.want)
+		}
+		if !c.want && reason == "" {
+			t.Fatalf("case %d: skipped update must carry a reason", i)
+		}
+	}
+}
+
+func TestDefaultRTTFallbackBypassesSmoother(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DLInterface, cfg.RTTMarginPercent = "eth0", 0
+	cfg.RTTSmoothing, cfg.RTTSmoothingAlpha = "ewma", 0.5
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeQdiscController{qdiscs: []CakeQdisc{{Interface: "eth0"}}}
+	s := &CakeAutoRTTService{config: cfg, qdisc: fake, targets: targets}
+	target := targets[0]
+
+	if err := s.adjustTargetRTT(target, 40, true, 3); err != nil {
+		t.Fatal(err)
+	}
+	// The fallback is applied right away, inside the hold time, and does
+	// not pull the filter towards the configured constant
+	if err := s.adjustTargetRTT(target, 100, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if fake.changes["eth0"] != 100000 {
+		t.Fatalf("expected default_rtt applied, got %dus", fake.changes["eth0"])
+	}
+	if v, _ := target.smoother.Value(); v != 40 {
+		t.Fatalf("fallback must not reach the smoother, got %.1f", v)
+	}
+	if err := s.adjustTargetRTT(target, 100, false, 0); err != nil || target.status.Updates.Skipped != 1 {
+		t.Fatalf("an unchanged fallback should not be reapplied: %v %+v", err, target.status.Updates)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Passive RTT harvesting from the kernel's TCP_INFO via NETLINK_SOCK_DIAG,
+// i.e. the data behind `ss -ti`. No probe traffic is generated; the RTT is
+// the kernel's own estimate for established sockets on the router.
+
+const (
+	// sizes of struct inet_diag_req_v2 and struct inet_diag_msg
+	inetDiagReqV2Len = 56
+	inetDiagMsgLen   = 72
+	// INET_DIAG_INFO attribute carries struct tcp_info
+	inetDiagInfo = 2
+	// offsets of tcpi_rtt and tcpi_min_rtt (both usec) within struct tcp_info
+	tcpInfoRTTOffset    = 68
+	tcpInfoMinRTTOffset = 148
+	tcpEstablished      = 1
+)
+
+// tcpDiagSocket is the RTT information of one established socket
+type tcpDiagSocket struct {
+	Src    net.IP
+	Dst    net.IP
+	SPort  uint16
+	DPort  uint16
+	RTT    time.Duration
+	MinRTT time.Duration // zero when the kernel does not report it (< 4.6)
+}
+
+// buildInetDiagRequest encodes an inet_diag_req_v2 dumping established TCP
+// sockets of one address family with INET_DIAG_INFO requested
+func buildInetDiagRequest(family uint8) []byte {
+	req := make([]byte, inetDiagReqV2Len)
+	req[0] = family
+	req[1] = unix.IPPROTO_TCP
+	req[2] = 1 << (inetDiagInfo - 1) // idiag_ext
+	binary.NativeEndian.PutUint32(req[4:8], 1<<tcpEstablished)
+	return req
+}
+
+// parseInetDiagMessage decodes one SOCK_DIAG_BY_FAMILY reply payload.
+// ok is false for sockets without tcp_info (e.g. not yet established).
+func parseInetDiagMessage(data []byte) (sock tcpDiagSocket, ok bool, err error) {
+	if len(data) < inetDiagMsgLen {
+		return sock, false, fmt.Errorf("sock_diag: truncated inet_diag_msg (%d bytes)", len(data))
+	}
+
+	family := data[0]
+	// inet_diag_sockid: ports are big-endian, addresses 16 bytes each
+	sock.SPort = binary.BigEndian.Uint16(data[4:6])
+	sock.DPort = binary.BigEndian.Uint16(data[6:8])
+	switch family {
+	case unix.AF_INET:
+		sock.Src = net.IP(append([]byte(nil), data[8:12]...))
+		sock.Dst = net.IP(append([]byte(nil), data[24:28]...))
+	case unix.AF_INET6:
+		sock.Src = net.IP(append([]byte(nil), data[8:24]...))
+		sock.Dst = net.IP(append([]byte(nil), data[24:40]...))
+		// v4-mapped addresses on dual-stack sockets
+		if v4 := sock.Dst.To4(); v4 != nil {
+			sock.Src, sock.Dst = sock.Src.To4(), v4
+		}
+	default:
+		return sock, false, fmt.Errorf("sock_diag: unexpected family %d", family)
+	}
+
+	attrs, err := parseNetlinkAttrs(data[inetDiagMsgLen:])
+	if err != nil {
+		return sock, false, err
+	}
+	for _, a := range attrs {
+		if a.Type != inetDiagInfo || len(a.Value) < tcpInfoRTTOffset+4 {
+			continue
+		}
+		sock.RTT = time.Duration(binary.NativeEndian.Uint32(a.Value[tcpInfoRTTOffset:])) * time.Microsecond
+		if len(a.Value) >= tcpInfoMinRTTOffset+4 {
+			sock.MinRTT = time.Duration(binary.NativeEndian.Uint32(a.Value[tcpInfoMinRTTOffset:])) * time.Microsecond
+		}
+		return sock, sock.RTT > 0, nil
+	}
+	return sock, false, nil
+}
+
+// parseSockDiagReplies decodes all SOCK_DIAG_BY_FAMILY messages of a dump
+func parseSockDiagReplies(msgs []netlinkMessage) ([]tcpDiagSocket, error) {
+	var out []tcpDiagSocket
+	for _, m := range msgs {
+		if m.Type != unix.SOCK_DIAG_BY_FAMILY {
+			continue
+		}
+		sock, ok, err := parseInetDiagMessage(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, sock)
+		}
+	}
+	return out, nil
+}
+
+// dumpTCPSockets returns RTT information for all established IPv4 and IPv6
+// TCP sockets on this host
+func dumpTCPSockets() ([]tcpDiagSocket, error) {
+	var out []tcpDiagSocket
+	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+		msgs, err := netlinkExecute(unix.NETLINK_SOCK_DIAG, unix.SOCK_DIAG_BY_FAMILY,
+			unix.NLM_F_DUMP, buildInetDiagRequest(family))
+		if err != nil {
+			return nil, fmt.Errorf("sock_diag dump (family %d): %w", family, err)
+		}
+		socks, err := parseSockDiagReplies(msgs)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, socks...)
+	}
+	return out, nil
+}
+
+// passiveSamplesFromSockets reduces socket RTTs to one sample per non-LAN
+// destination: the lowest RTT across its sockets, weighted by socket count.
+// useMinRTT selects tcpi_min_rtt over the smoothed tcpi_rtt when available.
+func passiveSamplesFromSockets(socks []tcpDiagSocket, useMinRTT bool, isLAN func(string) bool) []RTTSample {
+	byHost := make(map[string]*RTTSample)
+	var order []string
+	for _, sk := range socks {
+		host := sk.Dst.String()
+		if isLAN(host) {
+			continue
+		}
+		rtt := sk.RTT
+		if useMinRTT && sk.MinRTT > 0 {
+			rtt = sk.MinRTT
+		}
+		rttMs := float64(rtt.Nanoseconds()) / 1e6
+
+		if cur, ok := byHost[host]; ok {
+			if rttMs < cur.RTTMs {
+				cur.RTTMs = rttMs
+			}
+			cur.Weight++
+			continue
+		}
+		byHost[host] = &RTTSample{Host: host, RTTMs: rttMs, Weight: 1, Probe: "passive"}
+		order = append(order, host)
+	}
+
+	out := make([]RTTSample, 0, len(order))
+	for _, h := range order {
+		out = append(out, *byHost[h])
+	}
+	return out
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cannedInetDiagMsg builds a SOCK_DIAG_BY_FAMILY reply as the kernel would
+// send it: nlmsghdr, inet_diag_msg and an INET_DIAG_INFO attribute holding a
+// struct tcp_info with tcpi_rtt / tcpi_min_rtt set (microseconds)
+func cannedInetDiagMsg(seq uint32, src, dst net.IP, sport, dport uint16, rttUs, minRTTUs uint32, infoLen int) []byte {
+	msg := make([]byte, inetDiagMsgLen)
+	family := byte(unix.AF_INET6)
+	if dst.To4() != nil {
+		family = unix.AF_INET
+		src, dst = src.To4(), dst.To4()
+	}
+	msg[0] = family
+	msg[1] = tcpEstablished
+	binary.BigEndian.PutUint16(msg[4:6], sport)
+	binary.BigEndian.PutUint16(msg[6:8], dport)
+	copy(msg[8:24], src)
+	copy(msg[24:40], dst)
+
+	info := make([]byte, infoLen)
+	info[0] = tcpEstablished
+	if infoLen >= tcpInfoRTTOffset+4 {
+		binary.NativeEndian.PutUint32(info[tcpInfoRTTOffset:], rttUs)
+	}
+	if infoLen >= tcpInfoMinRTTOffset+4 {
+		binary.NativeEndian.PutUint32(info[tcpInfoMinRTTOffset:], minRTTUs)
+	}
+
+	// a meminfo attribute before the tcp_info one, as the kernel often emits
+	payload := append(msg, encodeNetlinkAttr(1, make([]byte, 16))...)
+	payload = append(payload, encodeNetlinkAttr(inetDiagInfo, info)...)
+	return encodeNetlinkMessage(unix.SOCK_DIAG_BY_FAMILY, unix.NLM_F_MULTI, seq, payload)
+}
+
+func TestParseSockDiagReplies(t *testing.T) {
+	var dump []byte
+	dump = append(dump, cannedInetDiagMsg(7, net.ParseIP("192.168.1.1"), net.ParseIP("93.184.216.34"), 40000, 443, 23456, 20100, 232)...)
+	dump = append(dump, cannedInetDiagMsg(7, net.ParseIP("2001:db8::1"), net.ParseIP("2606:4700::1111"), 40001, 443, 12000, 11000, 232)...)
+	// pre-4.6 kernel: tcp_info ends before tcpi_min_rtt
+	dump = append(dump, cannedInetDiagMsg(7, net.ParseIP("192.168.1.1"), net.ParseIP("8.8.8.8"), 40002, 53, 30000, 0, 104)...)
+	// v4-mapped destination on a dual-stack socket
+	dump = append(dump, cannedInetDiagMsg(7, net.ParseIP("::ffff:192.168.1.1"), net.ParseIP("::ffff:1.1.1.1"), 40003, 853, 5000, 4000, 232)...)
+	dump = append(dump, encodeNetlinkMessage(unix.NLMSG_DONE, unix.NLM_F_MULTI, 7, make([]byte, 4))...)
+
+	msgs, err := parseNetlinkMessages(dump)
+	if err != nil {
+		t.Fatalf("parse messages: %v", err)
+	}
+	if len(msgs) != 5 {
+		t.Fatalf("expected 5 netlink messages, got %d", len(msgs))
+	}
+
+	socks, err := parseSockDiagReplies(msgs)
+	if err != nil {
+		t.Fatalf("parse sock_diag: %v", err)
+	}
+	if len(socks) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(socks))
+	}
+
+	want := []struct {
+		dst    string
+		dport  uint16
+		rtt    time.Duration
+		minRTT time.Duration
+	}{
+		{"93.184.216.34", 443, 23456 * time.Microsecond, 20100 * time.Microsecond},
+		{"2606:4700::1111", 443, 12 * time.Millisecond, 11 * time.Millisecond},
+		{"8.8.8.8", 53, 30 * time.Millisecond, 0},
+		{"1.1.1.1", 853, 5 * time.Millisecond, 4 * time.Millisecond},
+	}
+	for i, w := range want {
+		got := socks[i]
+		if got.Dst.String() != w.dst || got.DPort != w.dport || got.RTT != w.rtt || got.MinRTT != w.minRTT {
+			t.Fatalf("socket %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestParseInetDiagMessageTruncated(t *testing.T) {
+	if _, _, err := parseInetDiagMessage(make([]byte, 10)); err == nil {
+		t.Fatalf("expected error for truncated inet_diag_msg")
+	}
+	if _, err := parseNetlinkMessages([]byte{0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Fatalf("expected error for bogus message length")
+	}
+}
+
+func TestPassiveSamplesFromSockets(t *testing.T) {
+	s := &CakeAutoRTTService{}
+	socks := []tcpDiagSocket{
+		{Dst: net.ParseIP("93.184.216.34"), RTT: 30 * time.Millisecond, MinRTT: 20 * time.Millisecond},
+		{Dst: net.ParseIP("93.184.216.34"), RTT: 25 * time.Millisecond, MinRTT: 22 * time.Millisecond},
+		{Dst: net.ParseIP("192.168.1.10"), RTT: time.Millisecond},
+		{Dst: net.ParseIP("8.8.8.8"), RTT: 40 * time.Millisecond},
+	}
+
+	samples := passiveSamplesFromSockets(socks, false, s.isLANAddress)
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 non-LAN hosts, got %d", len(samples))
+	}
+	if samples[0].Host != "93.184.216.34" || samples[0].RTTMs != 25 || samples[0].Weight != 2 {
+		t.Fatalf("unexpected sample: %+v", samples[0])
+	}
+
+	// min_rtt is preferred when requested, falling back to rtt when missing
+	samples = passiveSamplesFromSockets(socks, true, s.isLANAddress)
+	if samples[0].RTTMs != 20 || samples[1].RTTMs != 40 {
+		t.Fatalf("unexpected min_rtt samples: %+v", samples)
+	}
+}
+
+func TestDumpTCPSocketsLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			defer c.Close()
+			buf := make([]byte, 1)
+			c.Read(buf)
+		}
+	}()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	socks, err := dumpTCPSockets()
+	if err != nil {
+		t.Skipf("sock_diag unavailable: %v", err)
+	}
+	for _, sk := range socks {
+		if sk.DPort == port && sk.Dst.Equal(net.ParseIP("127.0.0.1")) {
+			if sk.RTT <= 0 {
+				t.Fatalf("expected positive rtt for loopback socket, got %s", sk.RTT)
+			}
+			return
+		}
+	}
+	t.Fatalf("loopback socket to port %d not found among %d sockets", port, len(socks))
+}
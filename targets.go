@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rttHistoryLen is the number of per-interface RTT points kept for the status API
+const rttHistoryLen = 120
+
+// InterfaceConfig is one managed CAKE interface from the interfaces list.
+// Each interface probes its own hosts and keeps its own smoothing, dead-band
+// and history, so multi-WAN and asymmetric links are tuned independently.
+type InterfaceConfig struct {
+	Name string `mapstructure:"name" yaml:"name"`
+	// Only probe flows whose conntrack mark matches (mark & conntrack_mark_mask == conntrack_mark)
+	ConntrackMark     uint32 `mapstructure:"conntrack_mark" yaml:"conntrack_mark"`
+	ConntrackMarkMask uint32 `mapstructure:"conntrack_mark_mask" yaml:"conntrack_mark_mask"`
+	// Only probe flows from, or NATed to, these addresses (CIDR or bare IP)
+	SourceCIDRs []string `mapstructure:"source_cidrs" yaml:"source_cidrs"`
+	// Per-interface overrides; 0 or empty inherits the global setting
+	RTTMarginPercent int    `mapstructure:"rtt_margin_percent" yaml:"rtt_margin_percent"`
+	MinRTTMs         int    `mapstructure:"min_rtt_ms" yaml:"min_rtt_ms"`
+	MaxRTTMs         int    `mapstructure:"max_rtt_ms" yaml:"max_rtt_ms"`
+	RTTSource        string `mapstructure:"rtt_source" yaml:"rtt_source"`
+	// WAN device this interface shapes; probes leave through it and, without
+	// source_cidrs or conntrack_mark, flows NATed to its addresses are attributed to it
+	Uplink string `mapstructure:"uplink" yaml:"uplink"`
+	// Firewall mark for probe sockets (defaults to conntrack_mark) and probe source address
+	ProbeMark   uint32 `mapstructure:"probe_mark" yaml:"probe_mark"`
+	ProbeSource string `mapstructure:"probe_source" yaml:"probe_source"`
+}
+
+// InterfaceRTTStatus is the RTT state of one managed interface
+type InterfaceRTTStatus struct {
+	// Source is "measured" or "default" for the most recent cycle
+	Source      string    `json:"source"`
+	RTTSource   string    `json:"rtt_source"`
+	Probe       string    `json:"probe"`
+	RawMs       int       `json:"raw_ms"`
+	SmoothedMs  int       `json:"smoothed_ms"`
+	FinalMs     int       `json:"final_ms"`
+	ActiveHosts int       `json:"active_hosts"`
+	Stats       *RTTStats `json:"stats,omitempty"`
+	// FamilyStats splits Stats by address family (ipv4, ipv6); replaced, never mutated
+	FamilyStats map[string]RTTStats `json:"family_stats,omitempty"`
+	Updates     RTTUpdateStats      `json:"updates"`
+	History     []RTTHistoryPoint   `json:"history,omitempty"`
+}
+
+// RTTHistoryPoint is one cycle's final RTT for an interface
+type RTTHistoryPoint struct {
+	Time     time.Time `json:"time"`
+	RTTMs    int       `json:"rtt_ms"`
+	Measured bool      `json:"measured"`
+	Applied  bool      `json:"applied"`
+}
+
+// hostFilter selects the conntrack flows (and passive sockets) that belong to
+// one interface
+type hostFilter struct {
+	mark, markMask uint32
+	sources        []*net.IPNet
+	// uplink whose current addresses stand in for sources; resolved each cycle
+	uplink string
+}
+
+// parseCIDROrIP parses a CIDR; a bare address becomes a /32 or /128
+func parseCIDROrIP(c string) (*net.IPNet, error) {
+	if !strings.Contains(c, "/") {
+		ip := net.ParseIP(c)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", c)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		c = fmt.Sprintf("%s/%d", c, bits)
+	}
+	_, n, err := net.ParseCIDR(c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", c)
+	}
+	return n, nil
+}
+
+// newHostFilter parses the filter settings of an interface entry
+func newHostFilter(ic InterfaceConfig) (hostFilter, error) {
+	f := hostFilter{mark: ic.ConntrackMark, markMask: ic.ConntrackMarkMask}
+	if f.markMask == 0 && f.mark != 0 {
+		f.markMask = 0xffffffff
+	}
+	for _, c := range ic.SourceCIDRs {
+		n, err := parseCIDROrIP(c)
+		if err != nil {
+			return f, fmt.Errorf("interface %s: %w", ic.Name, err)
+		}
+		f.sources = append(f.sources, n)
+	}
+	if ic.Uplink != "" && len(f.sources) == 0 && f.markMask == 0 {
+		f.uplink = ic.Uplink
+	}
+	return f, nil
+}
+
+// matchSource reports whether ip is in one of the source CIDRs (true when none are set)
+func (f hostFilter) matchSource(ip net.IP) bool {
+	if len(f.sources) == 0 {
+		return true
+	}
+	for _, n := range f.sources {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchEntry reports whether a conntrack flow belongs to the interface. The
+// source matches either the original source (LAN client or router address)
+// or the reply destination (the WAN address the flow was masqueraded to).
+func (f hostFilter) matchEntry(e ConntrackEntry) bool {
+	if f.markMask != 0 && e.Mark&f.markMask != f.mark {
+		return false
+	}
+	if len(f.sources) == 0 {
+		return true
+	}
+	return f.matchSource(e.Src) || f.matchSource(e.ReplyDst)
+}
+
+// key identifies the filter so interfaces sharing one are measured once
+func (f hostFilter) key() string {
+	parts := []string{fmt.Sprintf("%08x/%08x@%s", f.mark, f.markMask, f.uplink)}
+	for _, n := range f.sources {
+		parts = append(parts, n.String())
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, ",")
+}
+
+// rttTarget is the runtime state of one managed interface. Protected by the
+// service mutex.
+type rttTarget struct {
+	InterfaceConfig
+	filter  hostFilter
+	binding ProbeBinding
+
+	smoother    RTTSmoother
+	smootherSig string
+	gate        rttUpdateGate
+
+	status  InterfaceRTTStatus
+	history []RTTHistoryPoint
+}
+
+// resolveInterfaces returns the managed interfaces with inherited settings
+// filled in: the interfaces list when set, otherwise dl_interface and
+// ul_interface sharing the global settings (the pre-list behaviour)
+func resolveInterfaces(cfg *Config) ([]InterfaceConfig, error) {
+	list := cfg.Interfaces
+	if len(list) == 0 {
+		for _, name := range []string{cfg.DLInterface, cfg.ULInterface} {
+			if name != "" && (len(list) == 0 || list[0].Name != name) {
+				list = append(list, InterfaceConfig{Name: name})
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(list))
+	out := make([]InterfaceConfig, 0, len(list))
+	for _, ic := range list {
+		if ic.Name == "" {
+			return nil, fmt.Errorf("interfaces: entry without a name")
+		}
+		if seen[ic.Name] {
+			return nil, fmt.Errorf("interfaces: %s listed twice", ic.Name)
+		}
+		seen[ic.Name] = true
+
+		if ic.RTTMarginPercent < 0 || ic.MinRTTMs < 0 || ic.MaxRTTMs < 0 {
+			return nil, fmt.Errorf("interface %s: margin and bounds must not be negative", ic.Name)
+		}
+		if ic.MaxRTTMs > 0 && ic.MinRTTMs > ic.MaxRTTMs {
+			return nil, fmt.Errorf("interface %s: min_rtt_ms %d above max_rtt_ms %d", ic.Name, ic.MinRTTMs, ic.MaxRTTMs)
+		}
+		if ic.RTTMarginPercent == 0 {
+			ic.RTTMarginPercent = cfg.RTTMarginPercent
+		}
+		if ic.RTTSource == "" {
+			ic.RTTSource = cfg.RTTSource
+		}
+		if err := validateRTTSource(ic.RTTSource); err != nil {
+			return nil, fmt.Errorf("interface %s: %w", ic.Name, err)
+		}
+		out = append(out, ic)
+	}
+	return out, nil
+}
+
+// newRTTTargets builds the per-interface state for cfg, carrying smoothing,
+// gate, counters and history over from previous targets with the same name
+func newRTTTargets(cfg *Config, previous []*rttTarget) ([]*rttTarget, error) {
+	targets, err := buildRTTTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	inheritRTTTargets(cfg, targets, previous)
+	return targets, nil
+}
+
+// buildRTTTargets validates the interfaces of cfg and builds fresh targets
+// for them. It does not touch any running state, so a reload can build the
+// targets before it takes the service lock.
+func buildRTTTargets(cfg *Config) ([]*rttTarget, error) {
+	list, err := resolveInterfaces(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := smootherSignature(cfg)
+	targets := make([]*rttTarget, 0, len(list))
+	for _, ic := range list {
+		filter, err := newHostFilter(ic)
+		if err != nil {
+			return nil, err
+		}
+		binding, err := newProbeBinding(ic)
+		if err != nil {
+			return nil, err
+		}
+		smoother, err := NewRTTSmoother(cfg)
+		if err != nil {
+			return nil, err
+		}
+		t := &rttTarget{InterfaceConfig: ic, filter: filter, binding: binding,
+			smoother: smoother, smootherSig: sig}
+		t.gate.configure(cfg)
+		t.status.RTTSource = ic.RTTSource
+		t.status.Probe = binding.String()
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// inheritRTTTargets carries the smoother, gate, counters and history of
+// previous targets over to the targets with the same name. The smoother is
+// kept unless its settings changed, in which case the fresh one is seeded
+// with the current value so a reload does not cause a jump. Callers hold
+// the service lock the previous targets are updated under.
+func inheritRTTTargets(cfg *Config, targets, previous []*rttTarget) {
+	old := make(map[string]*rttTarget, len(previous))
+	for _, t := range previous {
+		old[t.Name] = t
+	}
+	for _, t := range targets {
+		prev, ok := old[t.Name]
+		if !ok {
+			continue
+		}
+		if prev.smootherSig == t.smootherSig {
+			t.smoother = prev.smoother
+		} else if v, ok := prev.smoother.Value(); ok {
+			t.smoother.Update(v)
+		}
+		t.gate = prev.gate
+		t.gate.configure(cfg)
+		status := prev.status
+		status.RTTSource, status.Probe = t.status.RTTSource, t.status.Probe
+		t.status = status
+		t.history = prev.history
+	}
+}
+
+// clampRTT applies the interface's min/max RTT bounds (ms)
+func (t *rttTarget) clampRTT(rttMs float64) float64 {
+	if t.MinRTTMs > 0 && rttMs < float64(t.MinRTTMs) {
+		return float64(t.MinRTTMs)
+	}
+	if t.MaxRTTMs > 0 && rttMs > float64(t.MaxRTTMs) {
+		return float64(t.MaxRTTMs)
+	}
+	return rttMs
+}
+
+// groupKey identifies targets that can share one measurement
+func (t *rttTarget) groupKey() string {
+	return t.RTTSource + "|" + t.filter.key() + "|" + t.binding.String()
+}
+
+// record appends a history point, keeping the last rttHistoryLen
+func (t *rttTarget) record(p RTTHistoryPoint) {
+	t.history = append(t.history, p)
+	if len(t.history) > rttHistoryLen {
+		t.history = t.history[len(t.history)-rttHistoryLen:]
+	}
+}
+
+// snapshot returns a copy of the status including history
+func (t *rttTarget) snapshot() InterfaceRTTStatus {
+	st := t.status
+	if st.Stats != nil {
+		stats := *st.Stats
+		st.Stats = &stats
+	}
+	st.Updates.Smoothing = t.smoother.Name()
+	st.Updates.SmoothedMs, _ = t.smoother.Value()
+	st.Updates.AppliedUs = t.gate.appliedUs
+	st.History = append([]RTTHistoryPoint(nil), t.history...)
+	return st
+}
+
+// rttTargetGroup is a set of interfaces measured with the same hosts
+type rttTargetGroup struct {
+	source  string
+	filter  hostFilter
+	binding ProbeBinding
+	targets []*rttTarget
+}
+
+// groupRTTTargets groups targets by RTT source and host filter, preserving order
+func groupRTTTargets(targets []*rttTarget) []*rttTargetGroup {
+	var groups []*rttTargetGroup
+	index := make(map[string]*rttTargetGroup)
+	for _, t := range targets {
+		key := t.groupKey()
+		g, ok := index[key]
+		if !ok {
+			g = &rttTargetGroup{source: t.RTTSource, filter: t.filter, binding: t.binding}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.targets = append(g.targets, t)
+	}
+	return groups
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// probeFuncFromTable returns a ProbeFunc answering from rtts (ms) and counting
+// probes per host in probed
+func probeFuncFromTable(probed map[string]int, rtts map[string]float64) func(context.Context, string, int, ProbeBinding) (time.Duration, string, error) {
+	var mu sync.Mutex
+	return func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		mu.Lock()
+		probed[host]++
+		mu.Unlock()
+		rtt, ok := rtts[host]
+		if !ok {
+			return 0, "", fmt.Errorf("unreachable")
+		}
+		return time.Duration(rtt * float64(time.Millisecond)), "tcp", nil
+	}
+}
+
+func TestResolveInterfaces(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DLInterface, cfg.ULInterface = "ifb4eth0", "eth0"
+	list, err := resolveInterfaces(cfg)
+	if err != nil || len(list) != 2 || list[0].Name != "ifb4eth0" || list[1].Name != "eth0" {
+		t.Fatalf("legacy dl/ul: got %+v, %v", list, err)
+	}
+	if list[0].RTTMarginPercent != 10 || list[0].RTTSource != "active" {
+		t.Fatalf("expected inherited settings, got %+v", list[0])
+	}
+
+	// The same interface for both directions is managed once
+	cfg.DLInterface, cfg.ULInterface = "lo", "lo"
+	if list, _ := resolveInterfaces(cfg); len(list) != 1 {
+		t.Fatalf("expected one target for dl == ul, got %+v", list)
+	}
+
+	cfg.Interfaces = []InterfaceConfig{
+		{Name: "eth0", RTTMarginPercent: 20, MaxRTTMs: 200},
+		{Name: "wwan0", RTTSource: "hybrid"},
+	}
+	list, err = resolveInterfaces(cfg)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("interfaces list: got %+v, %v", list, err)
+	}
+	if list[0].RTTMarginPercent != 20 || list[1].RTTMarginPercent != 10 || list[1].RTTSource != "hybrid" {
+		t.Fatalf("unexpected overrides: %+v", list)
+	}
+
+	for name, bad := range map[string][]InterfaceConfig{
+		"no name":   {{RTTSource: "active"}},
+		"duplicate": {{Name: "eth0"}, {Name: "eth0"}},
+		"bounds":    {{Name: "eth0", MinRTTMs: 300, MaxRTTMs: 200}},
+		"source":    {{Name: "eth0", RTTSource: "bogus"}},
+	} {
+		cfg.Interfaces = bad
+		if _, err := resolveInterfaces(cfg); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	cfg.Interfaces = []InterfaceConfig{{Name: "eth0", SourceCIDRs: []string{"not-an-ip"}}}
+	if _, err := newRTTTargets(cfg, nil); err == nil {
+		t.Fatalf("expected error for invalid source CIDR")
+	}
+}
+
+func TestHostFilterMatching(t *testing.T) {
+	f, err := newHostFilter(InterfaceConfig{Name: "wan2", ConntrackMark: 0x200, ConntrackMarkMask: 0xff00,
+		SourceCIDRs: []string{"198.51.100.7", "192.168.2.0/24"}})
+	if err != nil {
+		t.Fatalf("filter: %v", err)
+	}
+	entry := func(src, replyDst string, mark uint32) ConntrackEntry {
+		return ConntrackEntry{Src: net.ParseIP(src), ReplyDst: net.ParseIP(replyDst), Mark: mark}
+	}
+	cases := []struct {
+		e    ConntrackEntry
+		want bool
+	}{
+		{entry("192.168.1.10", "198.51.100.7", 0x2ff), true},  // NATed to the WAN2 address
+		{entry("192.168.2.10", "192.168.2.10", 0x201), true},  // client subnet routed via WAN2
+		{entry("192.168.1.10", "203.0.113.5", 0x200), false},  // other WAN address
+		{entry("192.168.1.10", "198.51.100.7", 0x100), false}, // wrong mark
+	}
+	for i, c := range cases {
+		if got := f.matchEntry(c.e); got != c.want {
+			t.Fatalf("case %d: got %t, want %t", i, got, c.want)
+		}
+	}
+
+	// An empty filter matches everything; a bare mark implies an exact mask
+	if !(hostFilter{}).matchEntry(entry("10.0.0.1", "", 7)) {
+		t.Fatalf("empty filter should match")
+	}
+	exact, _ := newHostFilter(InterfaceConfig{Name: "wan1", ConntrackMark: 1})
+	if exact.matchEntry(entry("10.0.0.1", "", 0x101)) || !exact.matchEntry(entry("10.0.0.1", "", 1)) {
+		t.Fatalf("expected exact mark match")
+	}
+}
+
+func TestRTTTargetsReloadKeepsState(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Interfaces = []InterfaceConfig{{Name: "eth0"}, {Name: "wwan0"}}
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	targets[0].smoother.Update(40)
+	targets[0].status.Updates.Applied = 3
+	targets[0].record(RTTHistoryPoint{RTTMs: 44, Applied: true})
+
+	// Same smoothing: state carries over by name, removed interfaces drop out
+	cfg.Interfaces = []InterfaceConfig{{Name: "eth0", RTTMarginPercent: 30}}
+	reloaded, err := newRTTTargets(cfg, targets)
+	if err != nil || len(reloaded) != 1 {
+		t.Fatalf("reload: %+v, %v", reloaded, err)
+	}
+	if reloaded[0].smoother != targets[0].smoother || reloaded[0].status.Updates.Applied != 3 ||
+		len(reloaded[0].history) != 1 || reloaded[0].RTTMarginPercent != 30 {
+		t.Fatalf("expected state carried over: %+v", reloaded[0])
+	}
+
+	// Changed smoothing: a new filter seeded with the previous value
+	cfg.RTTSmoothing = "kalman"
+	reloaded, err = newRTTTargets(cfg, reloaded)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if v, ok := reloaded[0].smoother.Value(); reloaded[0].smoother.Name() != "kalman" || !ok || v != 40 {
+		t.Fatalf("expected seeded kalman filter, got %s %v", reloaded[0].smoother.Name(), v)
+	}
+}
+
+func TestMeasurementCyclePerInterface(t *testing.T) {
+	flow := func(dst, natAddr string) ConntrackEntry {
+		return ConntrackEntry{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"),
+			Dst: net.ParseIP(dst), ReplyDst: net.ParseIP(natAddr)}
+	}
+	entries := []ConntrackEntry{
+		flow("1.1.1.1", "203.0.113.5"),
+		flow("8.8.8.8", "203.0.113.5"),
+		flow("9.9.9.9", "198.51.100.7"),
+		flow("4.4.4.4", "198.51.100.7"),
+	}
+	cfg := DefaultConfig()
+	cfg.MinHosts = 2
+	cfg.RTTSmoothing = "none"
+	cfg.Interfaces = []InterfaceConfig{
+		{Name: "eth0", SourceCIDRs: []string{"203.0.113.5"}},
+		{Name: "ifb4eth0", SourceCIDRs: []string{"203.0.113.5"}, MaxRTTMs: 30},
+		{Name: "wwan0", SourceCIDRs: []string{"198.51.100.7"}, RTTMarginPercent: 50},
+	}
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	fake := &fakeQdiscController{}
+	probed := make(map[string]int)
+	s := &CakeAutoRTTService{
+		config:          cfg,
+		qdisc:           fake,
+		conntrackSource: &fakeConntrack{entries: entries},
+		targets:         targets,
+		currentProbes:   make(map[string]ProbeStatus),
+	}
+	s.ProbeFunc = probeFuncFromTable(probed, map[string]float64{
+		"1.1.1.1": 20, "8.8.8.8": 40, "9.9.9.9": 60, "4.4.4.4": 80,
+	})
+
+	s.performRTTMeasurementCycle(context.Background())
+
+	// eth0 and ifb4eth0 share one measurement, so each host is probed once
+	for host, n := range probed {
+		if n != 1 {
+			t.Fatalf("host %s probed %d times", host, n)
+		}
+	}
+	// max of 20/40 + 10% = 44; ifb4eth0 capped at 30; wwan0 max 80 + 50% = 120
+	want := map[string]int{"eth0": 44000, "ifb4eth0": 30000, "wwan0": 120000}
+	for iface, us := range want {
+		if fake.changes[iface] != us {
+			t.Fatalf("%s: got %dus, want %dus (all: %v)", iface, fake.changes[iface], us, fake.changes)
+		}
+	}
+
+	status := s.GetSystemStatus()
+	wwan := status.CurrentRTT["wwan0"]
+	if wwan.Source != "measured" || wwan.FinalMs != 120 || wwan.ActiveHosts != 2 || len(wwan.History) != 1 ||
+		!wwan.History[0].Applied || wwan.Stats == nil || wwan.Stats.MaxMs != 80 {
+		t.Fatalf("unexpected wwan0 status: %+v", wwan)
+	}
+	if status.RTTUpdates.Applied != 3 || status.ActiveHosts != 4 {
+		t.Fatalf("unexpected totals: %+v, active %d", status.RTTUpdates, status.ActiveHosts)
+	}
+}
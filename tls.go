@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// selfSignedValidity is the lifetime of a generated certificate; it is
+// regenerated on start once expired
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// webCertificate holds the serving certificate so it can be swapped on
+// reload without restarting the listener
+type webCertificate struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// load reads the key pair, generating and saving a self-signed one for
+// hosts when both files are missing or the generated one has expired
+func (w *webCertificate) load(hosts []string, now time.Time) (bool, error) {
+	return w.reload(w.certFile, w.keyFile, hosts, now)
+}
+
+// reload loads certFile and keyFile and switches to them, keeping the
+// current certificate and files when that fails
+func (w *webCertificate) reload(certFile, keyFile string, hosts []string, now time.Time) (bool, error) {
+	cert, created, err := loadOrCreateCertificate(certFile, keyFile, hosts, now)
+	if err != nil {
+		return false, err
+	}
+	w.certFile, w.keyFile = certFile, keyFile
+	w.cert.Store(cert)
+	return created, nil
+}
+
+func (w *webCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.cert.Load(), nil
+}
+
+// tlsConfig serves the current certificate with TLS 1.2 or newer
+func (w *webCertificate) tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: w.getCertificate}
+}
+
+// loadOrCreateCertificate loads certFile and keyFile. When both are missing
+// it generates a self-signed certificate and writes it there, so browsers
+// see the same certificate on every start; an expired self-signed
+// certificate is replaced the same way.
+func loadOrCreateCertificate(certFile, keyFile string, hosts []string, now time.Time) (*tls.Certificate, bool, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	switch {
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+	case errors.Is(certErr, os.ErrNotExist) || errors.Is(keyErr, os.ErrNotExist):
+		return nil, false, fmt.Errorf("tls: only one of %s and %s exists", certFile, keyFile)
+	default:
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("tls: %w", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, false, fmt.Errorf("tls: %w", err)
+		}
+		selfSigned := leaf.Issuer.String() == leaf.Subject.String() && leaf.Subject.CommonName == selfSignedCommonName
+		if !selfSigned || now.Before(leaf.NotAfter) {
+			cert.Leaf = leaf
+			return &cert, false, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(hosts, now)
+	if err != nil {
+		return nil, false, fmt.Errorf("tls: %w", err)
+	}
+	for _, f := range []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{{keyFile, keyPEM, 0o600}, {certFile, certPEM, 0o644}} {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+			return nil, false, fmt.Errorf("tls: %w", err)
+		}
+		if err := os.WriteFile(f.path, f.data, f.mode); err != nil {
+			return nil, false, fmt.Errorf("tls: %w", err)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, false, fmt.Errorf("tls: %w", err)
+	}
+	return &cert, true, nil
+}
+
+// selfSignedCommonName marks certificates generated by generateSelfSigned
+const selfSignedCommonName = "cake-autortt self-signed"
+
+// generateSelfSigned creates an ECDSA P-256 certificate for hosts (names or
+// addresses) and returns it and its key PEM-encoded
+func generateSelfSigned(hosts []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: selfSignedCommonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// certificateHosts are the names a generated certificate covers: localhost,
+// the host name, the bind address or else every local interface address
+func certificateHosts(bindAddress string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	if ip := net.ParseIP(bindAddress); bindAddress != "" && (ip == nil || !ip.IsUnspecified()) {
+		return append(hosts, bindAddress)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && !ipn.IP.IsLoopback() && !ipn.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipn.IP.String())
+		}
+	}
+	return hosts
+}
+
+// httpsRedirect sends plain HTTP requests to the same path on the HTTPS port
+func httpsRedirect(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
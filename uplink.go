@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProbeBinding pins probes to one uplink on multi-WAN routers: the egress
+// device (SO_BINDTODEVICE), a firewall mark picked up by policy routing such
+// as mwan3 (SO_MARK) and/or a source address. The zero value probes via the
+// default route.
+type ProbeBinding struct {
+	Device string
+	Mark   uint32
+	Source net.IP
+}
+
+// newProbeBinding derives the probe binding of a managed interface. The
+// probe mark defaults to the conntrack mark, which is what mwan3-style
+// policy routing matches on.
+func newProbeBinding(ic InterfaceConfig) (ProbeBinding, error) {
+	b := ProbeBinding{Device: ic.Uplink, Mark: ic.ProbeMark}
+	if b.Mark == 0 {
+		b.Mark = ic.ConntrackMark
+	}
+	if ic.ProbeSource != "" {
+		b.Source = net.ParseIP(ic.ProbeSource)
+		if b.Source == nil {
+			return b, fmt.Errorf("interface %s: invalid probe_source %q", ic.Name, ic.ProbeSource)
+		}
+	}
+	return b, nil
+}
+
+// IsZero reports whether the binding leaves routing to the default route
+func (b ProbeBinding) IsZero() bool {
+	return b.Device == "" && b.Mark == 0 && b.Source == nil
+}
+
+// String describes the binding for logs and the status API
+func (b ProbeBinding) String() string {
+	if b.IsZero() {
+		return "default route"
+	}
+	var parts []string
+	if b.Device != "" {
+		parts = append(parts, "dev "+b.Device)
+	}
+	if b.Mark != 0 {
+		parts = append(parts, fmt.Sprintf("mark %#x", b.Mark))
+	}
+	if b.Source != nil {
+		parts = append(parts, "src "+b.Source.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// sourceFor returns the source address to bind for a destination, or nil
+// when none is configured for that address family
+func (b ProbeBinding) sourceFor(dst net.IP) net.IP {
+	if b.Source == nil || (b.Source.To4() != nil) != (dst.To4() != nil) {
+		return nil
+	}
+	return b.Source
+}
+
+// apply sets the device and mark socket options on fd
+func (b ProbeBinding) apply(fd int) error {
+	if b.Device != "" {
+		if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, b.Device); err != nil {
+			return fmt.Errorf("bind to device %s: %w", b.Device, err)
+		}
+	}
+	if b.Mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(b.Mark)); err != nil {
+			return fmt.Errorf("set mark %#x: %w", b.Mark, err)
+		}
+	}
+	return nil
+}
+
+// bindSource binds fd to the configured source address for dst, if any
+func (b ProbeBinding) bindSource(fd int, dst net.IP) error {
+	src := b.sourceFor(dst)
+	if src == nil {
+		return nil
+	}
+	var sa unix.Sockaddr
+	if v4 := src.To4(); v4 != nil {
+		addr := &unix.SockaddrInet4{}
+		copy(addr.Addr[:], v4)
+		sa = addr
+	} else {
+		addr := &unix.SockaddrInet6{}
+		copy(addr.Addr[:], src.To16())
+		sa = addr
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return fmt.Errorf("bind to %s: %w", src, err)
+	}
+	return nil
+}
+
+// dialer returns a net.Dialer whose sockets carry the binding for dst
+func (b ProbeBinding) dialer(dst net.IP, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if src := b.sourceFor(dst); src != nil {
+		d.LocalAddr = &net.TCPAddr{IP: src}
+	}
+	if b.Device != "" || b.Mark != 0 {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var applyErr error
+			if err := c.Control(func(fd uintptr) { applyErr = b.apply(int(fd)) }); err != nil {
+				return err
+			}
+			return applyErr
+		}
+	}
+	return d
+}
+
+// uplinkPrefixes returns the sources conntrack shows for flows leaving an
+// uplink. IPv4 flows are NATed, so their reply destination is one of the
+// uplink's addresses. IPv6 flows are routed and keep the LAN client's
+// address, taken from a prefix delegated by that uplink; the router ties
+// such prefixes to their uplink with source-specific routes ("default from
+// <prefix> dev <uplink>", as OpenWrt's netifd installs them). The uplink's
+// own global IPv6 prefixes cover the router's flows.
+func uplinkPrefixes(name string) ([]*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if v4 := n.IP.To4(); v4 != nil {
+			nets = append(nets, &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)})
+			continue
+		}
+		nets = append(nets, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+	}
+
+	rtm := make([]byte, unix.SizeofRtMsg)
+	rtm[0] = unix.AF_INET6
+	msgs, err := netlinkExecute(unix.NETLINK_ROUTE, unix.RTM_GETROUTE, unix.NLM_F_DUMP, rtm)
+	if err != nil {
+		return nil, fmt.Errorf("rtnetlink route dump: %w", err)
+	}
+	return append(nets, parseSourceRoutes(msgs, iface.Index)...), nil
+}
+
+// parseSourceRoutes returns the source prefixes of the IPv6 source-specific
+// routes out of ifindex in an RTM_GETROUTE dump, without duplicates
+func parseSourceRoutes(msgs []netlinkMessage, ifindex int) []*net.IPNet {
+	var nets []*net.IPNet
+	seen := make(map[string]bool)
+	for _, m := range msgs {
+		if m.Type != unix.RTM_NEWROUTE || len(m.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		family, srcLen := m.Data[0], int(m.Data[2])
+		if family != unix.AF_INET6 || srcLen == 0 || srcLen > 128 {
+			continue
+		}
+		attrs, err := parseNetlinkAttrs(m.Data[unix.SizeofRtMsg:])
+		if err != nil {
+			continue
+		}
+		oif := attrValue(attrs, unix.RTA_OIF)
+		src := attrValue(attrs, unix.RTA_SRC)
+		if len(oif) < 4 || int(binary.NativeEndian.Uint32(oif)) != ifindex || len(src) != net.IPv6len {
+			continue
+		}
+		mask := net.CIDRMask(srcLen, 128)
+		n := &net.IPNet{IP: net.IP(src).Mask(mask), Mask: mask}
+		if !seen[n.String()] {
+			seen[n.String()] = true
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNewProbeBinding(t *testing.T) {
+	b, err := newProbeBinding(InterfaceConfig{Name: "wwan0", Uplink: "wwan0", ConntrackMark: 0x200})
+	if err != nil {
+		t.Fatalf("binding: %v", err)
+	}
+	if b.Device != "wwan0" || b.Mark != 0x200 || b.String() != "dev wwan0 mark 0x200" {
+		t.Fatalf("expected mark to default to conntrack_mark: %+v %q", b, b)
+	}
+	b, _ = newProbeBinding(InterfaceConfig{Name: "eth1", ConntrackMark: 0x200, ProbeMark: 0x300, ProbeSource: "198.51.100.7"})
+	if b.Mark != 0x300 || !b.Source.Equal(net.ParseIP("198.51.100.7")) {
+		t.Fatalf("unexpected binding: %+v", b)
+	}
+	if b.sourceFor(net.ParseIP("2001:db8::1")) != nil || b.sourceFor(net.ParseIP("1.1.1.1")) == nil {
+		t.Fatalf("source must only apply to its own address family")
+	}
+	if _, err := newProbeBinding(InterfaceConfig{Name: "eth1", ProbeSource: "nope"}); err == nil {
+		t.Fatalf("expected error for invalid probe_source")
+	}
+	if (ProbeBinding{}).String() != "default route" {
+		t.Fatalf("unexpected zero binding string")
+	}
+}
+
+func TestProbeBindingDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// A source address is bound for same-family destinations
+	b := ProbeBinding{Source: net.ParseIP("127.0.0.2")}
+	conn, err := b.dialer(net.ParseIP("127.0.0.1"), time.Second).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial with source: %v", err)
+	}
+	if local := conn.LocalAddr().(*net.TCPAddr); !local.IP.Equal(b.Source) {
+		t.Fatalf("expected source %s, got %s", b.Source, local.IP)
+	}
+	conn.Close()
+
+	// Device binding needs CAP_NET_RAW; only check it where permitted
+	b = ProbeBinding{Device: "lo"}
+	conn, err = b.dialer(net.ParseIP("127.0.0.1"), time.Second).Dial("tcp", ln.Addr().String())
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("SO_BINDTODEVICE not permitted: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("dial bound to lo: %v", err)
+	}
+	conn.Close()
+}
+
+func TestMeasurementCycleAttributesHostsToUplinks(t *testing.T) {
+	flow := func(dst, natAddr string) ConntrackEntry {
+		return ConntrackEntry{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("192.168.1.10"),
+			Dst: net.ParseIP(dst), ReplyDst: net.ParseIP(natAddr)}
+	}
+	entries := []ConntrackEntry{
+		flow("1.1.1.1", "203.0.113.5"),
+		flow("8.8.8.8", "203.0.113.5"),
+		flow("9.9.9.9", "198.51.100.7"),
+		// IPv6 is routed, not NATed: the source is the client's address in
+		// the prefix eth0 delegated
+		{Proto: 6, State: "ESTABLISHED", Src: net.ParseIP("2001:db8:1:10::10"),
+			Dst: net.ParseIP("2606:4700:4700::1111"), ReplyDst: net.ParseIP("2001:db8:1:10::10")},
+	}
+	cfg := DefaultConfig()
+	cfg.MinHosts = 1
+	cfg.RTTSmoothing = "none"
+	cfg.Interfaces = []InterfaceConfig{
+		{Name: "eth0", Uplink: "eth0"},
+		{Name: "ifb4eth0", Uplink: "eth0"},
+		{Name: "wwan0", Uplink: "wwan0", ProbeMark: 0x200},
+		{Name: "eth2", Uplink: "eth2"},
+	}
+	targets, err := newRTTTargets(cfg, nil)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+
+	var mu sync.Mutex
+	probedVia := make(map[string]string)
+	fake := &fakeQdiscController{}
+	s := &CakeAutoRTTService{
+		config:          cfg,
+		qdisc:           fake,
+		conntrackSource: &fakeConntrack{entries: entries},
+		targets:         targets,
+		currentProbes:   make(map[string]ProbeStatus),
+		uplinkNets: func(name string) ([]*net.IPNet, error) {
+			switch name {
+			case "eth0":
+				_, delegated, _ := net.ParseCIDR("2001:db8:1::/48")
+				return []*net.IPNet{{IP: net.ParseIP("203.0.113.5").To4(), Mask: net.CIDRMask(32, 32)}, delegated}, nil
+			case "wwan0":
+				return []*net.IPNet{{IP: net.ParseIP("198.51.100.7").To4(), Mask: net.CIDRMask(32, 32)}}, nil
+			}
+			return nil, fmt.Errorf("no such interface")
+		},
+	}
+	s.ProbeFunc = func(ctx context.Context, host string, timeoutSec int, bind ProbeBinding) (time.Duration, string, error) {
+		mu.Lock()
+		probedVia[host] = bind.String()
+		mu.Unlock()
+		if host == "9.9.9.9" {
+			return 80 * time.Millisecond, "tcp", nil
+		}
+		return 20 * time.Millisecond, "tcp", nil
+	}
+
+	s.performRTTMeasurementCycle(context.Background())
+
+	want := map[string]string{"1.1.1.1": "dev eth0", "8.8.8.8": "dev eth0", "2606:4700:4700::1111": "dev eth0",
+		"9.9.9.9": "dev wwan0 mark 0x200"}
+	if len(probedVia) != len(want) {
+		t.Fatalf("unexpected probes: %v", probedVia)
+	}
+	for host, via := range want {
+		if probedVia[host] != via {
+			t.Fatalf("%s probed via %q, want %q", host, probedVia[host], via)
+		}
+	}
+	if fake.changes["eth0"] != 22000 || fake.changes["ifb4eth0"] != 22000 || fake.changes["wwan0"] != 88000 {
+		t.Fatalf("unexpected rtt changes: %v", fake.changes)
+	}
+	// An uplink that cannot be resolved falls back to the default RTT
+	if st := s.GetSystemStatus().CurrentRTT["eth2"]; st.Source != "default" || st.Probe != "dev eth2" {
+		t.Fatalf("unexpected eth2 status: %+v", st)
+	}
+}
+
+func TestParseSourceRoutes(t *testing.T) {
+	route := func(srcLen int, src string, oif uint32) netlinkMessage {
+		rtm := make([]byte, unix.SizeofRtMsg)
+		rtm[0], rtm[2] = unix.AF_INET6, byte(srcLen)
+		idx := make([]byte, 4)
+		binary.NativeEndian.PutUint32(idx, oif)
+		payload := append(rtm, encodeNetlinkAttr(unix.RTA_OIF, idx)...)
+		if src != "" {
+			payload = append(payload, encodeNetlinkAttr(unix.RTA_SRC, net.ParseIP(src).To16())...)
+		}
+		return netlinkMessage{Type: unix.RTM_NEWROUTE, Data: payload}
+	}
+	msgs := []netlinkMessage{
+		route(48, "2001:db8:1::", 2),
+		route(48, "2001:db8:1::", 2), // the same prefix on another route
+		route(56, "2001:db8:2:100::", 3),
+		route(0, "", 2), // the plain default route
+	}
+	nets := parseSourceRoutes(msgs, 2)
+	if len(nets) != 1 || nets[0].String() != "2001:db8:1::/48" {
+		t.Fatalf("unexpected prefixes: %v", nets)
+	}
+}
@@ -4,18 +4,21 @@ import (
 	_ "embed"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
-	"math"
+	"net"
 	"net/http"
-	"os/exec"
-	"regexp"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
 )
 
 // Embed the single index.html file located next to main.go as a string
@@ -26,14 +29,26 @@ var homePage string
 // No runtime reference to the embed package is necessary when we embed into
 // a string, so import it for the compiler/tooling as a blank import above.
 
+//go:embed login.html
+var loginPage string
+
 // WebServer handles the HTTP server for monitoring
 type WebServer struct {
-	service  *CakeAutoRTTService
-	config   *Config
+	service *CakeAutoRTTService
+	// current configuration, swapped whole on reload and read lock-free by
+	// request handlers
+	config   atomic.Pointer[Config]
 	clients  map[*websocket.Conn]bool
 	clientMu sync.RWMutex
 	upgrader websocket.Upgrader
 	logChan  chan LogMessage
+	// access control from web_auth, swapped on reload; sessions outlive reloads
+	auth     atomic.Pointer[webAuth]
+	sessions *webSessions
+	// serving certificate once the TLS listener is up, reloaded with the config
+	cert atomic.Pointer[webCertificate]
+	// config file /api/config edits are written back to
+	configPath string
 }
 
 // LogMessage represents a log entry for the web interface
@@ -43,83 +58,310 @@ type LogMessage struct {
 	Message   string `json:"message"`
 }
 
-// QdiscStats represents traffic control qdisc statistics
-type QdiscStats struct {
-	Interface string `json:"interface"`
-	Qdisc     string `json:"qdisc"`
-	Stats     string `json:"stats"`
-	RTT       string `json:"rtt"`
-}
-
 // WebSystemStatus represents the current system status for web interface
 type WebSystemStatus struct {
 	Timestamp     string       `json:"timestamp"`
 	ServiceStatus string       `json:"service_status"`
 	ActiveHosts   int          `json:"active_hosts"`
 	CurrentRTT    string       `json:"current_rtt"`
-	QdiscStats    []QdiscStats `json:"qdisc_stats"`
+	QdiscStats    []CakeQdisc  `json:"qdisc_stats"`
 	RecentLogs    []LogMessage `json:"recent_logs"`
+	// RTTAggregation is the configured strategy; RTTStats the last aggregation pass
+	RTTAggregation string    `json:"rtt_aggregation"`
+	RTTStats       *RTTStats `json:"rtt_stats,omitempty"`
+	// RTTStatsByFamily splits RTTStats into ipv4 and ipv6
+	RTTStatsByFamily map[string]RTTStats `json:"rtt_stats_by_family,omitempty"`
+	// RTTUpdates reports smoothing state and applied/skipped qdisc updates
+	RTTUpdates RTTUpdateStats `json:"rtt_updates"`
+	// ConntrackBackend is the conntrack source in use (netlink or procfs)
+	ConntrackBackend string `json:"conntrack_backend"`
+	// QdiscBackend is the qdisc controller in use (netlink or exec)
+	QdiscBackend string `json:"qdisc_backend"`
+	// Interfaces is the per-interface RTT state and history, keyed by interface
+	Interfaces map[string]InterfaceRTTStatus `json:"interfaces,omitempty"`
+	// Autorate is the bandwidth controller state when autorate is enabled
+	Autorate *AutorateStatus `json:"autorate,omitempty"`
+	// Cycles reports measurement cycle durations, deadline and skipped ticks
+	Cycles CycleStatus `json:"cycles"`
+	// Adaptive is the probe worker cap and the load signals behind it
+	Adaptive *AdaptiveStatus `json:"adaptive,omitempty"`
 }
 
 // NewWebServer creates a new web server instance
-func NewWebServer(service *CakeAutoRTTService, config *Config) *WebServer {
-	return &WebServer{
-		service: service,
-		config:  config,
-		clients: make(map[*websocket.Conn]bool),
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow all origins for simplicity
-			},
+func NewWebServer(service *CakeAutoRTTService, config *Config) (*WebServer, error) {
+	ws := &WebServer{
+		service:    service,
+		clients:    make(map[*websocket.Conn]bool),
+		logChan:    make(chan LogMessage, 100),
+		sessions:   newWebSessions(),
+		configPath: configFilePath(),
+	}
+	// Browsers send cookies and cached basic credentials with cross-site
+	// WebSocket handshakes, so only our own pages and listed origins may connect
+	ws.upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return originAllowed(r.Header.Get("Origin"), r.Host, ws.config.Load().WebAllowedOrigins)
 		},
-		logChan: make(chan LogMessage, 100),
+	}
+	if err := ws.UpdateConfig(config); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// UpdateConfig applies a reloaded configuration; invalid access control
+// settings keep the previous ones. The listener settings and the other
+// restart-only settings keep their running values.
+func (ws *WebServer) UpdateConfig(config *Config) error {
+	if err := validateAllowedOrigins(config.WebAllowedOrigins); err != nil {
+		return err
+	}
+	if cur := ws.config.Load(); cur != nil {
+		c := *config
+		keepRestartSettings(&c, cur)
+		config = &c
+	}
+	auth, err := newWebAuth(config.WebAuth)
+	if err != nil {
+		return err
+	}
+	ws.config.Store(config)
+	ws.auth.Store(auth)
+	return nil
+}
+
+// ReloadCertificate loads the TLS key pair named in the current configuration
+// again, keeping the served one when that fails. SIGHUP calls it so a
+// certificate renewed in place is picked up; API edits cannot change
+// web_tls_cert or web_tls_key and leave it alone.
+func (ws *WebServer) ReloadCertificate() {
+	c := ws.cert.Load()
+	if c == nil {
+		return
+	}
+	cfg := ws.config.Load()
+	if _, err := c.reload(cfg.WebTLSCert, cfg.WebTLSKey, certificateHosts(cfg.WebBindAddress), time.Now()); err != nil {
+		log.Printf("[ERROR] Failed to reload TLS certificate, keeping the previous one: %v", err)
+	} else {
+		log.Printf("[INFO] Reloaded TLS certificate from %s", cfg.WebTLSCert)
 	}
 }
 
 // Start starts the web server
 func (ws *WebServer) Start() error {
-	if !ws.config.WebEnabled {
+	// Listener settings are read once; changing them needs a restart
+	cfg := ws.config.Load()
+	if !cfg.WebEnabled {
 		return nil
 	}
 
+	if !ws.auth.Load().enabled() && cfg.WebBindAddress == "" {
+		log.Printf("[WARN] Web interface has no credentials and listens on all interfaces; set web_auth or web_bind_address")
+	}
+
+	// Start background goroutine for broadcasting updates
+	go ws.broadcastUpdates()
+
+	addr := net.JoinHostPort(cfg.WebBindAddress, strconv.Itoa(cfg.WebPort))
+	if !cfg.WebTLSEnabled {
+		log.Printf("[INFO] Starting web server on %s", addr)
+		return ws.router().Run(addr)
+	}
+
+	// Without a certificate a self-signed one is generated once and kept, so
+	// browsers only need to trust it on the first visit
+	cert := &webCertificate{certFile: cfg.WebTLSCert, keyFile: cfg.WebTLSKey}
+	created, err := cert.load(certificateHosts(cfg.WebBindAddress), time.Now())
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Printf("[INFO] Generated a self-signed certificate in %s", cfg.WebTLSCert)
+	}
+	ws.cert.Store(cert)
+
+	if port := cfg.WebTLSRedirectPort; port > 0 {
+		redirectAddr := net.JoinHostPort(cfg.WebBindAddress, strconv.Itoa(port))
+		go func() {
+			log.Printf("[INFO] Redirecting HTTP on %s to HTTPS", redirectAddr)
+			if err := http.ListenAndServe(redirectAddr, httpsRedirect(cfg.WebPort)); err != nil {
+				log.Printf("[ERROR] HTTP redirect server: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("[INFO] Starting web server on %s (HTTPS)", addr)
+	srv := &http.Server{Addr: addr, Handler: ws.router(), TLSConfig: cert.tlsConfig()}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// router builds the routes; every route passes the access check for the
+// role it requires, read for GET and write for anything else
+func (ws *WebServer) router() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
 	r.Use(gin.Recovery())
 
-	// Parse the embedded HTML string into a *template.Template which Gin
+	// Parse the embedded HTML strings into a *template.Template which Gin
 	// expects via SetHTMLTemplate.
 	tmpl := template.Must(template.New("index.html").Parse(homePage))
+	template.Must(tmpl.New("login.html").Parse(loginPage))
 	r.SetHTMLTemplate(tmpl)
 
+	read := ws.require(roleRead)
+	write := ws.require(roleWrite)
+
 	// Main monitoring page
-	r.GET("/cake-autortt", ws.handleIndex)
-	r.GET("/", ws.handleIndex)
+	r.GET("/cake-autortt", read, ws.handleIndex)
+	r.GET("/", read, ws.handleIndex)
+
+	// Login page sessions
+	public := ws.require(roleNone)
+	r.GET("/login", public, ws.handleLoginPage)
+	r.POST("/login", public, ws.handleLogin)
+	r.POST("/logout", public, ws.handleLogout)
 
 	// API endpoints
 	api := r.Group("/api")
 	{
-		api.GET("/status", ws.handleStatus)
-		api.GET("/probes", ws.handleProbes)
-		api.GET("/qdisc", ws.handleQdiscStats)
-		api.GET("/logs", ws.handleLogs)
+		api.GET("/status", read, ws.handleStatus)
+		api.GET("/probes", read, ws.handleProbes)
+		api.GET("/qdisc", read, ws.handleQdiscStats)
+		api.GET("/logs", read, ws.handleLogs)
+		api.GET("/hosts", read, ws.handleHosts)
+		api.GET("/host-health", read, ws.handleHostHealth)
+		api.GET("/history", read, ws.handleHistory)
+		api.GET("/config", read, ws.handleConfig)
+		api.PUT("/config", write, ws.handleConfigEdit(true))
+		api.PATCH("/config", write, ws.handleConfigEdit(false))
 	}
 
+	// Prometheus scrape endpoint
+	r.GET("/metrics", read, ws.handleMetrics)
+
 	// WebSocket endpoint for real-time updates
-	r.GET("/ws", ws.handleWebSocket)
+	r.GET("/ws", read, ws.handleWebSocket)
 
-	// Start background goroutine for broadcasting updates
-	go ws.broadcastUpdates()
+	return r
+}
+
+// require returns the access check for a route needing def, or the role set
+// for it in web_auth.endpoint_roles; public routes (def none) cannot be
+// restricted so the login page stays reachable. Unauthenticated browsers are sent to the
+// login page when it is enabled; state-changing requests must also come from
+// an allowed origin, since cookies and cached basic credentials are sent
+// cross-site.
+func (ws *WebServer) require(def webRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := ws.auth.Load()
+		need := def
+		if def != roleNone {
+			need = auth.endpointRole(c.FullPath(), def)
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !originAllowed(c.GetHeader("Origin"), c.Request.Host, ws.config.Load().WebAllowedOrigins) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "cross-origin request refused"})
+				return
+			}
+		}
+
+		p, err := auth.authenticate(c.Request, ws.sessions, time.Now())
+		if err == nil && p.role >= need {
+			c.Set("web_principal", p)
+			c.Next()
+			return
+		}
+		if err == nil && p.via != "anonymous" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%s role required", need)})
+			return
+		}
+
+		if auth.loginPage && c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+			c.Redirect(http.StatusFound, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+			c.Abort()
+			return
+		}
+		if len(auth.users) > 0 && !auth.loginPage {
+			c.Header("WWW-Authenticate", `Basic realm="cake-autortt", charset="UTF-8"`)
+		}
+		msg := "authentication required"
+		if err != nil {
+			msg = err.Error()
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": msg})
+	}
+}
+
+// handleLoginPage serves the login form when the login page is enabled
+func (ws *WebServer) handleLoginPage(c *gin.Context) {
+	if !ws.auth.Load().loginPage {
+		c.JSON(http.StatusNotFound, gin.H{"error": "login page is disabled"})
+		return
+	}
+	c.HTML(http.StatusOK, "login.html", gin.H{
+		"title": "CAKE Auto RTT Monitor",
+		"next":  safeRedirect(c.Query("next")),
+		"error": c.Query("error") != "",
+	})
+}
+
+// handleLogin checks the submitted user and password and starts a session
+func (ws *WebServer) handleLogin(c *gin.Context) {
+	auth := ws.auth.Load()
+	if !auth.loginPage {
+		c.JSON(http.StatusNotFound, gin.H{"error": "login page is disabled"})
+		return
+	}
+	user, next := c.PostForm("username"), safeRedirect(c.PostForm("next"))
+	if _, ok := auth.checkPassword(user, c.PostForm("password"), time.Now()); !ok {
+		log.Printf("[WARN] Failed web login for %q from %s", user, c.ClientIP())
+		c.Redirect(http.StatusSeeOther, "/login?error=1&next="+url.QueryEscape(next))
+		return
+	}
+	id, err := ws.sessions.create(user, auth.sessionTTL, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ws.setSessionCookie(c, id, int(auth.sessionTTL.Seconds()))
+	c.Redirect(http.StatusSeeOther, next)
+}
+
+// handleLogout ends the session of the request
+func (ws *WebServer) handleLogout(c *gin.Context) {
+	if cookie, err := c.Request.Cookie(sessionCookie); err == nil {
+		ws.sessions.remove(cookie.Value)
+	}
+	ws.setSessionCookie(c, "", -1)
+	c.Redirect(http.StatusSeeOther, "/login")
+}
 
-	addr := fmt.Sprintf(":%d", ws.config.WebPort)
-	log.Printf("[INFO] Starting web server on %s", addr)
-	return r.Run(addr)
+// setSessionCookie sets (or with maxAge -1 clears) the session cookie; it
+// never leaves the site and is marked secure when served over TLS
+func (ws *WebServer) setSessionCookie(c *gin.Context, id string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
 }
 
 // handleIndex serves the main monitoring page
 func (ws *WebServer) handleIndex(c *gin.Context) {
 	// Render using the base template name so it works with both disk and embedded templates.
+	p, _ := c.Get("web_principal")
+	principal, _ := p.(webPrincipal)
 	c.HTML(http.StatusOK, "index.html", gin.H{
-		"title": "CAKE Auto RTT Monitor",
+		"title":   "CAKE Auto RTT Monitor",
+		"session": principal.via == "session",
+		"user":    principal.name,
 	})
 }
 
@@ -141,16 +383,185 @@ func (ws *WebServer) handleLogs(c *gin.Context) {
 	c.JSON(http.StatusOK, logs)
 }
 
-// handleProbes returns the current probe statuses
+// handleProbes returns the current probe statuses; with ?completed=true the
+// recently completed probes, with their per-host sample statistics, follow
 func (ws *WebServer) handleProbes(c *gin.Context) {
 	if ws.service == nil {
 		c.JSON(http.StatusOK, []ProbeStatus{})
 		return
 	}
 	probes := ws.service.GetCurrentProbes()
+	if c.Query("completed") == "true" {
+		probes = append(probes, ws.service.GetRecentCompletedProbes()...)
+	}
 	c.JSON(http.StatusOK, probes)
 }
 
+// handleHosts returns every conntrack destination with the filter rule that
+// accepted or rejected it
+func (ws *WebServer) handleHosts(c *gin.Context) {
+	if ws.service == nil {
+		c.JSON(http.StatusOK, []HostDecision{})
+		return
+	}
+	hosts, err := ws.service.HostDecisions()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, hosts)
+}
+
+// handleMetrics serves the Prometheus text exposition format
+func (ws *WebServer) handleMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if ws.service == nil {
+		return
+	}
+	if err := ws.service.WriteMetrics(c.Writer); err != nil {
+		log.Printf("[ERROR] Failed to write metrics: %v", err)
+	}
+}
+
+// handleHostHealth returns the per-host probe history and backoff state
+func (ws *WebServer) handleHostHealth(c *gin.Context) {
+	if ws.service == nil {
+		c.JSON(http.StatusOK, []HostHealth{})
+		return
+	}
+	c.JSON(http.StatusOK, ws.service.HostHealth())
+}
+
+// handleHistory returns the RTT and tin delay history between from and to
+// (default the last hour), optionally of one interface and averaged to step
+func (ws *WebServer) handleHistory(c *gin.Context) {
+	now := time.Now()
+	from, err := parseHistoryTime(c.Query("from"), now, now.Add(-time.Hour))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parseHistoryTime(c.Query("to"), now, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	step, err := parseHistoryStep(c.Query("step"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+	if ws.service == nil {
+		c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "series": []HistorySeries{}})
+		return
+	}
+	series, err := ws.service.History(c.Query("interface"), from, to, step)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "series": series})
+}
+
+// handleConfig returns the editable settings and which of them need a restart
+func (ws *WebServer) handleConfig(c *gin.Context) {
+	configMu.Lock()
+	values, err := configValues(ws.config.Load())
+	configMu.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file": ws.configPath, "config": values, "restart_keys": sortedKeys(configRestartKeys)})
+}
+
+// handleConfigEdit changes settings from a JSON or YAML body: PATCH sets the
+// keys it names, PUT replaces the whole configuration. The result is
+// validated, written back to the config file, applied like a SIGHUP reload
+// and audited; ?dry_run=true only returns the changes.
+func (ws *WebServer) handleConfigEdit(replace bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		edit := make(map[string]any)
+		if err := yaml.Unmarshal(body, &edit); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid body: %v", err)})
+			return
+		}
+
+		configMu.Lock()
+		defer configMu.Unlock()
+		cur := ws.config.Load()
+		next, changes, err := editConfig(cur, edit, replace)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		restart := false
+		for _, ch := range changes {
+			restart = restart || ch.RestartRequired
+		}
+		if c.Query("dry_run") == "true" || len(changes) == 0 {
+			c.JSON(http.StatusOK, gin.H{"changes": changes, "applied": false, "restart_required": restart})
+			return
+		}
+
+		// The service validates and switches first, so a config it refuses is
+		// never saved; a failed save switches it back
+		if ws.service != nil {
+			if err := ws.service.UpdateConfig(next); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if err := persistConfig(ws.configPath, next, changes); err != nil {
+			if ws.service != nil {
+				if rerr := ws.service.UpdateConfig(cur); rerr != nil {
+					log.Printf("[ERROR] Failed to restore the previous configuration: %v", rerr)
+				}
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to save %s: %v", ws.configPath, err)})
+			return
+		}
+		if err := ws.UpdateConfig(next); err != nil {
+			log.Printf("[ERROR] Invalid web access settings, keeping previous ones: %v", err)
+		}
+
+		p, _ := c.Get("web_principal")
+		principal, _ := p.(webPrincipal)
+		user := principal.name
+		if user == "" {
+			user = principal.via
+		}
+		msg := fmt.Sprintf("Configuration changed via API by %s from %s: %s", user, c.ClientIP(), formatConfigChanges(changes))
+		if ws.service != nil {
+			ws.service.AddLog("INFO", msg)
+		} else {
+			log.Printf("[INFO] %s", msg)
+		}
+		entry := ConfigAuditEntry{
+			Time:    time.Now(),
+			User:    principal.name,
+			Via:     principal.via,
+			Remote:  c.ClientIP(),
+			Method:  c.Request.Method,
+			Changes: changes,
+		}
+		if err := auditConfigChange(next.ConfigAuditFile, entry); err != nil {
+			log.Printf("[ERROR] Failed to write config audit log: %v", err)
+		}
+		c.JSON(http.StatusOK, gin.H{"changes": changes, "applied": true, "restart_required": restart})
+	}
+}
+
 // handleWebSocket handles WebSocket connections for real-time updates
 func (ws *WebServer) handleWebSocket(c *gin.Context) {
 	conn, err := ws.upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -239,12 +650,28 @@ func (ws *WebServer) getSystemStatus() WebSystemStatus {
 		sysStatus := ws.service.GetSystemStatus()
 		status.ActiveHosts = sysStatus.ActiveHosts
 		if len(sysStatus.CurrentRTT) > 0 {
-			// Get the most recent RTT value
-			for key, rtt := range sysStatus.CurrentRTT {
-				status.CurrentRTT = fmt.Sprintf("%s: %dms", key, rtt)
-				break // Just show the first one for now
+			// Show the final RTT of every managed interface, in name order
+			names := make([]string, 0, len(sysStatus.CurrentRTT))
+			for name := range sysStatus.CurrentRTT {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			parts := make([]string, 0, len(names))
+			for _, name := range names {
+				parts = append(parts, fmt.Sprintf("%s: %dms", name, sysStatus.CurrentRTT[name].FinalMs))
 			}
+			status.CurrentRTT = strings.Join(parts, ", ")
 		}
+		status.Interfaces = sysStatus.CurrentRTT
+		status.RTTAggregation = sysStatus.Config.RTTAggregation
+		status.RTTStats = sysStatus.RTTStats
+		status.RTTStatsByFamily = sysStatus.RTTStatsByFamily
+		status.RTTUpdates = sysStatus.RTTUpdates
+		status.ConntrackBackend = sysStatus.ConntrackBackend
+		status.QdiscBackend = sysStatus.QdiscBackend
+		status.Autorate = sysStatus.Autorate
+		status.Cycles = sysStatus.Cycles
+		status.Adaptive = sysStatus.Adaptive
 		// keep /api/status simple; richer payloads (config + probes) are sent via WebSocket
 	}
 
@@ -254,19 +681,30 @@ func (ws *WebServer) getSystemStatus() WebSystemStatus {
 // getRichStatus returns a richer status payload suitable for WebSocket clients
 func (ws *WebServer) getRichStatus() map[string]interface{} {
 	status := ws.getSystemStatus()
+	cfg := ws.config.Load()
 	result := map[string]interface{}{
-		"type":           "status",
-		"timestamp":      status.Timestamp,
-		"service_status": status.ServiceStatus,
-		"active_hosts":   status.ActiveHosts,
-		"current_rtt":    status.CurrentRTT,
-		"qdisc_stats":    status.QdiscStats,
-		"recent_logs":    status.RecentLogs,
+		"type":                "status",
+		"timestamp":           status.Timestamp,
+		"service_status":      status.ServiceStatus,
+		"active_hosts":        status.ActiveHosts,
+		"current_rtt":         status.CurrentRTT,
+		"qdisc_stats":         status.QdiscStats,
+		"recent_logs":         status.RecentLogs,
+		"rtt_stats":           status.RTTStats,
+		"rtt_stats_by_family": status.RTTStatsByFamily,
+		"rtt_updates":         status.RTTUpdates,
+		"conntrack_backend":   status.ConntrackBackend,
+		"qdisc_backend":       status.QdiscBackend,
+		"autorate":            status.Autorate,
+		"interfaces":          status.Interfaces,
+		"cycles":              status.Cycles,
+		"adaptive":            status.Adaptive,
 		"config": map[string]interface{}{
-			"rtt_update_interval": ws.config.RTTUpdateInterval,
-			"min_hosts":           ws.config.MinHosts,
-			"max_hosts":           ws.config.MaxHosts,
-			"rtt_margin_percent":  ws.config.RTTMarginPercent,
+			"rtt_update_interval": cfg.RTTUpdateInterval,
+			"min_hosts":           cfg.MinHosts,
+			"max_hosts":           cfg.MaxHosts,
+			"rtt_margin_percent":  cfg.RTTMarginPercent,
+			"rtt_aggregation":     status.RTTAggregation,
 		},
 	}
 
@@ -285,156 +723,19 @@ func (ws *WebServer) getRichStatus() map[string]interface{} {
 	return result
 }
 
-// getQdiscStats returns current qdisc statistics
-func (ws *WebServer) getQdiscStats() []QdiscStats {
-	var stats []QdiscStats
-
-	// Execute tc -s qdisc command
-	cmd := exec.Command("tc", "-s", "qdisc")
-	output, err := cmd.Output()
-	if err != nil {
-		log.Printf("[ERROR] Failed to get qdisc stats: %v", err)
+// getQdiscStats returns the typed statistics of every CAKE qdisc
+func (ws *WebServer) getQdiscStats() []CakeQdisc {
+	stats := []CakeQdisc{}
+	if ws.service == nil {
 		return stats
 	}
 
-	// Parse output and extract CAKE qdiscs
-	lines := strings.Split(string(output), "\n")
-	var currentInterface, currentQdisc, currentStats string
-	var rttInfo string
-	inQdiscBlock := false
-
-	for i, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			// Empty line might indicate end of qdisc block
-			if inQdiscBlock && currentInterface != "" {
-				// Check if this is the end of the current qdisc block
-				nextLineEmpty := i+1 >= len(lines) || strings.TrimSpace(lines[i+1]) == ""
-				if nextLineEmpty || (i+1 < len(lines) && strings.Contains(lines[i+1], "qdisc")) {
-					// End of current qdisc block, add it to stats
-					stats = append(stats, QdiscStats{
-						Interface: currentInterface,
-						Qdisc:     currentQdisc,
-						Stats:     strings.TrimSpace(currentStats),
-						RTT:       rttInfo,
-					})
-					// Reset for next qdisc
-					currentInterface = ""
-					currentQdisc = ""
-					currentStats = ""
-					rttInfo = "N/A"
-					inQdiscBlock = false
-				}
-			}
-			continue
-		}
-
-		if strings.Contains(line, "qdisc cake") {
-			// Save previous qdisc if exists
-			if currentInterface != "" {
-				stats = append(stats, QdiscStats{
-					Interface: currentInterface,
-					Qdisc:     currentQdisc,
-					Stats:     strings.TrimSpace(currentStats),
-					RTT:       rttInfo,
-				})
-			}
-
-			// Start new qdisc
-			parts := strings.Fields(line)
-			if len(parts) >= 5 {
-				currentInterface = parts[4]
-				currentQdisc = line
-				currentStats = ""
-				rttInfo = "N/A"
-				inQdiscBlock = true
-			}
-		} else if inQdiscBlock && currentInterface != "" {
-			// Collect all lines that belong to this qdisc
-			if strings.HasPrefix(line, "Sent") || strings.HasPrefix(line, "backlog") ||
-				strings.Contains(line, "bytes") || strings.Contains(line, "pkt") ||
-				strings.Contains(line, "dropped") || strings.Contains(line, "overlimits") {
-				currentStats += line + "\n"
-			} else if strings.Contains(line, "interval") {
-				// Extract RTT/interval information from CAKE output (support us, ms, s)
-				rttInfo = ws.extractRTTFromLine(line)
-				currentStats += line + "\n"
-			} else if strings.Contains(line, "thresh") || strings.Contains(line, "target") ||
-				strings.Contains(line, "pkts") || strings.Contains(line, "flows") {
-				// Include other CAKE-specific statistics
-				currentStats += line + "\n"
-			}
-		}
-	}
-
-	// Add any remaining qdisc
-	if currentInterface != "" {
-		stats = append(stats, QdiscStats{
-			Interface: currentInterface,
-			Qdisc:     currentQdisc,
-			Stats:     strings.TrimSpace(currentStats),
-			RTT:       rttInfo,
-		})
-	}
-
-	return stats
-}
-
-// extractRTTFromLine extracts RTT information from a tc output line
-func (ws *WebServer) extractRTTFromLine(line string) string {
-	// Find candidate token after 'interval' or 'rtt'
-	parts := strings.Fields(line)
-	var candidate string
-	for i, part := range parts {
-		if part == "interval" && i+1 < len(parts) {
-			candidate = strings.Trim(parts[i+1], ",;")
-			break
-		}
-	}
-	if candidate == "" {
-		for i, part := range parts {
-			if part == "rtt" && i+1 < len(parts) {
-				candidate = strings.Trim(parts[i+1], ",;")
-				break
-			}
-		}
-	}
-	if candidate == "" {
-		return "N/A"
-	}
-
-	// Parse numeric value and unit (supports floats) - e.g. 1.42s, 100ms, 500us
-	re := regexp.MustCompile(`^([0-9]*\.?[0-9]+)(us|ms|s)?$`)
-	matches := re.FindStringSubmatch(candidate)
-	if len(matches) < 2 {
-		// couldn't parse, return raw candidate
-		return candidate
-	}
-
-	valStr := matches[1]
-	unit := matches[2]
-	v, err := strconv.ParseFloat(valStr, 64)
+	qdiscs, err := ws.service.GetQdiscStats()
 	if err != nil {
-		return candidate
-	}
-
-	switch unit {
-	case "us":
-		// microseconds -> milliseconds
-		ms := v / 1000.0
-		if ms < 1.0 {
-			// keep in microseconds for precision
-			return fmt.Sprintf("%dus", int(math.Round(v)))
-		}
-		return fmt.Sprintf("%dms", int(math.Round(ms)))
-	case "", "ms":
-		return fmt.Sprintf("%dms", int(math.Round(v)))
-	case "s":
-		ms := v * 1000.0
-		return fmt.Sprintf("%dms", int(math.Round(ms)))
-	default:
-		return candidate
+		log.Printf("[ERROR] Failed to get qdisc stats: %v", err)
+		return stats
 	}
+	return append(stats, qdiscs...)
 }
 
 // getRecentLogs returns recent log messages